@@ -0,0 +1,135 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
+	"net"
+	"net/http"
+	"os"
+)
+
+const (
+	AdminTailPath      = "/tail"
+	AdminLogBundlePath = "/logs"
+	AdminMetricsPath   = "/metrics"
+	AdminReloadPath    = "/reload"
+	AdminStatusPath    = "/status"
+)
+
+// StartAdminServer serves local admin requests over the unix socket
+// config.AdminSocketFile, which only the agent user can access.
+func StartAdminServer() error {
+	os.Remove(config.AdminSocketFile)
+	listener, err := net.Listen("unix", config.AdminSocketFile)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(config.AdminSocketFile, 0600); err != nil {
+		return err
+	}
+	LogInfo("admin server listen to %v", config.AdminSocketFile)
+	return http.Serve(listener, adminMux())
+}
+
+// adminMux serves admin requests of the admin socket, which are served by
+// StartRemoteAdminServer too.
+func adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminTailPath, tailHandler)
+	mux.HandleFunc(AdminLogBundlePath, logBundleHandler)
+	mux.HandleFunc(AdminMetricsPath, metricsHandler)
+	mux.HandleFunc(AdminReloadPath, reloadHandler)
+	mux.HandleFunc(AdminStatusPath, adminStatusHandler)
+	for name, control := range adminControls {
+		mux.HandleFunc("/"+name, adminControlHandler(control))
+	}
+	mux.HandleFunc(StatusReportPath, StatusReportHandler)
+	return mux
+}
+
+func tailHandler(w http.ResponseWriter, req *http.Request) {
+	flusher, _ := w.(http.Flusher)
+	closed := req.Context().Done()
+	ch := consoleTail.Subscribe()
+	defer consoleTail.Unsubscribe(ch)
+
+	if build := GetState("buildLocatorForDisplay"); build != "" && GetState("runtimeStatus") == protocol.RuntimeStatusBuilding {
+		w.Write([]byte(Sprintf("[tail] console of %v\n", build)))
+	} else {
+		w.Write([]byte("[tail] agent is idle, waiting for next build\n"))
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for {
+		select {
+		case <-closed:
+			return
+		case data := <-ch:
+			if _, err := w.Write(data); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func logBundleHandler(w http.ResponseWriter, req *http.Request) {
+	var bundle bytes.Buffer
+	if err := WriteLogBundle(&bundle); err != nil {
+		logger.Error.Printf("generate log bundle failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Write(bundle.Bytes())
+}
+
+func adminClient(socketFile string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socketFile)
+			},
+		},
+	}
+}
+
+// Tail streams console output of the builds of the agent running locally
+// to out, until stop is closed or the agent goes away.
+func Tail(socketFile string, out io.Writer, stop chan bool) error {
+	resp, err := adminClient(socketFile).Get("http://agent" + AdminTailPath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	go func() {
+		<-stop
+		resp.Body.Close()
+	}()
+	_, err = io.Copy(out, resp.Body)
+	if isClosedChan(stop) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Admin statuses of the agent, empty when it takes builds as usual.
+const (
+	AdminStatusDraining = "Draining"
+	AdminStatusPaused   = "Paused"
+)
+
+// AgentPausedError means the agent disconnected from server as it was
+// paused, Start waits until it is resumed.
+type AgentPausedError struct{}
+
+func (e *AgentPausedError) Error() string {
+	return "agent is paused"
+}
+
+// AgentUpdatedError means the update script ran after the agent drained,
+// the agent quits so that its supervisor starts the updated agent.
+type AgentUpdatedError struct{}
+
+func (e *AgentUpdatedError) Error() string {
+	return "agent is updated"
+}
+
+var (
+	adminMu         sync.Mutex
+	adminStatus     string
+	cancelRequested bool
+	updateRequested bool
+	// adminWake tells the agent loop to carry out admin requests
+	adminWake = make(chan bool, 1)
+)
+
+func wakeAgent() {
+	select {
+	case adminWake <- true:
+	default:
+	}
+}
+
+// AdminStatus returns whether the agent is paused or draining.
+func AdminStatus() string {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	return adminStatus
+}
+
+// PauseAgent disconnects the agent from server until it is resumed, a
+// running build keeps running and reports once the agent is resumed.
+func PauseAgent() {
+	setAdminStatus(AdminStatusPaused)
+}
+
+// DrainAgent pauses the agent once the running build is done.
+func DrainAgent() {
+	setAdminStatus(AdminStatusDraining)
+}
+
+// ResumeAgent connects the paused or draining agent to server again, and
+// drops an update not started yet.
+func ResumeAgent() {
+	adminMu.Lock()
+	updateRequested = false
+	adminMu.Unlock()
+	setAdminStatus("")
+}
+
+// CancelCurrentBuild cancels the running build like server does.
+func CancelCurrentBuild() {
+	adminMu.Lock()
+	cancelRequested = true
+	adminMu.Unlock()
+	wakeAgent()
+}
+
+// UpdateAgent drains the agent and runs config.UpdateScript, the agent
+// quits after the script succeeded.
+func UpdateAgent() error {
+	if config.UpdateScript == "" {
+		return Err("no update script is configured")
+	}
+	adminMu.Lock()
+	updateRequested = true
+	if adminStatus != AdminStatusPaused {
+		adminStatus = AdminStatusDraining
+	}
+	adminMu.Unlock()
+	wakeAgent()
+	return nil
+}
+
+func setAdminStatus(status string) {
+	adminMu.Lock()
+	LogInfo("set admin status to %v", status)
+	adminStatus = status
+	adminMu.Unlock()
+	wakeAgent()
+}
+
+// handleAdminRequests carries out admin requests in the agent loop, which
+// owns the build session, returns an error when the agent should stop.
+func handleAdminRequests() error {
+	adminMu.Lock()
+	cancel := cancelRequested
+	cancelRequested = false
+	adminMu.Unlock()
+	if cancel {
+		cancelBuildSession()
+	}
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	building := GetState("runtimeStatus") == protocol.RuntimeStatusBuilding
+	if adminStatus == AdminStatusDraining && !building {
+		LogInfo("agent is drained")
+		adminStatus = AdminStatusPaused
+	}
+	if adminStatus != AdminStatusPaused {
+		return nil
+	}
+	if updateRequested && !building {
+		updateRequested = false
+		if err := runUpdateScript(); err != nil {
+			logger.Error.Printf("update script %v failed: %v", config.UpdateScript, err)
+		} else {
+			return &AgentUpdatedError{}
+		}
+	}
+	return &AgentPausedError{}
+}
+
+// waitForResume blocks while the agent is paused, carrying out admin
+// requests meanwhile.
+func waitForResume() error {
+	for {
+		err := handleAdminRequests()
+		if _, paused := err.(*AgentPausedError); !paused {
+			return err
+		}
+		<-adminWake
+	}
+}
+
+func runUpdateScript() error {
+	LogInfo("run update script %v", config.UpdateScript)
+	output, err := exec.Command(config.UpdateScript).CombinedOutput()
+	LogInfo("update script output: %s", output)
+	return err
+}
+
+// adminControls are the admin requests served at "/<name>" of the admin
+// socket, e.g. "/drain".
+var adminControls = map[string]func() error{
+	"cancel": func() error { CancelCurrentBuild(); return nil },
+	"drain":  func() error { DrainAgent(); return nil },
+	"pause":  func() error { PauseAgent(); return nil },
+	"resume": func() error { ResumeAgent(); return nil },
+	"update": UpdateAgent,
+}
+
+// AdminStatusMessage is the admin status of the agent served at
+// AdminStatusPath and replied to admin controls.
+type AdminStatusMessage struct {
+	AgentId       string `json:"agentId"`
+	RuntimeStatus string `json:"runtimeStatus"`
+	AdminStatus   string `json:"adminStatus"`
+	BuildId       string `json:"buildId"`
+	BuildLocator  string `json:"buildLocator"`
+}
+
+func currentAdminStatus() *AdminStatusMessage {
+	return &AdminStatusMessage{
+		AgentId:       AgentId,
+		RuntimeStatus: GetState("runtimeStatus"),
+		AdminStatus:   AdminStatus(),
+		BuildId:       GetState("buildId"),
+		BuildLocator:  GetState("buildLocator"),
+	}
+}
+
+func adminStatusHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentAdminStatus())
+}
+
+func adminControlHandler(control func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := control(); err != nil {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		adminStatusHandler(w, req)
+	}
+}
+
+// Status prints admin status of the agent running locally to out in JSON.
+func Status(socketFile string, out io.Writer) error {
+	resp, err := adminClient(socketFile).Get("http://agent" + AdminStatusPath)
+	if err != nil {
+		return err
+	}
+	return copyAdminResponse(resp, "fetch status", out)
+}
+
+// Control asks the agent running locally to carry out admin request
+// action, one of "cancel", "drain", "pause", "resume" and "update", and
+// prints admin status of the agent after it to out.
+func Control(socketFile, action string, out io.Writer) error {
+	if _, ok := adminControls[action]; !ok {
+		return Err("unknown admin request %v", action)
+	}
+	resp, err := adminClient(socketFile).Post("http://agent/"+action, "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	return copyAdminResponse(resp, action, out)
+}
+
+func copyAdminResponse(resp *http.Response, action string, out io.Writer) error {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return Err("%v failed: %v %v", action, resp.Status, strings.TrimSpace(string(body)))
+	}
+	_, err := out.Write(body)
+	return err
+}
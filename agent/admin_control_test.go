@@ -0,0 +1,60 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestControlAgentOverAdminSocket(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	socket := GetConfig().AdminSocketFile
+
+	status := adminSocketStatus(t, func(out *bytes.Buffer) error { return Status(socket, out) })
+	assert.Equal(t, AgentId, status.AgentId)
+	assert.Equal(t, "Idle", status.RuntimeStatus)
+
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("sleep", "5"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	status = adminSocketStatus(t, func(out *bytes.Buffer) error { return Control(socket, "drain", out) })
+	assert.Equal(t, AdminStatusDraining, status.AdminStatus)
+	assert.Equal(t, "Building", status.RuntimeStatus)
+	assert.Equal(t, buildId, status.BuildId)
+	status = adminSocketStatus(t, func(out *bytes.Buffer) error { return Control(socket, "resume", out) })
+	assert.Equal(t, "", status.AdminStatus)
+
+	adminSocketStatus(t, func(out *bytes.Buffer) error { return Control(socket, "cancel", out) })
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	err := Control(socket, "restart", &bytes.Buffer{})
+	assert.Equal(t, "unknown admin request restart", err.Error())
+}
+
+func adminSocketStatus(t *testing.T, request func(out *bytes.Buffer) error) *AdminStatusMessage {
+	var out bytes.Buffer
+	assert.Nil(t, request(&out))
+	var status AdminStatusMessage
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &status))
+	return &status
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// RemoteAdminReadHeaderTimeout is how long the remote admin server waits
+// for headers of a request.
+var RemoteAdminReadHeaderTimeout = 10 * time.Second
+
+// StartRemoteAdminServer serves the admin requests of the admin socket at
+// config.AdminAddress for fleet orchestration tools, to clients with
+// certificates signed by config.AdminClientCAFile.
+func StartRemoteAdminServer() error {
+	cert, err := tls.LoadX509KeyPair(config.AdminCertFile, config.AdminKeyFile)
+	if err != nil {
+		return err
+	}
+	ca, err := ioutil.ReadFile(config.AdminClientCAFile)
+	if err != nil {
+		return err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(ca) {
+		return Err("no certificate is found in %v", config.AdminClientCAFile)
+	}
+	server := &http.Server{
+		Addr:    config.AdminAddress,
+		Handler: adminMux(),
+		// responses like tail stream as long as the client reads, so only
+		// clients slow to send request headers are cut off
+		ReadHeaderTimeout: RemoteAdminReadHeaderTimeout,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+	LogInfo("remote admin server listen to %v", config.AdminAddress)
+	return server.ListenAndServeTLS("", "")
+}
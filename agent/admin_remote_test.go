@@ -0,0 +1,217 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteAdmin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocd-admin-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	timeout := RemoteAdminReadHeaderTimeout
+	RemoteAdminReadHeaderTimeout = 200 * time.Millisecond
+	client, baseURL := startRemoteAdminServer(t, dir)
+	updated := filepath.Join(dir, "updated")
+	script := filepath.Join(dir, "update.sh")
+	assert.Nil(t, ioutil.WriteFile(script, []byte("#!/bin/sh\ntouch "+updated+"\n"), 0755))
+	GetConfig().UpdateScript = script
+	defer func() {
+		GetConfig().UpdateScript = ""
+		RemoteAdminReadHeaderTimeout = timeout
+	}()
+
+	buildId = "TestRemoteAdmin"
+	stateLog.Reset(buildId, AgentId)
+	stopped := make(chan error, 1)
+	go func() {
+		for {
+			err := Start()
+			if _, paused := err.(*AgentPausedError); !paused {
+				stopped <- err
+				return
+			}
+		}
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	status, code := callRemoteAdmin(t, client, http.MethodGet, baseURL+AdminStatusPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, AgentId, status.AgentId)
+	assert.Equal(t, "Idle", status.RuntimeStatus)
+
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("sleep", "5"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	status, _ = callRemoteAdmin(t, client, http.MethodGet, baseURL+AdminStatusPath)
+	assert.Equal(t, buildId, status.BuildId)
+	callRemoteAdmin(t, client, http.MethodPost, baseURL+"/cancel")
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	status, _ = callRemoteAdmin(t, client, http.MethodPost, baseURL+"/pause")
+	assert.Equal(t, AdminStatusPaused, status.AdminStatus)
+	status, _ = callRemoteAdmin(t, client, http.MethodPost, baseURL+"/resume")
+	assert.Equal(t, "", status.AdminStatus)
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("sleep", "0.5"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	status, _ = callRemoteAdmin(t, client, http.MethodPost, baseURL+"/update")
+	assert.Equal(t, AdminStatusDraining, status.AdminStatus)
+	assert.Equal(t, "Building", status.RuntimeStatus)
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	select {
+	case err = <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait for agent update timeout")
+	}
+	_, ok := err.(*AgentUpdatedError)
+	assert.True(t, ok)
+	assert.True(t, ShouldStop(err))
+	_, err = os.Stat(updated)
+	assert.Nil(t, err)
+	ResumeAgent()
+
+	GetConfig().UpdateScript = ""
+	_, code = callRemoteAdmin(t, client, http.MethodPost, baseURL+"/update")
+	assert.Equal(t, http.StatusPreconditionFailed, code)
+	_, code = callRemoteAdmin(t, client, http.MethodPost, baseURL+"/restart")
+	assert.Equal(t, http.StatusNotFound, code)
+	// clients without a certificate signed by the client CA are refused
+	_, err = http.Get(baseURL + AdminStatusPath)
+	assert.NotNil(t, err)
+
+	// connections not sending a request are closed
+	conn, err := net.Dial("tcp", strings.TrimPrefix(baseURL, "https://"))
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	if netErr, ok := err.(net.Error); ok {
+		assert.False(t, netErr.Timeout(), "connection is not closed by server")
+	}
+}
+
+func callRemoteAdmin(t *testing.T, client *http.Client, method, url string) (*AdminStatusMessage, int) {
+	req, err := http.NewRequest(method, url, nil)
+	assert.Nil(t, err)
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode
+	}
+	var status AdminStatusMessage
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&status))
+	return &status, resp.StatusCode
+}
+
+// startRemoteAdminServer serves remote admin with certificates generated
+// in dir, returns a client authenticated to it and URL of the server.
+func startRemoteAdminServer(t *testing.T, dir string) (*http.Client, string) {
+	ca, caKey := newTestCert(t, nil, nil, "admin ca")
+	serverCert, serverKey := newTestCert(t, ca, caKey, "127.0.0.1")
+	clientCert, clientKey := newTestCert(t, ca, caKey, "fleet")
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.Raw)
+	writePEM(t, filepath.Join(dir, "server.pem"), "CERTIFICATE", serverCert.Raw)
+	keyDER, err := x509.MarshalECPrivateKey(serverKey)
+	assert.Nil(t, err)
+	writePEM(t, filepath.Join(dir, "server-key.pem"), "EC PRIVATE KEY", keyDER)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+	GetConfig().AdminAddress = address
+	GetConfig().AdminCertFile = filepath.Join(dir, "server.pem")
+	GetConfig().AdminKeyFile = filepath.Join(dir, "server-key.pem")
+	GetConfig().AdminClientCAFile = filepath.Join(dir, "ca.pem")
+	go StartRemoteAdminServer()
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs: roots,
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{clientCert.Raw},
+				PrivateKey:  clientKey,
+			}},
+		},
+	}}
+	return client, "https://" + address
+}
+
+func newTestCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return cert, key
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	assert.Nil(t, ioutil.WriteFile(file, data, 0600))
+}
@@ -20,16 +20,45 @@ import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"github.com/satori/go.uuid"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// RestartInterval is how long to wait before starting the agent again
+// after it stopped with an error.
+var RestartInterval = 10 * time.Second
+
+// ServerURLDialTimeout is how long the agent waits for connecting to
+// console and artifact urls before starting a build.
+var ServerURLDialTimeout = 10 * time.Second
+
+// MaxLoggedMessageSize is how much of an unknown message's data is logged.
+const MaxLoggedMessageSize = 256
+
+// OutboxSize is how many messages of builds are queued while the agent is
+// not connected to server.
+const OutboxSize = 1024
+
 var (
 	buildSession *BuildSession
 	logger       *Logger
 	config       *Config
 	AgentId      string
+
+	unknownActionsMu sync.Mutex
+	unknownActions   = make(map[protocol.Action]int64)
+
+	// outbox queues messages of builds across websocket connections, so
+	// that a build keeps running and reporting while the agent reconnects
+	outbox = make(chan *protocol.Message, OutboxSize)
+	// unsent is the message taken from outbox when connection closed
+	unsent *protocol.Message
 )
 
 func LogDebug(format string, v ...interface{}) {
@@ -49,6 +78,13 @@ func Initialize() {
 	logger = MakeLogger(config.LogDir, "gocd-golang-agent.log", config.OutputDebugLog)
 	LogInfo(">>>>>>> go >>>>>>>")
 	LogInfo("working directory: %v", config.WorkingDir)
+	tuneRuntime()
+	registerDefaultCredentialProviders()
+	if config.EventsURL != "" {
+		// validated by LoadConfig
+		publisher, _ := NewEventPublisher(config.EventsURL)
+		SetEventPublisher(publisher)
+	}
 	if _, err := os.Stat(config.WorkingDir); err != nil {
 		logger.Error.Fatal(err)
 	}
@@ -71,8 +107,25 @@ func Initialize() {
 	}
 }
 
-func Start() error {
-	err := Register()
+func tuneRuntime() {
+	gogc := "default"
+	if config.GCPercent != 0 {
+		debug.SetGCPercent(config.GCPercent)
+		gogc = strconv.Itoa(config.GCPercent)
+	}
+	limit := "none"
+	if config.MemoryLimit > 0 {
+		debug.SetMemoryLimit(config.MemoryLimit)
+		limit = FormatByteSize(config.MemoryLimit)
+	}
+	LogInfo("GOGC: %v, memory limit: %v", gogc, limit)
+}
+
+func Start() (err error) {
+	if err := waitForResume(); err != nil {
+		return err
+	}
+	err = Register()
 	if err != nil {
 		return err
 	}
@@ -81,23 +134,64 @@ func Start() error {
 	if err != nil {
 		return err
 	}
+	if err := checkConnectingServerVersion(httpClient); err != nil {
+		return err
+	}
 
 	conn, err := MakeWebsocketConnection(config.WssServerURL(), config.HttpsServerURL())
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
-	defer closeBuildSession()
+	// server may be upgraded while the agent was disconnected
+	resetGzipUploads()
+	resetPropertyBatch()
+	publishEvent(&Event{Type: EventAgentConnected})
+	defer func() {
+		event := &Event{Type: EventAgentDisconnected}
+		if err != nil {
+			event.Reason = err.Error()
+		}
+		publishEvent(event)
+	}()
+	stopForwarding := forwardOutbox(conn.Send)
+	// queued messages are sent before the agent pauses itself, and are
+	// kept for the next connection otherwise
+	flush := false
+	defer func() {
+		stopForwarding(flush)
+	}()
+	// build keeps running when connection is closed, until reconnected
+	keepBuild := false
+	defer func() {
+		if !keepBuild {
+			closeBuildSession()
+		}
+	}()
 
+	var expired <-chan time.Time
+	if config.MaxConnectionAge > 0 {
+		expired = time.After(config.MaxConnectionAge)
+	}
 	pingTick := time.NewTicker(10 * time.Second)
 	ping(conn.Send)
 	for {
 		select {
 		case <-pingTick.C:
 			ping(conn.Send)
+		case <-expired:
+			keepBuild = true
+			return &ConnectionExpiredError{Age: config.MaxConnectionAge}
+		case <-adminWake:
+			if err := handleAdminRequests(); err != nil {
+				keepBuild = true
+				flush = true
+				return err
+			}
 		case msg, ok := <-conn.Received:
 			if !ok {
-				return Err("Websocket connection is closed")
+				keepBuild = true
+				return connectionClosed(conn.CloseStatus())
 			}
 			err := processMessage(msg, httpClient, conn.Send)
 			if err != nil {
@@ -110,60 +204,213 @@ func Start() error {
 func processMessage(msg *protocol.Message, httpClient *http.Client, send chan *protocol.Message) error {
 	switch msg.Action {
 	case protocol.SetCookieAction:
-		SetState("cookie", msg.DataString())
+		SetAgentSession(msg.DataAgentSession())
 	case protocol.CancelBuildAction:
-		closeBuildSession()
+		cancelBuildSession()
+	case protocol.UploadAgentLogsAction:
+		go func(uploadUrl string) {
+			if err := uploadLogBundle(httpClient, uploadUrl); err != nil {
+				logger.Error.Printf("upload log bundle failed: %v", err)
+			}
+		}(msg.DataString())
 	case protocol.ReregisterAction:
 		CleanRegistration()
 		return Err("received reregister message")
 	case protocol.BuildAction:
+		received := time.Now()
 		closeBuildSession()
 		build := msg.DataBuild()
+		SetState("buildId", build.BuildId)
 		SetState("buildLocator", build.BuildLocator)
 		SetState("buildLocatorForDisplay", build.BuildLocatorForDisplay)
-		curl, err := config.MakeFullServerURL(build.ConsoleUrl)
-		if err != nil {
-			return err
-		}
-		aurl, err := config.MakeFullServerURL(build.ArtifactUploadBaseUrl)
-		if err != nil {
-			return err
-		}
+		publishEvent(&Event{Type: EventBuildStarted, BuildId: build.BuildId, BuildLocator: build.BuildLocator})
+		curl, curlErr := resolveServerURL(build.ConsoleUrl)
+		aurl, aurlErr := resolveServerURL(build.ArtifactUploadBaseUrl)
+		retries := config.retryBudget()
 		buildSession = MakeBuildSession(
 			build.BuildId,
 			build.BuildCommand,
-			MakeBuildConsole(httpClient, curl),
-			&Artifacts{httpClient: httpClient},
+			MakeBuildConsole(httpClient, curl, retries),
+			&Artifacts{httpClient: httpClient, retries: retries},
 			aurl,
-			send,
+			outbox,
 			config.WorkingDir,
 		)
+		buildSession.agentSession = GetAgentSession()
+		buildSession.buildLocator = build.BuildLocator
+		buildSession.receivedAt = received
+		if build.PropertyBaseUrl != "" {
+			if purl, err := config.MakeFullServerURL(build.PropertyBaseUrl); err == nil {
+				buildSession.properties = NewProperties(httpClient, purl, retries)
+			} else {
+				LogInfo("properties of build %v are dropped: %v", build.BuildId, err)
+			}
+		}
+		if curlErr != nil {
+			buildSession.setupErr = curlErr
+		} else if aurlErr != nil {
+			buildSession.setupErr = aurlErr
+		}
 		buildSession.ReplaceEcho("${agent.location}", config.WorkingDir)
 		buildSession.ReplaceEcho("${agent.hostname}", config.Hostname)
 		buildSession.ReplaceEcho("${date}", func() string { return time.Now().Format("2006-01-02 15:04:05 PDT") })
-		go processBuild(send, buildSession)
+		go processBuild(outbox, buildSession)
 	default:
-		panic(Sprintf("Unknown message action: %+v", msg))
+		skipUnknownMessage(msg, send)
 	}
 	return nil
 }
 
+// skipUnknownMessage keeps the agent running when the server sends an
+// action it does not know, e.g. a newer server, and nacks the message when
+// the server asked for an acknowledgement.
+func skipUnknownMessage(msg *protocol.Message, send chan *protocol.Message) {
+	unknownActionsMu.Lock()
+	unknownActions[msg.Action]++
+	count := unknownActions[msg.Action]
+	unknownActionsMu.Unlock()
+
+	logger.Error.Printf("Skipped unknown message action %v (%v times), data: %v",
+		SanitizeForLog(string(msg.Action), MaxLoggedMessageSize),
+		count,
+		SanitizeForLog(msg.Data, MaxLoggedMessageSize))
+	if msg.AcknowledgeId != "" {
+		send <- protocol.NackMessage(&protocol.Nack{
+			AcknowledgeId: msg.AcknowledgeId,
+			Action:        msg.Action,
+			Reason:        "unknown message action",
+		})
+	}
+}
+
+// UnknownActionCounts returns how many messages of each unknown action the
+// agent skipped since it started.
+func UnknownActionCounts() map[string]int64 {
+	unknownActionsMu.Lock()
+	defer unknownActionsMu.Unlock()
+	counts := make(map[string]int64, len(unknownActions))
+	for action, count := range unknownActions {
+		counts[string(action)] = count
+	}
+	return counts
+}
+
+// resolveServerURL resolves url of a build and checks that the agent can
+// connect to it, so that the build fails before running any task instead
+// of losing console output or artifacts later.
+func resolveServerURL(u string) (*url.URL, error) {
+	resolved, err := config.MakeFullServerURL(u)
+	if err != nil {
+		return nil, Err("agent cannot reach server URL %v: %v", SanitizeURLString(u), SanitizeError(err))
+	}
+	conn, err := net.DialTimeout("tcp", hostAndPort(resolved), ServerURLDialTimeout)
+	if err != nil {
+		return resolved, Err("agent cannot reach server URL %v: %v", SanitizeURL(resolved), err)
+	}
+	conn.Close()
+	return resolved, nil
+}
+
+// hostAndPort returns host of u with the default port of its scheme if
+// it has no port.
+func hostAndPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "443"
+	if u.Scheme == "http" || u.Scheme == "ws" {
+		port = "80"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
 func processBuild(send chan *protocol.Message, buildSession *BuildSession) {
 	defer func() {
-		SetState("runtimeStatus", "Idle")
+		SetState("runtimeStatus", protocol.RuntimeStatusIdle)
+		SetState("buildId", "")
 		ping(send)
+		// a draining agent pauses once build is done
+		wakeAgent()
 		logger.Debug.Printf("! exit goroutine: process build command message")
 	}()
-	SetState("runtimeStatus", "Building")
+	SetState("runtimeStatus", protocol.RuntimeStatusBuilding)
 	ping(send)
 	buildSession.Run()
 	LogInfo("done")
+	SetState("lastBuildLocator", GetState("buildLocator"))
+	SetState("lastBuildLocatorForDisplay", GetState("buildLocatorForDisplay"))
+	SetState("lastBuildStatus", string(buildSession.buildStatus))
+	publishEvent(&Event{
+		Type:         EventBuildFinished,
+		BuildId:      buildSession.buildId,
+		BuildLocator: GetState("buildLocator"),
+		Result:       buildSession.buildStatus,
+	})
+}
+
+// forwardOutbox sends messages of builds to send until the returned stop
+// function is called, which sends all queued messages first when flush.
+func forwardOutbox(send chan *protocol.Message) (stop func(flush bool)) {
+	stopping := make(chan bool, 1)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for {
+			msg := unsent
+			if msg == nil {
+				select {
+				case msg = <-outbox:
+				case flush := <-stopping:
+					if flush {
+						flushOutbox(send)
+					}
+					return
+				}
+			}
+			select {
+			case send <- msg:
+				unsent = nil
+			case flush := <-stopping:
+				unsent = msg
+				if flush {
+					flushOutbox(send)
+				}
+				return
+			}
+		}
+	}()
+	return func(flush bool) {
+		stopping <- flush
+		<-stopped
+	}
+}
+
+func flushOutbox(send chan *protocol.Message) {
+	if unsent != nil {
+		send <- unsent
+		unsent = nil
+	}
+	for {
+		select {
+		case msg := <-outbox:
+			send <- msg
+		default:
+			return
+		}
+	}
 }
 
 func ping(send chan *protocol.Message) {
 	send <- protocol.PingMessage(GetAgentRuntimeInfo())
 }
 
+func cancelBuildSession() {
+	if buildSession != nil {
+		buildSession.Cancel()
+		buildSession = nil
+	}
+}
+
 func closeBuildSession() {
 	if buildSession != nil {
 		buildSession.Close()
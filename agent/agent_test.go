@@ -56,6 +56,55 @@ func TestSetCookieAfterConnected(t *testing.T) {
 	assert.Equal(t, "agent Idle", stateLog.Next())
 }
 
+func TestSetCookieWithSessionProperties(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.Send(AgentId, protocol.SetAgentSessionMessage(&protocol.AgentSession{
+		Cookie: "session-cookie",
+		Flags:  map[string]string{"fastCheckout": "true"},
+	}))
+	waitFor(t, func() bool { return GetState("cookie") == "session-cookie" })
+	assert.Equal(t, "true", GetAgentSession().Flags["fastCheckout"])
+}
+
+func TestReportLabelsInPing(t *testing.T) {
+	GetConfig().Labels = map[string]string{"team": "payments", "zone": "eu-west-1"}
+	defer func() {
+		GetConfig().Labels = nil
+	}()
+	setUp(t)
+	defer tearDown()
+
+	info := goServer.AgentRuntimeInfo(AgentId)
+	assert.NotNil(t, info)
+	assert.Equal(t, "payments", info.Labels["team"])
+	assert.Equal(t, "eu-west-1", info.Labels["zone"])
+}
+
+func TestSkipUnknownMessageAction(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	msg := &protocol.Message{
+		Action:        "upgradeAgent",
+		Data:          `"` + strings.Repeat("x", 1024) + `"`,
+		AcknowledgeId: "unknown-message-ack",
+	}
+	goServer.Send(AgentId, msg)
+	waitFor(t, func() bool { return len(goServer.Nacks(AgentId)) > 0 })
+	nack := goServer.Nacks(AgentId)[0]
+	assert.Equal(t, "unknown-message-ack", nack.AcknowledgeId)
+	assert.Equal(t, protocol.Action("upgradeAgent"), nack.Action)
+	assert.Equal(t, "unknown message action", nack.Reason)
+	assert.Equal(t, int64(1), UnknownActionCounts()["upgradeAgent"])
+
+	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("still alive"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 
@@ -86,6 +135,7 @@ func TestMain(m *testing.M) {
 	os.Setenv("GOCD_AGENT_LOG_DIR", agentWorkingDir)
 
 	Initialize()
+	go StartAdminServer()
 
 	os.Exit(m.Run())
 }
@@ -207,6 +257,11 @@ func trimTimestamp(log string) string {
 	return buf.String()
 }
 
+// execBanner is what is printed before running exec command args in wd.
+func execBanner(wd string, args ...string) string {
+	return Sprintf("[go] Start to execute task: %v, working directory: %v\n", ShellQuote(args...), wd)
+}
+
 func createPipelineDir() string {
 	dir := pipelineDir()
 	err := Mkdirs(dir)
@@ -303,7 +358,13 @@ func setUp(t *testing.T) {
 	_func := runtime.FuncForPC(pc)
 	parts := strings.Split(_func.Name(), ".")
 
-	buildId = parts[len(parts)-1]
+	setUpBuild(t, parts[len(parts)-1])
+}
+
+// setUpBuild is setUp with the id of the build, for tests running several
+// builds from one function, e.g. subtests.
+func setUpBuild(t *testing.T, id string) {
+	buildId = id
 	stateLog.Reset(buildId, AgentId)
 	agentStopped = startAgent(t)
 }
@@ -0,0 +1,169 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// artifactCache keeps files of artifacts fetched from server in
+// config.ArtifactCacheDir, keyed by their url and md5, so that jobs
+// fetching the same artifact again don't download it. It is bounded by
+// config.ArtifactCacheSize, least recently used files are evicted.
+type artifactCache struct {
+	mu sync.Mutex
+}
+
+var artifactFetchCache = &artifactCache{}
+
+func (c *artifactCache) enabled() bool {
+	return config.ArtifactCacheDir != ""
+}
+
+// file returns where file of the artifact at src, rel to the artifact
+// directory or "" for a file artifact, is cached with md5.
+func (c *artifactCache) file(src *url.URL, rel, md5 string) string {
+	sum := sha256.Sum256([]byte(src.Path + "\x00" + rel + "\x00" + md5))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(config.ArtifactCacheDir, key[:2], key)
+}
+
+// restore copies files of the artifact at src, which are md5s by path
+// relative to destPath, from the cache into destPath. It fails without
+// copying anything when any of them is not cached.
+func (c *artifactCache) restore(src *url.URL, files map[string]string, destPath string) error {
+	for rel, md5 := range files {
+		if _, err := os.Stat(c.file(src, rel, md5)); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	for rel, md5 := range files {
+		cached := c.file(src, rel, md5)
+		dest := filepath.Join(destPath, rel)
+		if err := Mkdirs(filepath.Dir(dest)); err != nil {
+			return err
+		}
+		if err := copyLocalArtifact(cached, dest); err != nil {
+			return err
+		}
+		os.Chtimes(cached, now, now)
+	}
+	return nil
+}
+
+// store caches files of the artifact at src fetched into destPath, and
+// evicts least recently used files when the cache is over its size.
+func (c *artifactCache) store(src *url.URL, files map[string]string, destPath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for rel, md5 := range files {
+		cached := c.file(src, rel, md5)
+		if err := Mkdirs(filepath.Dir(cached)); err != nil {
+			return err
+		}
+		tmp, err := ioutil.TempFile(filepath.Dir(cached), "tmp")
+		if err != nil {
+			return err
+		}
+		err = copyLocalArtifactFile(tmp, filepath.Join(destPath, rel))
+		tmp.Close()
+		if err == nil {
+			err = os.Rename(tmp.Name(), cached)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	return evictLeastRecentlyUsed(config.ArtifactCacheDir, config.ArtifactCacheSize)
+}
+
+// remove drops cached files of the artifact at src, e.g. when they failed
+// checksum verification.
+func (c *artifactCache) remove(src *url.URL, files map[string]string) {
+	for rel, md5 := range files {
+		os.Remove(c.file(src, rel, md5))
+	}
+}
+
+// evictLeastRecentlyUsed removes files in dir by their modification time,
+// which is when they were last used, until their size is under maxSize.
+func evictLeastRecentlyUsed(dir string, maxSize int64) error {
+	type cached struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var files []cached
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		files = append(files, cached{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil || total <= maxSize {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].used.Before(files[j].used) })
+	for _, f := range files {
+		if total <= maxSize {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+		total -= f.size
+	}
+	return nil
+}
+
+// artifactChecksums returns md5s of files of the artifact srcPath in
+// checksum file, by path relative to where the artifact is fetched to.
+// It is false when any of them is missing.
+func artifactChecksums(srcPath, checksumFile string, dir bool) (map[string]string, bool) {
+	content, err := ioutil.ReadFile(checksumFile)
+	if err != nil {
+		return nil, false
+	}
+	checksums := ParseChecksum(string(content))
+	srcPath = strings.Trim(filepath.ToSlash(srcPath), "/")
+	files := make(map[string]string)
+	if !dir {
+		md5 := checksums[srcPath]
+		files[""] = md5
+		return files, md5 != ""
+	}
+	for path, md5 := range checksums {
+		if strings.HasPrefix(path, srcPath+"/") {
+			files[filepath.FromSlash(path[len(srcPath)+1:])] = md5
+		}
+	}
+	return files, len(files) > 0
+}
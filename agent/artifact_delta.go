@@ -0,0 +1,83 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// ArtifactDelta holds md5 checksums of the artifacts uploaded by the
+// previous run of a job, files not changed since are left out of the
+// upload and listed for the server to copy over from BaseURL instead.
+type ArtifactDelta struct {
+	BaseURL   string
+	Checksums map[string]string
+	Skipped   int
+}
+
+// Unchanged returns true when destFile was uploaded with the same md5 by
+// the previous run.
+func (d *ArtifactDelta) Unchanged(destFile, md5 string) bool {
+	if d == nil {
+		return false
+	}
+	checksum, ok := d.Checksums[destFile]
+	return ok && checksum == md5
+}
+
+func (d *ArtifactDelta) skipped() int {
+	if d == nil {
+		return 0
+	}
+	return d.Skipped
+}
+
+// loadArtifactDelta downloads the md5.checksum file of the previous run at
+// base, all files are uploaded when it is not available.
+func loadArtifactDelta(ctx *BuildContext, base string) *ArtifactDelta {
+	if base == "" {
+		return nil
+	}
+	checksums, err := downloadChecksums(ctx, base)
+	if err != nil {
+		ctx.ConsoleLog("Could not fetch artifact checksums of the previous run, uploading all files: %v\n", err)
+		return nil
+	}
+	return &ArtifactDelta{BaseURL: base, Checksums: checksums}
+}
+
+func downloadChecksums(ctx *BuildContext, base string) (map[string]string, error) {
+	u, err := config.MakeFullServerURL(base)
+	if err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile("", "md5.checksum")
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	if err = ctx.Artifacts.DownloadFile(u, file.Name()); err != nil {
+		return nil, err
+	}
+	checksum, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		return nil, err
+	}
+	return ParseChecksum(string(checksum)), nil
+}
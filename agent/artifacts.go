@@ -19,10 +19,12 @@ package agent
 import (
 	"archive/zip"
 	"bytes"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -31,8 +33,55 @@ import (
 	"time"
 )
 
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+var pathSegmentEscaper = strings.NewReplacer("+", "%2B")
+
+// ArtifactPublisher uploads and fetches artifacts of a build, Artifacts
+// is the implementation talking to Go server over HTTP.
+type ArtifactPublisher interface {
+	Upload(source, destPath string, destURL *ArtifactDestURL) error
+	DownloadFile(source *url.URL, destPath string) error
+	DownloadDir(source *url.URL, destPath string) error
+	VerifyChecksum(srcPath, destPath, checksumFname string) error
+}
+
 type Artifacts struct {
 	httpClient *http.Client
+	retries    *RetryBudget
+}
+
+// ArtifactDestURL is where artifacts uploaded into DestDir of a build
+// are posted to, Delta is set for uploading only files changed since the
+// previous run.
+type ArtifactDestURL struct {
+	Base    *url.URL
+	DestDir string
+	BuildId string
+	Delta   *ArtifactDelta
+}
+
+// Attempt returns the upload url of the given attempt, every segment of
+// DestDir is escaped so that spaces, '+' and unicode survive the trip.
+func (d *ArtifactDestURL) Attempt(attempt int) *url.URL {
+	u := *d.Base
+	var escaped []string
+	for _, segment := range strings.Split(strings.Replace(d.DestDir, "\\", "/", -1), "/") {
+		if segment != "" {
+			escaped = append(escaped, pathSegmentEscaper.Replace(url.PathEscape(segment)))
+		}
+	}
+	if len(escaped) > 0 {
+		dest := strings.Join(escaped, "/")
+		unescaped, _ := url.PathUnescape(dest)
+		u.RawPath = Join("/", u.EscapedPath(), dest)
+		u.Path = Join("/", u.Path, unescaped)
+	}
+	values := u.Query()
+	values.Set("buildId", d.BuildId)
+	values.Set("attempt", strconv.Itoa(attempt))
+	u.RawQuery = values.Encode()
+	return &u
 }
 
 func (u *Artifacts) DownloadFile(source *url.URL, destPath string) (err error) {
@@ -60,57 +109,37 @@ func (u *Artifacts) DownloadDir(source *url.URL, destPath string) error {
 		return err
 	}
 
-	zipReader, err := zip.OpenReader(zipfile.Name())
-	if err != nil {
-		return err
-	}
-	LogDebug("unzip to %v", destPath)
-	defer zipReader.Close()
-	destDir := filepath.Dir(destPath)
-	for _, file := range zipReader.File {
-		dest := filepath.Join(destDir, file.FileHeader.Name)
-		if file.FileHeader.FileInfo().IsDir() {
-			LogDebug("mkdirs %v", dest)
-			err = Mkdirs(dest)
-		} else {
-			LogDebug("extract file %v => %v", file.FileHeader.Name, dest)
-			err = u.extractFile(file, dest)
-		}
-		if err != nil {
-			return err
-		}
-	}
-	LogDebug("unzip finished")
-	return nil
+	return extractZip(zipfile.Name(), filepath.Dir(destPath))
 }
 
 func (u *Artifacts) downloadFile(source *url.URL, destFile *os.File) (err error) {
 	defer destFile.Close()
-	LogDebug("download file %v => %v", source, destFile.Name())
+	LogDebug("download file %v => %v", SanitizeURL(source), destFile.Name())
 	retry := 0
 startDownload:
 	resp, err := u.httpClient.Get(source.String())
 	if err != nil {
-		return
+		return SanitizeError(err)
 	}
 	LogDebug("response: %v", resp.Status)
+	observeThrottle(resp)
 	if resp.StatusCode == http.StatusAccepted {
 		LogDebug("Server responsed StatusAccepted, sleep 1 sec and start download again")
 		time.Sleep(1 * time.Second)
 		goto startDownload
 	}
 	if resp.StatusCode != http.StatusOK {
-		if retry < 3 {
+		if retry < 3 && u.retries.Retry(retry+1) {
 			retry++
-			LogDebug("sleep %v sec and start download again", retry)
-			time.Sleep(time.Duration(retry) * time.Second)
+			time.Sleep(throttleOf(source).delay())
+			LogDebug("start download again, server responded %v", resp.Status)
 			goto startDownload
 		} else {
-			return Err("tried %v times to download [%v] and all failed.", retry, source)
+			return Err("tried %v times to download [%v] and all failed.", retry, SanitizeURL(source))
 		}
 	}
 	defer resp.Body.Close()
-	_, err = io.Copy(destFile, resp.Body)
+	_, err = copyBuffered(destFile, resp.Body)
 	return
 }
 
@@ -156,31 +185,52 @@ func (u *Artifacts) VerifyChecksumFile(srcFname, fname, checksumFname string) er
 	}
 }
 
-func (u *Artifacts) Upload(source, destPath string, destURL *url.URL) (err error) {
-	zipped, checksum, err := u.zipSource(source, destPath)
+func (u *Artifacts) Upload(source, destPath string, destURL *ArtifactDestURL) (err error) {
+	gzipped := gzipUploads()
+	zipped, checksum, unchanged, stored, err := u.zipSource(source, destPath, gzipped, destURL.Delta)
 	defer os.Remove(zipped)
 	if err != nil {
 		return
 	}
-	var body bytes.Buffer
-	writer := multipart.NewWriter(&body)
-	err = u.writeFilePart(writer, zipped, "zipfile")
+	// files other than the stored ones are deflated in the zip already
+	gzipped = gzipped && stored > 0
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	err = u.writeFilePart(writer, zipped, "zipfile", "application/zip")
 	if err != nil {
 		return
 	}
-	err = u.writePart(writer, bytes.NewBufferString(checksum), "file_checksum", "checksum_file")
+	err = u.writePart(writer, bytes.NewBufferString(checksum), "file_checksum", "checksum_file", "text/plain")
 	if err != nil {
 		return
 	}
+	if unchanged != "" {
+		// server copies unchanged files over from the previous run
+		err = u.writePart(writer, bytes.NewBufferString(destURL.Delta.BaseURL), "delta_base", "delta_base", "text/plain")
+		if err != nil {
+			return
+		}
+		err = u.writePart(writer, bytes.NewBufferString(unchanged), "file_unchanged", "unchanged_file", "text/plain")
+		if err != nil {
+			return
+		}
+	}
 	err = writer.Close()
 	if err != nil {
 		return
 	}
+	payload, encoding := body.Bytes(), ""
+	if gzipped {
+		gz := new(bytes.Buffer)
+		if err = gzipBody(gz, body.Bytes()); err != nil {
+			return
+		}
+		payload, encoding = gz.Bytes(), "gzip"
+	}
 
 	attempt := 1
 tryPost:
-	attemptUrl := AppendUrlParam(destURL, "attempt", strconv.Itoa(attempt))
-	statusCode, err := u.post(source, writer.FormDataContentType(), attemptUrl, &body)
+	statusCode, err := u.post(source, writer.FormDataContentType(), encoding, destURL.Attempt(attempt), bytes.NewReader(payload))
 	// client side errors, no retry
 	if err != nil {
 		return
@@ -189,62 +239,81 @@ tryPost:
 	if statusCode == http.StatusCreated {
 		return
 	}
+	// server does not take gzipped body, send it again as it is
+	if statusCode == http.StatusUnsupportedMediaType && encoding != "" {
+		rejectGzipUploads()
+		payload, encoding = body.Bytes(), ""
+		goto tryPost
+	}
 	// handle errors
 	if statusCode == http.StatusRequestEntityTooLarge {
 		info, _ := os.Stat(zipped)
 		return Err("Artifact upload for file %s (Size: %d) was denied by the server. This usually happens when server runs out of disk space.", source, info.Size())
 	}
 	// retry for other errors
-	if attempt < 3 {
+	if attempt < 3 && u.retries.Retry(attempt) {
 		attempt++
+		time.Sleep(throttleOf(destURL.Base).delay())
 		goto tryPost
 	}
 	return Err("Failed to upload %v. Server response: %v", source, statusCode)
 }
 
-func (u *Artifacts) post(source, contentType string, destURL *url.URL, body *bytes.Buffer) (statusCode int, err error) {
+func (u *Artifacts) post(source, contentType, contentEncoding string, destURL *url.URL, body *bytes.Reader) (statusCode int, err error) {
 	req, err := http.NewRequest("POST", destURL.String(), body)
 	if err != nil {
 		return
 	}
 	req.Header.Add("Content-Type", contentType)
+	if contentEncoding != "" {
+		req.Header.Add("Content-Encoding", contentEncoding)
+	}
 	req.Header.Add("Confirm","true")
 
 	resp, err := u.httpClient.Do(req)
 	if err != nil {
-		return
+		return 0, SanitizeError(err)
 	}
+	observeThrottle(resp)
 	return resp.StatusCode, nil
 }
 
-func (u *Artifacts) writeFilePart(writer *multipart.Writer, path, paramName string) error {
+func (u *Artifacts) writeFilePart(writer *multipart.Writer, path, paramName, contentType string) error {
 	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	return u.writePart(writer, file, paramName, filepath.Base(path))
+	return u.writePart(writer, file, paramName, filepath.Base(path), contentType)
 }
 
-func (u *Artifacts) writePart(writer *multipart.Writer, src io.Reader, fieldname, filename string) error {
-	part, err := writer.CreateFormFile(fieldname, filename)
+func (u *Artifacts) writePart(writer *multipart.Writer, src io.Reader, fieldname, filename, contentType string) error {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", Sprintf(`form-data; name="%s"; filename="%s"`,
+		quoteEscaper.Replace(fieldname), quoteEscaper.Replace(filename)))
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(part, src)
+	_, err = copyBuffered(part, src)
 	return err
 }
 
-func (u *Artifacts) zipSource(source string, dest string) (string, string, error) {
+// zipSource zips source as dest, compressible files are stored without
+// compression when store is true, the number of them is returned. Files
+// unchanged since the delta are left out and listed with their checksums.
+func (u *Artifacts) zipSource(source string, dest string, store bool, delta *ArtifactDelta) (string, string, string, int, error) {
 	zipfile, err := ioutil.TempFile("", "tmp.zip")
 	if err != nil {
-		return "", "", err
+		return "", "", "", 0, err
 	}
 	defer zipfile.Close()
 	w := zip.NewWriter(zipfile)
 	defer w.Close()
 
-	var checksum bytes.Buffer
+	var checksum, unchanged bytes.Buffer
+	var stored int
 	checksum.WriteString(Sprintf("#\n#%v\n", time.Now()))
 	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -274,40 +343,30 @@ func (u *Artifacts) zipSource(source string, dest string) (string, string, error
 		if err != nil {
 			return err
 		}
-		checksum.WriteString(Sprintf("%v=%v\n", destFile, md5))
+		if delta.Unchanged(destFile, md5) {
+			unchanged.WriteString(Sprintf("%v=%v\n", protocol.EscapePropertyKey(destFile), md5))
+			delta.Skipped++
+			return nil
+		}
+		checksum.WriteString(Sprintf("%v=%v\n", protocol.EscapePropertyKey(destFile), md5))
 
 		file, err := os.Open(path)
 		if err != nil {
 			return err
 		}
 		defer file.Close()
-		writer, err := w.Create(destFile)
+		header := &zip.FileHeader{Name: destFile, Method: zip.Deflate}
+		if store && compressible(path) {
+			header.Method = zip.Store
+			stored++
+		}
+		writer, err := w.CreateHeader(header)
 		if err != nil {
 			return err
 		}
 
-		_, err = io.Copy(writer, file)
+		_, err = copyBuffered(writer, file)
 		return err
 	})
-	return zipfile.Name(), checksum.String(), err
-}
-
-func (u *Artifacts) extractFile(file *zip.File, dest string) error {
-	rc, err := file.Open()
-	if err != nil {
-		return err
-	}
-	defer rc.Close()
-
-	err = os.MkdirAll(filepath.Dir(dest), 0755)
-	if err != nil {
-		return err
-	}
-	destFile, err := os.Create(dest)
-	if err != nil {
-		return err
-	}
-	defer destFile.Close()
-	_, err = io.Copy(destFile, rc)
-	return err
+	return zipfile.Name(), checksum.String(), unchanged.String(), stored, err
 }
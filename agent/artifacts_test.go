@@ -22,12 +22,34 @@ import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"github.com/xli/assert"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
+func TestArtifactDestURL(t *testing.T) {
+	base, _ := url.Parse("https://localhost:8154/go/remoting/files/up42/1/stage/1/job")
+	dest := &ArtifactDestURL{Base: base, BuildId: "5"}
+	assert.Equal(t, "https://localhost:8154/go/remoting/files/up42/1/stage/1/job?attempt=1&buildId=5", dest.Attempt(1).String())
+
+	dest.DestDir = "dir with spaces/a+b/%25#?/ünïcødé"
+	u := dest.Attempt(2)
+	assert.Equal(t, "https://localhost:8154/go/remoting/files/up42/1/stage/1/job/dir%20with%20spaces/a%2Bb/%2525%23%3F/%C3%BCn%C3%AFc%C3%B8d%C3%A9?attempt=2&buildId=5", u.String())
+	assert.Equal(t, "/go/remoting/files/up42/1/stage/1/job/dir with spaces/a+b/%25#?/ünïcødé", u.Path)
+	assert.Equal(t, "https://localhost:8154/go/remoting/files/up42/1/stage/1/job", base.String())
+
+	dest.DestDir = "dir\\sub/"
+	assert.Equal(t, "https://localhost:8154/go/remoting/files/up42/1/stage/1/job/dir/sub?attempt=3&buildId=5", dest.Attempt(3).String())
+
+	base, _ = url.Parse("https://localhost:8154/go/files/job%20name?x=1")
+	dest = &ArtifactDestURL{Base: base, DestDir: "a b", BuildId: "5"}
+	assert.Equal(t, "https://localhost:8154/go/files/job%20name/a%20b?attempt=1&buildId=5&x=1", dest.Attempt(1).String())
+}
+
 func TestUploadArtifactFailed(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -92,6 +114,107 @@ ERROR: Artifact upload for file %v/large.txt (Size: 609) was denied by the serve
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
+func TestUploadArtifactFailedWhenExceedsMaxArtifactSize(t *testing.T) {
+	GetConfig().MaxArtifactSize = 50
+	defer func() {
+		GetConfig().MaxArtifactSize = 0
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createTestProjectInPipelineDir()
+	writeFile(filepath.Join(wd, "src"), "big.txt", "a file that is bigger than the others")
+	goServer.SendBuild(AgentId, buildId,
+		protocol.UploadArtifactCommand("src/hello/3.txt", "", "false").Setwd(relativePath(wd)),
+		protocol.UploadArtifactCommand("src/*.txt", "", "false").Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	f := `Uploading artifacts from %v/src/hello/3.txt to [defaultRoot]
+Artifacts of this job would be 100 B, which exceeds the maximum artifact size 50 B (GOCD_AGENT_MAX_ARTIFACT_SIZE). Biggest files:
+  %v/src/big.txt (37 B)
+  %v/src/1.txt (21 B)
+  %v/src/2.txt (21 B)
+ERROR: Artifacts size exceeds the maximum artifact size 50 B
+`
+	assert.Equal(t, Sprintf(f, wd, wd, wd, wd), trimTimestamp(log))
+}
+
+func TestSkipUploadArtifactWhenArtifactUploadIsDisabled(t *testing.T) {
+	GetConfig().DisableArtifactUpload = true
+	defer func() {
+		GetConfig().DisableArtifactUpload = false
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createTestProjectInPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.UploadArtifactCommand("src/hello", "dest", "false").Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "Artifact upload is disabled on this agent, skipped uploading src/hello to dest\n", trimTimestamp(log))
+
+	_, err = os.Stat(goServer.ArtifactFile(buildId, "dest"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAsyncUploadArtifactFinishesBeforeReportCompleting(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createTestProjectInPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.AsyncUploadArtifactCommand("src/hello/4.txt", "dest", "false").Setwd(relativePath(wd)),
+		echo("after upload"),
+		protocol.ReportCompletingCommand(),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	_, err := os.Stat(goServer.ArtifactFile(buildId, "dest/4.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	lines := strings.Split(trimTimestamp(log), "\n")
+	assert.Equal(t, Sprintf("Uploading artifacts from %v/src/hello/4.txt to dest in background", wd), lines[0])
+	assert.True(t, strings.Contains(log, "after upload\n"))
+}
+
+func TestAsyncUploadArtifactFailureFailsBuild(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.AsyncUploadArtifactCommand("nofile", "", "false").Setwd(relativePath(wd)),
+		echo("after upload"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf("Uploading artifacts from %v/nofile to [defaultRoot] in background\nafter upload\nERROR: stat %v/nofile: no such file or directory\n", wd, wd)
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
 func TestUploadDirectory1(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -340,6 +463,59 @@ func testUpload(t *testing.T, srcPath, destDir, checksum string, src2dest map[st
 	assert.Equal(t, len(split(checksum, "\n"))-1, count)
 }
 
+func TestUploadAndDownloadArtifactsWithSpecialCharactersInPath(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	names := []string{"with space.txt", "hash#1.txt", "100%.txt", "a+b.txt",
+		"ünïcødé.txt", "eq=1:2!.txt", "[br]{ce}?.txt", `back\slash "quoted".txt`}
+	wd := createPipelineDir()
+	dir := filepath.Join(wd, "nasty [dir] {x} %d")
+	for _, name := range names {
+		assert.Nil(t, writeFile(dir, name, name))
+	}
+	goServer.SendBuild(AgentId, buildId,
+		protocol.UploadArtifactCommand("nasty [dir] {x} %d/*.txt", "dest dir/#1", "false").Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, Sprintf("Uploading artifacts from %v/with space.txt to dest dir/#1/\n", dir)))
+
+	uploadedChecksum, err := goServer.Checksum(buildId)
+	assert.Nil(t, err)
+	checksums := ParseChecksum(uploadedChecksum)
+	assert.Equal(t, len(names), len(checksums))
+	for _, name := range names {
+		content, err := ioutil.ReadFile(goServer.ArtifactFile(buildId, "dest dir/#1/"+name))
+		assert.Nil(t, err)
+		assert.Equal(t, name, string(content))
+		md5, _ := ComputeMd5(filepath.Join(dir, name))
+		assert.Equal(t, md5, checksums["dest dir/#1/"+name])
+	}
+
+	checksumPath := Sprintf("build-%v.md5", buildId)
+	goServer.SendBuild(AgentId, buildId,
+		protocol.DownloadDirCommand("dest dir", goServer.ArtifactUrl(buildId, "dest dir"), "downloaded",
+			goServer.ChecksumUrl(buildId), checksumPath).Setwd(relativePath(wd)),
+		protocol.DownloadFileCommand("dest dir/#1/100%.txt", goServer.ArtifactUrl(buildId, "dest dir/#1/100%.txt"), "100%.txt",
+			goServer.ChecksumUrl(buildId), checksumPath).Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	for _, name := range names {
+		content, err := ioutil.ReadFile(filepath.Join(wd, "downloaded", "dest dir", "#1", name))
+		assert.Nil(t, err)
+		assert.Equal(t, name, string(content))
+	}
+	content, err := ioutil.ReadFile(filepath.Join(wd, "100%.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "100%.txt", string(content))
+}
+
 func TestDownloadArtifactFile(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -376,6 +552,28 @@ func TestShouldDownloadIfDestFileExistedButMismatchedChecksum(t *testing.T) {
 	testDownload(t, wd, "artifacts/src/1.txt", "dest", []string{"dest/1.txt"}, false)
 }
 
+func TestFailDownloadArtifactFileNotMatchingChecksum(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createTestProjectInPipelineDir()
+	uploadSrcAsArtifacts(t, wd)
+	srcPath := "artifacts/src/1.txt"
+	assert.Nil(t, ioutil.WriteFile(goServer.ArtifactFile(buildId, srcPath), []byte("changed"), 0644))
+
+	checksumPath := Sprintf("build-%v.md5", buildId)
+	goServer.SendBuild(AgentId, buildId,
+		protocol.DownloadFileCommand(srcPath, goServer.ArtifactUrl(buildId, srcPath), "dest/1.txt", goServer.ChecksumUrl(buildId), checksumPath).Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "Verification of the integrity of the artifact [artifacts/src/1.txt] failed"), log)
+	_, err = os.Stat(filepath.Join(wd, "dest/1.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
 func TestDownloadArtifactDir(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -383,6 +581,48 @@ func TestDownloadArtifactDir(t *testing.T) {
 	testDownload(t, wd, "artifacts/src/hello", "dest", []string{"dest/hello/3.txt", "dest/hello/4.txt"}, true)
 }
 
+func TestDownloadArtifactDirIntoNestedDestDir(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createTestProjectInPipelineDir()
+	testDownload(t, wd, "artifacts/src/hello", "dest/a/b", []string{"dest/a/b/hello/3.txt", "dest/a/b/hello/4.txt"}, true)
+}
+
+func TestDownloadArtifactFileIntoExistingDir(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createTestProjectInPipelineDir()
+	err := Mkdirs(filepath.Join(wd, "dest"))
+	assert.Nil(t, err)
+	uploadSrcAsArtifacts(t, wd)
+
+	srcPath := "artifacts/src/hello/4.txt"
+	checksumPath := Sprintf("build-%v.md5", buildId)
+	cmd := protocol.DownloadFileCommand(srcPath, goServer.ArtifactUrl(buildId, srcPath), "dest", goServer.ChecksumUrl(buildId), checksumPath)
+	cmd.AddArg("job", "up42/1/up42_stage/1/up42_job")
+	goServer.SendBuild(AgentId, buildId, cmd.Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	md5, err := ComputeMd5(filepath.Join(wd, "dest/4.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, testFileContentMD5, md5)
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "Fetching artifact [artifacts/src/hello/4.txt] from [up42/1/up42_stage/1/up42_job]\n", trimTimestamp(log))
+}
+
+func uploadSrcAsArtifacts(t *testing.T, wd string) {
+	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("src", "artifacts", "false").Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	os.Truncate(goServer.ConsoleLogFile(buildId), 0)
+}
+
 func testDownload(t *testing.T, wd, srcPath, destDir string, destFiles []string, sourceIsDir bool) {
 	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("src", "artifacts", "false").Setwd(relativePath(wd)))
 	assert.Equal(t, "agent Building", stateLog.Next())
@@ -447,3 +687,363 @@ func filterComments(str string) string {
 	}
 	return ret.String()
 }
+
+func TestUploadHtmlReport(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	writeFile(filepath.Join(wd, "build/allure"), "index.html", "<html>allure</html>")
+	writeFile(filepath.Join(wd, "build/allure/data"), "suites.json", "{}")
+	goServer.SendBuild(AgentId, buildId,
+		protocol.UploadHtmlReportCommand("build/allure", "allure").Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	content, err := ioutil.ReadFile(goServer.ArtifactFile(buildId, "testoutput/allure/index.html"))
+	assert.Nil(t, err)
+	assert.Equal(t, "<html>allure</html>", string(content))
+	_, err = os.Stat(goServer.ArtifactFile(buildId, "testoutput/allure/data/suites.json"))
+	assert.Nil(t, err)
+}
+
+func TestUploadHtmlReportFailsWithoutIndex(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createTestProjectInPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.UploadHtmlReportCommand("src", "src-report").Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, Sprintf("ERROR: HTML report index index.html not found in %v/src\n", wd), trimTimestamp(log))
+}
+
+func TestWarnWhenPipelineWorkspaceIsCloseToDiskQuota(t *testing.T) {
+	GetConfig().PipelineDiskQuota = 300
+	defer func() {
+		GetConfig().PipelineDiskQuota = 0
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createTestProjectInPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.UploadArtifactCommand("src/1.txt", "", "false").Setwd(relativePath(wd)),
+		protocol.UploadArtifactCommand("src/2.txt", "", "false").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	f := `WARN: Workspace of pipeline %v uses 294 B of its disk quota 300 B
+Uploading artifacts from %v/src/1.txt to [defaultRoot]
+Uploading artifacts from %v/src/2.txt to [defaultRoot]
+`
+	assert.Equal(t, Sprintf(f, buildId, wd, wd), trimTimestamp(log))
+}
+
+func TestUploadArtifactFailedWhenPipelineWorkspaceExceedsDiskQuota(t *testing.T) {
+	GetConfig().PipelineDiskQuota = 200
+	defer func() {
+		GetConfig().PipelineDiskQuota = 0
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createTestProjectInPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.UploadArtifactCommand("src/1.txt", "", "false").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	f := "ERROR: Workspace of pipeline %v uses 294 B, which exceeds its disk quota 200 B (GOCD_AGENT_PIPELINE_DISK_QUOTA), uploadArtifact is refused\n"
+	assert.Equal(t, Sprintf(f, buildId), trimTimestamp(log))
+}
+
+func TestUploadLiveArtifactsDuringBuild(t *testing.T) {
+	LiveArtifactsInterval = 20 * time.Millisecond
+	defer func() {
+		LiveArtifactsInterval = 30 * time.Second
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand(LiveArtifactsEnv, "logs", "false").Setwd(relativePath(wd)),
+		protocol.ExecCommand("sh", "-c", "mkdir -p logs/nested && echo first > logs/nested/a.log && sleep 1 && echo second >> logs/nested/a.log").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	liveLog := goServer.ArtifactFile(buildId, "live/nested/a.log")
+	waitFor(t, func() bool {
+		content, _ := ioutil.ReadFile(liveLog)
+		return string(content) == "first\n"
+	})
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	content, err := ioutil.ReadFile(liveLog)
+	assert.Nil(t, err)
+	assert.Equal(t, "first\nsecond\n", string(content))
+}
+
+func TestGzipUploadOfCompressibleArtifacts(t *testing.T) {
+	GetConfig().GzipUploadExtensions = []string{"log", ".json"}
+	defer func() {
+		GetConfig().GzipUploadExtensions = nil
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	logs := filepath.Join(wd, "logs")
+	assert.Nil(t, os.Mkdir(logs, 0755))
+	writeFile(logs, "build.log", strings.Repeat("compile ok\n", 100))
+	writeFile(logs, "result.json", `{"passed": true}`)
+	writeFile(wd, "app.bin", "binary")
+	goServer.SendBuild(AgentId, buildId,
+		protocol.UploadArtifactCommand("logs", "", "false").Setwd(relativePath(wd)),
+		protocol.UploadArtifactCommand("app.bin", "", "false").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	assert.Equal(t, []string{"gzip", ""}, goServer.UploadEncodings(buildId))
+	content, err := ioutil.ReadFile(goServer.ArtifactFile(buildId, "logs/build.log"))
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("compile ok\n", 100), string(content))
+	content, err = ioutil.ReadFile(goServer.ArtifactFile(buildId, "logs/result.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"passed": true}`, string(content))
+}
+
+func TestSendUploadsAsTheyAreWhenServerRejectsGzip(t *testing.T) {
+	GetConfig().GzipUploadExtensions = []string{"log"}
+	goServer.SetRejectGzip(true)
+	defer func() {
+		GetConfig().GzipUploadExtensions = nil
+		goServer.SetRejectGzip(false)
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	writeFile(wd, "a.log", "first")
+	writeFile(wd, "b.log", "second")
+	goServer.SendBuild(AgentId, buildId,
+		protocol.UploadArtifactCommand("a.log", "", "false").Setwd(relativePath(wd)),
+		protocol.UploadArtifactCommand("b.log", "", "false").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	assert.Equal(t, []string{"gzip", "", ""}, goServer.UploadEncodings(buildId))
+	content, err := ioutil.ReadFile(goServer.ArtifactFile(buildId, "b.log"))
+	assert.Nil(t, err)
+	assert.Equal(t, "second", string(content))
+}
+
+func TestUploadOnlyArtifactsChangedSincePreviousRun(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	previous := buildId + "-previous"
+	for _, file := range []string{"src/1.txt", "src/2.txt", "src/hello/3.txt", "src/hello/4.txt"} {
+		dir, fname := filepath.Split(goServer.ArtifactFile(previous, file))
+		assert.Nil(t, os.MkdirAll(dir, 0755))
+		writeFile(dir, fname, "file created for test")
+	}
+	writeFile(filepath.Dir(goServer.ChecksumFile(previous)), "md5.checksum", `src/1.txt=41e43efb30d3fbfcea93542157809ac0
+src/2.txt=41e43efb30d3fbfcea93542157809ac0
+src/hello/3.txt=41e43efb30d3fbfcea93542157809ac0
+src/hello/4.txt=41e43efb30d3fbfcea93542157809ac0
+`)
+
+	wd := createTestProjectInPipelineDir()
+	assert.Nil(t, os.Remove(filepath.Join(wd, "src", "2.txt")))
+	writeFile(filepath.Join(wd, "src"), "2.txt", "changed")
+	goServer.SendBuild(AgentId, buildId,
+		protocol.DeltaUploadArtifactCommand("src", "", "false", goServer.ChecksumUrl(previous)).Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, Sprintf("Uploading artifacts from %v/src to [defaultRoot]\nSkipped 3 files unchanged since the previous run\n", wd), trimTimestamp(log))
+
+	uploadedChecksum, err := goServer.Checksum(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, `src/2.txt=8977dfac2f8e04cb96e66882235f5aba
+src/1.txt=41e43efb30d3fbfcea93542157809ac0
+src/hello/3.txt=41e43efb30d3fbfcea93542157809ac0
+src/hello/4.txt=41e43efb30d3fbfcea93542157809ac0
+`, filterComments(uploadedChecksum))
+	for file, expected := range map[string]string{
+		"src/1.txt":       "file created for test",
+		"src/2.txt":       "changed",
+		"src/hello/4.txt": "file created for test",
+	} {
+		content, err := ioutil.ReadFile(goServer.ArtifactFile(buildId, file))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+}
+
+func TestFetchArtifactsKeptOnAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local-artifacts")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	GetConfig().LocalArtifactsDir = dir
+	defer func() {
+		GetConfig().LocalArtifactsDir = ""
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createTestProjectInPipelineDir()
+	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("src", "artifacts", "false").Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	// fetches below fail if they go to server
+	assert.Nil(t, os.RemoveAll(goServer.ArtifactFile(buildId, "artifacts")))
+	// rewriting uploaded files in place doesn't change the kept artifacts
+	for _, f := range []string{"src/hello/3.txt", "src/1.txt"} {
+		file, err := os.OpenFile(filepath.Join(wd, f), os.O_WRONLY|os.O_TRUNC, 0644)
+		assert.Nil(t, err)
+		file.WriteString("rewritten")
+		file.Close()
+	}
+
+	checksumPath := Sprintf("build-%v.md5", buildId)
+	goServer.SendBuild(AgentId, buildId,
+		protocol.DownloadDirCommand("artifacts/src/hello", goServer.ArtifactUrl(buildId, "artifacts/src/hello"), "dest", goServer.ChecksumUrl(buildId), checksumPath).Setwd(relativePath(wd)),
+		protocol.DownloadFileCommand("artifacts/src/1.txt", goServer.ArtifactUrl(buildId, "artifacts/src/1.txt"), "dest/1.txt", goServer.ChecksumUrl(buildId), checksumPath).Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	for _, f := range []string{"dest/hello/3.txt", "dest/hello/4.txt", "dest/1.txt"} {
+		md5, err := ComputeMd5(filepath.Join(wd, f))
+		assert.Nil(t, err)
+		assert.Equal(t, "41e43efb30d3fbfcea93542157809ac0", md5)
+	}
+}
+
+func TestFetchArtifactsFromArtifactCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	GetConfig().ArtifactCacheDir = dir
+	defer func() {
+		GetConfig().ArtifactCacheDir = ""
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createTestProjectInPipelineDir()
+	uploadSrcAsArtifacts(t, wd)
+	fetchArtifacts(t, wd)
+	// fetches below fail if they go to server
+	assert.Nil(t, os.RemoveAll(filepath.Join(wd, "dest")))
+	assert.Nil(t, os.RemoveAll(goServer.ArtifactFile(buildId, "artifacts")))
+	os.Truncate(goServer.ConsoleLogFile(buildId), 0)
+	fetchArtifacts(t, wd)
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "Fetched [artifacts/src/hello] from artifact cache of the agent."), log)
+	assert.True(t, strings.Contains(log, "Fetched [artifacts/src/1.txt] from artifact cache of the agent."), log)
+	for _, f := range []string{"dest/hello/3.txt", "dest/hello/4.txt", "dest/1.txt"} {
+		md5, err := ComputeMd5(filepath.Join(wd, f))
+		assert.Nil(t, err)
+		assert.Equal(t, "41e43efb30d3fbfcea93542157809ac0", md5)
+	}
+}
+
+func TestArtifactCacheEvictsFilesOverItsSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	GetConfig().ArtifactCacheDir = dir
+	size := GetConfig().ArtifactCacheSize
+	GetConfig().ArtifactCacheSize = 32
+	defer func() {
+		GetConfig().ArtifactCacheDir = ""
+		GetConfig().ArtifactCacheSize = size
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createTestProjectInPipelineDir()
+	uploadSrcAsArtifacts(t, wd)
+	fetchArtifacts(t, wd)
+
+	var cached int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			cached += info.Size()
+		}
+		return nil
+	})
+	assert.True(t, cached > 0 && cached <= 32, Sprintf("%v", cached))
+}
+
+func TestLocalArtifactsEvictFilesOverTheirSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local-artifacts")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	GetConfig().LocalArtifactsDir = dir
+	size := GetConfig().LocalArtifactsSize
+	GetConfig().LocalArtifactsSize = 32
+	defer func() {
+		GetConfig().LocalArtifactsDir = ""
+		GetConfig().LocalArtifactsSize = size
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createTestProjectInPipelineDir()
+	uploadSrcAsArtifacts(t, wd)
+
+	var kept int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			kept += info.Size()
+		}
+		return nil
+	})
+	assert.True(t, kept > 0 && kept <= 32, Sprintf("%v", kept))
+}
+
+func fetchArtifacts(t *testing.T, wd string) {
+	checksumPath := Sprintf("build-%v.md5", buildId)
+	goServer.SendBuild(AgentId, buildId,
+		protocol.DownloadDirCommand("artifacts/src/hello", goServer.ArtifactUrl(buildId, "artifacts/src/hello"), "dest", goServer.ChecksumUrl(buildId), checksumPath).Setwd(relativePath(wd)),
+		protocol.DownloadFileCommand("artifacts/src/1.txt", goServer.ArtifactUrl(buildId, "artifacts/src/1.txt"), "dest/1.txt", goServer.ChecksumUrl(buildId), checksumPath).Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"sync"
+)
+
+// asyncUploads runs uploadArtifact commands flagged async one after
+// another in the background while the job carries on.
+type asyncUploads struct {
+	mu   sync.Mutex
+	last chan bool
+	err  error
+}
+
+func (u *asyncUploads) queue(upload func() error) {
+	u.mu.Lock()
+	prev := u.last
+	done := make(chan bool)
+	u.last = done
+	u.mu.Unlock()
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		if err := upload(); err != nil {
+			u.mu.Lock()
+			if u.err == nil {
+				u.err = err
+			}
+			u.mu.Unlock()
+		}
+	}()
+}
+
+// wait blocks until all queued uploads are done, returns the first
+// error of them once.
+func (u *asyncUploads) wait() error {
+	u.mu.Lock()
+	last := u.last
+	u.mu.Unlock()
+	if last != nil {
+		<-last
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	err := u.err
+	u.err = nil
+	return err
+}
+
+// waitUploads fails the build when a background upload failed.
+func (s *BuildSession) waitUploads() {
+	if s.uploads == nil {
+		return
+	}
+	if err := s.uploads.wait(); err != nil && !s.isCanceled() {
+		s.fail(err)
+	}
+}
+
+func (s *BuildSession) backgroundUploads() func(upload func() error) {
+	if s.uploads == nil {
+		return nil
+	}
+	return s.uploads.queue
+}
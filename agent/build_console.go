@@ -19,12 +19,38 @@ package agent
 import (
 	"bytes"
 	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
+const ConsoleOffsetHeader = "X-Console-Offset"
+
+var (
+	ConsoleFlushInterval  = 5 * time.Second
+	ConsoleWriteQueueSize = 256
+)
+
+// ConsoleWriter receives console output of a build, Close flushes what is
+// left. BuildConsole is the implementation sending it to Go server.
+type ConsoleWriter interface {
+	io.Writer
+	io.Closer
+}
+
+// consoleSyncer is a ConsoleWriter that can send what is written so far
+// before it is closed.
+type consoleSyncer interface {
+	Sync() error
+}
+
+// BuildConsole is safe for concurrent use, writes from all producers
+// are queued in order and consumed by a single goroutine that owns the
+// buffer.
 type BuildConsole struct {
 	Url        *url.URL
 	HttpClient *http.Client
@@ -32,6 +58,14 @@ type BuildConsole struct {
 	stop       chan bool
 	closed     chan bool
 	write      chan []byte
+	sync       chan chan error
+	retries    *RetryBudget
+
+	// err is the error of the last flush when console is closed
+	err error
+
+	// offset is the number of console bytes sent to server so far
+	offset int64
 }
 
 func timestampPrefix() []byte {
@@ -39,33 +73,102 @@ func timestampPrefix() []byte {
 	return []byte(ts)
 }
 
-func MakeBuildConsole(httpClient *http.Client, url *url.URL) *BuildConsole {
+// consolePrefix returns the prefix of console lines for mode, one of
+// ConsoleTimestamps*, elapsed time is since started.
+func consolePrefix(mode string, started time.Time) func() []byte {
+	switch mode {
+	case ConsoleTimestampsISO8601:
+		return func() []byte {
+			return []byte(time.Now().Format("2006-01-02T15:04:05.000Z07:00 "))
+		}
+	case ConsoleTimestampsElapsed:
+		return func() []byte {
+			d := time.Since(started)
+			return []byte(Sprintf("+%02d:%02d:%02d.%03d ", int(d.Hours()), int(d.Minutes())%60,
+				int(d.Seconds())%60, int(d.Nanoseconds()/int64(time.Millisecond))%1000))
+		}
+	case ConsoleTimestampsNone:
+		return func() []byte {
+			return nil
+		}
+	}
+	return timestampPrefix
+}
+
+// MakeBuildConsole starts sending console output to url, failed periodic
+// flushes are retried with retries, nil to retry at every flush interval.
+func MakeBuildConsole(httpClient *http.Client, url *url.URL, retries *RetryBudget) *BuildConsole {
 	console := BuildConsole{
 		HttpClient: httpClient,
 		Url:        url,
 		buffer:     bytes.NewBuffer(make([]byte, 0, 10*1024)),
+		retries:    retries,
 
 		stop:   make(chan bool),
 		closed: make(chan bool),
-		write:  make(chan []byte),
+		write:  make(chan []byte, ConsoleWriteQueueSize),
+		sync:   make(chan chan error),
+	}
+	name := GetState("buildLocator")
+	if name == "" && url != nil {
+		name = url.Path
 	}
+	recent := recordRecentConsole(name)
+	redactor := &lineRedactor{rules: config.redactionRules()}
+	prefix := consolePrefix(config.ConsoleTimestamps, time.Now())
 	go func() {
 		defer func() {
 			close(console.closed)
 			LogInfo("build console closed")
 		}()
-		tw := stream.NewPrefixWriter(console.buffer, timestampPrefix)
-		flushTick := time.NewTicker(5 * time.Second)
+		out := io.MultiWriter(console.buffer, consoleTail, recent)
+		var sampler *consoleSampler
+		if config.ConsoleSampleAfter > 0 {
+			if sampler = startConsoleSampling(console.buffer, GetState("buildId"), prefix); sampler != nil {
+				// full output goes last, a failed write to it must not
+				// stop the others
+				out = io.MultiWriter(sampler, consoleTail, recent, sampler.file)
+			}
+		}
+		tw := stream.NewPrefixWriter(out, prefix)
+		tw.Tags = consoleTags
+		flushTick := time.NewTicker(ConsoleFlushInterval)
 		defer flushTick.Stop()
+		var failures int
+		var retryAt time.Time
+		// output is left to Sync and Close once retries are spent
+		var exhausted bool
 		for {
 			select {
 			case log := <-console.write:
-				tw.Write(log)
+				tw.Write(redactor.redact(log))
+			case done := <-console.sync:
+				console.drain(tw, redactor)
+				done <- console.Flush()
 			case <-console.stop:
-				console.Flush()
+				console.drain(tw, redactor)
+				if sampler != nil {
+					sampler.Close()
+				}
+				console.err = console.Flush()
 				return
 			case <-flushTick.C:
-				console.Flush()
+				// skipping flushes while server pushes back stretches
+				// the flush interval
+				if exhausted || time.Now().Before(retryAt) || throttleOf(console.Url).delay() > 0 {
+					continue
+				}
+				if err := console.Flush(); err != nil {
+					logger.Error.Printf("build console flush failed: %v", err)
+					failures++
+					if wait, ok := console.retries.Take(failures); ok {
+						retryAt = time.Now().Add(wait)
+					} else {
+						exhausted = true
+					}
+				} else {
+					failures, retryAt = 0, time.Time{}
+				}
 			}
 		}
 	}()
@@ -73,31 +176,96 @@ func MakeBuildConsole(httpClient *http.Client, url *url.URL) *BuildConsole {
 	return &console
 }
 
+// Close flushes console output left and returns error if it could not be
+// sent to server.
 func (console *BuildConsole) Close() error {
-	return closeAndWait(console.stop, console.closed, CancelCommandTimeout)
+	if err := closeAndWait(console.stop, console.closed, CancelCommandTimeout); err != nil {
+		return err
+	}
+	return console.err
+}
+
+// Sync sends console output written before it is called to server.
+func (console *BuildConsole) Sync() error {
+	done := make(chan error, 1)
+	select {
+	case console.sync <- done:
+	case <-console.closed:
+		return console.err
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-console.closed:
+		return console.err
+	}
 }
 
 func (console *BuildConsole) Write(data []byte) (int, error) {
-	console.write <- data
-	return len(data), nil
+	// callers may reuse data once Write returns
+	log := make([]byte, len(data))
+	copy(log, data)
+	select {
+	case <-console.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	select {
+	case console.write <- log:
+		return len(data), nil
+	case <-console.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// drain writes out queued console output, with the line held by redactor.
+func (console *BuildConsole) drain(w io.Writer, redactor *lineRedactor) {
+	for {
+		select {
+		case log := <-console.write:
+			w.Write(redactor.redact(log))
+		default:
+			w.Write(redactor.flush())
+			return
+		}
+	}
 }
 
-func (console *BuildConsole) Flush() {
+// Flush sends buffered console output to server, output is kept and sent
+// again by next Flush when it fails, so that server does not see a gap.
+func (console *BuildConsole) Flush() error {
 	if console.buffer.Len() == 0 {
-		return
+		return nil
 	}
 	LogDebug("ConsoleLog: \n%v", console.buffer.String())
 
+	size := int64(console.buffer.Len())
+	offset := console.Offset()
 	req := http.Request{
 		Method:        http.MethodPut,
 		URL:           console.Url,
-		Body:          ioutil.NopCloser(console.buffer),
-		ContentLength: int64(console.buffer.Len()),
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(bytes.NewReader(console.buffer.Bytes())),
+		ContentLength: size,
 		Close:         true,
 	}
-	_, err := console.HttpClient.Do(&req)
+	req.Header.Set(ConsoleOffsetHeader, strconv.FormatInt(offset, 10))
+	resp, err := console.HttpClient.Do(&req)
 	if err != nil {
-		logger.Error.Printf("build console flush failed: %v", err)
+		return SanitizeError(err)
+	}
+	resp.Body.Close()
+	observeThrottle(resp)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return Err("server responded %v", resp.Status)
 	}
+	atomic.StoreInt64(&console.offset, offset+size)
 	console.buffer.Reset()
+	return nil
+}
+
+// Offset returns how many bytes of console output have been flushed,
+// which is where the next flush appends on server side.
+func (console *BuildConsole) Offset() int64 {
+	return atomic.LoadInt64(&console.offset)
 }
@@ -0,0 +1,389 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFetchConsoleLogIncrementallyDuringBuild(t *testing.T) {
+	ConsoleFlushInterval = 10 * time.Millisecond
+	defer func() {
+		ConsoleFlushInterval = 5 * time.Second
+	}()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		echo("before sleep"),
+		protocol.ExecCommand("sleep", "1"),
+		echo("after sleep"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	var log string
+	var offset int64
+	timeout := time.After(900 * time.Millisecond)
+	banner := execBanner(GetConfig().WorkingDir, "sleep", "1")
+	for !contains(log, banner) {
+		select {
+		case <-timeout:
+			t.Fatal("wait for partial console log timeout")
+		case <-time.After(10 * time.Millisecond):
+			log, offset, _ = goServer.ConsoleLogFrom(buildId, 0)
+		}
+	}
+	assert.Equal(t, "before sleep\n"+banner, trimTimestamp(log))
+
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, _, err := goServer.ConsoleLogFrom(buildId, offset)
+	assert.Nil(t, err)
+	assert.Equal(t, "after sleep\n", trimTimestamp(log))
+}
+
+func TestTailConsoleOfLocalAgent(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	var out syncBuffer
+	stop := make(chan bool)
+	tailed := make(chan error)
+	go func() {
+		tailed <- Tail(GetConfig().AdminSocketFile, &out, stop)
+	}()
+	waitFor(t, func() bool { return strings.Contains(out.String(), "[tail]") })
+
+	goServer.SendBuild(AgentId, buildId, echo("hello tail"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	waitFor(t, func() bool { return strings.Contains(out.String(), "hello tail\n") })
+	close(stop)
+	assert.Nil(t, <-tailed)
+}
+
+func TestBuildConsoleWriteFromConcurrentProducers(t *testing.T) {
+	var received syncBuffer
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received.Write(body)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	console := MakeBuildConsole(server.Client(), u, nil)
+
+	producers, lines := 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			buf := make([]byte, 0, 32)
+			for l := 0; l < lines; l++ {
+				// reuse the buffer like exec output pipes do
+				buf = append(buf[:0], Sprintf("producer %v line %v\n", p, l)...)
+				console.Write(buf)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Nil(t, console.Close())
+
+	_, err := console.Write([]byte("after close\n"))
+	assert.NotNil(t, err)
+
+	next := make([]int, producers)
+	for _, line := range strings.Split(strings.TrimSpace(trimTimestamp(received.String())), "\n") {
+		var p, l int
+		_, err := fmt.Sscanf(line, "producer %d line %d", &p, &l)
+		assert.Nil(t, err)
+		assert.Equal(t, next[p], l)
+		next[p]++
+	}
+	for p := 0; p < producers; p++ {
+		assert.Equal(t, lines, next[p])
+	}
+}
+
+func TestResendConsoleOutputAfterFlushFailed(t *testing.T) {
+	var received syncBuffer
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if requests++; requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received.Write(body)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	console := MakeBuildConsole(server.Client(), u, nil)
+
+	console.Write([]byte("first\n"))
+	assert.NotNil(t, console.Sync())
+	console.Write([]byte("second\n"))
+	assert.Nil(t, console.Close())
+	assert.Equal(t, "first\nsecond\n", trimTimestamp(received.String()))
+	assert.Equal(t, int64(len(received.String())), console.Offset())
+}
+
+func TestStopRetryingConsoleFlushWhenRetryBudgetIsSpent(t *testing.T) {
+	ConsoleFlushInterval = 10 * time.Millisecond
+	defer func() {
+		ConsoleFlushInterval = 5 * time.Second
+	}()
+	var mu sync.Mutex
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	console := MakeBuildConsole(server.Client(), u, NewRetryBudget(0, 0, 0))
+
+	console.Write([]byte("hello\n"))
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, 1, requests)
+	mu.Unlock()
+	assert.NotNil(t, console.Close())
+	assert.Equal(t, 2, requests)
+}
+
+func TestSlowDownConsoleFlushWhileServerPushesBack(t *testing.T) {
+	ConsoleFlushInterval = 10 * time.Millisecond
+	defer func() {
+		ConsoleFlushInterval = 5 * time.Second
+	}()
+	var mu sync.Mutex
+	var requests []time.Time
+	var received syncBuffer
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(req.Body)
+		if requests = append(requests, time.Now()); len(requests) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		received.Write(body)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	console := MakeBuildConsole(server.Client(), u, nil)
+
+	console.Write([]byte("hello\n"))
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(requests) == 2
+	})
+	mu.Lock()
+	assert.True(t, requests[1].Sub(requests[0]) >= time.Second)
+	mu.Unlock()
+	assert.Nil(t, console.Close())
+	assert.Equal(t, "hello\n", trimTimestamp(received.String()))
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	timeout := time.After(2 * time.Second)
+	for !condition() {
+		select {
+		case <-timeout:
+			t.Fatal("wait for condition timeout")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestRedactConsoleOutputWithPolicyRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redaction-policy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeFile(dir, "policy.json", `{"rules": [
+  {"name": "card", "regexp": "\\b\\d{4}(-?\\d{4}){3}\\b"},
+  {"name": "host", "regexp": "\\b([a-z]+)\\.corp\\.example\\.com\\b", "replacement": "$1.[internal]"}
+]}`)
+	rules, err := LoadRedactionPolicy(filepath.Join(dir, "policy.json"))
+	assert.Nil(t, err)
+	GetConfig().RedactionRules = rules
+	defer func() {
+		GetConfig().RedactionRules = nil
+	}()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		echo("paid with 4111-1111-1111-1111 at db.corp.example.com"),
+		protocol.ExecCommand("echo", "card 4111111111111111"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := "paid with ******** at db.[internal]\n" +
+		execBanner(GetConfig().WorkingDir, "echo", "card ********") +
+		"card ********\n"
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestRedactMatchesWrittenInPiecesToConsole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redaction-policy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeFile(dir, "policy.json", `{"rules": [{"name": "card", "regexp": "\\b\\d{4}(-?\\d{4}){3}\\b"}]}`)
+	rules, err := LoadRedactionPolicy(filepath.Join(dir, "policy.json"))
+	assert.Nil(t, err)
+	GetConfig().RedactionRules = rules
+	defer func() {
+		GetConfig().RedactionRules = nil
+	}()
+	var received syncBuffer
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received.Write(body)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	console := MakeBuildConsole(server.Client(), u, nil)
+
+	console.Write([]byte("card 4111-1111"))
+	console.Write([]byte("-1111-1111\nlast 4111-1111-"))
+	console.Write([]byte("1111-1111"))
+	assert.Nil(t, console.Close())
+	assert.Equal(t, "card ********\nlast ********\n", trimTimestamp(received.String()))
+}
+
+func TestPrefixConsoleLinesWithConfiguredTimestamps(t *testing.T) {
+	defer func() {
+		GetConfig().ConsoleTimestamps = ConsoleTimestampsTime
+	}()
+	tests := []struct {
+		mode string
+		line string
+	}{
+		{ConsoleTimestampsTime, `\d{2}:\d{2}:\d{2}\.\d{3} hello`},
+		{ConsoleTimestampsISO8601, `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}(Z|[+-]\d{2}:\d{2}) hello`},
+		{ConsoleTimestampsElapsed, `\+00:00:\d{2}\.\d{3} hello`},
+		{ConsoleTimestampsNone, `hello`},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			GetConfig().ConsoleTimestamps = test.mode
+			setUpBuild(t, "TestPrefixConsoleLinesWithConfiguredTimestamps"+test.mode)
+			defer tearDown()
+
+			goServer.SendBuild(AgentId, buildId, echo("hello"))
+			assert.Equal(t, "agent Building", stateLog.Next())
+			assert.Equal(t, "build Passed", stateLog.Next())
+			assert.Equal(t, "agent Idle", stateLog.Next())
+
+			log, err := goServer.ConsoleLog(buildId)
+			assert.Nil(t, err)
+			assert.True(t, regexp.MustCompile("^"+test.line+"\n$").MatchString(log))
+		})
+	}
+}
+
+func TestLoadInvalidRedactionPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redaction-policy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeFile(dir, "policy.json", `{"rules": [{"name": "broken", "regexp": "("}]}`)
+	_, err = LoadRedactionPolicy(filepath.Join(dir, "policy.json"))
+	assert.NotNil(t, err)
+}
+
+func TestSampleConsoleOutputOverThreshold(t *testing.T) {
+	GetConfig().ConsoleSampleAfter = 2
+	GetConfig().ConsoleSampleEvery = 5
+	defer func() {
+		GetConfig().ConsoleSampleAfter = 0
+		GetConfig().ConsoleSampleEvery = 100
+	}()
+	setUp(t)
+	defer tearDown()
+
+	script := "for i in 1 2 3 4 5 6 7 8 9 10 11 12; do if [ $i = 7 ]; then echo line $i failed; else echo line $i; fi; done"
+	goServer.SendBuild(AgentId, buildId,
+		echo("hello"),
+		protocol.ExecCommand("sh", "-c", script),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	fullLog := filepath.Join(GetConfig().WorkingDir, "consoles", buildId+".log")
+	kept := Sprintf("full output is kept in %v on agent %v", fullLog, GetConfig().Hostname)
+	banner := execBanner(GetConfig().WorkingDir, "sh", "-c", script)
+	expected := "hello\n" + banner +
+		"[go] Console output is over 2 lines, only every 5th line and lines matching /(?i)error|warn|fail|exception/ are sent to server from here on, " + kept + "\n" +
+		"[go] ... 4 lines skipped ...\nline 5\n" +
+		"[go] ... 1 lines skipped ...\nline 7 failed\n" +
+		"[go] ... 2 lines skipped ...\nline 10\n" +
+		"[go] 9 console lines were not sent to server, " + kept + "\n"
+	assert.Equal(t, expected, trimTimestamp(log))
+
+	full, err := ioutil.ReadFile(fullLog)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(trimTimestamp(string(full)), "hello\n"+banner+"line 1\nline 2\nline 3\n"), string(full))
+	assert.True(t, strings.HasSuffix(trimTimestamp(string(full)), "line 7 failed\nline 8\nline 9\nline 10\nline 11\nline 12\n"), string(full))
+}
@@ -0,0 +1,314 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+)
+
+// BuildContext is the job context a command handler runs in. Handlers
+// get what they need of the build from it instead of reaching into
+// BuildSession, so that a handler can be tested with a BuildContext of
+// only the fields it uses.
+type BuildContext struct {
+	BuildId      string
+	BuildLocator string
+
+	// ConsoleURL and ArtifactUploadBaseURL are where console output and
+	// artifacts of the build are sent to
+	ConsoleURL            *url.URL
+	ArtifactUploadBaseURL *url.URL
+
+	// RootDir is the agent working directory, commands may not write
+	// outside of it. Wd is the working directory of the command.
+	RootDir string
+	Wd      string
+
+	// Env is environment variables of the build, export adds to it
+	Env map[string]string
+
+	// Console is console output of the build for messages of the agent,
+	// Output is for output of tasks, with secrets of the build masked
+	Console io.Writer
+	Output  io.Writer
+
+	Artifacts ArtifactPublisher
+
+	// Canceled is closed when the build is canceled
+	Canceled <-chan bool
+
+	// Echo is where echo commands write to, Output when it is nil
+	Echo io.Writer
+
+	// Secrets masks secrets registered by commands in Output and Echo,
+	// nothing is masked when it is nil
+	Secrets *stream.SubstituteWriter
+
+	// Properties are properties of the job generated by commands, nil
+	// when server has no property URL
+	Properties *Properties
+
+	// Testing is true for commands of test commands, whose output is
+	// compared instead of shown in console
+	Testing bool
+
+	// CommandEnv makes environment of processes started by commands
+	// from env of the command, Env of the build with environment of the
+	// agent when it is nil
+	CommandEnv func(env map[string]string) []string
+
+	// processes tracks processes started by commands, so that they are
+	// killed with the build and their resource usage is reported
+	processes *jobProcesses
+	// problems scans output of tasks for problems, nil when the job
+	// has no problem matchers
+	problems *problemMatchers
+	// materials are revisions of materials checked out by the build
+	materials *materialRevisions
+
+	// subCommands, resources, uploads and reporter are what the build
+	// session does for commands beyond the context, commands needing
+	// them fail when they are nil, see noSession
+	subCommands subCommandRunner
+	resources   jobResources
+	uploads     artifactUploads
+	reporter    statusReporter
+}
+
+// subCommandRunner processes sub commands of compound commands.
+type subCommandRunner interface {
+	process(cmd *protocol.BuildCommand) error
+	processTestCommand(cmd *protocol.BuildCommand) (bytes.Buffer, error)
+	compose(cmd *protocol.BuildCommand) error
+	// buildFailed tells whether the build has failed so far
+	buildFailed() bool
+}
+
+// jobResources are resources commands start or set up for the job,
+// released when the build is done.
+type jobResources interface {
+	writeSecretFile(name string, content []byte) (string, error)
+	checkToolRequirements(requires string) error
+	startLiveArtifacts(dir string) error
+	loadProblemMatchers(path string) error
+	loadSSHKeys(names string) error
+	addService(p *composeProject) error
+	uploadCoreDumps(started time.Time)
+	killFailed(err error)
+}
+
+// artifactUploads keeps the artifacts size of the job and its background
+// uploads.
+type artifactUploads interface {
+	// reserveArtifactsSize adds size of files matched by source to the
+	// artifacts size, fails when it would be over the maximum
+	reserveArtifactsSize(source string) error
+	// backgroundUploads returns what queues uploads running in
+	// background, nil when they are not supported
+	backgroundUploads() func(upload func() error)
+}
+
+// statusReporter reports status of the build to server.
+type statusReporter interface {
+	sendReport(action protocol.Action, jobState protocol.JobState) error
+}
+
+// noSession is what commands get for a BuildContext not made by a build
+// session, e.g. in tests calling handlers directly.
+type noSession struct{}
+
+var errNoSession = Err("build session is required")
+
+func (noSession) process(cmd *protocol.BuildCommand) error {
+	return errNoSession
+}
+
+func (noSession) processTestCommand(cmd *protocol.BuildCommand) (bytes.Buffer, error) {
+	return bytes.Buffer{}, errNoSession
+}
+
+func (noSession) compose(cmd *protocol.BuildCommand) error {
+	return errNoSession
+}
+
+func (noSession) buildFailed() bool {
+	return false
+}
+
+func (noSession) writeSecretFile(name string, content []byte) (string, error) {
+	return "", errNoSession
+}
+
+func (noSession) checkToolRequirements(requires string) error {
+	return errNoSession
+}
+
+func (noSession) startLiveArtifacts(dir string) error {
+	return errNoSession
+}
+
+func (noSession) loadProblemMatchers(path string) error {
+	return errNoSession
+}
+
+func (noSession) loadSSHKeys(names string) error {
+	return errNoSession
+}
+
+func (noSession) addService(p *composeProject) error {
+	return errNoSession
+}
+
+func (noSession) uploadCoreDumps(started time.Time) {}
+
+func (noSession) killFailed(err error) {
+	LogInfo("WARN: %v", err)
+}
+
+func (noSession) reserveArtifactsSize(source string) error {
+	return nil
+}
+
+func (noSession) backgroundUploads() func(upload func() error) {
+	return nil
+}
+
+func (noSession) sendReport(action protocol.Action, jobState protocol.JobState) error {
+	return errNoSession
+}
+
+// context is the BuildContext of the command being processed in s.
+func (s *BuildSession) context() *BuildContext {
+	ctx := &BuildContext{
+		BuildId:               s.buildId,
+		BuildLocator:          s.buildLocator,
+		ArtifactUploadBaseURL: s.artifactUploadBaseURL,
+		RootDir:               s.rootDir,
+		Wd:                    s.wd,
+		Env:                   s.envs,
+		Console:               s.console,
+		Output:                untaggedWriter{s.secrets},
+		Artifacts:             s.artifacts,
+		Canceled:              s.cancel,
+		Echo:                  s.echo,
+		Secrets:               s.secrets,
+		Properties:            s.properties,
+		Testing:               s.testing,
+		CommandEnv:            s.commandEnv,
+		processes:             s.processes,
+		problems:              s.problems,
+		materials:             s.materials,
+		subCommands:           s,
+		resources:             s,
+		uploads:               s,
+		reporter:              s,
+	}
+	if console, ok := s.console.(*BuildConsole); ok {
+		ctx.ConsoleURL = console.Url
+	}
+	return ctx
+}
+
+func (ctx *BuildContext) commands() subCommandRunner {
+	if ctx.subCommands == nil {
+		return noSession{}
+	}
+	return ctx.subCommands
+}
+
+func (ctx *BuildContext) job() jobResources {
+	if ctx.resources == nil {
+		return noSession{}
+	}
+	return ctx.resources
+}
+
+func (ctx *BuildContext) artifactUploads() artifactUploads {
+	if ctx.uploads == nil {
+		return noSession{}
+	}
+	return ctx.uploads
+}
+
+func (ctx *BuildContext) statusReporter() statusReporter {
+	if ctx.reporter == nil {
+		return noSession{}
+	}
+	return ctx.reporter
+}
+
+// jobProcesses tracks processes of commands in a context without a build
+// session by processes of their own.
+func (ctx *BuildContext) jobProcesses() *jobProcesses {
+	if ctx.processes == nil {
+		ctx.processes = newJobProcesses(ctx.BuildId)
+	}
+	return ctx.processes
+}
+
+// commandEnv is environment of a process started by a command with env.
+func (ctx *BuildContext) commandEnv(env map[string]string) []string {
+	if ctx.CommandEnv != nil {
+		return ctx.CommandEnv(env)
+	}
+	return appendEnv(appendEnv(os.Environ(), ctx.Env), env)
+}
+
+// addSecret masks secret by substitution in output of the build.
+func (ctx *BuildContext) addSecret(secret, substitution string) {
+	if ctx.Secrets != nil {
+		ctx.Secrets.Substitutions[secret] = substitution
+	}
+}
+
+// appendEnv appends env sorted by key to environ, exec takes the last
+// value of duplicate keys, so that env overrides environ.
+func appendEnv(environ []string, env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		environ = append(environ, Sprintf("%v=%v", key, env[key]))
+	}
+	return environ
+}
+
+func (ctx *BuildContext) ConsoleLog(format string, a ...interface{}) {
+	ctx.Console.Write([]byte(Sprintf(format, a...)))
+}
+
+func (ctx *BuildContext) warn(format string, a ...interface{}) {
+	ctx.ConsoleLog(Sprintf("WARN: %v\n", format), a...)
+}
+
+func (ctx *BuildContext) debugLog(format string, a ...interface{}) {
+	LogDebug(Sprintf("%v\n", format), a...)
+}
+
+// ArtifactDestURL is where artifacts uploaded to destDir go.
+func (ctx *BuildContext) ArtifactDestURL(destDir string) *ArtifactDestURL {
+	return &ArtifactDestURL{Base: ctx.ArtifactUploadBaseURL, DestDir: destDir, BuildId: ctx.BuildId}
+}
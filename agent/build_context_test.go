@@ -0,0 +1,91 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bytes"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCallCommandHandlerWithBuildContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build-context")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	var console bytes.Buffer
+	ctx := &BuildContext{BuildId: "build-1", RootDir: dir, Wd: dir, Console: &console}
+
+	assert.Nil(t, CommandMkdirs(ctx, protocol.MkdirsCommand("a/b")))
+	info, err := os.Stat(filepath.Join(dir, "a", "b"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+
+	assert.Nil(t, writeFile(filepath.Join(dir, "a", "b"), "ready", "ok"))
+	assert.Nil(t, CommandWaitFor(ctx, protocol.WaitForCommand("file", "a/b/ready", "exists", "1s")))
+	assert.True(t, strings.Contains(console.String(), "Condition 'exists' of file a/b/ready is met"), console.String())
+}
+
+func TestCommandHandlerSeesCancelOfBuildContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build-context")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	canceled := make(chan bool)
+	close(canceled)
+	ctx := &BuildContext{RootDir: dir, Wd: dir, Console: ioutil.Discard, Canceled: canceled}
+
+	err = CommandWaitFor(ctx, protocol.WaitForCommand("file", "missing", "exists", "1m"))
+	assert.NotNil(t, err)
+	assert.Equal(t, "waitFor file missing is canceled", err.Error())
+}
+
+func TestRunTaskWithBuildContextOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build-context")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	var output bytes.Buffer
+	secrets := stream.NewSubstituteWriter(&output)
+	ctx := &BuildContext{RootDir: dir, Wd: dir, Env: map[string]string{"NAME": "go"},
+		Console: &output, Output: secrets, Secrets: secrets, Testing: true}
+
+	assert.Nil(t, CommandSecret(ctx, protocol.SecretCommand("s3cret")))
+	assert.Nil(t, CommandExec(ctx, protocol.ExecCommand("sh", "-c", "echo $NAME s3cret")))
+	assert.Nil(t, secrets.Flush())
+	assert.Equal(t, "go ********\n", output.String())
+
+	err = CommandCompose(ctx, protocol.ComposeCommand(protocol.EchoCommand("hello")))
+	assert.NotNil(t, err)
+	assert.Equal(t, "build session is required", err.Error())
+}
+
+func TestSkipGeneratedPropertyWithoutPropertiesOfBuildContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build-context")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	var console bytes.Buffer
+	ctx := &BuildContext{RootDir: dir, Wd: dir, Console: &console}
+	assert.Nil(t, writeFile(dir, "coverage.xml", `<coverage line-rate="0.875"/>`))
+
+	assert.Nil(t, CommandGenerateProperty(ctx, protocol.GeneratePropertyCommand("coverage", "coverage.xml", "/coverage/@line-rate")))
+	assert.Equal(t, "Property coverage is skipped, the build does not send properties.\n", console.String())
+}
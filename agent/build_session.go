@@ -20,85 +20,170 @@ import (
 	"bytes"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"github.com/gocd-contrib/gocd-golang-agent/stream"
-	"io"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	DefaultSecretMask           = "********"
 	DefaultCancelCommandTimeout = 25 * time.Second
+	DefaultCancelBuildTimeout   = 30 * time.Second
 )
 
 var (
 	CancelCommandTimeout   = DefaultCancelCommandTimeout
-	CancelBuildTimeout     = 30 * time.Second
+	CancelBuildTimeout     = DefaultCancelBuildTimeout
 	BuildDebugToConsoleLog = true
 )
 
-type Executor func(session *BuildSession, cmd *protocol.BuildCommand) error
-
-func Executors() map[string]Executor {
-	return map[string]Executor{
-		protocol.CommandExport:              CommandExport,
-		protocol.CommandEcho:                CommandEcho,
-		protocol.CommandSecret:              CommandSecret,
-		protocol.CommandReportCurrentStatus: CommandReport,
-		protocol.CommandReportCompleting:    CommandReport,
-		protocol.CommandCompose:             CommandCompose,
-		protocol.CommandCond:                CommandCond,
-		protocol.CommandAnd:                 CommandAnd,
-		protocol.CommandOr:                  CommandOr,
-		protocol.CommandTest:                CommandTest,
-		protocol.CommandExec:                CommandExec,
-		protocol.CommandMkdirs:              CommandMkdirs,
-		protocol.CommandCleandir:            CommandCleandir,
-		protocol.CommandUploadArtifact:      CommandUploadArtifact,
-		protocol.CommandDownloadFile:        CommandDownloadArtifact,
-		protocol.CommandDownloadDir:         CommandDownloadArtifact,
-		protocol.CommandFail:                CommandFail,
-		protocol.CommandGenerateTestReport:  CommandGenerateTestReport,
-		protocol.CommandGenerateProperty:    NotImplemented,
+// Executor is the handler of a build command.
+type Executor func(ctx *BuildContext, cmd *protocol.BuildCommand) error
+
+func Executors() map[protocol.CommandName]Executor {
+	return map[protocol.CommandName]Executor{
+		protocol.CommandExport:               CommandExport,
+		protocol.CommandEcho:                 CommandEcho,
+		protocol.CommandSecret:               CommandSecret,
+		protocol.CommandReportCurrentStatus:  CommandReport,
+		protocol.CommandReportCompleting:     CommandReport,
+		protocol.CommandCompose:              CommandCompose,
+		protocol.CommandCond:                 CommandCond,
+		protocol.CommandAnd:                  CommandAnd,
+		protocol.CommandOr:                   CommandOr,
+		protocol.CommandTest:                 CommandTest,
+		protocol.CommandExec:                 CommandExec,
+		protocol.CommandMkdirs:               CommandMkdirs,
+		protocol.CommandCleandir:             CommandCleandir,
+		protocol.CommandUploadArtifact:       CommandUploadArtifact,
+		protocol.CommandDownloadFile:         CommandDownloadArtifact,
+		protocol.CommandDownloadDir:          CommandDownloadArtifact,
+		protocol.CommandFail:                 CommandFail,
+		protocol.CommandGenerateTestReport:   CommandGenerateTestReport,
+		protocol.CommandGenerateProperty:     CommandGenerateProperty,
+		protocol.CommandUploadHtmlReport:     CommandUploadHtmlReport,
+		protocol.CommandDownloadAgentPlugins: CommandDownloadAgentPlugins,
+		protocol.CommandExtract:              CommandExtract,
+		protocol.CommandWaitFor:              CommandWaitFor,
+		protocol.CommandDockerCompose:        CommandDockerCompose,
+		protocol.CommandWorkspaceSnapshot:    CommandWorkspaceSnapshot,
+		protocol.CommandGit:                  CommandGit,
+		protocol.CommandSvn:                  CommandSvn,
 	}
 }
 
 type BuildSession struct {
 	send                  chan *protocol.Message
-	console               io.WriteCloser
-	artifacts             *Artifacts
+	console               ConsoleWriter
+	artifacts             ArtifactPublisher
 	command               *protocol.BuildCommand
 	artifactUploadBaseURL *url.URL
 
-	envs    map[string]string
-	cancel  chan bool
-	done    chan bool
-	echo    *stream.SubstituteWriter
-	secrets *stream.SubstituteWriter
+	envs       map[string]string
+	cancel     chan bool
+	cancelOnce sync.Once
+	done       chan bool
+	echo       *stream.SubstituteWriter
+	secrets    *stream.SubstituteWriter
 
-	buildId     string
-	buildStatus string
+	buildId       string
+	buildLocator  string
+	buildStatus   protocol.BuildStatus
+	artifactsSize int64
+
+	// runIfStatus is what runIf of commands is evaluated against, the
+	// status of the compose command being processed
+	runIfStatus protocol.BuildStatus
+
+	completed    sync.Once
+	killFailures []string
+	killMu       sync.Mutex
+
+	diagnosticsOnFailure bool
+
+	// reassign is the hint of the first failure caused by the agent
+	reassign *protocol.ReassignHint
+
+	// timedOut is set to 1 when the build ran over config.MaxBuildDuration
+	timedOut int32
+
+	agentSession *protocol.AgentSession
 
 	rootDir string
 	wd      string
 
-	executors map[string]Executor
+	executors map[protocol.CommandName]Executor
+
+	// setupErr fails the build before running any command
+	setupErr error
+
+	quotaWarned bool
+	// workspaceUsage is disk usage of pipeline workspaces tracked by
+	// checkWorkspaceQuota
+	workspaceUsage map[string]int64
+
+	live *liveArtifacts
+
+	problems *problemMatchers
+
+	services *jobServices
+
+	// uploads are the artifact uploads running in background, see asyncUploads
+	uploads *asyncUploads
+
+	// materials are revisions of materials checked out by the build
+	materials *materialRevisions
+
+	// secretFiles are files of environment variables exported as files
+	secretFiles *secretFiles
+
+	// properties generated by the build, nil when server has no property URL
+	properties *Properties
+
+	// ssh is the ssh-agent of the job, see SSHKeysEnv
+	ssh *sshAgent
+
+	// scratch is the temp directory of the job, see makeScratchDir
+	scratch *scratchDir
+
+	processes *jobProcesses
+
+	// testing is true for sessions of test commands, whose output is
+	// compared instead of shown in console
+	testing bool
+
+	// taskConsole is console of a task of a parallel compose
+	taskConsole *stream.LinePrefixWriter
+
+	// receivedAt is when the agent received the build, completingAt is
+	// when reportCompleting is sent, for latency metrics
+	latencyMu         sync.Mutex
+	receivedAt        time.Time
+	completingAt      time.Time
+	assignmentLatency time.Duration
 }
 
 func MakeBuildSession(buildId string,
 	command *protocol.BuildCommand,
-	console io.WriteCloser,
-	artifacts *Artifacts,
+	console ConsoleWriter,
+	artifacts ArtifactPublisher,
 	artifactUploadBaseURL *url.URL,
 	send chan *protocol.Message,
 	rootDir string) *BuildSession {
 
 	secrets := stream.NewSubstituteWriter(console)
+	if config.AgentAutoRegisterKey != "" {
+		secrets.Substitutions[config.AgentAutoRegisterKey] = DefaultSecretMask
+	}
 	return &BuildSession{
 		buildId:               buildId,
 		buildStatus:           protocol.BuildPassed,
+		runIfStatus:           protocol.BuildPassed,
 		console:               console,
 		artifacts:             artifacts,
 		artifactUploadBaseURL: artifactUploadBaseURL,
@@ -110,12 +195,108 @@ func MakeBuildSession(buildId string,
 		secrets:               secrets,
 		echo:                  stream.NewSubstituteWriter(secrets),
 		rootDir:               rootDir,
-		executors:             Executors(),
+		executors:             config.executors(),
+		diagnosticsOnFailure:  diagnosticsEnabled(),
+		services:              &jobServices{},
+		uploads:               &asyncUploads{},
+		materials:             &materialRevisions{},
+		secretFiles:           &secretFiles{},
 	}
 }
 
 func (s *BuildSession) Close() error {
-	return closeAndWait(s.cancel, s.done, CancelBuildTimeout)
+	// the build may time out while server cancels it
+	s.cancelOnce.Do(func() {
+		close(s.cancel)
+	})
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(CancelBuildTimeout + config.CancelGracePeriod):
+		return Err("Wait for closed timeout")
+	}
+}
+
+// Cancel stops the build, the completed report sent when build stops
+// acknowledges the cancellation to server. The report is sent right
+// away when the build did not stop in time.
+func (s *BuildSession) Cancel() {
+	if err := s.Close(); err != nil {
+		LogInfo("build did not stop in %v after canceled", CancelBuildTimeout)
+		s.complete(protocol.BuildCanceled, s.cancelReport(Err("build did not stop in %v", CancelBuildTimeout)))
+	}
+}
+
+func (s *BuildSession) complete(result protocol.BuildStatus, cancel *protocol.CancelReport) {
+	s.completed.Do(func() {
+		report := s.report("", result)
+		report.Cancel = cancel
+		report.TimedOut = atomic.LoadInt32(&s.timedOut) == 1
+		if failed(result) {
+			report.Reassign = s.reassign
+		}
+		report.AssignmentLatency, report.TeardownLatency = s.latencies()
+		report.ResourceUsage = s.processes.resourceUsage()
+		s.send <- protocol.CompletedMessage(report)
+	})
+}
+
+func (s *BuildSession) processStarted() {
+	s.latencyMu.Lock()
+	defer s.latencyMu.Unlock()
+	if s.receivedAt.IsZero() {
+		return
+	}
+	s.assignmentLatency = time.Since(s.receivedAt)
+	observeLatency(assignmentLatency, s.assignmentLatency)
+}
+
+func (s *BuildSession) reportingCompleting() {
+	s.latencyMu.Lock()
+	defer s.latencyMu.Unlock()
+	s.completingAt = time.Now()
+}
+
+// latencies returns assignment and teardown latency of the build in
+// milliseconds for the completed report.
+func (s *BuildSession) latencies() (int64, int64) {
+	s.latencyMu.Lock()
+	defer s.latencyMu.Unlock()
+	var teardown time.Duration
+	if !s.completingAt.IsZero() {
+		teardown = time.Since(s.completingAt)
+		observeLatency(teardownLatency, teardown)
+	}
+	return int64(s.assignmentLatency / time.Millisecond), int64(teardown / time.Millisecond)
+}
+
+// syncConsole sends console output written so far to server, so that
+// server has the whole log when it is told the build is completing.
+func (s *BuildSession) syncConsole() {
+	if syncer, ok := s.console.(consoleSyncer); ok {
+		if err := syncer.Sync(); err != nil {
+			LogInfo("WARN: console output of build %v may be incomplete: %v", s.buildId, err)
+		}
+	}
+}
+
+func (s *BuildSession) cancelReport(closeErr error) *protocol.CancelReport {
+	if !isClosedChan(s.cancel) {
+		return nil
+	}
+	s.killMu.Lock()
+	errs := append([]string{}, s.killFailures...)
+	s.killMu.Unlock()
+	if closeErr != nil {
+		errs = append(errs, closeErr.Error())
+	}
+	return &protocol.CancelReport{Clean: len(errs) == 0, Error: strings.Join(errs, "; ")}
+}
+
+func (s *BuildSession) killFailed(err error) {
+	s.killMu.Lock()
+	defer s.killMu.Unlock()
+	s.killFailures = append(s.killFailures, err.Error())
 }
 
 func (s *BuildSession) isCanceled() bool {
@@ -131,15 +312,64 @@ func (s *BuildSession) isCanceled() bool {
 }
 
 func (s *BuildSession) Run() error {
+	started := time.Now()
 	defer func() {
-		s.console.Close()
-		s.send <- protocol.CompletedMessage(s.Report(""))
+		s.waitUploads()
+		s.flushProperties()
+		s.stopLiveArtifacts()
+		s.publishProblems()
+		s.stopServices()
+		s.stopSSHAgent()
+		if killed := s.processes.killAll(); killed > 0 {
+			s.warn("Killed %v processes left running by the job.", killed)
+		}
+		s.logResourceUsage()
+		s.secretFiles.shred()
+		s.removeScratchDir()
+		s.checkDurationTrend(time.Since(started))
+		s.flushSecrets()
+		if err := s.console.Close(); err != nil {
+			LogInfo("WARN: console output of build %v may be incomplete: %v", s.buildId, err)
+		}
+		s.complete(s.buildStatus, s.cancelReport(nil))
+		s.dropJobBadge(time.Since(started))
 		LogInfo("Build completed")
 	}()
 	LogInfo("Build started, root directory: %v", s.rootDir)
+	s.processStarted()
+	defer lockConfig()()
+	if max := config.MaxBuildDuration; max > 0 {
+		timer := time.AfterFunc(max, func() {
+			s.timeout(max)
+		})
+		defer timer.Stop()
+	}
+	s.processes = newJobProcesses(s.buildId)
+	if s.setupErr == nil {
+		s.setupErr = s.repairWorkspaces()
+	}
+	if s.setupErr == nil {
+		s.setupErr = s.makeScratchDir()
+	}
+	if s.setupErr != nil {
+		defer close(s.done)
+		s.fail(s.setupErr)
+		return s.setupErr
+	}
 	return s.ProcessCommand()
 }
 
+// timeout cancels the build as it ran over config.MaxBuildDuration.
+func (s *BuildSession) timeout(max time.Duration) {
+	if isClosedChan(s.done) {
+		return
+	}
+	atomic.StoreInt32(&s.timedOut, 1)
+	LogInfo("build ran over max build duration %v", max)
+	s.ConsoleLog("ERROR: Build ran over the maximum build duration %v of the agent (GOCD_AGENT_MAX_BUILD_DURATION), it is canceled\n", max)
+	s.Cancel()
+}
+
 func (s *BuildSession) ProcessCommand() error {
 	defer func() {
 		close(s.done)
@@ -149,6 +379,15 @@ func (s *BuildSession) ProcessCommand() error {
 }
 
 func (s *BuildSession) process(cmd *protocol.BuildCommand) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			LogInfo("panic while processing build command: %v\n%s", r, debug.Stack())
+			err = Err("Unexpected error while processing build command: %v", r)
+			if s.runIfStatus != protocol.BuildFailed {
+				s.fail(err)
+			}
+		}
+	}()
 	defer s.onCancel(cmd)
 
 	if s.isCanceled() {
@@ -156,8 +395,8 @@ func (s *BuildSession) process(cmd *protocol.BuildCommand) (err error) {
 		return nil
 	}
 
-	if !cmd.RunIfAny() && !cmd.RunIfMatch(s.buildStatus) {
-		s.debugLog("ignore %v: build[%v] != runIf[%v]", cmd.Name, s.buildStatus, cmd.RunIfConfig)
+	if !cmd.RunIfAny() && !cmd.RunIfMatch(s.runIfStatus) {
+		s.debugLog("ignore %v: status[%v] != runIf[%v]", cmd.Name, s.runIfStatus, cmd.RunIfConfig)
 		//skip, no failure
 		return nil
 	}
@@ -167,19 +406,46 @@ func (s *BuildSession) process(cmd *protocol.BuildCommand) (err error) {
 	}
 
 	err = s.doProcess(cmd)
+	s.flushSecrets()
 	if s.isCanceled() {
 		LogInfo("build canceled")
 		s.buildStatus = protocol.BuildCanceled
-	} else if err != nil && s.buildStatus != protocol.BuildFailed {
-		s.buildStatus = protocol.BuildFailed
-		errMsg := Sprintf("ERROR: %v\n", err)
-		LogInfo(errMsg)
-		s.ConsoleLog(errMsg)
+	} else if err != nil && s.runIfStatus != protocol.BuildFailed {
+		s.fail(err)
 	}
 
 	return
 }
 
+// fail fails the build, with status protocol.BuildError once it failed
+// for an issue of the agent.
+func (s *BuildSession) fail(err error) {
+	if s.reassign == nil {
+		s.reassign = reassignHint(err)
+	}
+	if s.reassign != nil {
+		s.buildStatus = protocol.BuildError
+	} else {
+		s.buildStatus = protocol.BuildFailed
+	}
+	s.runIfStatus = protocol.BuildFailed
+	LogInfo("ERROR: %v", err)
+	s.ConsoleLog("ERROR: %v\n", err)
+	s.diagnoseFailure()
+}
+
+// failed is true for statuses of failed builds, see protocol.BuildError.
+func failed(status protocol.BuildStatus) bool {
+	return status == protocol.BuildFailed || status == protocol.BuildError
+}
+
+func (s *BuildSession) diagnoseFailure() {
+	if s.diagnosticsOnFailure {
+		s.diagnosticsOnFailure = false
+		s.collectDiagnostics()
+	}
+}
+
 func (s *BuildSession) doProcess(cmd *protocol.BuildCommand) error {
 	s.wd = filepath.Clean(filepath.Join(s.rootDir, cmd.WorkingDirectory))
 	s.debugLog("set wd to %v", s.wd)
@@ -187,21 +453,65 @@ func (s *BuildSession) doProcess(cmd *protocol.BuildCommand) error {
 	if !strings.HasPrefix(s.wd, s.rootDir) {
 		return Err("Working directory[%v] is outside the agent sandbox.", s.wd)
 	}
-	_, err := os.Stat(s.wd)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return Err("Working directory \"%v\" is not a directory", s.wd)
-		} else {
+	if err := s.prepareWorkingDir(cmd); err != nil {
+		return err
+	}
+
+	if err := cmd.Validate(); err != nil {
+		return err
+	}
+	if quotaCheckedCommands[cmd.Name] {
+		if err := s.checkWorkspaceQuota(cmd.Name); err != nil {
 			return err
 		}
+		defer s.trackWorkspaceUsage(cmd)()
+	} else {
+		defer s.dropWorkspaceUsage()
 	}
-
 	exec := s.executors[cmd.Name]
 	if exec == nil {
 		return Err("Unknown build command: %v", cmd.Name)
 	} else {
-		return exec(s, cmd)
+		return exec(s.context(), cmd)
+	}
+}
+
+// prepareWorkingDir creates missing working directory for commands that
+// write files into it, like the Java agent fetching artifacts, other
+// commands fail unless config.CreateWorkingDir says otherwise.
+func (s *BuildSession) prepareWorkingDir(cmd *protocol.BuildCommand) error {
+	info, err := os.Stat(s.wd)
+	if err == nil {
+		if !info.IsDir() {
+			return infraErr(protocol.ReassignWorkspaceCorrupted, Err("Working directory \"%v\" is not a directory", s.wd))
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return infraErr(protocol.ReassignWorkspaceCorrupted, err)
+	}
+	if !createsWorkingDir(cmd.Name) {
+		return Err("Working directory \"%v\" is not a directory", s.wd)
 	}
+	s.debugLog("create working directory %v", s.wd)
+	return Mkdirs(s.wd)
+}
+
+var workingDirCreatingCommands = map[protocol.CommandName]bool{
+	protocol.CommandMkdirs:       true,
+	protocol.CommandDownloadFile: true,
+	protocol.CommandDownloadDir:  true,
+	protocol.CommandExtract:      true,
+}
+
+func createsWorkingDir(command protocol.CommandName) bool {
+	switch config.CreateWorkingDir {
+	case CreateWorkingDirAlways:
+		return true
+	case CreateWorkingDirNever:
+		return false
+	}
+	return workingDirCreatingCommands[command]
 }
 
 func (s *BuildSession) testFailed(test *protocol.BuildCommand) bool {
@@ -229,6 +539,7 @@ func (s *BuildSession) onCancel(cmd *protocol.BuildCommand) {
 	}
 	cancel := &BuildSession{
 		buildId:               s.buildId,
+		buildLocator:          s.buildLocator,
 		console:               s.console,
 		artifacts:             s.artifacts,
 		artifactUploadBaseURL: s.artifactUploadBaseURL,
@@ -238,8 +549,12 @@ func (s *BuildSession) onCancel(cmd *protocol.BuildCommand) {
 		echo:        s.echo,
 		rootDir:     s.rootDir,
 		executors:   s.executors,
-		command:     cmd.OnCancel,
-		buildStatus: protocol.BuildPassed,
+		command:      cmd.OnCancel,
+		buildStatus:  protocol.BuildPassed,
+		runIfStatus:  protocol.BuildPassed,
+		agentSession: s.agentSession,
+		processes:    s.processes,
+		secretFiles:  s.secretFiles,
 		cancel:      make(chan bool),
 		done:        make(chan bool),
 	}
@@ -258,6 +573,7 @@ func (s *BuildSession) processTestCommand(cmd *protocol.BuildCommand) (bytes.Buf
 	var output bytes.Buffer
 	session := &BuildSession{
 		buildId:               s.buildId,
+		buildLocator:          s.buildLocator,
 		artifacts:             s.artifacts,
 		artifactUploadBaseURL: s.artifactUploadBaseURL,
 		send:        s.send,
@@ -267,9 +583,14 @@ func (s *BuildSession) processTestCommand(cmd *protocol.BuildCommand) (bytes.Buf
 		rootDir:     s.rootDir,
 		executors:   s.executors,
 		console:     stream.NopCloser(&output),
-		command:     cmd,
-		buildStatus: protocol.BuildPassed,
-		cancel:      s.cancel,
+		testing:      true,
+		command:      cmd,
+		buildStatus:  protocol.BuildPassed,
+		runIfStatus:  protocol.BuildPassed,
+		agentSession: s.agentSession,
+		processes:    s.processes,
+		secretFiles:  s.secretFiles,
+		cancel:       s.cancel,
 		done:        make(chan bool),
 	}
 
@@ -277,19 +598,123 @@ func (s *BuildSession) processTestCommand(cmd *protocol.BuildCommand) (bytes.Buf
 	return output, err
 }
 
-func (s *BuildSession) Report(jobState string) *protocol.Report {
+// fork makes a session for running a task of a parallel compose, its
+// console output lines are prefixed with prefix and it has copies of
+// environment variables and secrets, join merges them back.
+func (s *BuildSession) fork(prefix string) *BuildSession {
+	taskConsole := stream.NewLinePrefixWriter(s.console, prefix)
+	secrets := stream.NewSubstituteWriter(taskConsole)
+	secrets.Substitutions = copySubstitutions(s.secrets.Substitutions)
+	echo := stream.NewSubstituteWriter(secrets)
+	echo.Substitutions = copySubstitutions(s.echo.Substitutions)
+	envs := make(map[string]string, len(s.envs))
+	for k, v := range s.envs {
+		envs[k] = v
+	}
+	return &BuildSession{
+		buildId:               s.buildId,
+		buildLocator:          s.buildLocator,
+		console:               stream.NopCloser(taskConsole),
+		taskConsole:           taskConsole,
+		artifacts:             s.artifacts,
+		artifactUploadBaseURL: s.artifactUploadBaseURL,
+		send:                  s.send,
+		envs:                  envs,
+		secrets:               secrets,
+		echo:                  echo,
+		rootDir:               s.rootDir,
+		executors:             s.executors,
+		buildStatus:           protocol.BuildPassed,
+		runIfStatus:           protocol.BuildPassed,
+		agentSession:          s.agentSession,
+		processes:             s.processes,
+		cancel:                s.cancel,
+		done:                  make(chan bool),
+		artifactsSize:         s.artifactsSize,
+		quotaWarned:           s.quotaWarned,
+		problems:              s.problems,
+		services:              s.services,
+		uploads:               s.uploads,
+		materials:             s.materials,
+		properties:            s.properties,
+		ssh:                   s.ssh,
+		secretFiles:           s.secretFiles,
+	}
+}
+
+// join merges what a task of a parallel compose found into s.
+func (s *BuildSession) join(task *BuildSession) {
+	task.flushSecrets()
+	if err := task.taskConsole.Flush(); err != nil {
+		LogInfo("flush console output of parallel task failed: %v", err)
+	}
+	for k, v := range task.secrets.Substitutions {
+		s.secrets.Substitutions[k] = v
+	}
+	task.killMu.Lock()
+	s.killMu.Lock()
+	s.killFailures = append(s.killFailures, task.killFailures...)
+	s.killMu.Unlock()
+	task.killMu.Unlock()
+	s.quotaWarned = s.quotaWarned || task.quotaWarned
+	if s.reassign == nil {
+		s.reassign = task.reassign
+	}
+	// ssh-agent started by the task is of the task only
+	if task.ssh != s.ssh {
+		task.stopSSHAgent()
+	}
+	if task.buildStatus == protocol.BuildCanceled {
+		s.buildStatus = protocol.BuildCanceled
+	}
+}
+
+func copySubstitutions(substitutions map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(substitutions))
+	for k, v := range substitutions {
+		copied[k] = v
+	}
+	return copied
+}
+
+func (s *BuildSession) Report(jobState protocol.JobState) *protocol.Report {
+	return s.report(jobState, s.buildStatus)
+}
+
+func (s *BuildSession) report(jobState protocol.JobState, result protocol.BuildStatus) *protocol.Report {
 	return &protocol.Report{
-		AgentRuntimeInfo: GetAgentRuntimeInfo(),
-		BuildId:          s.buildId,
-		JobState:         jobState,
-		Result:           s.buildStatus,
+		AgentRuntimeInfo:  GetAgentRuntimeInfo(),
+		BuildId:           s.buildId,
+		JobState:          jobState,
+		Result:            protocol.ServerResult(result),
+		MaterialRevisions: s.materials.list(),
+	}
+}
+
+// AgentSession returns session data server sent to the agent, e.g.
+// flags controlling how the build should be run.
+func (s *BuildSession) AgentSession() *protocol.AgentSession {
+	if s.agentSession == nil {
+		return &protocol.AgentSession{}
 	}
+	return s.agentSession
 }
 
 func (s *BuildSession) ConsoleLog(format string, a ...interface{}) {
 	s.console.Write([]byte(Sprintf(format, a...)))
 }
 
+// flushSecrets writes out console output held by secret masking as the
+// start of a secret.
+func (s *BuildSession) flushSecrets() {
+	if err := s.echo.Flush(); err != nil {
+		LogInfo("flush console output failed: %v", err)
+	}
+	if err := s.secrets.Flush(); err != nil {
+		LogInfo("flush console output failed: %v", err)
+	}
+}
+
 func (s *BuildSession) ReplaceEcho(name string, value interface{}) {
 	s.echo.Substitutions[name] = value
 }
@@ -304,6 +729,29 @@ func (s *BuildSession) Env() []string {
 	return bsEnv
 }
 
+// commandEnv is Env with env of a command appended, exec takes the last
+// value of duplicate keys, so that env overrides the build's variables.
+func (s *BuildSession) commandEnv(env map[string]string) []string {
+	return appendEnv(s.Env(), env)
+}
+
+func (s *BuildSession) buildFailed() bool {
+	return failed(s.buildStatus)
+}
+
+// sendReport sends status of the build to server, a completing report is
+// sent after uploads, properties and console output of the build.
+func (s *BuildSession) sendReport(action protocol.Action, jobState protocol.JobState) error {
+	if action == protocol.ReportCompletingAction {
+		s.waitUploads()
+		s.flushProperties()
+		s.syncConsole()
+		s.reportingCompleting()
+	}
+	s.send <- protocol.ReportMessage(action, s.Report(jobState))
+	return nil
+}
+
 func (s *BuildSession) warn(format string, a ...interface{}) {
 	s.ConsoleLog(Sprintf("WARN: %v\n", format), a...)
 }
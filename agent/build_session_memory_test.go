@@ -0,0 +1,80 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bytes"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type memoryPublisher struct {
+	uploads []string
+}
+
+func (p *memoryPublisher) Upload(source, destPath string, destURL *ArtifactDestURL) error {
+	p.uploads = append(p.uploads, Sprintf("%v => %v", filepath.Base(source), destPath))
+	return nil
+}
+
+func (p *memoryPublisher) DownloadFile(source *url.URL, destPath string) error {
+	return Err("not found: %v", source)
+}
+
+func (p *memoryPublisher) DownloadDir(source *url.URL, destPath string) error {
+	return Err("not found: %v", source)
+}
+
+func (p *memoryPublisher) VerifyChecksum(srcPath, destPath, checksumFname string) error {
+	return nil
+}
+
+func TestRunBuildSessionInMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory-build")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, writeFile(dir, "a.txt", "artifact"))
+
+	var console bytes.Buffer
+	publisher := &memoryPublisher{}
+	send := make(chan *protocol.Message, 1)
+	base, _ := url.Parse("https://localhost/artifacts")
+	session := MakeBuildSession("memory-build",
+		protocol.ComposeCommand(
+			protocol.EchoCommand("hello"),
+			protocol.UploadArtifactCommand("a.txt", "dest", "false"),
+		),
+		stream.NopCloser(&console),
+		publisher,
+		base,
+		send,
+		dir)
+	assert.Nil(t, session.Run())
+
+	assert.Equal(t, Sprintf("hello\nUploading artifacts from %v/a.txt to dest\n", dir), console.String())
+	assert.Equal(t, []string{"a.txt => dest/a.txt"}, publisher.uploads)
+	report := (<-send).Report()
+	assert.Equal(t, "memory-build", report.BuildId)
+	assert.Equal(t, protocol.BuildPassed, report.Result)
+}
@@ -19,11 +19,13 @@ import (
 	"github.com/bmatcuk/doublestar"
 	. "github.com/gocd-contrib/gocd-golang-agent/agent"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/server"
 	"github.com/xli/assert"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strings"
@@ -86,12 +88,47 @@ overriding environment variable 'env2' with value 'value6'
 overriding environment variable 'env2' with value 'value6'
 overriding environment variable 'env2' with value ''
 setting environment variable 'TEST_EXPORT' to value 'EXPORT_VALUE'
-value4
-exec command should have this
 `
+	wd := GetConfig().WorkingDir
+	expected += execBanner(wd, "bash", "-c", "echo $env1") + "value4\n" +
+		execBanner(wd, "bash", "-c", "echo $SHOULD_EXPORT") + "exec command should have this\n"
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
+func TestExportSecureValuesAsFiles(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	dir, err := ioutil.TempDir("", "gocd-secret-files-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	paths := filepath.Join(dir, "paths")
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportFileCommand("KUBECONFIG", "apiVersion: v1", "true", ""),
+		protocol.ExportFileCommand("KEYSTORE", "AAH/", "true", "base64"),
+		protocol.ExecCommand("sh", "-c", "stat -c %a $KUBECONFIG; cat $KUBECONFIG; echo; od -An -tx1 $KEYSTORE; echo $KUBECONFIG $KEYSTORE > "+paths),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	log = trimTimestamp(log)
+	assert.True(t, strings.Contains(log, "600\napiVersion: v1\n 00 01 ff\n"))
+	data, err := ioutil.ReadFile(paths)
+	assert.Nil(t, err)
+	files := strings.Fields(string(data))
+	assert.Equal(t, 2, len(files))
+	for _, file := range files {
+		assert.True(t, strings.Contains(log, "' to value '"+file+"'\n"))
+		_, err := os.Stat(file)
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Dir(file))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
 func TestExecCommand(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -104,8 +141,155 @@ func TestExecCommand(t *testing.T) {
 
 	log, err := goServer.ConsoleLog(buildId)
 	assert.Nil(t, err)
-	assert.Equal(t, "abcd\n", trimTimestamp(log))
+	assert.Equal(t, execBanner(GetConfig().WorkingDir, "echo", "abcd")+"abcd\n", trimTimestamp(log))
+}
+func TestExecCommandEnvOverridesBuildEnv(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	os.Setenv("EXEC_ENV_OS", "os")
+	defer os.Unsetenv("EXEC_ENV_OS")
+
+	script := "echo $EXEC_ENV_OS $EXEC_ENV_BUILD $EXEC_ENV_CMD"
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("EXEC_ENV_BUILD", "build", "false"),
+		protocol.ExecCommand("sh", "-c", script).SetEnv(map[string]string{
+			"EXEC_ENV_OS":    "cmd",
+			"EXEC_ENV_BUILD": "cmd",
+			"EXEC_ENV_CMD":   "cmd",
+		}),
+		protocol.ExecCommand("sh", "-c", script),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	banner := execBanner(GetConfig().WorkingDir, "sh", "-c", script)
+	expected := "setting environment variable 'EXEC_ENV_BUILD' to value 'build'\n" +
+		banner + "cmd cmd cmd\n" +
+		banner + "os build\n"
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestMaskSecureExecCommandEnv(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", "echo $EXEC_ENV_TOKEN $EXEC_ENV_USER").SetEnv(map[string]string{
+			"EXEC_ENV_TOKEN": "s3cr3t",
+			"EXEC_ENV_USER":  "bob",
+		}).SetSecureEnv("EXEC_ENV_TOKEN"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(trimTimestamp(log), "******** bob\n"), log)
+}
+
+func TestCollapseProgressLinesInExecOutput(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("printf", `pulling 10%%\rpulling 50%%\rpulling 100%%\ndone\rdone!`))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	banner := execBanner(GetConfig().WorkingDir, "printf", `pulling 10%%\rpulling 50%%\rpulling 100%%\ndone\rdone!`)
+	assert.Equal(t, banner+"pulling 100%\ndone!\n", trimTimestamp(log))
+}
+
+func TestConvertMarkersInExecOutputIntoConsoleSections(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	output := `::group::compile\nok\n::error file=a.go,line=3,col=5::undefined: x\n::warning::slow\n::endgroup::\n::group::test\n::set-output name=a::b\nPASS`
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("printf", output))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	timestamps := regexp.MustCompile(`(?m)^(\S\S\|)?\d\d:\d\d:\d\d\.\d\d\d `)
+	banner := execBanner(GetConfig().WorkingDir, "printf", output)
+	expected := banner +
+		"##|compile\n" +
+		"ok\n" +
+		"!!|ERROR a.go:3:5: undefined: x\n" +
+		"!!|WARNING slow\n" +
+		"#/|compile\n" +
+		"##|test\n" +
+		"::set-output name=a::b\n" +
+		"PASS\n" +
+		"#/|test\n"
+	assert.Equal(t, expected, timestamps.ReplaceAllString(log, "$1"))
+}
+
+func TestTaskOutputLooksLikeConsoleTagsIsNotTagged(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	output := `##|fake section\n?0|fake end\n\036!!|fake annotation\n`
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("printf", output))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	lines := strings.Split(log, "\n")
+	for _, line := range lines[1 : len(lines)-1] {
+		assert.True(t, regexp.MustCompile(`^\d\d:\d\d:\d\d\.\d\d\d `).MatchString(line), log)
+	}
+	assert.True(t, strings.HasSuffix(log, " !!|fake annotation\n"), log)
+}
+
+func TestHintReassignmentWhenWorkspaceOfParallelTaskIsCorrupted(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	writeFile(wd, "src", "not a directory")
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ParallelComposeCommand(0,
+			echo("hello"),
+			protocol.ExecCommand("ls").Setwd(relativePath(filepath.Join(wd, "src"))),
+		),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	report := goServer.CompletedReport(buildId)
+	assert.NotNil(t, report.Reassign)
+	assert.Equal(t, protocol.ReassignWorkspaceCorrupted, report.Reassign.Reason)
+	assert.Equal(t, Sprintf("Working directory \"%v\" is not a directory", filepath.Join(wd, "src")), report.Reassign.Message)
+}
+
+func TestNoReassignmentHintWhenJobFails(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId, protocol.FailCommand("tests failed"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	assert.Nil(t, goServer.CompletedReport(buildId).Reassign)
 }
+
 func TestMkdirCommand(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -202,10 +386,28 @@ func TestShouldMaskSecretInExecOutput(t *testing.T) {
 
 	log, err := goServer.ConsoleLog(buildId)
 	assert.Nil(t, err)
-	expected := Sprintf("hello ($$$$$$)\n")
+	expected := execBanner(GetConfig().WorkingDir, "echo", "hello ($$$$$$)") + "hello ($$$$$$)\n"
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
+func TestShouldMaskSecretSplitAcrossWritesOfExecOutput(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SecretCommand("thisissecret", "$$$$$$"),
+		protocol.ExecCommand("sh", "-c", "printf 'hello (this'; sleep 0.2; printf 'issecret) thisis'"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.False(t, strings.Contains(log, "thisissecret"), log)
+	assert.True(t, strings.Contains(log, "hello ($$$$$$) thisis"), log)
+}
+
 func TestReplaceAgentBuildVairables(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -258,6 +460,50 @@ func TestFailBuildWhenThereIsUnsupportedBuildCommand(t *testing.T) {
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
+func TestFailBuildWhenBuildCommandMissesRequiredArg(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	cmd := protocol.NewBuildCommand(protocol.CommandUploadArtifact).AddArg("dest", "dir")
+	goServer.SendBuild(AgentId, buildId, cmd)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+
+	expected := "ERROR: Invalid build command, uploadArtifact command requires arg 'src': {\"Name\":\"uploadArtifact\",\"Args\":{\"dest\":\"dir\"},"
+	assert.True(t, strings.HasPrefix(trimTimestamp(log), expected))
+}
+
+func TestFailBuildAndKeepAgentAliveWhenCommandPanics(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId, protocol.ComposeCommand(
+		protocol.EchoCommand("before"),
+		nil,
+		protocol.EchoCommand("after").RunIf("failed"),
+	))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	lines := strings.Split(trimTimestamp(log), "\n")
+	assert.Equal(t, 4, len(lines))
+	assert.Equal(t, "before", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "ERROR: Unexpected error while processing build command: runtime error: invalid memory address or nil pointer dereference"))
+	assert.Equal(t, "after", lines[2])
+
+	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("alive"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
+
 func TestShouldFailBuildIfWorkingDirIsSetToOutsideOfAgentWorkingDir(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -289,6 +535,102 @@ func TestShouldFailBuildIfWorkingDirDoesNotExist(t *testing.T) {
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
+func TestFailBuildBeforeRunningTasksWhenArtifactURLIsUnreachable(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	locator := "/builds/" + buildId
+	build := protocol.NewBuild(buildId, locator, locator,
+		server.ConsoleLogPath+locator,
+		"https://localhost:1/artifacts"+locator,
+		server.PropertiesPath+locator,
+		protocol.ExecCommand("touch", "marker").Setwd(relativePath(wd)))
+	goServer.Send(AgentId, protocol.BuildMessage(build))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(trimTimestamp(log), "ERROR: agent cannot reach server URL https://localhost:1/artifacts"+locator+": "))
+	_, err = os.Stat(filepath.Join(wd, "marker"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNeverShowCredentialsOfServerURLsInConsole(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.DownloadFileCommand("a.txt", "https://localhost:1/files/a.txt?token=download-token", "a.txt",
+			"https://localhost:1/files/md5.checksum?token=download-token", "md5.checksum").Setwd(pipelineDirRelativePath()),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(log, "https://localhost:1/files/md5.checksum?token=REDACTED"))
+	assert.False(t, contains(log, "download-token"))
+}
+
+func TestCreateNestedWorkingDirForCommandsWritingIntoIt(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := filepath.Join(pipelineDirRelativePath(), "notexist", "nested")
+	goServer.SendBuild(AgentId, buildId, protocol.MkdirsCommand("dir").Setwd(wd))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	info, err := os.Stat(filepath.Join(pipelineDir(), "notexist", "nested", "dir"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+}
+
+func TestAlwaysCreateWorkingDir(t *testing.T) {
+	GetConfig().CreateWorkingDir = CreateWorkingDirAlways
+	defer func() {
+		GetConfig().CreateWorkingDir = CreateWorkingDirAuto
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := filepath.Join(pipelineDirRelativePath(), "notexist", "nested")
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("pwd").Setwd(wd))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	absWd := filepath.Join(pipelineDir(), "notexist", "nested")
+	assert.Equal(t, execBanner(absWd, "pwd")+absWd+"\n", trimTimestamp(log))
+}
+
+func TestNeverCreateWorkingDir(t *testing.T) {
+	GetConfig().CreateWorkingDir = CreateWorkingDirNever
+	defer func() {
+		GetConfig().CreateWorkingDir = CreateWorkingDirAuto
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := filepath.Join(pipelineDirRelativePath(), "notexist", "nested")
+	goServer.SendBuild(AgentId, buildId, protocol.MkdirsCommand("dir").Setwd(wd))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, Sprintf("ERROR: Working directory \"%v\" is not a directory\n", filepath.Join(pipelineDir(), "notexist", "nested")), trimTimestamp(log))
+}
+
 func TestReportStatusAndCompleting(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -310,6 +652,73 @@ func TestReportStatusAndCompleting(t *testing.T) {
 	assert.Equal(t, "agent Idle", stateLog.Next())
 }
 
+func TestSendConsoleOutputBeforeReportCompleting(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		echo("before completing"),
+		protocol.ReportCompletingCommand(),
+		protocol.ExecCommand("sleep", "1"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	// the banner of the sleep command may be flushed in the meantime
+	assert.True(t, strings.HasPrefix(trimTimestamp(log), "before completing\n"))
+
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
+
+func TestParallelComposeMergesPrefixedConsoleOutput(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ParallelComposeCommand(2,
+			protocol.ExecCommand("sh", "-c", "sleep 0.3; echo one; printf partial"),
+			echo("two"),
+		),
+		echo("after"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	// banner of task 1 races with echo of task 2
+	banner := "[task 1] " + execBanner(GetConfig().WorkingDir, "sh", "-c", "sleep 0.3; echo one; printf partial")
+	assert.True(t, contains(trimTimestamp(log), banner))
+	assert.Equal(t, "[task 2] two\n[task 1] one\n[task 1] partial\nafter\n", strings.Replace(trimTimestamp(log), banner, "", 1))
+}
+
+func TestParallelComposeFailsWhenAnyTaskFails(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ParallelComposeCommand(2,
+			protocol.FailCommand("boom"),
+			protocol.ExecCommand("sh", "-c", "sleep 0.2; echo still runs"),
+		),
+		echo("skipped"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	// banner of task 2 races with failure of task 1
+	banner := "[task 2] " + execBanner(GetConfig().WorkingDir, "sh", "-c", "sleep 0.2; echo still runs")
+	assert.True(t, contains(trimTimestamp(log), banner))
+	assert.Equal(t, "[task 1] ERROR: boom\n[task 2] still runs\n", strings.Replace(trimTimestamp(log), banner, "", 1))
+}
+
 func TestTestCommand(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -438,6 +847,34 @@ func TestGenerateTestReportFromTestSuitesReport(t *testing.T) {
 	assert.True(t, strings.Contains(string(content), "<span class=\"tests_total_count\">1</span>"), Sprintf("wrong unit test report? %s", content))
 }
 
+func TestGenerateTestReportCountsErrorsApartFromFailures(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createTestProjectInPipelineDir()
+	copyTestReports(filepath.Join(wd, "reports"), "junit", "junit_report_errors.xml")
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.GenerateTestReportCommand("testoutput", "reports/junit_report_errors.xml").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	content, err := ioutil.ReadFile(goServer.ArtifactFile(buildId, "testoutput/index.html"))
+	assert.Nil(t, err)
+	report := string(content)
+	for _, expected := range []string{
+		`<span class="tests_total_count">4</span>`,
+		`<span class="tests_failed_count">1</span>`,
+		`<span class="tests_error_count">2</span>`,
+		"Unit Test Failure and Error Details (3)",
+		"java.lang.NullPointerException at com.ErrorTest.shouldNotThrowNullPointer",
+		"java.lang.IllegalStateException at com.ErrorTest.shouldNotThrowIllegalState",
+	} {
+		assert.True(t, strings.Contains(report, expected), Sprintf("%v not in report %s", expected, content))
+	}
+}
+
 func TestDoNothingIfGenerateTestReportSrcsIsEmpty(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -0,0 +1,170 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// CacheBackend stores task cache entries shared by agents, an entry is a
+// gzipped tar of the outputs of a task, keyed by the task fingerprint.
+type CacheBackend interface {
+	// Get writes entry of key to w, false when there is no such entry
+	Get(key string, w io.Writer) (bool, error)
+	Put(key string, body io.Reader, size int64) error
+}
+
+// NewCacheBackend makes the backend of a remote task cache URL, either
+// "s3://<bucket>/<prefix>" for an S3 bucket accessed with the standard AWS
+// environment variables, or an http(s) URL entries are put to and got from.
+func NewCacheBackend(cacheURL string) (CacheBackend, error) {
+	u, err := url.Parse(cacheURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &HTTPCacheBackend{
+			URL:    strings.TrimSuffix(cacheURL, "/"),
+			Client: &http.Client{Timeout: 5 * time.Minute},
+		}, nil
+	case "s3":
+		b := &S3CacheBackend{
+			Bucket:          u.Host,
+			Prefix:          strings.TrimPrefix(u.Path, "/"),
+			Region:          readEnv("AWS_REGION", os.Getenv("AWS_DEFAULT_REGION")),
+			AccessKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			Endpoint:        readEnv("AWS_ENDPOINT_URL_S3", os.Getenv("AWS_ENDPOINT_URL")),
+			Client:          &http.Client{Timeout: 5 * time.Minute},
+		}
+		if b.Region == "" || b.AccessKeyId == "" || b.SecretAccessKey == "" {
+			return nil, Err("AWS region and credentials are required by task cache %v", cacheURL)
+		}
+		return b, nil
+	}
+	return nil, Err("unsupported task cache URL %v", SanitizeURL(u))
+}
+
+// HTTPCacheBackend gets and puts entries as <URL>/<key>.tar.gz, user info
+// of URL is sent as basic authentication.
+type HTTPCacheBackend struct {
+	URL    string
+	Client *http.Client
+}
+
+func (b *HTTPCacheBackend) Get(key string, w io.Writer) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, b.URL+"/"+key+".tar.gz", nil)
+	if err != nil {
+		return false, err
+	}
+	return getCacheEntry(b.Client, req, w)
+}
+
+func (b *HTTPCacheBackend) Put(key string, body io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPut, b.URL+"/"+key+".tar.gz", body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	return putCacheEntry(b.Client, req)
+}
+
+// S3CacheBackend gets and puts entries as objects <Prefix><key>.tar.gz
+// of Bucket.
+type S3CacheBackend struct {
+	Bucket          string
+	Prefix          string
+	Region          string
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	// Endpoint defaults to https://<bucket>.s3.<region>.amazonaws.com,
+	// the bucket is in path of the other endpoints
+	Endpoint string
+	Client   *http.Client
+}
+
+func (b *S3CacheBackend) objectURL(key string) string {
+	object := b.Prefix + key + ".tar.gz"
+	if b.Endpoint == "" {
+		return Sprintf("https://%v.s3.%v.amazonaws.com/%v", b.Bucket, b.Region, object)
+	}
+	return Sprintf("%v/%v/%v", strings.TrimSuffix(b.Endpoint, "/"), b.Bucket, object)
+}
+
+func (b *S3CacheBackend) sign(req *http.Request) {
+	// body is streamed, so it is not part of the signature
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if b.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.SessionToken)
+	}
+	signAWSRequest(req, "UNSIGNED-PAYLOAD", b.AccessKeyId, b.SecretAccessKey, b.Region, "s3", time.Now())
+}
+
+func (b *S3CacheBackend) Get(key string, w io.Writer) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, b.objectURL(key), nil)
+	if err != nil {
+		return false, err
+	}
+	b.sign(req)
+	return getCacheEntry(b.Client, req, w)
+}
+
+func (b *S3CacheBackend) Put(key string, body io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPut, b.objectURL(key), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	b.sign(req)
+	return putCacheEntry(b.Client, req)
+}
+
+func getCacheEntry(client *http.Client, req *http.Request, w io.Writer) (bool, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, SanitizeError(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		_, err = io.Copy(w, resp.Body)
+		return err == nil, err
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, Err("get %v responded %v", SanitizeURL(req.URL), resp.Status)
+}
+
+func putCacheEntry(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return SanitizeError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return Err("put %v responded %v", SanitizeURL(req.URL), resp.Status)
+	}
+	return nil
+}
@@ -20,9 +20,9 @@ import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 )
 
-func CommandAnd(s *BuildSession, cmd *protocol.BuildCommand) error {
+func CommandAnd(ctx *BuildContext, cmd *protocol.BuildCommand) error {
 	for _, sub := range cmd.SubCommands {
-		_, err := s.processTestCommand(sub)
+		_, err := ctx.commands().processTestCommand(sub)
 		if err != nil {
 			return err
 		}
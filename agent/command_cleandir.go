@@ -26,15 +26,15 @@ import (
 	"strings"
 )
 
-func CommandCleandir(s *BuildSession, cmd *protocol.BuildCommand) (err error) {
+func CommandCleandir(ctx *BuildContext, cmd *protocol.BuildCommand) (err error) {
 	path := cmd.Args["path"]
 	allows, err := cmd.ListArg("allowed")
 	if err != nil {
 		return
 	}
-	fullPath := filepath.Join(s.wd, path)
-	s.debugLog("cleandir %v, excludes: %+v", fullPath, allows)
-	return Cleandir(s.console, fullPath, allows...)
+	fullPath := filepath.Join(ctx.Wd, path)
+	ctx.debugLog("cleandir %v, excludes: %+v", fullPath, allows)
+	return Cleandir(ctx.Console, fullPath, allows...)
 }
 
 func Cleandir(log io.Writer, root string, allows ...string) error {
@@ -50,7 +50,11 @@ func Cleandir(log io.Writer, root string, allows ...string) error {
 	}
 	w := stream.NewSubstituteWriter(log)
 	w.Substitutions[" "+root+"/"] = " "
-	return cleandir(w, root, allows...)
+	err := cleandir(w, root, allows...)
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	return err
 }
 
 func cleandir(log io.Writer, root string, allows ...string) error {
@@ -18,9 +18,32 @@ package agent
 
 import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"runtime"
+	"strconv"
+	"sync"
 )
 
-func CommandCompose(s *BuildSession, cmd *protocol.BuildCommand) error {
+// CommandCompose processes sub commands in order. Once a compose runs,
+// no matter its runIf is passed, failed or any, its sub commands start
+// with a passed status: runIf of each sub command is evaluated against
+// whether an earlier sibling has failed. Failure of a sub command fails
+// the compose and the build. With arg parallel=true sub commands run
+// concurrently, see composeParallel.
+func CommandCompose(ctx *BuildContext, cmd *protocol.BuildCommand) error {
+	return ctx.commands().compose(cmd)
+}
+
+func (s *BuildSession) compose(cmd *protocol.BuildCommand) error {
+	if cmd.Args["parallel"] == "true" {
+		return composeParallel(s, cmd)
+	}
+	outer := s.runIfStatus
+	s.runIfStatus = protocol.BuildPassed
+	defer func() {
+		if outer == protocol.BuildFailed {
+			s.runIfStatus = outer
+		}
+	}()
 	var err error
 	for _, sub := range cmd.SubCommands {
 		if err != nil {
@@ -31,3 +54,58 @@ func CommandCompose(s *BuildSession, cmd *protocol.BuildCommand) error {
 	}
 	return err
 }
+
+// composeParallel runs sub commands concurrently, at most maxParallel arg
+// or number of CPUs of them at a time. Each sub command runs in a session
+// of its own starting with a passed status and a copy of environment
+// variables, console output lines are prefixed with "[task N] " of the
+// sub command. The compose fails when any sub command fails, after all
+// of them are done.
+func composeParallel(s *BuildSession, cmd *protocol.BuildCommand) error {
+	limit := runtime.NumCPU()
+	if arg := cmd.Args["maxParallel"]; arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return Err("Invalid maxParallel of compose: %v", arg)
+		}
+		limit = n
+	}
+	// tasks start with artifacts size of s and add what they upload
+	baseArtifactsSize := s.artifactsSize
+	slots := make(chan bool, limit)
+	tasks := make([]*BuildSession, len(cmd.SubCommands))
+	errs := make([]error, len(cmd.SubCommands))
+	var wg sync.WaitGroup
+	for i, sub := range cmd.SubCommands {
+		tasks[i] = s.fork(Sprintf("[task %v] ", i+1))
+		wg.Add(1)
+		go func(i int, sub *protocol.BuildCommand) {
+			defer wg.Done()
+			slots <- true
+			defer func() { <-slots }()
+			errs[i] = tasks[i].process(sub)
+		}(i, sub)
+	}
+	wg.Wait()
+
+	var err error
+	for i, task := range tasks {
+		s.join(task)
+		s.artifactsSize += task.artifactsSize - baseArtifactsSize
+		if err == nil && failed(task.buildStatus) {
+			err = errs[i]
+			if err == nil {
+				err = Err("task %v failed", i+1)
+			}
+		}
+	}
+	if err != nil && !s.isCanceled() {
+		s.buildStatus = protocol.BuildFailed
+		if s.reassign != nil {
+			s.buildStatus = protocol.BuildError
+		}
+		s.runIfStatus = protocol.BuildFailed
+		s.diagnoseFailure()
+	}
+	return err
+}
@@ -20,17 +20,17 @@ import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 )
 
-func CommandCond(s *BuildSession, cmd *protocol.BuildCommand) error {
+func CommandCond(ctx *BuildContext, cmd *protocol.BuildCommand) error {
 	for i := 0; i < len(cmd.SubCommands); i += 2 {
 		if i == len(cmd.SubCommands)-1 {
 			// else branch
-			return s.process(cmd.SubCommands[i])
+			return ctx.commands().process(cmd.SubCommands[i])
 		}
 		test := cmd.SubCommands[i]
 		action := cmd.SubCommands[i+1]
-		_, err := s.processTestCommand(test)
+		_, err := ctx.commands().processTestCommand(test)
 		if err == nil {
-			return s.process(action)
+			return ctx.commands().process(action)
 		}
 	}
 	return nil
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// DockerCompose is the command line of docker compose.
+	DockerCompose = []string{"docker", "compose"}
+	// DockerComposeDownTimeout is how long collecting logs and stopping
+	// services of a compose file take at most when the job ends.
+	DockerComposeDownTimeout = 2 * time.Minute
+
+	invalidProjectNameChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+)
+
+// composeProject is a docker compose file, relative to wd, whose services
+// are up while the job is running.
+type composeProject struct {
+	file string
+	name string
+	wd   string
+	env  []string
+}
+
+// jobServices are compose projects started by a job, shared by tasks of
+// parallel composes.
+type jobServices struct {
+	mu       sync.Mutex
+	projects []*composeProject
+}
+
+func (j *jobServices) add(p *composeProject) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.projects = append(j.projects, p)
+}
+
+func (s *BuildSession) addService(p *composeProject) error {
+	s.services.add(p)
+	return nil
+}
+
+func (j *jobServices) take() []*composeProject {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	projects := j.projects
+	j.projects = nil
+	return projects
+}
+
+func CommandDockerCompose(ctx *BuildContext, cmd *protocol.BuildCommand) error {
+	var services []string
+	if _, ok := cmd.Args["services"]; ok {
+		var err error
+		if services, err = cmd.ListArg("services"); err != nil {
+			return err
+		}
+	}
+	p := &composeProject{
+		file: cmd.Args["file"],
+		name: cmd.Args["project"],
+		wd:   ctx.Wd,
+		env:  ctx.commandEnv(nil),
+	}
+	if p.name == "" {
+		p.name = composeProjectName(ctx.BuildId)
+	}
+	// services partially started are stopped as well
+	if err := ctx.job().addService(p); err != nil {
+		return err
+	}
+
+	title := Sprintf("Starting services of %v", p.file)
+	ctx.ConsoleLog("%v", tagged(ConsoleSectionStartTag, title))
+	defer ctx.ConsoleLog("%v", tagged(ConsoleSectionEndTag, title))
+	up := p.command(context.Background(), ctx.Output, append([]string{"up", "--detach", "--wait"}, services...)...)
+	if err := up.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- up.Wait()
+	}()
+	select {
+	case <-ctx.Canceled:
+		up.Process.Kill()
+		<-done
+		return Err("docker compose up of %v is canceled", p.file)
+	case err := <-done:
+		if err != nil {
+			return Err("docker compose up of %v failed: %v", p.file, err)
+		}
+		return nil
+	}
+}
+
+func (p *composeProject) command(ctx context.Context, output io.Writer, args ...string) *exec.Cmd {
+	args = append(append(append([]string{}, DockerCompose[1:]...), "--file", p.file, "--project-name", p.name), args...)
+	cmd := exec.CommandContext(ctx, DockerCompose[0], args...)
+	cmd.Dir = p.wd
+	cmd.Env = p.env
+	cmd.Stdout = output
+	cmd.Stderr = output
+	return cmd
+}
+
+// stopServices writes logs of every service started by the job into a
+// console section of its own, and stops them, also when the job is
+// canceled.
+func (s *BuildSession) stopServices() {
+	if s.services == nil {
+		return
+	}
+	projects := s.services.take()
+	for i := len(projects) - 1; i >= 0; i-- {
+		p := projects[i]
+		ctx, cancel := context.WithTimeout(context.Background(), DockerComposeDownTimeout)
+		var names bytes.Buffer
+		if err := p.command(ctx, &names, "config", "--services").Run(); err != nil {
+			s.warn("Could not list services of %v: %v", p.file, err)
+		}
+		for _, service := range strings.Fields(names.String()) {
+			s.composeSection(Sprintf("Logs of service %v", service), p.command(ctx, s.secrets, "logs", "--no-color", service))
+		}
+		if err := s.composeSection(Sprintf("Stopping services of %v", p.file), p.command(ctx, s.secrets, "down", "--volumes", "--remove-orphans")); err != nil {
+			s.warn("Could not stop services of %v: %v", p.file, err)
+		}
+		cancel()
+	}
+}
+
+func (s *BuildSession) composeSection(title string, cmd *exec.Cmd) error {
+	s.ConsoleLog("%v", tagged(ConsoleSectionStartTag, title))
+	defer s.ConsoleLog("%v", tagged(ConsoleSectionEndTag, title))
+	return cmd.Run()
+}
+
+// composeProjectName is the default project name of compose files of a
+// build, so that concurrent builds on a docker host don't share services.
+func composeProjectName(buildId string) string {
+	return "gocd-" + invalidProjectNameChars.ReplaceAllString(strings.ToLower(buildId), "-")
+}
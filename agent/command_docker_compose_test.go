@@ -0,0 +1,108 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// fakeDockerCompose records calls of docker compose into calls.log of wd
+func fakeDockerCompose(wd string) func() {
+	writeFile(wd, "compose.sh", `echo "$5 $6 $7" >> calls.log
+case "$5" in
+  config) printf 'db\nqueue\n' ;;
+  logs) echo "log of $7" ;;
+  up) echo "started $4" ;;
+  down) echo "stopped $4" ;;
+esac
+`)
+	DockerCompose = []string{"sh", filepath.Join(wd, "compose.sh")}
+	return func() {
+		DockerCompose = []string{"docker", "compose"}
+	}
+}
+
+func TestDockerComposeServicesAreStoppedWhenJobEnds(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	defer fakeDockerCompose(wd)()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.DockerComposeCommand("docker-compose.yml", "db").Setwd(relativePath(wd)),
+		echo("running tests"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	timestamps := regexp.MustCompile(`(?m)^(\S\S\|)?\d\d:\d\d:\d\d\.\d\d\d `)
+	expected := "##|Starting services of docker-compose.yml\n" +
+		"started gocd-testdockercomposeservicesarestoppedwhenjobends\n" +
+		"#/|Starting services of docker-compose.yml\n" +
+		"running tests\n" +
+		"##|Logs of service db\n" +
+		"log of db\n" +
+		"#/|Logs of service db\n" +
+		"##|Logs of service queue\n" +
+		"log of queue\n" +
+		"#/|Logs of service queue\n" +
+		"##|Stopping services of docker-compose.yml\n" +
+		"stopped gocd-testdockercomposeservicesarestoppedwhenjobends\n" +
+		"#/|Stopping services of docker-compose.yml\n"
+	assert.Equal(t, expected, timestamps.ReplaceAllString(log, "$1"))
+
+	calls, err := ioutil.ReadFile(filepath.Join(wd, "calls.log"))
+	assert.Nil(t, err)
+	assert.Equal(t, "up --detach --wait\nconfig --services \nlogs --no-color db\nlogs --no-color queue\ndown --volumes --remove-orphans\n", string(calls))
+}
+
+func TestDockerComposeServicesAreStoppedWhenJobIsCanceled(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	defer fakeDockerCompose(wd)()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.DockerComposeCommand("docker-compose.yml").Setwd(relativePath(wd)),
+		protocol.ExecCommand("sleep", "5"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(filepath.Join(wd, "calls.log")); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	goServer.Send(AgentId, protocol.CancelMessage())
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	calls, err := ioutil.ReadFile(filepath.Join(wd, "calls.log"))
+	assert.Nil(t, err)
+	assert.Equal(t, "up --detach --wait\nconfig --services \nlogs --no-color db\nlogs --no-color queue\ndown --volumes --remove-orphans\n", string(calls))
+}
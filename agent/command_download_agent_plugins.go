@@ -0,0 +1,86 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CommandDownloadAgentPlugins syncs plugins or tools server asks for before
+// a job. The zip is unzipped into dest inside agent working directory, and
+// md5 of it is kept in dest.md5 so that the same zip is downloaded once.
+func CommandDownloadAgentPlugins(ctx *BuildContext, cmd *protocol.BuildCommand) error {
+	dest := filepath.Join(ctx.RootDir, cmd.Args["dest"])
+	if !strings.HasPrefix(dest, ctx.RootDir+string(os.PathSeparator)) {
+		return Err("Agent plugins destination[%v] is outside the agent sandbox.", dest)
+	}
+	checksum := cmd.Args["checksum"]
+	checksumFile := dest + ".md5"
+	if synced, err := ioutil.ReadFile(checksumFile); err == nil && checksum != "" && string(synced) == checksum {
+		ctx.ConsoleLog("Agent plugins in [%v] are up to date.\n", cmd.Args["dest"])
+		return nil
+	}
+
+	source, err := config.MakeFullServerURL(cmd.Args["url"])
+	if err != nil {
+		return err
+	}
+	zipfile, err := ioutil.TempFile("", "agent-plugins.zip")
+	if err != nil {
+		return err
+	}
+	zipfile.Close()
+	defer os.Remove(zipfile.Name())
+	ctx.ConsoleLog("Downloading agent plugins to [%v]\n", cmd.Args["dest"])
+	if err := ctx.Artifacts.DownloadFile(source, zipfile.Name()); err != nil {
+		return err
+	}
+	if checksum != "" {
+		md5, err := ComputeMd5(zipfile.Name())
+		if err != nil {
+			return err
+		}
+		if md5 != checksum {
+			return Err("Agent plugins downloaded from [%v] do not match checksum, expected %v but got %v", SanitizeURL(source), checksum, md5)
+		}
+	}
+
+	// unzip aside so that a failed sync does not leave dest half updated
+	unzipped := dest + ".tmp"
+	if err := os.RemoveAll(unzipped); err != nil {
+		return err
+	}
+	if err := extractZip(zipfile.Name(), unzipped); err != nil {
+		os.RemoveAll(unzipped)
+		return err
+	}
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	if err := os.Rename(unzipped, dest); err != nil {
+		return err
+	}
+	if checksum == "" {
+		os.Remove(checksumFile)
+		return nil
+	}
+	return ioutil.WriteFile(checksumFile, []byte(checksum), 0644)
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"archive/zip"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadAgentPlugins(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	pluginsZip := goServer.ArtifactFile(buildId, "plugins.zip")
+	writeZip(t, pluginsZip, map[string]string{"tools/lint.sh": "echo lint"})
+	checksum, err := ComputeMd5(pluginsZip)
+	assert.Nil(t, err)
+	dest := filepath.Join(pipelineDirRelativePath(), "plugins")
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.DownloadAgentPluginsCommand(goServer.ArtifactUrl(buildId, "plugins.zip"), checksum, dest))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, Sprintf("Downloading agent plugins to [%v]\n", dest), trimTimestamp(log))
+	os.Truncate(goServer.ConsoleLogFile(buildId), 0)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.DownloadAgentPluginsCommand(goServer.ArtifactUrl(buildId, "plugins.zip"), checksum, dest))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err = goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, Sprintf("Agent plugins in [%v] are up to date.\n", dest), trimTimestamp(log))
+	content, err := ioutil.ReadFile(filepath.Join(pipelineDir(), "plugins", "tools", "lint.sh"))
+	assert.Nil(t, err)
+	assert.Equal(t, "echo lint", string(content))
+}
+
+func TestFailToDownloadAgentPluginsNotMatchingChecksum(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	pluginsZip := goServer.ArtifactFile(buildId, "plugins.zip")
+	writeZip(t, pluginsZip, map[string]string{"tools/lint.sh": "echo lint"})
+	dest := filepath.Join(pipelineDirRelativePath(), "plugins")
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.DownloadAgentPluginsCommand(goServer.ArtifactUrl(buildId, "plugins.zip"), "bad-checksum", dest))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	_, err := os.Stat(filepath.Join(pipelineDir(), "plugins"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func writeZip(t *testing.T, file string, entries map[string]string) {
+	assert.Nil(t, Mkdirs(filepath.Dir(file)))
+	f, err := os.Create(file)
+	assert.Nil(t, err)
+	w := zip.NewWriter(f)
+	for name, content := range entries {
+		ew, err := w.Create(name)
+		assert.Nil(t, err)
+		ew.Write([]byte(content))
+	}
+	assert.Nil(t, w.Close())
+	assert.Nil(t, f.Close())
+}
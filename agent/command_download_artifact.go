@@ -18,16 +18,18 @@ package agent
 
 import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"os"
 	"path/filepath"
+	"strings"
 )
 
-func CommandDownloadArtifact(s *BuildSession, cmd *protocol.BuildCommand) error {
+func CommandDownloadArtifact(ctx *BuildContext, cmd *protocol.BuildCommand) error {
 	checksumURL, err := config.MakeFullServerURL(cmd.Args["checksumUrl"])
 	if err != nil {
 		return err
 	}
-	absChecksumFile := filepath.Join(s.wd, cmd.Args["checksumFile"])
-	err = s.artifacts.DownloadFile(checksumURL, absChecksumFile)
+	absChecksumFile := filepath.Join(ctx.Wd, cmd.Args["checksumFile"])
+	err = ctx.Artifacts.DownloadFile(checksumURL, absChecksumFile)
 	if err != nil {
 		return err
 	}
@@ -37,24 +39,83 @@ func CommandDownloadArtifact(s *BuildSession, cmd *protocol.BuildCommand) error
 		return err
 	}
 	srcPath := cmd.Args["src"]
-	absDestPath := filepath.Join(s.wd, cmd.Args["dest"])
-	if cmd.Name == protocol.CommandDownloadDir {
-		_, fname := filepath.Split(srcPath)
-		absDestPath = filepath.Join(s.wd, cmd.Args["dest"], fname)
+	absDestPath, err := fetchArtifactDestPath(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	if job := cmd.Args["job"]; job != "" {
+		ctx.ConsoleLog("Fetching artifact [%v] from [%v]\n", srcPath, job)
 	}
-	err = s.artifacts.VerifyChecksum(srcPath, absDestPath, absChecksumFile)
+	err = ctx.Artifacts.VerifyChecksum(srcPath, absDestPath, absChecksumFile)
 	if err == nil {
-		s.ConsoleLog("[%v] exists and matches checksum, does not need dowload it from server.\n", srcPath)
+		ctx.ConsoleLog("[%v] exists and matches checksum, does not need dowload it from server.\n", srcPath)
 		return nil
 	}
-	s.debugLog("download %v to %v", srcURL, absDestPath)
+	if config.LocalArtifactsDir != "" {
+		err = fetchLocalArtifact(srcURL, absDestPath, cmd.Name == protocol.CommandDownloadDir)
+		if err == nil {
+			err = ctx.Artifacts.VerifyChecksum(srcPath, absDestPath, absChecksumFile)
+		}
+		if err == nil {
+			ctx.ConsoleLog("Fetched [%v] from artifacts kept on this agent.\n", srcPath)
+			return nil
+		}
+		ctx.debugLog("fetch local artifact %v failed: %v", srcURL, err)
+		if cmd.Name != protocol.CommandDownloadDir {
+			os.Remove(absDestPath)
+		}
+	}
+	isDir := cmd.Name == protocol.CommandDownloadDir
+	cached, cacheable := artifactChecksums(srcPath, absChecksumFile, isDir)
+	cacheable = cacheable && artifactFetchCache.enabled()
+	if cacheable {
+		err = artifactFetchCache.restore(srcURL, cached, absDestPath)
+		if err == nil {
+			err = ctx.Artifacts.VerifyChecksum(srcPath, absDestPath, absChecksumFile)
+			if err == nil {
+				ctx.ConsoleLog("Fetched [%v] from artifact cache of the agent.\n", srcPath)
+				return nil
+			}
+			artifactFetchCache.remove(srcURL, cached)
+		}
+		ctx.debugLog("fetch cached artifact %v failed: %v", srcURL, err)
+	}
+	ctx.debugLog("download %v to %v", srcURL, absDestPath)
 	if cmd.Name == protocol.CommandDownloadDir {
-		err = s.artifacts.DownloadDir(srcURL, absDestPath)
+		err = ctx.Artifacts.DownloadDir(srcURL, absDestPath)
 	} else {
-		err = s.artifacts.DownloadFile(srcURL, absDestPath)
+		err = ctx.Artifacts.DownloadFile(srcURL, absDestPath)
 	}
 	if err != nil {
 		return err
 	}
-	return s.artifacts.VerifyChecksum(srcPath, absDestPath, absChecksumFile)
+	err = ctx.Artifacts.VerifyChecksum(srcPath, absDestPath, absChecksumFile)
+	if err != nil && cmd.Name != protocol.CommandDownloadDir {
+		// later tasks must not pick up a file that failed verification
+		os.Remove(absDestPath)
+	}
+	if err == nil && cacheable {
+		if err := artifactFetchCache.store(srcURL, cached, absDestPath); err != nil {
+			ctx.debugLog("cache artifact %v failed: %v", srcURL, err)
+		}
+	}
+	return err
+}
+
+// fetchArtifactDestPath resolves where a fetched artifact lands, following
+// the Java agent: a directory is always fetched into dest/<last src segment>,
+// a file is fetched to dest unless dest is an existing directory, in which
+// case the file keeps its source name inside it.
+func fetchArtifactDestPath(ctx *BuildContext, cmd *protocol.BuildCommand) (string, error) {
+	srcName := filepath.Base(filepath.FromSlash(strings.TrimRight(cmd.Args["src"], "/")))
+	absDestPath := filepath.Join(ctx.Wd, cmd.Args["dest"])
+	if cmd.Name == protocol.CommandDownloadDir {
+		absDestPath = filepath.Join(absDestPath, srcName)
+	} else if info, err := os.Stat(absDestPath); err == nil && info.IsDir() {
+		absDestPath = filepath.Join(absDestPath, srcName)
+	}
+	if !strings.HasPrefix(absDestPath, ctx.RootDir) {
+		return "", Err("Fetch artifact destination[%v] is outside the agent sandbox.", absDestPath)
+	}
+	return absDestPath, nil
 }
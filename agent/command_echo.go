@@ -20,9 +20,13 @@ import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 )
 
-func CommandEcho(s *BuildSession, cmd *protocol.BuildCommand) error {
+func CommandEcho(ctx *BuildContext, cmd *protocol.BuildCommand) error {
 	line := cmd.Args["line"]
-	s.echo.Write([]byte(line))
-	s.echo.Write([]byte{'\n'})
+	echo := ctx.Echo
+	if echo == nil {
+		echo = ctx.Output
+	}
+	echo.Write([]byte(line))
+	echo.Write([]byte{'\n'})
 	return nil
 }
@@ -18,40 +18,228 @@ package agent
 
 import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"io"
+	"os"
 	"os/exec"
+	"runtime"
 	"strings"
+	"syscall"
+	"time"
 )
 
-func CommandExec(s *BuildSession, cmd *protocol.BuildCommand) error {
+func CommandExec(ctx *BuildContext, cmd *protocol.BuildCommand) error {
 	args, err := cmd.ListArg("args")
 	if err != nil {
 		return err
 	}
+	env, err := cmd.MapArg("env")
+	if err != nil {
+		return err
+	}
+	if err := resolveSecureEnv(ctx, cmd, env); err != nil {
+		return err
+	}
 	execCmd := exec.Command(cmd.Args["command"], args...)
-	execCmd.Env = s.Env()
-	execCmd.Stdout = s.secrets
-	execCmd.Stderr = s.secrets
-	execCmd.Dir = s.wd
+	execCmd.Env = ctx.commandEnv(env)
+	markers := newMarkerWriter(ctx.Output)
+	var output io.Writer = markers
+	flushes := []func() error{markers.Flush}
+	if problems, flushProblems := ctx.problems.scanner(ctx.Secrets); problems != nil {
+		output = io.MultiWriter(markers, problems)
+		flushes = append(flushes, flushProblems)
+	}
+	if !config.KeepProgressLines {
+		crw := stream.NewCarriageReturnWriter(output)
+		output = crw
+		flushes = append([]func() error{crw.Flush}, flushes...)
+	}
+	flush := func() {
+		for _, f := range flushes {
+			f()
+		}
+	}
+	var heartbeat *heartbeatWriter
+	if config.ConsoleHeartbeatInterval > 0 && !ctx.Testing {
+		heartbeat = &heartbeatWriter{Writer: output}
+		output = heartbeat
+	}
+	// same writer for both so that exec copies them in one goroutine
+	execCmd.Stdout = output
+	execCmd.Stderr = output
+	execCmd.Dir = ctx.Wd
 	execCmd.Stdin = strings.NewReader(cmd.ExecInput)
-	done := make(chan error)
-	if err := execCmd.Start(); err != nil {
+	cache, err := newTaskCache(ctx.Wd, cmd, execCmd)
+	if err != nil {
+		return err
+	}
+	if restored, err := cache.restore(); err != nil {
+		ctx.warn("Could not restore outputs from task cache: %v", err)
+	} else if restored {
+		ctx.ConsoleLog("[go] Skipped task %v, outputs are restored from task cache %v\n",
+			ShellQuote(execCmd.Args...), cache.fingerprint)
+		return nil
+	}
+	if !ctx.Testing {
+		// like the Java agent, through secrets so that secure values are masked
+		ctx.Output.Write([]byte(Sprintf("[go] Start to execute task: %v, working directory: %v\n",
+			ShellQuote(execCmd.Args...), ctx.Wd)))
+	}
+	done := make(chan error, 1)
+	started := time.Now()
+	processes := ctx.jobProcesses()
+	if err := startProcess(execCmd, processes.prepare(execCmd)); err != nil {
 		return err
 	}
+	processes.track(execCmd.Process.Pid)
+	if heartbeat != nil {
+		stopHeartbeat := make(chan bool)
+		defer close(stopHeartbeat)
+		startHeartbeat(ctx, heartbeat, started, config.ConsoleHeartbeatInterval, stopHeartbeat)
+	}
 	go func() {
 		done <- execCmd.Wait()
 	}()
 
 	select {
-	case <-s.cancel:
-		s.debugLog("received cancel signal")
-		LogInfo("kill process(%v) %v", execCmd.Process, cmd.Args)
-		if err := execCmd.Process.Kill(); err != nil {
+	case <-ctx.Canceled:
+		ctx.debugLog("received cancel signal")
+		exited := terminateGracefully(ctx, execCmd.Process, done)
+		LogInfo("kill process(%v) %v", execCmd.Process.Pid, cmd.Args)
+		if err := processes.killTree(execCmd.Process); err != nil {
 			LogInfo("Kill command %v failed, error: %v\n", cmd.Args, err)
+			ctx.job().killFailed(Err("kill %v failed: %v", cmd.Args["command"], err))
 		} else {
-			LogInfo("process %v is killed", execCmd.Process)
+			// reaped, so that it is not taken as left running by the job
+			if !exited {
+				select {
+				case <-done:
+					exited = true
+				case <-time.After(time.Second):
+				}
+			}
+			LogInfo("process %v is killed", execCmd.Process.Pid)
+		}
+		// output is copied until the process is waited for, the last
+		// progress line is flushed only after that
+		if exited {
+			flush()
+			processes.recordUsage(execCmd.ProcessState)
 		}
 		return Err("%v is canceled", cmd.Args)
 	case err := <-done:
+		flush()
+		processes.recordUsage(execCmd.ProcessState)
+		if status, ok := execCmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() && !ctx.Testing {
+			coreDumped := ""
+			if status.CoreDump() {
+				coreDumped = " (core dumped)"
+			}
+			ctx.ConsoleLog("[go] Task was killed by signal: %v%v\n", status.Signal(), coreDumped)
+			ctx.job().uploadCoreDumps(started)
+		}
+		if err == nil {
+			err = ctx.problems.checkThresholds()
+		}
+		if err == nil {
+			if err := cache.save(); err != nil {
+				ctx.warn("Could not save outputs to task cache: %v", err)
+			}
+		}
 		return err
 	}
 }
+
+// resolveSecureEnv resolves values of env marked secure by the exec
+// command like CommandExport does, and masks them in console as there is
+// no secret command of them.
+func resolveSecureEnv(ctx *BuildContext, cmd *protocol.BuildCommand, env map[string]string) error {
+	if _, ok := cmd.Args["secureEnv"]; !ok {
+		return nil
+	}
+	names, err := cmd.ListArg("secureEnv")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		value, ok := env[name]
+		if !ok {
+			continue
+		}
+		resolved, secrets, err := ResolveSecrets(value)
+		if err != nil {
+			return Err("Could not resolve secure environment variable '%v': %v", name, err)
+		}
+		for _, secret := range append(secrets, resolved) {
+			if secret != "" {
+				ctx.addSecret(secret, DefaultSecretMask)
+			}
+		}
+		env[name] = resolved
+	}
+	return nil
+}
+
+// terminateGracefully sends SIGTERM to the process tree of a canceled
+// command and waits config.CancelGracePeriod for it to exit, so that it
+// can clean up before it is killed. Returns whether it exited.
+func terminateGracefully(ctx *BuildContext, p *os.Process, done chan error) bool {
+	grace := config.CancelGracePeriod
+	if grace <= 0 {
+		return false
+	}
+	if err := ctx.jobProcesses().terminate(p); err != nil {
+		ctx.ConsoleLog("[go] Could not send SIGTERM to task, killing it: %v\n", err)
+		return false
+	}
+	started := time.Now()
+	select {
+	case <-done:
+		ctx.ConsoleLog("[go] Task stopped in %v after SIGTERM.\n", time.Since(started).Round(time.Millisecond))
+		return true
+	case <-time.After(grace):
+		ctx.ConsoleLog("[go] Task did not stop in %v after SIGTERM, killing it.\n", grace)
+		return false
+	}
+}
+
+// startProcess starts cmd from a thread set up by setup first when it is
+// not nil.
+func startProcess(cmd *exec.Cmd, setup func() error) error {
+	var setups []func() error
+	if setup != nil {
+		setups = append(setups, setup)
+	}
+	if config.ProtectConfig == ProtectConfigMount {
+		setups = append(setups, func() error {
+			return mountReadOnly(config.ConfigDir)
+		})
+	}
+	if config.JobNetworkNamespace != "" {
+		setups = append(setups, func() error {
+			return joinNetworkNamespace(cmd, config.JobNetworkNamespace)
+		})
+	}
+	if len(setups) == 0 {
+		return cmd.Start()
+	}
+	return startOnLockedThread(cmd, setups...)
+}
+
+// startOnLockedThread starts cmd from an OS thread changed by setups, the
+// thread is never unlocked, so that it is terminated with the goroutine
+// instead of being reused by the agent
+func startOnLockedThread(cmd *exec.Cmd, setups ...func() error) error {
+	started := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		for _, setup := range setups {
+			if err := setup(); err != nil {
+				started <- err
+				return
+			}
+		}
+		started <- cmd.Start()
+	}()
+	return <-started
+}
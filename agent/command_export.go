@@ -17,28 +17,65 @@
 package agent
 
 import (
+	"encoding/base64"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"os"
 )
 
-func CommandExport(s *BuildSession, cmd *protocol.BuildCommand) error {
+func CommandExport(ctx *BuildContext, cmd *protocol.BuildCommand) error {
 	msg := "setting environment variable '%v' to value '%v'\n"
 	name := cmd.Args["name"]
 	value, ok := cmd.Args["value"]
 	if !ok {
-		s.ConsoleLog(msg, name, os.Getenv(name))
+		ctx.ConsoleLog(msg, name, os.Getenv(name))
 		return nil
 	}
 	secure := cmd.Args["secure"]
 	displayValue := value
 	if secure == "true" {
 		displayValue = DefaultSecretMask
+		resolved, secrets, err := ResolveSecrets(value)
+		if err != nil {
+			return Err("Could not resolve secure environment variable '%v': %v", name, err)
+		}
+		for _, secret := range secrets {
+			if secret != "" {
+				ctx.addSecret(secret, DefaultSecretMask)
+			}
+		}
+		value = resolved
 	}
-	_, override := s.envs[name]
+	if cmd.Args["file"] == "true" {
+		content := []byte(value)
+		if cmd.Args["encoding"] == "base64" {
+			decoded, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return Err("Could not decode base64 value of environment variable '%v': %v", name, err)
+			}
+			content = decoded
+		}
+		path, err := ctx.job().writeSecretFile(name, content)
+		if err != nil {
+			return Err("Could not write file of environment variable '%v': %v", name, err)
+		}
+		value = path
+		displayValue = path
+	}
+	_, override := ctx.Env[name]
 	if override || os.Getenv(name) != "" {
 		msg = "overriding environment variable '%v' with value '%v'\n"
 	}
-	s.envs[name] = value
-	s.ConsoleLog(msg, name, displayValue)
+	ctx.Env[name] = value
+	ctx.ConsoleLog(msg, name, displayValue)
+	switch name {
+	case ToolRequirementsEnv:
+		return ctx.job().checkToolRequirements(value)
+	case LiveArtifactsEnv:
+		return ctx.job().startLiveArtifacts(value)
+	case ProblemMatchersEnv:
+		return ctx.job().loadProblemMatchers(value)
+	case SSHKeysEnv:
+		return ctx.job().loadSSHKeys(value)
+	}
 	return nil
 }
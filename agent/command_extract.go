@@ -0,0 +1,242 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func CommandExtract(ctx *BuildContext, cmd *protocol.BuildCommand) error {
+	src := filepath.Join(ctx.Wd, cmd.Args["src"])
+	dest := filepath.Join(ctx.Wd, cmd.Args["dest"])
+	if !strings.HasPrefix(dest, ctx.RootDir) {
+		return Err("Extract destination[%v] is outside the agent sandbox.", dest)
+	}
+	ctx.ConsoleLog("Extracting %v to %v\n", cmd.Args["src"], filepath.Join(".", cmd.Args["dest"]))
+	return Extract(src, dest)
+}
+
+// Extract unpacks zip, tar or gzipped tar archive src into destDir with
+// file permissions kept, format is detected by file extension.
+func Extract(src, destDir string) error {
+	name := strings.ToLower(src)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return extractZip(src, destDir)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return extractTar(gz, destDir)
+	case strings.HasSuffix(name, ".tar"):
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return extractTar(f, destDir)
+	}
+	return Err("Unsupported archive %v, supported are .zip, .tar, .tar.gz and .tgz", filepath.Base(src))
+}
+
+func extractZip(src, destDir string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := Mkdirs(destDir); err != nil {
+		return err
+	}
+	for _, file := range r.File {
+		dest, err := archiveEntryPath(destDir, file.Name)
+		if err != nil {
+			return err
+		}
+		mode := file.Mode()
+		switch {
+		case mode.IsDir():
+			err = os.MkdirAll(dest, mode.Perm()|0700)
+		case mode&os.ModeSymlink != 0:
+			err = extractZipSymlink(file, dest, destDir)
+		default:
+			err = extractZipFile(file, dest, mode.Perm())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractZipFile(file *zip.File, dest string, perm os.FileMode) error {
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return writeExtractedFile(rc, dest, perm)
+}
+
+func extractZipSymlink(file *zip.File, dest, destDir string) error {
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	target := new(strings.Builder)
+	if _, err := io.Copy(target, rc); err != nil {
+		return err
+	}
+	return extractSymlink(target.String(), dest, destDir)
+}
+
+func extractTar(r io.Reader, destDir string) error {
+	if err := Mkdirs(destDir); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		dest, err := archiveEntryPath(destDir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		perm := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(dest, perm|0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeExtractedFile(tr, dest, perm)
+		case tar.TypeSymlink:
+			err = extractSymlink(hdr.Linkname, dest, destDir)
+		default:
+			LogDebug("skipped archive entry %v of type %c", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// archiveEntryPath resolves where an archive entry goes, entries must
+// stay inside destDir. Besides checking name, symlinks in the existing
+// parent directories of the entry, e.g. extracted by earlier entries, are
+// resolved, so that the entry is not written through them out of destDir.
+func archiveEntryPath(destDir, name string) (string, error) {
+	dest := filepath.Join(destDir, name)
+	if !insideDir(dest, destDir) {
+		return "", Err("Illegal file path %v in archive", name)
+	}
+	if dest == filepath.Clean(destDir) {
+		return dest, nil
+	}
+	inside, err := realParentInside(dest, destDir)
+	if err != nil {
+		return "", err
+	}
+	if !inside {
+		return "", Err("Illegal file path %v in archive, its parent directory is a symlink out of %v", name, destDir)
+	}
+	return dest, nil
+}
+
+// realParentInside tells whether the deepest existing parent directory of
+// path, with symlinks resolved, is inside existing dir. Missing parent
+// directories are created inside it.
+func realParentInside(path, dir string) (bool, error) {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false, err
+	}
+	parent := filepath.Dir(path)
+	for insideDir(parent, dir) {
+		if _, err := os.Lstat(parent); err == nil {
+			break
+		}
+		parent = filepath.Dir(parent)
+	}
+	realParent, err := filepath.EvalSymlinks(parent)
+	if err != nil {
+		return false, err
+	}
+	return insideDir(realParent, realDir), nil
+}
+
+func insideDir(path, dir string) bool {
+	dir = filepath.Clean(dir)
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+func extractSymlink(target, dest, destDir string) error {
+	resolved := filepath.Clean(target)
+	if !filepath.IsAbs(target) {
+		resolved = filepath.Join(filepath.Dir(dest), target)
+	}
+	if !insideDir(resolved, destDir) {
+		return Err("Illegal symlink %v -> %v in archive", dest, target)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	os.Remove(dest)
+	return os.Symlink(target, dest)
+}
+
+func writeExtractedFile(r io.Reader, dest string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	// a symlink at dest is replaced instead of written through
+	if info, err := os.Lstat(dest); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(dest); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := copyBuffered(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// umask may have dropped permission bits
+	return os.Chmod(dest, perm)
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractCommand(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	f, err := os.Create(filepath.Join(wd, "tools.tar.gz"))
+	assert.Nil(t, err)
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "bin/run.sh", Typeflag: tar.TypeReg, Mode: 0755, Size: 8})
+	tw.Write([]byte("echo run"))
+	tw.WriteHeader(&tar.Header{Name: "run", Typeflag: tar.TypeSymlink, Linkname: "bin/run.sh"})
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, gz.Close())
+	assert.Nil(t, f.Close())
+
+	goServer.SendBuild(AgentId, buildId, protocol.ExtractCommand("tools.tar.gz", "tools").Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "Extracting tools.tar.gz to tools\n", trimTimestamp(log))
+	info, err := os.Stat(filepath.Join(wd, "tools", "bin", "run.sh"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	content, err := ioutil.ReadFile(filepath.Join(wd, "tools", "run"))
+	assert.Nil(t, err)
+	assert.Equal(t, "echo run", string(content))
+}
+
+func TestExtractZipKeepsPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "tools.zip")
+	f, err := os.Create(src)
+	assert.Nil(t, err)
+	zw := zip.NewWriter(f)
+	header := &zip.FileHeader{Name: "bin/run.sh", Method: zip.Deflate}
+	header.SetMode(0750)
+	w, err := zw.CreateHeader(header)
+	assert.Nil(t, err)
+	w.Write([]byte("echo run"))
+	assert.Nil(t, zw.Close())
+	assert.Nil(t, f.Close())
+
+	assert.Nil(t, Extract(src, filepath.Join(dir, "out")))
+	info, err := os.Stat(filepath.Join(dir, "out", "bin", "run.sh"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+}
+
+func TestExtractRejectsEntriesOutsideOfDest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "evil.tar")
+	f, err := os.Create(src)
+	assert.Nil(t, err)
+	tw := tar.NewWriter(f)
+	tw.WriteHeader(&tar.Header{Name: "../evil.sh", Typeflag: tar.TypeReg, Mode: 0755, Size: 4})
+	tw.Write([]byte("evil"))
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, f.Close())
+
+	assert.NotNil(t, Extract(src, filepath.Join(dir, "out")))
+	_, err = os.Stat(filepath.Join(dir, "evil.sh"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestExtractRejectsEntriesWrittenThroughSymlinkChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "evil.tar")
+	f, err := os.Create(src)
+	assert.Nil(t, err)
+	tw := tar.NewWriter(f)
+	// each symlink alone stays inside of dest
+	tw.WriteHeader(&tar.Header{Name: "sub", Typeflag: tar.TypeSymlink, Linkname: "."})
+	tw.WriteHeader(&tar.Header{Name: "sub/up", Typeflag: tar.TypeSymlink, Linkname: ".."})
+	tw.WriteHeader(&tar.Header{Name: "sub/up/evil.sh", Typeflag: tar.TypeReg, Mode: 0755, Size: 4})
+	tw.Write([]byte("evil"))
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, f.Close())
+
+	err = Extract(src, filepath.Join(dir, "out"))
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "symlink out of"), err.Error())
+	_, err = os.Stat(filepath.Join(dir, "evil.sh"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -20,6 +20,6 @@ import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 )
 
-func CommandFail(s *BuildSession, cmd *protocol.BuildCommand) error {
+func CommandFail(ctx *BuildContext, cmd *protocol.BuildCommand) error {
 	return Err(cmd.Args["message"])
 }
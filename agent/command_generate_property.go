@@ -0,0 +1,63 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/xpath"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CommandGenerateProperty sets property name of the job to the value of
+// xpath in the XML file src. Like the Java agent, a missing file, an xpath
+// matching nothing or an illegal xpath is logged in console without
+// failing the build, src outside of the agent sandbox fails it.
+func CommandGenerateProperty(ctx *BuildContext, cmd *protocol.BuildCommand) error {
+	name := cmd.Args["name"]
+	src := filepath.Join(ctx.Wd, cmd.Args["src"])
+	if !strings.HasPrefix(src, ctx.RootDir) {
+		return Err("Property source[%v] is outside the agent sandbox.", src)
+	}
+	if _, err := os.Stat(src); err != nil {
+		ctx.ConsoleLog("Failed to create property %v. File %v does not exist.\n", name, src)
+		return nil
+	}
+	expr, err := xpath.Compile(cmd.Args["xpath"])
+	if err != nil {
+		ctx.ConsoleLog("Failed to create property %v. Illegal xpath: \"%v\": %v\n", name, cmd.Args["xpath"], err)
+		return nil
+	}
+	doc, err := xpath.Read(src)
+	if err != nil {
+		ctx.ConsoleLog("Failed to create property %v. File %v is not valid XML: %v\n", name, src, err)
+		return nil
+	}
+	value, matched := expr.Evaluate(doc)
+	if !matched {
+		ctx.ConsoleLog("Failed to create property %v. Nothing matched xpath \"%v\" in the file: %v.\n", name, expr, src)
+		return nil
+	}
+	if ctx.Properties == nil {
+		ctx.ConsoleLog("Property %v is skipped, the build does not send properties.\n", name)
+		return nil
+	}
+	ctx.Properties.Add(name, value)
+	ctx.ConsoleLog("Property %v = %v created.\n", name, value)
+	return nil
+}
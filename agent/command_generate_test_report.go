@@ -31,15 +31,22 @@ import (
 type UnitTestReport struct {
 	Tests     int
 	Failures  int
+	Errors    int
 	Skipped   int
 	Time      float64
 	TestCases []*TestCase
+
+	// FlakyTests are tests that turned flaky in this build, see
+	// recordTestHistory
+	FlakyTests []*FlakyTest
 }
 
 type TestCase struct {
-	Name    string
-	Failure *Failure
-	Error   *Error
+	ClassName string
+	Name      string
+	Skipped   bool
+	Failure   *Failure
+	Error     *Error
 }
 
 type FailureMessage struct {
@@ -57,12 +64,18 @@ type Error struct {
 func (r *UnitTestReport) Merge(another *UnitTestReport) {
 	r.Tests += another.Tests
 	r.Failures += another.Failures
+	r.Errors += another.Errors
 	r.Skipped += another.Skipped
 	r.Time += another.Time
 	r.TestCases = append(r.TestCases, another.TestCases...)
 }
 
-func CommandGenerateTestReport(s *BuildSession, cmd *protocol.BuildCommand) error {
+// FailuresAndErrors is how many tests failed or had errors.
+func (r *UnitTestReport) FailuresAndErrors() int {
+	return r.Failures + r.Errors
+}
+
+func CommandGenerateTestReport(ctx *BuildContext, cmd *protocol.BuildCommand) error {
 	srcs, err := cmd.ListArg("srcs")
 	if err != nil {
 		return err
@@ -74,30 +87,31 @@ func CommandGenerateTestReport(s *BuildSession, cmd *protocol.BuildCommand) erro
 
 	report := new(UnitTestReport)
 
-	junitRep, err := generateUnitTestReportFromJunitReport(s, srcs)
+	junitRep, err := generateUnitTestReportFromJunitReport(ctx, srcs)
 	if err != nil {
 		return err
 	}
 	report.Merge(junitRep)
 
-	nUnitRep, err := generateUnitTestReportFromNunitReport(s, srcs)
+	nUnitRep, err := generateUnitTestReportFromNunitReport(ctx, srcs)
 	if err != nil {
 		return err
 	}
 
 	report.Merge(nUnitRep)
+	report.FlakyTests = recordTestHistory(ctx, report.TestCases)
 
-	return uploadUnitTestReportArtifacts(s, uploadPath, report)
+	return uploadUnitTestReportArtifacts(ctx, uploadPath, report)
 }
 
-func uploadUnitTestReportArtifacts(s *BuildSession, uploadPath string, req *UnitTestReport) error {
+func uploadUnitTestReportArtifacts(ctx *BuildContext, uploadPath string, req *UnitTestReport) error {
 
 	template, err := loadTestReportTemplate()
 	if err != nil {
 		return err
 	}
 
-	outputPath := filepath.Join(s.wd, uploadPath, protocol.TestReportFileName)
+	outputPath := filepath.Join(ctx.Wd, uploadPath, protocol.TestReportFileName)
 
 	err = Mkdirs(filepath.Dir(outputPath))
 	if err != nil {
@@ -116,16 +130,16 @@ func uploadUnitTestReportArtifacts(s *BuildSession, uploadPath string, req *Unit
 	if err != nil {
 		return err
 	}
-	return uploadArtifacts(s, file.Name(), uploadPath, false)
+	return uploadArtifacts(ctx, file.Name(), uploadPath, false, nil)
 }
 
-func generateUnitTestReportFromNunitReport(s *BuildSession, srcs []string) (report *UnitTestReport, err error) {
+func generateUnitTestReportFromNunitReport(ctx *BuildContext, srcs []string) (report *UnitTestReport, err error) {
 
 	results := nunit.NewTestResults()
 	report = new(UnitTestReport)
 
 	for _, src := range srcs {
-		path := filepath.Join(s.wd, src)
+		path := filepath.Join(ctx.Wd, src)
 		if strings.Contains(path, "*") {
 			matches, err1 := doublestar.Glob(path)
 			if err1 != nil {
@@ -133,18 +147,19 @@ func generateUnitTestReportFromNunitReport(s *BuildSession, srcs []string) (repo
 			}
 			sort.Strings(matches)
 			for _, fpath := range matches {
-				generateNUnitTestReport(s, results, fpath)
+				generateNUnitTestReport(ctx, results, fpath)
 			}
 		} else {
-			generateNUnitTestReport(s, results, path)
+			generateNUnitTestReport(ctx, results, path)
 		}
 	}
 
-	s.debugLog("nunit test report: %+v", results)
+	ctx.debugLog("nunit test report: %+v", results)
 
 	report.Tests = results.Total
 	report.Skipped = results.Skipped
-	report.Failures = results.Failures + results.Errors
+	report.Failures = results.Failures
+	report.Errors = results.Errors
 	report.Time = results.Time
 
 	report.TestCases = mapNunitTestCaseToTemplate(results.TestCases)
@@ -153,12 +168,12 @@ func generateUnitTestReportFromNunitReport(s *BuildSession, srcs []string) (repo
 
 }
 
-func generateUnitTestReportFromJunitReport(s *BuildSession, srcs []string) (report *UnitTestReport, err error) {
+func generateUnitTestReportFromJunitReport(ctx *BuildContext, srcs []string) (report *UnitTestReport, err error) {
 	suite := junit.NewTestSuite()
 	report = new(UnitTestReport)
 
 	for _, src := range srcs {
-		path := filepath.Join(s.wd, src)
+		path := filepath.Join(ctx.Wd, src)
 		if strings.Contains(path, "*") {
 			matches, err1 := doublestar.Glob(path)
 			if err1 != nil {
@@ -166,37 +181,38 @@ func generateUnitTestReportFromJunitReport(s *BuildSession, srcs []string) (repo
 			}
 			sort.Strings(matches)
 			for _, fpath := range matches {
-				generateJunitTestReport(s, suite, fpath)
+				generateJunitTestReport(ctx, suite, fpath)
 			}
 		} else {
-			generateJunitTestReport(s, suite, path)
+			generateJunitTestReport(ctx, suite, path)
 		}
 	}
 
-	s.debugLog("test report: %+v", suite)
+	ctx.debugLog("test report: %+v", suite)
 
 	report.Tests = suite.Tests
 	report.Skipped = suite.Skipped
-	report.Failures = suite.Failures + suite.Errors
+	report.Failures = suite.Failures
+	report.Errors = suite.Errors
 	report.TestCases = mapJunitTestCaseToTemplate(suite.TestCases)
 	report.Time = suite.Time
 
 	return
 }
 
-func generateNUnitTestReport(s *BuildSession, result *nunit.TestResults, path string) {
+func generateNUnitTestReport(ctx *BuildContext, result *nunit.TestResults, path string) {
 	err := nunit.GenerateNUnitTestReport(result, path)
 	if err != nil {
-		s.debugLog("ignore %v for error: %v", path, err)
+		ctx.debugLog("ignore %v for error: %v", path, err)
 		return
 	}
 	return
 }
 
-func generateJunitTestReport(s *BuildSession, result *junit.TestSuite, path string) {
+func generateJunitTestReport(ctx *BuildContext, result *junit.TestSuite, path string) {
 	err := junit.GenerateJunitTestReport(result, path)
 	if err != nil {
-		s.debugLog("ignore %v for error: %v", path, err)
+		ctx.debugLog("ignore %v for error: %v", path, err)
 		return
 	}
 	return
@@ -205,7 +221,9 @@ func generateJunitTestReport(s *BuildSession, result *junit.TestSuite, path stri
 func mapJunitTestCaseToTemplate(testCases []*junit.TestCase) (results []*TestCase) {
 	for _, item := range testCases {
 		t := new(TestCase)
+		t.ClassName = item.ClassName
 		t.Name = item.Name
+		t.Skipped = item.Skipped != nil
 		if item.Failure != nil {
 			t.Failure = new(Failure)
 			t.Failure.StackTrace = item.Failure.StackTrace
@@ -223,6 +241,7 @@ func mapNunitTestCaseToTemplate(testCases []*nunit.TestCase) (results []*TestCas
 	for _, item := range testCases {
 		t := new(TestCase)
 		t.Name = item.Name
+		t.Skipped = !item.Executed
 		if item.Failure != nil {
 			t.Failure = new(Failure)
 			t.Failure.StackTrace = item.Failure.StackTrace.Content
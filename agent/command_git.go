@@ -0,0 +1,352 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultGitBranch is the branch of a git material without "branch" arg,
+// like Go server.
+const DefaultGitBranch = "master"
+
+const (
+	// GitSparseCheckoutEnv is the job environment variable listing
+	// directories, separated by commas or new lines, git materials are
+	// sparse checked out with, e.g. "services/payments,libs/common".
+	GitSparseCheckoutEnv = "GO_GIT_SPARSE_CHECKOUT"
+	// GitCloneFilterEnv is the job environment variable of the partial
+	// clone filter git materials are fetched with, e.g. "blob:none".
+	GitCloneFilterEnv = "GO_GIT_CLONE_FILTER"
+)
+
+// CommandGit checks out revision, or the tip of branch, of the git
+// repository at url into dest of the working directory, see materialDest.
+// An existing clone of url is fetched and reused, an empty dest or a clone
+// of another repository is replaced by a fresh clone, anything else at dest
+// fails the command. Credentials of url are not saved in the clone, see
+// splitGitCredentials. Untracked files are cleaned unless "clean" is "false", and
+// submodules are updated. Monorepo jobs can fetch a partial clone and
+// check out only some directories, see GitCloneFilterEnv and
+// GitSparseCheckoutEnv. The checked out revision is exported to later
+// tasks, see addMaterialRevision.
+func CommandGit(ctx *BuildContext, cmd *protocol.BuildCommand) error {
+	url := cmd.Args["url"]
+	branch := cmd.Args["branch"]
+	if branch == "" {
+		branch = DefaultGitBranch
+	}
+	revision := cmd.Args["revision"]
+	shallow := cmd.Args["shallow"] == "true"
+	dest, err := materialDest(ctx, cmd.Args["dest"])
+	if err != nil {
+		return err
+	}
+
+	remote, credentials := splitGitCredentials(url)
+	g := &gitRunner{ctx: ctx, dir: dest, url: url, env: credentials}
+	if origin, cloned := g.origin(); cloned && (origin == remote || origin == url) {
+		// clones made before credentials were left out have them in config
+		if origin != remote {
+			if err := g.run("remote", "set-url", "origin", remote); err != nil {
+				return err
+			}
+		}
+	} else {
+		if !cloned && !isEmptyDir(dest) {
+			return Err("Cannot clone %v into %v, it is not empty and not a git clone", SanitizeURLString(url), dest)
+		}
+		ctx.ConsoleLog("[go] Cloning %v into %v\n", SanitizeURLString(url), dest)
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+		if err := Mkdirs(dest); err != nil {
+			return err
+		}
+		if err := g.run("init", "--quiet"); err != nil {
+			return err
+		}
+		if err := g.run("remote", "add", "origin", remote); err != nil {
+			return err
+		}
+	}
+
+	fetch := []string{"fetch", "--force", "--prune", "origin", Sprintf("+refs/heads/%v:refs/remotes/origin/%v", branch, branch)}
+	if shallow {
+		fetch = append(fetch[:1], append([]string{"--depth", "1"}, fetch[1:]...)...)
+	}
+	if filter := ctx.Env[GitCloneFilterEnv]; filter != "" {
+		fetch = append(fetch[:1], append([]string{"--filter=" + filter}, fetch[1:]...)...)
+	}
+	if err := g.run(fetch...); err != nil {
+		return err
+	}
+	target := "origin/" + branch
+	if revision != "" {
+		target = revision
+		if _, err := g.output("cat-file", "-e", revision+"^{commit}"); err != nil && g.isShallow() {
+			ctx.ConsoleLog("[go] Revision %v is not in the shallow clone, fetching full history\n", revision)
+			if err := g.run("fetch", "--unshallow", "origin"); err != nil {
+				return err
+			}
+		}
+	}
+	// sparse checkout is set before checking out, so that a partial clone
+	// only fetches files of the sparse directories
+	if err := g.sparseCheckout(ctx.Env[GitSparseCheckoutEnv]); err != nil {
+		return err
+	}
+	if err := g.run("checkout", "--quiet", "--force", "-B", branch, target); err != nil {
+		return err
+	}
+	if cmd.Args["clean"] != "false" {
+		if err := g.run("clean", "-ffdx"); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, ".gitmodules")); err == nil {
+		if err := g.updateSubmodules(shallow, cmd.Args["clean"] != "false"); err != nil {
+			return err
+		}
+	}
+	head, err := g.output("rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	ctx.addMaterialRevision(&protocol.MaterialRevision{
+		Type:     "git",
+		Url:      SanitizeURLString(url),
+		Dest:     cmd.Args["dest"],
+		Revision: head,
+	}, cmd.Args["fromRevision"])
+	ctx.ConsoleLog("[go] Checked out revision %v of %v on branch %v\n", head, SanitizeURLString(url), branch)
+	return nil
+}
+
+// materialDest is dest of a material command joined to the working
+// directory. As what is at dest may be replaced, it must be a directory
+// inside the agent working directory, and neither the agent nor the
+// command working directory.
+func materialDest(ctx *BuildContext, dest string) (string, error) {
+	path := filepath.Join(ctx.Wd, dest)
+	if path == filepath.Clean(ctx.Wd) || path == filepath.Clean(ctx.RootDir) || !insideDir(path, ctx.RootDir) {
+		return "", Err("Material destination[%v] is outside the agent sandbox.", dest)
+	}
+	return path, nil
+}
+
+// isEmptyDir tells whether dir is missing or has nothing in it.
+func isEmptyDir(dir string) bool {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return true
+	}
+	return err == nil && len(infos) == 0
+}
+
+// splitGitCredentials returns url without credentials, which is saved as
+// origin of the clone, and git environment sending the credentials of an
+// http url as a basic authorization header to its host only. Credentials
+// of other urls, e.g. the user of ssh, are kept in url.
+func splitGitCredentials(rawurl string) (string, []string) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return rawurl, nil
+	}
+	password, _ := u.User.Password()
+	auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+	u.User = nil
+	host := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}
+	return u.String(), []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http." + host.String() + ".extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic " + auth,
+	}
+}
+
+// sparseCheckout sets sparse checkout directories of the work tree, or
+// disables sparse checkout set by a previous job when there is none.
+func (g *gitRunner) sparseCheckout(dirs string) error {
+	var paths []string
+	for _, path := range strings.FieldsFunc(dirs, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) > 0 {
+		return g.run(append([]string{"sparse-checkout", "set", "--cone"}, paths...)...)
+	}
+	if sparse, _ := g.output("config", "--get", "core.sparseCheckout"); sparse == "true" {
+		return g.run("sparse-checkout", "disable")
+	}
+	return nil
+}
+
+func (g *gitRunner) updateSubmodules(shallow, clean bool) error {
+	if err := g.run("submodule", "sync", "--recursive"); err != nil {
+		return err
+	}
+	update := []string{"submodule", "update", "--init", "--recursive", "--force"}
+	if shallow {
+		update = append(update, "--depth", "1")
+	}
+	if err := g.run(update...); err != nil {
+		return err
+	}
+	if clean {
+		return g.run("submodule", "foreach", "--recursive", "git clean -ffdx")
+	}
+	return nil
+}
+
+// gitRunner runs git commands of a CommandGit in dir, as processes of the
+// job so that they are canceled and killed with it.
+type gitRunner struct {
+	ctx *BuildContext
+	dir string
+	url string
+	env []string
+}
+
+func (g *gitRunner) command(args ...string) *exec.Cmd {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = g.dir
+	cmd.Env = append(append(g.ctx.commandEnv(nil), "GIT_TERMINAL_PROMPT=0"), g.env...)
+	return cmd
+}
+
+// run logs git command line and its output in console, with credentials
+// of url left out.
+func (g *gitRunner) run(args ...string) error {
+	line := strings.Replace(ShellQuote(append([]string{"git"}, args...)...), g.url, SanitizeURLString(g.url), -1)
+	g.ctx.Output.Write([]byte(Sprintf("[go] %v\n", line)))
+	cmd := g.command(args...)
+	out := &urlSanitizer{w: g.ctx.Output, url: g.url}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := g.wait(cmd)
+	out.Flush()
+	if err != nil {
+		return Err("%v failed: %v", line, err)
+	}
+	return nil
+}
+
+// output runs git for its trimmed output, which is not logged.
+func (g *gitRunner) output(args ...string) (string, error) {
+	var out strings.Builder
+	cmd := g.command(args...)
+	cmd.Stdout = &out
+	err := g.wait(cmd)
+	return strings.TrimSpace(out.String()), err
+}
+
+func (g *gitRunner) wait(cmd *exec.Cmd) error {
+	return waitJobProcess(g.ctx, cmd)
+}
+
+// waitJobProcess runs cmd as a process of the job, it is killed when the
+// build is canceled.
+func waitJobProcess(ctx *BuildContext, cmd *exec.Cmd) error {
+	processes := ctx.jobProcesses()
+	if err := startProcess(cmd, processes.prepare(cmd)); err != nil {
+		return err
+	}
+	processes.track(cmd.Process.Pid)
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case <-ctx.Canceled:
+		processes.killTree(cmd.Process)
+		<-done
+		processes.recordUsage(cmd.ProcessState)
+		return Err("%v is canceled", filepath.Base(cmd.Path))
+	case err := <-done:
+		processes.recordUsage(cmd.ProcessState)
+		return err
+	}
+}
+
+// origin returns url of origin of the clone in dir, and whether dir is a
+// clone at all.
+func (g *gitRunner) origin() (string, bool) {
+	if !isGitWorkTree(g.dir) {
+		return "", false
+	}
+	origin, _ := g.output("config", "--get", "remote.origin.url")
+	return origin, true
+}
+
+func (g *gitRunner) isShallow() bool {
+	_, err := os.Stat(filepath.Join(g.dir, ".git", "shallow"))
+	return err == nil
+}
+
+func isGitWorkTree(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil && info.IsDir()
+}
+
+// urlSanitizer replaces url in git output by its sanitized form. Output is
+// written line by line, lines ending with "\n" or "\r" of progress, so
+// that url written in pieces is still replaced; Flush writes the last
+// line. Lines longer than stream.MaxPendingLineSize are not held.
+type urlSanitizer struct {
+	w    io.Writer
+	url  string
+	tail []byte
+}
+
+func (s *urlSanitizer) Write(p []byte) (int, error) {
+	data := append(s.tail, p...)
+	i := bytes.LastIndexAny(data, "\r\n") + 1
+	if len(data)-i >= stream.MaxPendingLineSize {
+		i = len(data)
+	}
+	s.tail = append([]byte(nil), data[i:]...)
+	if err := s.write(data[:i]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes the held last line.
+func (s *urlSanitizer) Flush() error {
+	tail := s.tail
+	s.tail = nil
+	return s.write(tail)
+}
+
+func (s *urlSanitizer) write(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	_, err := s.w.Write([]byte(strings.Replace(string(data), s.url, SanitizeURLString(s.url), -1)))
+	return err
+}
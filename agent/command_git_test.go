@@ -0,0 +1,285 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"encoding/base64"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// makeGitOrigin makes a git repository committing each content of
+// hello.txt in turn on master, and returns its url and the revisions.
+func makeGitOrigin(t *testing.T, contents ...string) (string, []string) {
+	dir, err := ioutil.TempDir("", "origin")
+	assert.Nil(t, err)
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=go", "-c", "user.email=go@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		assert.Nil(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "--quiet", "-b", "master")
+	var revisions []string
+	for _, content := range contents {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "hello.txt"), []byte(content), 0644))
+		git("add", "hello.txt")
+		git("commit", "--quiet", "-m", content)
+		revisions = append(revisions, git("rev-parse", "HEAD"))
+	}
+	return "file://" + dir, revisions
+}
+
+func TestGitChecksOutRevisionAndCleansWorkTree(t *testing.T) {
+	origin, revisions := makeGitOrigin(t, "v1", "v2")
+	defer os.RemoveAll(strings.TrimPrefix(origin, "file://"))
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.GitCommand(origin, "master", "", "src").Setwd(relativePath(wd)),
+		protocol.ExecCommand("cat", "src/hello.txt").Setwd(relativePath(wd)),
+		protocol.ExecCommand("touch", "src/untracked.txt").Setwd(relativePath(wd)),
+		protocol.GitCommand(origin, "master", revisions[0], "src").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "[go] Cloning "+origin), log)
+	assert.Equal(t, 1, strings.Count(log, "[go] Cloning "))
+	assert.True(t, strings.Contains(log, "[go] Checked out revision "+revisions[1]), log)
+	assert.True(t, strings.Contains(log, "[go] Checked out revision "+revisions[0]), log)
+	assert.True(t, strings.Contains(trimTimestamp(log), "\nv2"), log)
+
+	content, err := ioutil.ReadFile(filepath.Join(wd, "src", "hello.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", string(content))
+	_, err = os.Stat(filepath.Join(wd, "src", "untracked.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestShallowGitCloneFetchesHistoryOfOlderRevision(t *testing.T) {
+	origin, revisions := makeGitOrigin(t, "v1", "v2", "v3")
+	defer os.RemoveAll(strings.TrimPrefix(origin, "file://"))
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.GitCommand(origin, "", revisions[0], "src").AddArg("shallow", "true").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "[go] git fetch --depth 1 "), log)
+	assert.True(t, strings.Contains(log, "[go] Revision "+revisions[0]+" is not in the shallow clone"), log)
+	assert.True(t, strings.Contains(log, "[go] Checked out revision "+revisions[0]), log)
+	content, err := ioutil.ReadFile(filepath.Join(wd, "src", "hello.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", string(content))
+}
+
+func TestGitFailsWithCredentialsOfURLLeftOut(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	origin := strings.Replace(server.URL, "http://", "http://user:s3cret@", 1) + "/repo.git"
+	goServer.SendBuild(AgentId, buildId,
+		protocol.GitCommand(origin, "master", "", "src").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "ERROR: git fetch "), log)
+	assert.False(t, strings.Contains(log, "s3cret"), log)
+	assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:s3cret")), authorization)
+	config, err := ioutil.ReadFile(filepath.Join(wd, "src", ".git", "config"))
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(config), server.URL+"/repo.git"), string(config))
+	assert.False(t, strings.Contains(string(config), "s3cret"), string(config))
+}
+
+func TestGitRefusesToReplaceWhatIsNotAClone(t *testing.T) {
+	origin, _ := makeGitOrigin(t, "v1")
+	defer os.RemoveAll(strings.TrimPrefix(origin, "file://"))
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	writeFile(filepath.Join(wd, "src"), "precious.txt", "keep me")
+	goServer.SendBuild(AgentId, buildId,
+		protocol.GitCommand(origin, "master", "", "src").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "it is not empty and not a git clone"), log)
+	content, err := ioutil.ReadFile(filepath.Join(wd, "src", "precious.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "keep me", string(content))
+}
+
+func TestGitDestinationMustBeInsideAgentSandbox(t *testing.T) {
+	origin, _ := makeGitOrigin(t, "v1")
+	defer os.RemoveAll(strings.TrimPrefix(origin, "file://"))
+	for i, dest := range []string{"", "../..", "../../../outside"} {
+		t.Run(dest, func(t *testing.T) {
+			setUpBuild(t, Sprintf("TestGitDestinationMustBeInsideAgentSandbox%v", i))
+			defer tearDown()
+
+			wd := createPipelineDir()
+			goServer.SendBuild(AgentId, buildId,
+				protocol.GitCommand(origin, "master", "", dest).Setwd(relativePath(wd)),
+			)
+			assert.Equal(t, "agent Building", stateLog.Next())
+			assert.Equal(t, "build Failed", stateLog.Next())
+			assert.Equal(t, "agent Idle", stateLog.Next())
+
+			log, err := goServer.ConsoleLog(buildId)
+			assert.Nil(t, err)
+			assert.True(t, strings.Contains(log, "is outside the agent sandbox"), log)
+		})
+	}
+}
+
+func TestGitSparseCheckoutOfPartialClone(t *testing.T) {
+	origin, _ := makeGitOrigin(t, "v1")
+	dir := strings.TrimPrefix(origin, "file://")
+	defer os.RemoveAll(dir)
+	for _, file := range []string{"services/payments/main.go", "services/search/main.go"} {
+		assert.Nil(t, Mkdirs(filepath.Dir(filepath.Join(dir, file))))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, file), []byte("package main"), 0644))
+	}
+	for _, args := range [][]string{{"add", "services"}, {"-c", "user.name=go", "-c", "user.email=go@example.com", "commit", "--quiet", "-m", "services"}, {"config", "uploadpack.allowFilter", "true"}} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		assert.Nil(t, err, string(out))
+	}
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand(GitSparseCheckoutEnv, "services/payments", "false"),
+		protocol.ExportCommand(GitCloneFilterEnv, "blob:none", "false"),
+		protocol.GitCommand(origin, "master", "", "src").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "[go] git fetch --filter=blob:none "), log)
+	assert.True(t, strings.Contains(log, "[go] git sparse-checkout set --cone services/payments"), log)
+	_, err = os.Stat(filepath.Join(wd, "src", "services/payments/main.go"))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(wd, "src", "services/search/main.go"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(wd, "src", "hello.txt"))
+	assert.Nil(t, err)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.GitCommand(origin, "master", "", "src").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	_, err = os.Stat(filepath.Join(wd, "src", "services/search/main.go"))
+	assert.Nil(t, err)
+}
+
+func TestGitExportsMaterialRevisionsToTasks(t *testing.T) {
+	origin, revisions := makeGitOrigin(t, "v1", "v2")
+	defer os.RemoveAll(strings.TrimPrefix(origin, "file://"))
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.GitCommand(origin, "master", "", "src").AddArg("fromRevision", revisions[0]).Setwd(relativePath(wd)),
+		protocol.ExecCommand("sh", "-c", "echo one $GO_REVISION $GO_FROM_REVISION $GO_TO_REVISION_SRC").Setwd(relativePath(wd)),
+		protocol.GitCommand(origin, "master", revisions[0], "lib/common").Setwd(relativePath(wd)),
+		protocol.ExecCommand("sh", "-c", "echo two [$GO_REVISION] $GO_REVISION_SRC $GO_FROM_REVISION_LIB_COMMON").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	log = trimTimestamp(log)
+	assert.True(t, strings.Contains(log, Sprintf("\none %v %v %v\n", revisions[1], revisions[0], revisions[1])), log)
+	assert.True(t, strings.Contains(log, Sprintf("\ntwo [] %v %v\n", revisions[1], revisions[0])), log)
+}
+
+func TestGitCheckoutFailedWhenPipelineWorkspaceExceedsDiskQuota(t *testing.T) {
+	origin, _ := makeGitOrigin(t, "v1")
+	defer os.RemoveAll(strings.TrimPrefix(origin, "file://"))
+	GetConfig().PipelineDiskQuota = 1000
+	defer func() {
+		GetConfig().PipelineDiskQuota = 0
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.GitCommand(origin, "master", "", "src").Setwd(relativePath(wd)),
+		protocol.GitCommand(origin, "master", "", "other").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "exceeds its disk quota 1000 B (GOCD_AGENT_PIPELINE_DISK_QUOTA), git is refused"), log)
+	_, err = os.Stat(filepath.Join(wd, "other"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -21,9 +21,9 @@ import (
 	"path/filepath"
 )
 
-func CommandMkdirs(s *BuildSession, cmd *protocol.BuildCommand) error {
+func CommandMkdirs(ctx *BuildContext, cmd *protocol.BuildCommand) error {
 	path := cmd.Args["path"]
-	fullPath := filepath.Join(s.wd, path)
-	s.debugLog("mkdirs %v", fullPath)
+	fullPath := filepath.Join(ctx.Wd, path)
+	ctx.debugLog("mkdirs %v", fullPath)
 	return Mkdirs(fullPath)
 }
@@ -20,10 +20,10 @@ import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 )
 
-func CommandOr(s *BuildSession, cmd *protocol.BuildCommand) error {
+func CommandOr(ctx *BuildContext, cmd *protocol.BuildCommand) error {
 	var err error
 	for _, sub := range cmd.SubCommands {
-		_, te := s.processTestCommand(sub)
+		_, te := ctx.commands().processTestCommand(sub)
 		if te == nil {
 			return nil
 		} else {
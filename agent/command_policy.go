@@ -0,0 +1,59 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"strings"
+)
+
+// parseCommandNames parses a comma separated list of build command names
+// known by Executors.
+func parseCommandNames(value string) ([]string, error) {
+	executors := Executors()
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := executors[protocol.CommandName(name)]; !ok {
+			return nil, Err("unknown build command %v", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// commandPolicy replaces executors of commands not in allowed, when it is
+// not empty, or in denied, by deniedCommand.
+func commandPolicy(executors map[protocol.CommandName]Executor, allowed, denied []string) map[protocol.CommandName]Executor {
+	if len(allowed) > 0 {
+		for name := range executors {
+			if !containsString(allowed, string(name)) {
+				executors[name] = deniedCommand
+			}
+		}
+	}
+	for _, name := range denied {
+		executors[protocol.CommandName(name)] = deniedCommand
+	}
+	return executors
+}
+
+func deniedCommand(ctx *BuildContext, cmd *protocol.BuildCommand) error {
+	return Err("Build command %v is denied by the agent command policy", cmd.Name)
+}
@@ -20,9 +20,12 @@ import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 )
 
-func CommandReport(s *BuildSession, cmd *protocol.BuildCommand) error {
-	jobState := cmd.Args["status"]
-	s.debugLog("report %v", jobState)
-	s.send <- protocol.ReportMessage(cmd.Name, s.Report(jobState))
-	return nil
+func CommandReport(ctx *BuildContext, cmd *protocol.BuildCommand) error {
+	jobState := protocol.JobState(cmd.Args["status"])
+	ctx.debugLog("report %v", jobState)
+	action := protocol.ReportCurrentStatusAction
+	if cmd.Name == protocol.CommandReportCompleting {
+		action = protocol.ReportCompletingAction
+	}
+	return ctx.statusReporter().sendReport(action, jobState)
 }
@@ -20,13 +20,13 @@ import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 )
 
-func CommandSecret(s *BuildSession, cmd *protocol.BuildCommand) error {
+func CommandSecret(ctx *BuildContext, cmd *protocol.BuildCommand) error {
 	value := cmd.Args["value"]
 	substitution := cmd.Args["substitution"]
 	if substitution == "" {
 		substitution = DefaultSecretMask
 	}
-	s.debugLog("%v => %v", value, substitution)
-	s.secrets.Substitutions[value] = substitution
+	ctx.debugLog("%v => %v", value, substitution)
+	ctx.addSecret(value, substitution)
 	return nil
 }
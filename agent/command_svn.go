@@ -0,0 +1,207 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"encoding/xml"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// CommandSvn checks out revision, or HEAD, of the subversion repository at
+// url into dest of the working directory, see materialDest, like the Java
+// agent does for svn materials. An existing working copy of url is
+// updated, an empty dest or a working copy of another url is replaced by a
+// fresh checkout, anything else at dest fails the command. Credentials are
+// taken from "username" and "password", the password is passed to svn on
+// stdin instead of command line, masked in console and never cached by
+// svn. Unversioned and ignored files are removed unless "clean"
+// is "false", and externals are only checked out when "checkExternals" is
+// "true". The checked out revision is reported to server with the build
+// status.
+func CommandSvn(ctx *BuildContext, cmd *protocol.BuildCommand) error {
+	url := cmd.Args["url"]
+	revision := cmd.Args["revision"]
+	if revision == "" {
+		revision = "HEAD"
+	}
+	dest, err := materialDest(ctx, cmd.Args["dest"])
+	if err != nil {
+		return err
+	}
+	password := cmd.Args["password"]
+	if password != "" {
+		ctx.addSecret(password, DefaultSecretMask)
+	}
+	s := &svnRunner{ctx: ctx, dir: dest, url: url, username: cmd.Args["username"], password: password}
+
+	externals := []string{}
+	if cmd.Args["checkExternals"] != "true" {
+		externals = append(externals, "--ignore-externals")
+	}
+	if s.checkedOutFrom(url) {
+		if err := s.run("cleanup"); err != nil {
+			return err
+		}
+		if cmd.Args["clean"] != "false" {
+			if err := s.revert(); err != nil {
+				return err
+			}
+		}
+		if err := s.run(append([]string{"update", "--revision", revision}, externals...)...); err != nil {
+			return err
+		}
+	} else {
+		if !isSvnWorkingCopy(dest) && !isEmptyDir(dest) {
+			return Err("Cannot check out %v into %v, it is not empty and not a svn working copy", SanitizeURLString(url), dest)
+		}
+		ctx.ConsoleLog("[go] Checking out %v into %v\n", SanitizeURLString(url), dest)
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+		if err := Mkdirs(dest); err != nil {
+			return err
+		}
+		if err := s.run(append(append([]string{"checkout", "--revision", revision}, externals...), url, ".")...); err != nil {
+			return err
+		}
+	}
+	info, err := s.info()
+	if err != nil {
+		return err
+	}
+	ctx.addMaterialRevision(&protocol.MaterialRevision{
+		Type:     "svn",
+		Url:      SanitizeURLString(url),
+		Dest:     cmd.Args["dest"],
+		Revision: info.Entry.Revision,
+	}, cmd.Args["fromRevision"])
+	ctx.ConsoleLog("[go] Checked out revision %v of %v\n", info.Entry.Revision, SanitizeURLString(url))
+	return nil
+}
+
+// svnInfo is output of "svn info --xml" of a working copy
+type svnInfo struct {
+	Entry struct {
+		Revision string `xml:"revision,attr"`
+		Url      string `xml:"url"`
+	} `xml:"entry"`
+}
+
+// svnRunner runs svn commands of a CommandSvn in dir, as processes of the
+// job so that they are canceled and killed with it.
+type svnRunner struct {
+	ctx      *BuildContext
+	dir      string
+	url      string
+	username string
+	password string
+}
+
+func (s *svnRunner) command(args ...string) *exec.Cmd {
+	args = append(args, "--non-interactive", "--no-auth-cache")
+	if s.username != "" {
+		args = append(args, "--username", s.username)
+	}
+	if s.password != "" {
+		args = append(args, "--password-from-stdin")
+	}
+	cmd := exec.Command("svn", args...)
+	if s.password != "" {
+		cmd.Stdin = strings.NewReader(s.password + "\n")
+	}
+	cmd.Dir = s.dir
+	cmd.Env = append(s.ctx.commandEnv(nil), "LC_ALL=C")
+	return cmd
+}
+
+// run logs svn command line and its output in console, with the password
+// masked and credentials of url left out, also in the returned error.
+func (s *svnRunner) run(args ...string) error {
+	cmd := s.command(args...)
+	line := strings.Replace(ShellQuote(cmd.Args...), s.url, SanitizeURLString(s.url), -1)
+	if s.password != "" {
+		line = strings.Replace(line, s.password, DefaultSecretMask, -1)
+	}
+	s.ctx.Output.Write([]byte(Sprintf("[go] %v\n", line)))
+	out := &urlSanitizer{w: s.ctx.Output, url: s.url}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := waitJobProcess(s.ctx, cmd)
+	out.Flush()
+	if err != nil {
+		return Err("%v failed: %v", line, err)
+	}
+	return nil
+}
+
+// output runs svn for its output, which is not logged.
+func (s *svnRunner) output(args ...string) (string, error) {
+	var out strings.Builder
+	cmd := s.command(args...)
+	cmd.Stdout = &out
+	err := waitJobProcess(s.ctx, cmd)
+	return out.String(), err
+}
+
+func (s *svnRunner) info() (*svnInfo, error) {
+	out, err := s.output("info", "--xml")
+	if err != nil {
+		return nil, err
+	}
+	var info svnInfo
+	if err := xml.Unmarshal([]byte(out), &info); err != nil {
+		return nil, Err("invalid svn info of %v: %v", s.dir, err)
+	}
+	return &info, nil
+}
+
+func (s *svnRunner) checkedOutFrom(url string) bool {
+	if !isSvnWorkingCopy(s.dir) {
+		return false
+	}
+	info, err := s.info()
+	return err == nil && strings.TrimRight(info.Entry.Url, "/") == strings.TrimRight(url, "/")
+}
+
+func isSvnWorkingCopy(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, ".svn"))
+	return err == nil && info.IsDir()
+}
+
+// revert reverts local changes of the working copy, and removes files
+// that are not under version control, including ignored ones.
+func (s *svnRunner) revert() error {
+	if err := s.run("revert", "--recursive", "."); err != nil {
+		return err
+	}
+	status, err := s.output("status", "--no-ignore")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(status, "\n") {
+		if len(line) > 8 && (line[0] == '?' || line[0] == 'I') {
+			if err := os.RemoveAll(filepath.Join(s.dir, strings.TrimSpace(line[8:]))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSvn puts an svn script in front of PATH until the returned function
+// is called, it logs its args into the returned file and fakes working
+// copies checked out at revision 7 for HEAD.
+func fakeSvn(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "svn")
+	assert.Nil(t, err)
+	argsLog := filepath.Join(dir, "args.log")
+	script := `#!/bin/sh
+echo "$@" >> ` + argsLog + `
+case "$*" in *--password-from-stdin*) read password; echo "password $password" >> ` + argsLog + `;; esac
+rev=; url=; next=
+for a in "$@"; do
+  [ "$next" = rev ] && rev=$a
+  next=
+  case "$a" in --revision) next=rev;; *://*) url=$a;; esac
+done
+[ "$rev" = HEAD ] && rev=7
+case "$1" in
+checkout)
+  case "$url" in *missing*) echo "svn: E170000: URL '$url' doesn't exist" >&2; exit 1;; esac
+  mkdir .svn && echo "$url" > .svn/url && echo "$rev" > .svn/rev && echo "Checked out revision $rev.";;
+update) echo "$rev" > .svn/rev && echo "Updated to revision $rev.";;
+info)
+  [ -d .svn ] || exit 1
+  echo "<?xml version=\"1.0\"?><info><entry kind=\"dir\" path=\".\" revision=\"$(cat .svn/rev)\"><url>$(cat .svn/url)</url></entry></info>";;
+status) for f in *.tmp; do [ -e "$f" ] && echo "?       $f"; done;;
+esac
+exit 0
+`
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "svn"), []byte(script), 0755))
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return argsLog, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSvnChecksOutAndUpdatesWorkingCopy(t *testing.T) {
+	argsLog, restore := fakeSvn(t)
+	defer restore()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	url := "https://svn.example.com/repo/trunk"
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SvnCommand(url, "bob", "s3cret", "", "src").Setwd(relativePath(wd)),
+		protocol.ExecCommand("touch", "src/build.tmp").Setwd(relativePath(wd)),
+		protocol.SvnCommand(url, "bob", "s3cret", "5", "src").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(log, "[go] Checking out "+url))
+	assert.True(t, strings.Contains(log, "[go] Checked out revision 7 of "+url), log)
+	assert.True(t, strings.Contains(log, "[go] Checked out revision 5 of "+url), log)
+	assert.True(t, strings.Contains(log, "--password-from-stdin"), log)
+	assert.False(t, strings.Contains(log, "s3cret"), log)
+
+	args, err := ioutil.ReadFile(argsLog)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(args), "checkout --revision HEAD --ignore-externals "+url+" . --non-interactive --no-auth-cache --username bob --password-from-stdin\npassword s3cret\n"), string(args))
+	assert.True(t, strings.Contains(string(args), "update --revision 5 --ignore-externals --non-interactive"), string(args))
+	assert.False(t, strings.Contains(string(args), "--password s3cret"), string(args))
+	_, err = os.Stat(filepath.Join(wd, "src", "build.tmp"))
+	assert.True(t, os.IsNotExist(err))
+
+	revisions := goServer.CompletedReport(buildId).MaterialRevisions
+	assert.Equal(t, 1, len(revisions))
+	assert.Equal(t, protocol.MaterialRevision{Type: "svn", Url: url, Dest: "src", Revision: "5", FromRevision: "5"}, *revisions[0])
+}
+
+func TestSvnFailsWithPasswordMasked(t *testing.T) {
+	_, restore := fakeSvn(t)
+	defer restore()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SvnCommand("https://svn.example.com/missing", "bob", "s3cret", "", "src").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "doesn't exist"), log)
+	assert.True(t, strings.Contains(log, "ERROR: svn checkout "), log)
+	assert.False(t, strings.Contains(log, "s3cret"), log)
+	assert.Nil(t, goServer.CompletedReport(buildId).MaterialRevisions)
+}
+
+func TestSvnRefusesToReplaceWhatIsNotAWorkingCopy(t *testing.T) {
+	_, restore := fakeSvn(t)
+	defer restore()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	writeFile(filepath.Join(wd, "src"), "precious.txt", "keep me")
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SvnCommand("https://svn.example.com/repo/trunk", "", "", "", "src").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "it is not empty and not a svn working copy"), log)
+	content, err := ioutil.ReadFile(filepath.Join(wd, "src", "precious.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "keep me", string(content))
+}
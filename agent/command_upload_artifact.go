@@ -25,35 +25,58 @@ import (
 	"strings"
 )
 
-func CommandUploadArtifact(s *BuildSession, cmd *protocol.BuildCommand) error {
+func CommandUploadArtifact(ctx *BuildContext, cmd *protocol.BuildCommand) error {
 	src := cmd.Args["src"]
 	destDir := cmd.Args["dest"]
 	ignoreUnmatchError := cmd.Args["ignoreUnmatchError"] == "true"
 
-	absSrc := filepath.Join(s.wd, src)
-	return uploadArtifacts(s, absSrc, strings.Replace(destDir, "\\", "/", -1), ignoreUnmatchError)
+	if config.DisableArtifactUpload {
+		ctx.ConsoleLog("Artifact upload is disabled on this agent, skipped uploading %v to %v\n", src, destDescription(destDir))
+		return nil
+	}
+	absSrc := filepath.Join(ctx.Wd, src)
+	if err := ctx.artifactUploads().reserveArtifactsSize(absSrc); err != nil {
+		return err
+	}
+	delta := loadArtifactDelta(ctx, cmd.Args["deltaBase"])
+	dest := strings.Replace(destDir, "\\", "/", -1)
+	if queue := ctx.artifactUploads().backgroundUploads(); cmd.Args["async"] == "true" && queue != nil {
+		ctx.ConsoleLog("Uploading artifacts from %v to %v in background\n", absSrc, destDescription(destDir))
+		queue(func() error {
+			// background uploads give way while server pushes back
+			if !throttleOf(ctx.ArtifactUploadBaseURL).wait(ctx.Canceled) {
+				return nil
+			}
+			return uploadArtifacts(ctx, absSrc, dest, ignoreUnmatchError, delta)
+		})
+		return nil
+	}
+	return uploadArtifacts(ctx, absSrc, dest, ignoreUnmatchError, delta)
 }
 
-func uploadArtifacts(s *BuildSession, source, destDir string, ignoreUnmatchError bool) (err error) {
+func uploadArtifacts(ctx *BuildContext, source, destDir string, ignoreUnmatchError bool, delta *ArtifactDelta) (err error) {
 	if strings.Contains(source, "*") {
-		matches, err := doublestar.Glob(source)
+		base := BaseDirOfPathWithWildcard(source)
+		matches, err := doublestar.Glob(EscapeGlob(base) + source[len(base):])
 		if err != nil {
 			return err
 		}
 		sort.Strings(matches)
-		base := BaseDirOfPathWithWildcard(source)
 		baseLen := len(base)
 		for _, file := range matches {
 			fileDir, _ := filepath.Split(file)
 			dest := Join("/", destDir, fileDir[baseLen:len(fileDir)-1])
-			err = uploadArtifacts(s, file, dest, ignoreUnmatchError)
+			err = uploadArtifact(ctx, file, dest, ignoreUnmatchError, delta)
 			if err != nil {
 				return err
 			}
 		}
 		return nil
 	}
+	return uploadArtifact(ctx, source, destDir, ignoreUnmatchError, delta)
+}
 
+func uploadArtifact(ctx *BuildContext, source, destDir string, ignoreUnmatchError bool, delta *ArtifactDelta) (err error) {
 	srcInfo, err := os.Stat(source)
 	if err != nil {
 		if ignoreUnmatchError {
@@ -61,7 +84,7 @@ func uploadArtifacts(s *BuildSession, source, destDir string, ignoreUnmatchError
 		}
 		return
 	}
-	s.ConsoleLog("Uploading artifacts from %v to %v\n", source, destDescription(destDir))
+	ctx.ConsoleLog("Uploading artifacts from %v to %v\n", source, destDescription(destDir))
 
 	var destPath string
 	if destDir != "" {
@@ -69,9 +92,104 @@ func uploadArtifacts(s *BuildSession, source, destDir string, ignoreUnmatchError
 	} else {
 		destPath = srcInfo.Name()
 	}
-	destURL := AppendUrlParam(AppendUrlPath(s.artifactUploadBaseURL, destDir),
-		"buildId", s.buildId)
-	return s.artifacts.Upload(source, destPath, destURL)
+	destURL := ctx.ArtifactDestURL(destDir)
+	destURL.Delta = delta
+	skipped := delta.skipped()
+	err = ctx.Artifacts.Upload(source, destPath, destURL)
+	if err != nil {
+		return
+	}
+	if delta.skipped() > skipped {
+		ctx.ConsoleLog("Skipped %v files unchanged since the previous run\n", delta.skipped()-skipped)
+	}
+	if config.LocalArtifactsDir != "" {
+		if err := keepLocalArtifact(source, destPath, destURL); err != nil {
+			LogInfo("keep local artifact %v failed: %v", destPath, err)
+		}
+	}
+	return
+}
+
+// uploadArtifactsAs uploads source to destDir/name instead of naming it
+// after the source file or directory.
+func uploadArtifactsAs(ctx *BuildContext, source, destDir, name string) error {
+	destPath := name
+	if destDir != "" {
+		destPath = Join("/", destDir, name)
+	}
+	if config.DisableArtifactUpload {
+		ctx.ConsoleLog("Artifact upload is disabled on this agent, skipped uploading %v to %v\n", source, destPath)
+		return nil
+	}
+	destURL := ctx.ArtifactDestURL(destDir)
+	return ctx.Artifacts.Upload(source, destPath, destURL)
+}
+
+// reserveArtifactsSize fails the upload before anything is sent when the
+// files matched by source would push the job over config.MaxArtifactSize.
+func (s *BuildSession) reserveArtifactsSize(source string) error {
+	if config.MaxArtifactSize <= 0 {
+		return nil
+	}
+	files, err := artifactFileSizes(source)
+	if err != nil {
+		// let uploadArtifacts report missing files
+		return nil
+	}
+	total := s.artifactsSize
+	for _, file := range files {
+		total += file.size
+	}
+	if total <= config.MaxArtifactSize {
+		s.artifactsSize = total
+		return nil
+	}
+	sort.Stable(sort.Reverse(bySize(files)))
+	s.ConsoleLog("Artifacts of this job would be %v, which exceeds the maximum artifact size %v (GOCD_AGENT_MAX_ARTIFACT_SIZE). Biggest files:\n",
+		FormatByteSize(total), FormatByteSize(config.MaxArtifactSize))
+	for i, file := range files {
+		if i == 5 {
+			break
+		}
+		s.ConsoleLog("  %v (%v)\n", file.path, FormatByteSize(file.size))
+	}
+	return Err("Artifacts size exceeds the maximum artifact size %v", FormatByteSize(config.MaxArtifactSize))
+}
+
+type artifactFileSize struct {
+	path string
+	size int64
+}
+
+type bySize []artifactFileSize
+
+func (a bySize) Len() int           { return len(a) }
+func (a bySize) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a bySize) Less(i, j int) bool { return a[i].size < a[j].size }
+
+func artifactFileSizes(source string) (files []artifactFileSize, err error) {
+	sources := []string{source}
+	if strings.Contains(source, "*") {
+		sources, err = doublestar.Glob(source)
+		if err != nil {
+			return
+		}
+	}
+	for _, src := range sources {
+		err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				files = append(files, artifactFileSize{path: path, size: info.Size()})
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
 }
 
 func destDescription(path string) string {
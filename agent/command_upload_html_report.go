@@ -0,0 +1,53 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const HtmlReportDestDir = "testoutput"
+
+// CommandUploadHtmlReport publishes a directory of a generated HTML report
+// (Allure, Cypress, ...) as testoutput/<name>, which can then be shown in a
+// custom tab of the job.
+func CommandUploadHtmlReport(ctx *BuildContext, cmd *protocol.BuildCommand) error {
+	name := cmd.Args["name"]
+	if name == "" || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return Err("Invalid HTML report name: '%v'", name)
+	}
+	index := cmd.Args["index"]
+	if index == "" {
+		index = protocol.TestReportFileName
+	}
+	absSrc := filepath.Join(ctx.Wd, cmd.Args["src"])
+	if _, err := os.Stat(filepath.Join(absSrc, index)); err != nil {
+		return Err("HTML report index %v not found in %v", index, absSrc)
+	}
+
+	destPath := Join("/", HtmlReportDestDir, name)
+	ctx.ConsoleLog("Publishing HTML report [%v] from %v to %v\n", name, absSrc, destPath)
+	if err := uploadArtifactsAs(ctx, absSrc, HtmlReportDestDir, name); err != nil {
+		return err
+	}
+	ctx.ConsoleLog("HTML report [%v] is published as artifact %v, configure a custom tab with it to show the report.\n",
+		name, Join("/", destPath, index))
+	return nil
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/api"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// WaitForInterval is how often waitFor checks its condition unless
+	// the command sets "interval".
+	WaitForInterval = time.Second
+	// WaitForRequestTimeout limits every request checking a url.
+	WaitForRequestTimeout = 10 * time.Second
+)
+
+// waitForCheck returns whether the condition is met and what was seen,
+// an error stops waiting.
+type waitForCheck func() (bool, string, error)
+
+func CommandWaitFor(ctx *BuildContext, cmd *protocol.BuildCommand) error {
+	timeout, err := time.ParseDuration(cmd.Args["timeout"])
+	if err != nil {
+		return Err("Invalid waitFor timeout: %v", err)
+	}
+	interval := WaitForInterval
+	if v := cmd.Args["interval"]; v != "" {
+		if interval, err = time.ParseDuration(v); err != nil || interval <= 0 {
+			return Err("Invalid waitFor interval: %v", v)
+		}
+	}
+	var kind, condition string
+	var check waitForCheck
+	switch {
+	case cmd.Args["url"] != "":
+		kind, condition = "url", readArg(cmd, "condition", "status=2xx")
+		check, err = waitForURL(cmd.Args["url"], condition)
+	case cmd.Args["file"] != "":
+		kind, condition = "file", readArg(cmd, "condition", "exists")
+		check, err = waitForFile(filepath.Join(ctx.Wd, cmd.Args["file"]), condition)
+	case cmd.Args["stage"] != "":
+		kind, condition = "stage", readArg(cmd, "condition", "completed")
+		check, err = waitForStage(cmd.Args["stage"], condition)
+	default:
+		return Err("waitFor target is empty")
+	}
+	if err != nil {
+		return err
+	}
+	target := cmd.Args[kind]
+	ctx.ConsoleLog("Waiting for %v %v to meet condition '%v', timeout %v\n", kind, target, condition, timeout)
+	deadline := time.After(timeout)
+	for {
+		met, seen, err := check()
+		if err != nil {
+			return err
+		}
+		if met {
+			ctx.ConsoleLog("Condition '%v' of %v %v is met\n", condition, kind, target)
+			return nil
+		}
+		ctx.debugLog("waitFor %v %v: %v", kind, target, seen)
+		select {
+		case <-ctx.Canceled:
+			return Err("waitFor %v %v is canceled", kind, target)
+		case <-deadline:
+			return Err("Timed out after %v waiting for %v %v to meet condition '%v', last seen: %v", timeout, kind, target, condition, seen)
+		case <-time.After(interval):
+		}
+	}
+}
+
+func readArg(cmd *protocol.BuildCommand, name, defaultVal string) string {
+	if v := cmd.Args[name]; v != "" {
+		return v
+	}
+	return defaultVal
+}
+
+// waitForURL conditions are "status=<code>", where code can be like 2xx,
+// and "contains=<text>" of a 2xx response body.
+func waitForURL(url, condition string) (waitForCheck, error) {
+	client := &http.Client{Timeout: WaitForRequestTimeout}
+	name, value := splitCondition(condition)
+	if name != "status" && name != "contains" || value == "" {
+		return nil, Err("Unsupported waitFor url condition: %v", condition)
+	}
+	return func() (bool, string, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return false, err.Error(), nil
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return false, err.Error(), nil
+		}
+		code := strconv.Itoa(resp.StatusCode)
+		if name == "status" {
+			return matchStatus(code, value), "status " + code, nil
+		}
+		return code[0] == '2' && strings.Contains(string(body), value), "status " + code, nil
+	}, nil
+}
+
+func matchStatus(code, pattern string) bool {
+	if len(code) != len(pattern) {
+		return false
+	}
+	for i := range pattern {
+		if pattern[i] != 'x' && pattern[i] != code[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// waitForFile conditions are "exists", "absent" and "contains=<text>".
+func waitForFile(path, condition string) (waitForCheck, error) {
+	name, value := splitCondition(condition)
+	switch {
+	case name == "exists", name == "absent", name == "contains" && value != "":
+	default:
+		return nil, Err("Unsupported waitFor file condition: %v", condition)
+	}
+	return func() (bool, string, error) {
+		content, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return name == "absent", "file does not exist", nil
+		}
+		if err != nil {
+			return false, err.Error(), nil
+		}
+		switch name {
+		case "exists":
+			return true, "file exists", nil
+		case "absent":
+			return false, "file exists", nil
+		}
+		return strings.Contains(string(content), value), Sprintf("file has %v bytes", len(content)), nil
+	}, nil
+}
+
+// waitForStage conditions are "completed" and "passed", which fails once
+// the stage completed with other results.
+func waitForStage(locator, condition string) (waitForCheck, error) {
+	if condition != "completed" && condition != "passed" {
+		return nil, Err("Unsupported waitFor stage condition: %v", condition)
+	}
+	parts := strings.Split(locator, "/")
+	if len(parts) != 4 {
+		return nil, Err("Invalid waitFor stage %v, it should be <pipeline>/<counter>/<stage>/<counter>", locator)
+	}
+	pipelineCounter, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, Err("Invalid pipeline counter of waitFor stage %v", locator)
+	}
+	stageCounter, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return nil, Err("Invalid stage counter of waitFor stage %v", locator)
+	}
+	client, err := ServerAPIClient()
+	if err != nil {
+		return nil, err
+	}
+	return func() (bool, string, error) {
+		stage, err := client.StageInstance(parts[0], pipelineCounter, parts[2], stageCounter)
+		if api.IsNotFound(err) {
+			return false, "stage is not scheduled", nil
+		}
+		if err != nil {
+			return false, err.Error(), nil
+		}
+		if !stage.Completed() {
+			return false, "stage is not completed", nil
+		}
+		if condition == "passed" && stage.Result != api.ResultPassed {
+			return false, "", Err("Stage %v is %v", locator, stage.Result)
+		}
+		return true, "stage is " + stage.Result, nil
+	}, nil
+}
+
+func splitCondition(condition string) (string, string) {
+	kv := strings.SplitN(condition, "=", 2)
+	if len(kv) == 1 {
+		return kv[0], ""
+	}
+	return kv[0], kv[1]
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/api"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitForURLToBeReady(t *testing.T) {
+	WaitForInterval = 10 * time.Millisecond
+	defer func() {
+		WaitForInterval = time.Second
+	}()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("status: ready"))
+	}))
+	defer server.Close()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.WaitForCommand("url", server.URL, "contains=ready", "5s"),
+		echo("ready"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf("Waiting for url %v to meet condition 'contains=ready', timeout 5s\n", server.URL) +
+		Sprintf("Condition 'contains=ready' of url %v is met\n", server.URL) +
+		"ready\n"
+	assert.Equal(t, expected, trimTimestamp(log))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestFailWhenWaitForFileTimedOut(t *testing.T) {
+	WaitForInterval = 10 * time.Millisecond
+	defer func() {
+		WaitForInterval = time.Second
+	}()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.WaitForCommand("file", "ready.txt", "", "50ms"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := "Waiting for file ready.txt to meet condition 'exists', timeout 50ms\n" +
+		"ERROR: Timed out after 50ms waiting for file ready.txt to meet condition 'exists', last seen: file does not exist\n"
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestFailWhenWaitForStageToPassButItFailed(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.AddPipelineInstance(&api.PipelineInstance{Name: "deps", Counter: 1,
+		Stages: []*api.StageInstance{{Name: "build", Counter: 1, Result: api.ResultFailed}}})
+	goServer.SendBuild(AgentId, buildId,
+		protocol.WaitForCommand("stage", "deps/1/build/1", "passed", "1m"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := "Waiting for stage deps/1/build/1 to meet condition 'passed', timeout 1m0s\n" +
+		"ERROR: Stage deps/1/build/1 is Failed\n"
+	assert.Equal(t, expected, trimTimestamp(log))
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// CommandWorkspaceSnapshot warm-starts the working directory from the
+// snapshot keyed by content of keyFiles, lockfiles of the dependencies
+// installed by its sub commands, which are then skipped. Without a
+// snapshot the sub commands run and the working directory is snapshotted
+// after them.
+func CommandWorkspaceSnapshot(ctx *BuildContext, cmd *protocol.BuildCommand) error {
+	if config.WorkspaceSnapshotDir == "" {
+		return CommandCompose(ctx, cmd)
+	}
+	keyFiles, err := cmd.ListArg("keyFiles")
+	if err != nil {
+		return err
+	}
+	dir, key, err := workspaceSnapshotKey(ctx, keyFiles)
+	if err != nil {
+		return err
+	}
+	snapshot := filepath.Join(dir, key+".tar.gz")
+	if _, err := os.Stat(snapshot); err == nil {
+		restored, err := restoreWorkspaceSnapshot(snapshot, ctx.Wd)
+		if err == nil {
+			ctx.ConsoleLog("Restored %v files from workspace snapshot %v, skipped %v commands\n", restored, key[:12], len(cmd.SubCommands))
+			return nil
+		}
+		ctx.warn("Could not restore workspace snapshot %v, running commands instead: %v", key[:12], err)
+	}
+	if err := CommandCompose(ctx, cmd); err != nil {
+		return err
+	}
+	if ctx.commands().buildFailed() {
+		return nil
+	}
+	size, err := saveWorkspaceSnapshot(ctx.Wd, dir, key)
+	if err != nil {
+		ctx.warn("Could not snapshot workspace %v: %v", ctx.Wd, err)
+		return nil
+	}
+	ctx.ConsoleLog("Saved workspace snapshot %v (%v)\n", key[:12], FormatByteSize(size))
+	return nil
+}
+
+// workspaceSnapshotKey returns the directory of snapshots of the working
+// directory, and hash of the key files as key of the snapshot.
+func workspaceSnapshotKey(ctx *BuildContext, keyFiles []string) (string, string, error) {
+	rel, err := filepath.Rel(ctx.RootDir, ctx.Wd)
+	if err != nil {
+		return "", "", err
+	}
+	wd := sha256.Sum256([]byte(filepath.ToSlash(rel)))
+	files := append([]string{}, keyFiles...)
+	sort.Strings(files)
+	h := sha256.New()
+	for _, file := range files {
+		sum, err := fileSHA256(filepath.Join(ctx.Wd, file))
+		if os.IsNotExist(err) {
+			sum = "absent"
+		} else if err != nil {
+			return "", "", err
+		}
+		fmt.Fprintf(h, "%v=%v\n", file, sum)
+	}
+	dir := filepath.Join(config.WorkspaceSnapshotDir, hex.EncodeToString(wd[:8]))
+	return dir, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// saveWorkspaceSnapshot writes wd as snapshot key into dir, and removes
+// snapshots of other keys, which would not be restored again.
+func saveWorkspaceSnapshot(wd, dir, key string) (int64, error) {
+	if err := Mkdirs(dir); err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(dir, key+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeTarGz(wd, tmp); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	// rename so that a snapshot is never found half written
+	snapshot := filepath.Join(dir, key+".tar.gz")
+	if err := os.Rename(tmp.Name(), snapshot); err != nil {
+		return 0, err
+	}
+	others, _ := filepath.Glob(filepath.Join(dir, "*.tar.gz"))
+	for _, other := range others {
+		if other != snapshot {
+			os.Remove(other)
+		}
+	}
+	return info.Size(), nil
+}
+
+// restoreWorkspaceSnapshot extracts files of snapshot missing in wd, files
+// checked out by the build are newer than the snapshotted ones.
+func restoreWorkspaceSnapshot(snapshot, wd string) (int, error) {
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	restored := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return restored, nil
+		} else if err != nil {
+			return restored, err
+		}
+		dest, err := archiveEntryPath(wd, hdr.Name)
+		if err != nil {
+			return restored, err
+		}
+		if _, err := os.Lstat(dest); err == nil {
+			continue
+		}
+		perm := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(dest, perm|0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeExtractedFile(tr, dest, perm)
+			restored++
+		case tar.TypeSymlink:
+			err = extractSymlink(hdr.Linkname, dest, wd)
+			restored++
+		default:
+			LogDebug("skipped snapshot entry %v of type %c", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return restored, err
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWorkspaceSnapshotSkipsInstallWhileLockfileIsUnchanged(t *testing.T) {
+	snapshots, err := ioutil.TempDir("", "snapshots")
+	assert.Nil(t, err)
+	defer os.RemoveAll(snapshots)
+	GetConfig().WorkspaceSnapshotDir = snapshots
+	defer func() {
+		GetConfig().WorkspaceSnapshotDir = ""
+	}()
+
+	// builds share the working directory, which outlives each of them
+	wd := filepath.Join(os.Getenv("GOCD_AGENT_WORKING_DIR"), "pipelines", "WorkspaceSnapshot")
+	assert.Nil(t, Mkdirs(wd))
+	defer os.RemoveAll(wd)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(wd, "deps.lock"), []byte("v1\n"), 0644))
+
+	build := func(id string) string {
+		setUpBuild(t, id)
+		defer tearDown()
+		goServer.SendBuild(AgentId, buildId,
+			protocol.WorkspaceSnapshotCommand([]string{"deps.lock"},
+				protocol.ExecCommand("sh", "-c", "echo installing && mkdir -p deps && cat deps.lock >> deps/lib").Setwd(relativePath(wd)),
+			).Setwd(relativePath(wd)),
+			protocol.ExecCommand("cat", "deps/lib").Setwd(relativePath(wd)),
+		)
+		assert.Equal(t, "agent Building", stateLog.Next())
+		assert.Equal(t, "build Passed", stateLog.Next())
+		assert.Equal(t, "agent Idle", stateLog.Next())
+		log, err := goServer.ConsoleLog(buildId)
+		assert.Nil(t, err)
+		return trimTimestamp(log)
+	}
+
+	log := build("WorkspaceSnapshot1")
+	assert.True(t, strings.Contains(log, "installing\nSaved workspace snapshot "), log)
+	assert.True(t, strings.HasSuffix(log, "\nv1\n"), log)
+
+	// a fresh checkout has no dependencies installed
+	assert.Nil(t, os.RemoveAll(filepath.Join(wd, "deps")))
+	log = build("WorkspaceSnapshot2")
+	assert.True(t, strings.HasPrefix(log, "Restored 1 files from workspace snapshot "), log)
+	assert.True(t, strings.Contains(log, ", skipped 1 commands\n"), log)
+	assert.False(t, strings.Contains(log, "installing"), log)
+	assert.True(t, strings.HasSuffix(log, "\nv1\n"), log)
+
+	assert.Nil(t, os.RemoveAll(filepath.Join(wd, "deps")))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(wd, "deps.lock"), []byte("v2\n"), 0644))
+	log = build("WorkspaceSnapshot3")
+	assert.True(t, strings.Contains(log, "installing\nSaved workspace snapshot "), log)
+	assert.True(t, strings.HasSuffix(log, "\nv2\n"), log)
+
+	matches, err := filepath.Glob(filepath.Join(snapshots, "*", "*.tar.gz"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(matches))
+}
@@ -21,9 +21,31 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
-	"crypto/tls"
+)
+
+// IsolatedNetwork runs job processes in a network namespace of their own
+// with only loopback.
+const IsolatedNetwork = "isolated"
+
+// Values of Config.CreateWorkingDir, when a missing command working
+// directory is created.
+const (
+	CreateWorkingDirAuto   = "auto"
+	CreateWorkingDirAlways = "always"
+	CreateWorkingDirNever  = "never"
+)
+
+// Prefixes of console lines, see Config.ConsoleTimestamps: time of day,
+// ISO 8601 date and time, time elapsed since the build started, or none.
+const (
+	ConsoleTimestampsTime    = "time"
+	ConsoleTimestampsISO8601 = "iso8601"
+	ConsoleTimestampsElapsed = "elapsed"
+	ConsoleTimestampsNone    = "none"
 )
 
 type Config struct {
@@ -46,12 +68,165 @@ type Config struct {
 	AgentAutoRegisterElasticAgentId  string
 	AgentAutoRegisterElasticPluginId string
 
+	Labels map[string]string
+
+	IgnoreServerVersion bool
+	MaxServerVersion    string
+
 	GoServerCAFile      string
 	AgentPrivateKeyFile string
 	AgentCertFile       string
 	AgentIdFile         string
 	AgentTokenFile      string
+	ServerPinFile       string
+	AdminSocketFile     string
+	StatusReportAddress string
 	OutputDebugLog      bool
+
+	CreateWorkingDir string
+
+	// WorkspaceRepair is how git work trees in the workspace of a job are
+	// repaired before it starts, see WorkspaceRepairOff
+	WorkspaceRepair string
+
+	// JobTmpfsSize is the size of a tmpfs mounted as temp directory of
+	// each job, 0 for none
+	JobTmpfsSize int64
+
+	// ConfigFile is where settings are reloaded from, see ReloadConfig
+	ConfigFile string
+
+	// ProtectConfig is how config files are protected from build tasks
+	ProtectConfig string
+
+	// HttpAuth is how requests to server are authenticated, see HttpAuth
+	HttpAuth string
+
+	// TestHistoryFile keeps results of tests of jobs, see recordTestHistory
+	TestHistoryFile string
+
+	// DurationHistoryFile keeps durations of builds of jobs, see
+	// checkDurationTrend
+	DurationHistoryFile string
+
+	// ConsoleSampleAfter is the number of console lines of a build sent
+	// to server before it is sampled, 0 to send all, see consoleSampler
+	ConsoleSampleAfter   int
+	ConsoleSampleEvery   int
+	ConsoleSamplePattern *regexp.Regexp
+
+	// CancelGracePeriod is how long a canceled exec command has to stop
+	// after SIGTERM before it is killed, 0 to kill it right away
+	CancelGracePeriod time.Duration
+
+	// ConsoleTimestamps is the prefix of console lines, one of
+	// ConsoleTimestamps*
+	ConsoleTimestamps string
+
+	// ConsoleHeartbeatInterval is how long an exec command is silent
+	// before a "still running" console line, 0 to turn heartbeats off
+	ConsoleHeartbeatInterval time.Duration
+
+	// KeepProgressLines turns off collapsing lines rewritten with '\r'
+	// in exec output
+	KeepProgressLines bool
+
+	// RetriesPerBuild is the retry budget of artifact and console
+	// requests of a build, see RetryBudget
+	RetriesPerBuild int
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+
+	// MaxConnectionAge is how long the agent keeps a websocket connection
+	// before connecting to server again, 0 to keep it until it is closed
+	MaxConnectionAge time.Duration
+
+	// MaxBuildDuration is how long a build runs before the agent cancels
+	// it, 0 to not limit it
+	MaxBuildDuration time.Duration
+
+	MaxArtifactSize       int64
+	PipelineDiskQuota     int64
+	DisableArtifactUpload bool
+
+	// GzipUploadExtensions are extensions of artifact files whose uploads
+	// are gzipped, empty to not gzip uploads
+	GzipUploadExtensions []string
+
+	// JobNetworkNamespace is IsolatedNetwork or path of the network
+	// namespace exec commands run in, empty to run in agent's network
+	JobNetworkNamespace string
+
+	// TaskCacheDir keeps outputs of exec commands opted in the task cache,
+	// empty to turn the cache off
+	TaskCacheDir string
+	// TaskCacheURL is the remote task cache shared by agents, see
+	// NewCacheBackend
+	TaskCacheURL string
+
+	// WorkspaceSnapshotDir keeps snapshots of working directories taken by
+	// workspaceSnapshot commands, empty to turn snapshots off
+	WorkspaceSnapshotDir string
+
+	// LocalArtifactsDir keeps artifacts uploaded by jobs for fetches of
+	// later jobs on the agent, empty to always fetch them from server
+	LocalArtifactsDir  string
+	LocalArtifactsSize int64
+
+	// ArtifactCacheDir keeps artifacts fetched from server for later
+	// fetches of them, empty to turn the cache off, see artifactCache
+	ArtifactCacheDir  string
+	ArtifactCacheSize int64
+
+	// JobCgroup is the cgroup directory jobs get cgroups of their own
+	// in, empty to track job processes by session only
+	JobCgroup string
+
+	// GCPercent is GOGC of the agent process, negative turns GC off and 0
+	// keeps Go's default
+	GCPercent   int
+	MemoryLimit int64
+
+	// AdminAddress is where admin requests are served over mTLS, empty
+	// to only serve them on AdminSocketFile
+	AdminAddress      string
+	AdminCertFile     string
+	AdminKeyFile      string
+	AdminClientCAFile string
+	// EventsURL is where agent events are published to, see
+	// NewEventPublisher
+	EventsURL string
+
+	// BadgeDir is where badges of completed jobs are written to, and
+	// BadgeURL is where they are posted to, see JobBadge
+	BadgeDir string
+	BadgeURL string
+
+	// ResourceUsageSummary logs resources used by processes of builds to
+	// their consoles
+	ResourceUsageSummary bool
+
+	// CrashLoopRestarts is how many restarts of the agent within
+	// CrashLoopWindow make a crash loop, 0 to not detect crash loops, see
+	// CrashLoopDelay
+	CrashLoopRestarts        int
+	CrashLoopWindow          time.Duration
+	CrashLoopRestartInterval time.Duration
+
+	// UpdateScript updates the agent when it is asked to by admin
+	UpdateScript string
+
+	// RedactionRules are applied to all console output of builds
+	RedactionRules []*RedactionRule
+
+	// AllowedCommands are the only build commands run when it is not
+	// empty, DeniedCommands are never run
+	AllowedCommands []string
+	DeniedCommands  []string
+
+	DiagnosticsScript      string
+	DiagnosticsCollectors  []string
+	DiagnosticsCorePattern string
 }
 
 func LoadConfig() *Config {
@@ -69,11 +244,147 @@ func LoadConfig() *Config {
 	}
 	wd = filepath.Clean(wd)
 	configDir := filepath.Join(wd, readEnv("GOCD_AGENT_CONFIG_DIR", "config"))
+	maxArtifactSize, err := ParseByteSize(os.Getenv("GOCD_AGENT_MAX_ARTIFACT_SIZE"))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_MAX_ARTIFACT_SIZE is invalid: %v", err))
+	}
+	pipelineDiskQuota, err := ParseByteSize(os.Getenv("GOCD_AGENT_PIPELINE_DISK_QUOTA"))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_PIPELINE_DISK_QUOTA is invalid: %v", err))
+	}
+	maxServerVersion := os.Getenv("GOCD_AGENT_MAX_SERVER_VERSION")
+	if maxServerVersion != "" {
+		if _, err := ParseVersion(maxServerVersion); err != nil {
+			panic(Sprintf("GOCD_AGENT_MAX_SERVER_VERSION is invalid: %v", err))
+		}
+	}
+	var gcPercent int
+	if gogc := os.Getenv("GOCD_AGENT_GOGC"); gogc != "" {
+		if gcPercent, err = ParseGCPercent(gogc); err != nil || gcPercent == 0 {
+			panic(Sprintf("GOCD_AGENT_GOGC is invalid: %v", gogc))
+		}
+	}
+	memoryLimit, err := ParseByteSize(os.Getenv("GOCD_AGENT_MEMORY_LIMIT"))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_MEMORY_LIMIT is invalid: %v", err))
+	}
+	localArtifactsSize, err := ParseByteSize(readEnv("GOCD_AGENT_LOCAL_ARTIFACTS_SIZE", "10GB"))
+	if err != nil || localArtifactsSize < 0 {
+		panic(Sprintf("GOCD_AGENT_LOCAL_ARTIFACTS_SIZE is invalid: %v", os.Getenv("GOCD_AGENT_LOCAL_ARTIFACTS_SIZE")))
+	}
+	artifactCacheSize, err := ParseByteSize(readEnv("GOCD_AGENT_ARTIFACT_CACHE_SIZE", "10GB"))
+	if err != nil || artifactCacheSize < 0 {
+		panic(Sprintf("GOCD_AGENT_ARTIFACT_CACHE_SIZE is invalid: %v", os.Getenv("GOCD_AGENT_ARTIFACT_CACHE_SIZE")))
+	}
+	artifactCacheDir := readEnv("GOCD_AGENT_ARTIFACT_CACHE_DIR", filepath.Join(wd, "artifact-cache"))
+	if os.Getenv("GOCD_AGENT_DISABLE_ARTIFACT_CACHE") != "" {
+		artifactCacheDir = ""
+	}
+	jobTmpfsSize, err := ParseByteSize(os.Getenv("GOCD_AGENT_JOB_TMPFS_SIZE"))
+	if err != nil || jobTmpfsSize < 0 {
+		panic(Sprintf("GOCD_AGENT_JOB_TMPFS_SIZE is invalid: %v", os.Getenv("GOCD_AGENT_JOB_TMPFS_SIZE")))
+	}
+	consoleSampleAfter, err := strconv.Atoi(readEnv("GOCD_AGENT_CONSOLE_SAMPLE_AFTER", "0"))
+	if err != nil || consoleSampleAfter < 0 {
+		panic(Sprintf("GOCD_AGENT_CONSOLE_SAMPLE_AFTER is invalid: %v", os.Getenv("GOCD_AGENT_CONSOLE_SAMPLE_AFTER")))
+	}
+	consoleSampleEvery, err := strconv.Atoi(readEnv("GOCD_AGENT_CONSOLE_SAMPLE_EVERY", "100"))
+	if err != nil || consoleSampleEvery < 1 {
+		panic(Sprintf("GOCD_AGENT_CONSOLE_SAMPLE_EVERY is invalid: %v", os.Getenv("GOCD_AGENT_CONSOLE_SAMPLE_EVERY")))
+	}
+	consoleSamplePattern, err := regexp.Compile(readEnv("GOCD_AGENT_CONSOLE_SAMPLE_PATTERN", DefaultConsoleSamplePattern))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_CONSOLE_SAMPLE_PATTERN is invalid: %v", err))
+	}
+	createWorkingDir := readEnv("GOCD_AGENT_CREATE_WORKING_DIR", CreateWorkingDirAuto)
+	switch createWorkingDir {
+	case CreateWorkingDirAuto, CreateWorkingDirAlways, CreateWorkingDirNever:
+	default:
+		panic(Sprintf("GOCD_AGENT_CREATE_WORKING_DIR is invalid: %v", createWorkingDir))
+	}
+	cancelGracePeriod, err := time.ParseDuration(readEnv("GOCD_AGENT_CANCEL_GRACE_PERIOD", "0"))
+	if err != nil || cancelGracePeriod < 0 {
+		panic(Sprintf("GOCD_AGENT_CANCEL_GRACE_PERIOD is invalid: %v", os.Getenv("GOCD_AGENT_CANCEL_GRACE_PERIOD")))
+	}
+	consoleTimestamps := readEnv("GOCD_AGENT_CONSOLE_TIMESTAMPS", ConsoleTimestampsTime)
+	switch consoleTimestamps {
+	case ConsoleTimestampsTime, ConsoleTimestampsISO8601, ConsoleTimestampsElapsed, ConsoleTimestampsNone:
+	default:
+		panic(Sprintf("GOCD_AGENT_CONSOLE_TIMESTAMPS is invalid: %v", consoleTimestamps))
+	}
+	consoleHeartbeatInterval, err := time.ParseDuration(readEnv("GOCD_AGENT_CONSOLE_HEARTBEAT", "0"))
+	if err != nil || consoleHeartbeatInterval < 0 {
+		panic(Sprintf("GOCD_AGENT_CONSOLE_HEARTBEAT is invalid: %v", os.Getenv("GOCD_AGENT_CONSOLE_HEARTBEAT")))
+	}
+	reloadable, err := parseReloadable(readEnv)
+	if err != nil {
+		panic(err.Error())
+	}
+	maxConnectionAge, err := time.ParseDuration(readEnv("GOCD_AGENT_MAX_CONNECTION_AGE", "0"))
+	if err != nil || maxConnectionAge < 0 {
+		panic(Sprintf("GOCD_AGENT_MAX_CONNECTION_AGE is invalid: %v", os.Getenv("GOCD_AGENT_MAX_CONNECTION_AGE")))
+	}
+	crashLoopRestarts, err := strconv.Atoi(readEnv("GOCD_AGENT_CRASH_LOOP_RESTARTS", "0"))
+	if err != nil || crashLoopRestarts < 0 {
+		panic(Sprintf("GOCD_AGENT_CRASH_LOOP_RESTARTS is invalid: %v", os.Getenv("GOCD_AGENT_CRASH_LOOP_RESTARTS")))
+	}
+	crashLoopWindow, err := time.ParseDuration(readEnv("GOCD_AGENT_CRASH_LOOP_WINDOW", "5m"))
+	if err != nil || crashLoopWindow <= 0 {
+		panic(Sprintf("GOCD_AGENT_CRASH_LOOP_WINDOW is invalid: %v", os.Getenv("GOCD_AGENT_CRASH_LOOP_WINDOW")))
+	}
+	crashLoopRestartInterval, err := time.ParseDuration(readEnv("GOCD_AGENT_CRASH_LOOP_RESTART_INTERVAL", "5m"))
+	if err != nil || crashLoopRestartInterval < 0 {
+		panic(Sprintf("GOCD_AGENT_CRASH_LOOP_RESTART_INTERVAL is invalid: %v", os.Getenv("GOCD_AGENT_CRASH_LOOP_RESTART_INTERVAL")))
+	}
+	maxBuildDuration, err := time.ParseDuration(readEnv("GOCD_AGENT_MAX_BUILD_DURATION", "0"))
+	if err != nil || maxBuildDuration < 0 {
+		panic(Sprintf("GOCD_AGENT_MAX_BUILD_DURATION is invalid: %v", os.Getenv("GOCD_AGENT_MAX_BUILD_DURATION")))
+	}
+	if taskCacheURL := os.Getenv("GOCD_AGENT_TASK_CACHE_URL"); taskCacheURL != "" {
+		if _, err := NewCacheBackend(taskCacheURL); err != nil {
+			panic(Sprintf("GOCD_AGENT_TASK_CACHE_URL is invalid: %v", err))
+		}
+	}
+	if os.Getenv("GOCD_AGENT_ADMIN_ADDRESS") != "" {
+		for _, name := range []string{"GOCD_AGENT_ADMIN_CERT", "GOCD_AGENT_ADMIN_KEY", "GOCD_AGENT_ADMIN_CLIENT_CA"} {
+			if os.Getenv(name) == "" {
+				panic(Sprintf("%v is required by GOCD_AGENT_ADMIN_ADDRESS", name))
+			}
+		}
+	}
+	if eventsURL := os.Getenv("GOCD_AGENT_EVENTS_URL"); eventsURL != "" {
+		if _, err := NewEventPublisher(eventsURL); err != nil {
+			panic(Sprintf("GOCD_AGENT_EVENTS_URL is invalid: %v", err))
+		}
+	}
+	if badgeURL := os.Getenv("GOCD_AGENT_BADGE_URL"); badgeURL != "" {
+		if u, err := url.Parse(badgeURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			panic(Sprintf("GOCD_AGENT_BADGE_URL is invalid: %v", badgeURL))
+		}
+	}
+	workspaceRepair := readEnv("GOCD_AGENT_WORKSPACE_REPAIR", WorkspaceRepairOff)
+	switch workspaceRepair {
+	case WorkspaceRepairOff, WorkspaceRepairUnlock, WorkspaceRepairReset:
+	default:
+		panic(Sprintf("GOCD_AGENT_WORKSPACE_REPAIR is invalid: %v", workspaceRepair))
+	}
+	protectConfig := readEnv("GOCD_AGENT_PROTECT_CONFIG", ProtectConfigOff)
+	switch protectConfig {
+	case ProtectConfigChmod, ProtectConfigMount, ProtectConfigOff:
+	default:
+		panic(Sprintf("GOCD_AGENT_PROTECT_CONFIG is invalid: %v", protectConfig))
+	}
+	httpAuth := readEnv("GOCD_AGENT_HTTP_AUTH", HttpAuthCert)
+	switch httpAuth {
+	case HttpAuthCert, HttpAuthCookie, HttpAuthToken:
+	default:
+		panic(Sprintf("GOCD_AGENT_HTTP_AUTH is invalid: %v", httpAuth))
+	}
 	return &Config{
 		Hostname:                         hostname,
 		SendMessageTimeout:               120 * time.Second,
 		ServerUrl:                        serverUrl,
-		ServerHostAndPort:                serverUrl.Host,
+		ServerHostAndPort:                hostAndPort(serverUrl),
 		WorkingDir:                       wd,
 		LogDir:                           os.Getenv("GOCD_AGENT_LOG_DIR"),
 		ConfigDir:                        configDir,
@@ -82,29 +393,98 @@ func LoadConfig() *Config {
 		AgentCertFile:                    filepath.Join(configDir, "agent-cert.pem"),
 		AgentIdFile:                      filepath.Join(configDir, "agent-id"),
 		AgentTokenFile:                   filepath.Join(configDir, "token"),
+		ServerPinFile:                    ServerPinFile(),
+		AdminSocketFile:                  AdminSocketFile(),
+		StatusReportAddress:              os.Getenv("GOCD_AGENT_STATUS_REPORT_ADDRESS"),
 		AgentAutoRegisterKey:             os.Getenv("GOCD_AGENT_AUTO_REGISTER_KEY"),
 		AgentAutoRegisterResources:       os.Getenv("GOCD_AGENT_AUTO_REGISTER_RESOURCES"),
 		AgentAutoRegisterEnvironments:    os.Getenv("GOCD_AGENT_AUTO_REGISTER_ENVIRONMENTS"),
 		AgentAutoRegisterElasticAgentId:  os.Getenv("GOCD_AGENT_AUTO_REGISTER_ELASTIC_AGENT_ID"),
 		AgentAutoRegisterElasticPluginId: os.Getenv("GOCD_AGENT_AUTO_REGISTER_ELASTIC_PLUGIN_ID"),
-		OutputDebugLog:                   os.Getenv("DEBUG") != "",
+		Labels:                           reloadable.labels,
+		IgnoreServerVersion:              os.Getenv("GOCD_AGENT_IGNORE_SERVER_VERSION") != "",
+		MaxServerVersion:                 maxServerVersion,
+		OutputDebugLog:                   reloadable.debug,
 		WebSocketPath:                    readEnv("GOCD_SERVER_WEB_SOCKET_PATH", "/agent-websocket"),
 		RegistrationPath:                 readEnv("GOCD_SERVER_REGISTRATION_PATH", "/admin/agent"),
 		TokenPath:                        readEnv( "GOCD_SERVER_TOKEN_PATH", "/admin/agent/token"),
-		IpAddress:                        lookupIpAddress(serverUrl.Host),
+		IpAddress:                        lookupIpAddress(hostAndPort(serverUrl)),
+		CreateWorkingDir:                 createWorkingDir,
+		WorkspaceRepair:                  workspaceRepair,
+		JobTmpfsSize:                     jobTmpfsSize,
+		ConfigFile:                       os.Getenv("GOCD_AGENT_CONFIG_FILE"),
+		ProtectConfig:                    protectConfig,
+		HttpAuth:                         httpAuth,
+		TestHistoryFile:                  readEnv("GOCD_AGENT_TEST_HISTORY_FILE", filepath.Join(wd, "test-history.json")),
+		DurationHistoryFile:              readEnv("GOCD_AGENT_DURATION_HISTORY_FILE", filepath.Join(wd, "build-durations.json")),
+		ConsoleSampleAfter:               consoleSampleAfter,
+		ConsoleSampleEvery:               consoleSampleEvery,
+		CancelGracePeriod:                cancelGracePeriod,
+		ConsoleTimestamps:                consoleTimestamps,
+		ConsoleHeartbeatInterval:         consoleHeartbeatInterval,
+		ConsoleSamplePattern:             consoleSamplePattern,
+		KeepProgressLines:                os.Getenv("GOCD_AGENT_KEEP_PROGRESS_LINES") != "",
+		RetriesPerBuild:                  reloadable.retriesPerBuild,
+		RetryBackoff:                     reloadable.retryBackoff,
+		RetryMaxBackoff:                  reloadable.retryMaxBackoff,
+		MaxConnectionAge:                 maxConnectionAge,
+		MaxBuildDuration:                 maxBuildDuration,
+		MaxArtifactSize:                  maxArtifactSize,
+		PipelineDiskQuota:                pipelineDiskQuota,
+		DisableArtifactUpload:            os.Getenv("GOCD_AGENT_DISABLE_ARTIFACT_UPLOAD") != "",
+		GzipUploadExtensions:             readListEnv("GOCD_AGENT_GZIP_UPLOAD_EXTENSIONS"),
+		JobNetworkNamespace:              os.Getenv("GOCD_AGENT_JOB_NETWORK_NAMESPACE"),
+		JobCgroup:                        os.Getenv("GOCD_AGENT_JOB_CGROUP"),
+		TaskCacheDir:                     os.Getenv("GOCD_AGENT_TASK_CACHE_DIR"),
+		TaskCacheURL:                     os.Getenv("GOCD_AGENT_TASK_CACHE_URL"),
+		WorkspaceSnapshotDir:             os.Getenv("GOCD_AGENT_WORKSPACE_SNAPSHOT_DIR"),
+		LocalArtifactsDir:                os.Getenv("GOCD_AGENT_LOCAL_ARTIFACTS_DIR"),
+		LocalArtifactsSize:               localArtifactsSize,
+		ArtifactCacheDir:                 artifactCacheDir,
+		ArtifactCacheSize:                artifactCacheSize,
+		GCPercent:                        gcPercent,
+		MemoryLimit:                      memoryLimit,
+		AdminAddress:                     os.Getenv("GOCD_AGENT_ADMIN_ADDRESS"),
+		AdminCertFile:                    os.Getenv("GOCD_AGENT_ADMIN_CERT"),
+		AdminKeyFile:                     os.Getenv("GOCD_AGENT_ADMIN_KEY"),
+		AdminClientCAFile:                os.Getenv("GOCD_AGENT_ADMIN_CLIENT_CA"),
+		UpdateScript:                     os.Getenv("GOCD_AGENT_UPDATE_SCRIPT"),
+		ResourceUsageSummary:             os.Getenv("GOCD_AGENT_RESOURCE_USAGE_SUMMARY") != "",
+		CrashLoopRestarts:                crashLoopRestarts,
+		CrashLoopWindow:                  crashLoopWindow,
+		CrashLoopRestartInterval:         crashLoopRestartInterval,
+		BadgeDir:                         os.Getenv("GOCD_AGENT_BADGE_DIR"),
+		BadgeURL:                         os.Getenv("GOCD_AGENT_BADGE_URL"),
+		EventsURL:                        os.Getenv("GOCD_AGENT_EVENTS_URL"),
+		RedactionRules:                   reloadable.redactionRules,
+		AllowedCommands:                  reloadable.allowedCommands,
+		DeniedCommands:                   reloadable.deniedCommands,
+		DiagnosticsScript:                os.Getenv("GOCD_AGENT_DIAGNOSTICS_SCRIPT"),
+		DiagnosticsCollectors:            readListEnv("GOCD_AGENT_DIAGNOSTICS_COLLECTORS"),
+		DiagnosticsCorePattern:           readEnv("GOCD_AGENT_DIAGNOSTICS_CORE_PATTERN", "/tmp/core*"),
+	}
+}
+
+// AdminSocketFile is where the agent listens to local admin requests,
+// resolved without loading the whole config so that CLI commands can find it.
+func AdminSocketFile() string {
+	if socket := os.Getenv("GOCD_AGENT_ADMIN_SOCKET"); socket != "" {
+		return socket
 	}
+	wd, _ := filepath.Abs(os.Getenv("GOCD_AGENT_WORKING_DIR"))
+	return filepath.Join(wd, readEnv("GOCD_AGENT_CONFIG_DIR", "config"), "agent.sock")
 }
 
-func lookupIpAddress(host string) string {
-	conn, err := tls.Dial("tcp", host, &tls.Config{
-		InsecureSkipVerify: true,
-	})
+// lookupIpAddress is the address the agent connects to server at, the
+// first global address of its interfaces when server is not reachable,
+// IPv4 ones are preferred.
+func lookupIpAddress(hostport string) string {
+	conn, err := net.DialTimeout("tcp", hostport, ServerURLDialTimeout)
 	if err != nil {
 		return checkAllInterfaces()
 	}
-	ipAddress := strings.Split(conn.LocalAddr().String(), ":")[0]
-	conn.Close()
-	return ipAddress
+	defer conn.Close()
+	return conn.LocalAddr().(*net.TCPAddr).IP.String()
 }
 
 func checkAllInterfaces() string {
@@ -113,13 +493,20 @@ func checkAllInterfaces() string {
 		panic(err)
 	}
 
+	var ipv6 string
 	for _, a := range addrs {
-		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
 			if ipnet.IP.To4() != nil {
 				return ipnet.IP.String()
 			}
+			if ipv6 == "" {
+				ipv6 = ipnet.IP.String()
+			}
 		}
 	}
+	if ipv6 != "" {
+		return ipv6
+	}
 	return "127.0.0.1"
 }
 
@@ -161,3 +548,13 @@ func readEnv(varname string, defaultVal string) string {
 		return val
 	}
 }
+
+func readListEnv(varname string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(varname), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
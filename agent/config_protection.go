@@ -0,0 +1,84 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Values of Config.ProtectConfig, how agent config and identity files are
+// protected from build tasks while a build is running.
+const (
+	ProtectConfigChmod = "chmod"
+	ProtectConfigMount = "mount"
+	ProtectConfigOff   = "off"
+)
+
+// lockConfig takes write permissions of the agent config files and config
+// directory away until the returned function restores them. It stops
+// tasks from modifying them by accident, tasks running as the agent user
+// can still chmod them back, which ProtectConfigMount prevents.
+func lockConfig() func() {
+	if config.ProtectConfig == ProtectConfigOff {
+		return func() {}
+	}
+	modes := make(map[string]os.FileMode)
+	lock := func(path string, mode os.FileMode) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		if err := os.Chmod(path, info.Mode().Perm()&mode); err != nil {
+			LogInfo("WARN: could not lock %v: %v", path, err)
+			return
+		}
+		modes[path] = info.Mode().Perm()
+	}
+	for _, f := range configFiles() {
+		lock(f, 0400)
+	}
+	if !containsWorkingDir(config.ConfigDir) {
+		lock(config.ConfigDir, 0500)
+	}
+	return func() {
+		for path, mode := range modes {
+			if err := os.Chmod(path, mode); err != nil {
+				LogInfo("WARN: could not unlock %v: %v", path, err)
+			}
+		}
+	}
+}
+
+func configFiles() []string {
+	return []string{
+		config.GoServerCAFile,
+		config.AgentPrivateKeyFile,
+		config.AgentCertFile,
+		config.AgentIdFile,
+		config.AgentTokenFile,
+		config.ServerPinFile,
+	}
+}
+
+// containsWorkingDir is true when the agent working directory is dir or
+// inside it, locking dir would fail builds writing their workspace.
+func containsWorkingDir(dir string) bool {
+	rel, err := filepath.Rel(dir, config.WorkingDir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
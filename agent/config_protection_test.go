@@ -0,0 +1,81 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestLockConfigFilesDuringBuild(t *testing.T) {
+	GetConfig().ProtectConfig = ProtectConfigChmod
+	defer func() {
+		GetConfig().ProtectConfig = ProtectConfigOff
+	}()
+	setUp(t)
+	defer tearDown()
+	config := GetConfig()
+	fileMode, _ := os.Stat(config.AgentIdFile)
+	dirMode, _ := os.Stat(config.ConfigDir)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("stat", "-c", "%a", config.AgentIdFile, config.ConfigDir))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	banner := execBanner(config.WorkingDir, "stat", "-c", "%a", config.AgentIdFile, config.ConfigDir)
+	assert.Equal(t, banner+"400\n500\n", trimTimestamp(log))
+
+	info, _ := os.Stat(config.AgentIdFile)
+	assert.Equal(t, fileMode.Mode(), info.Mode())
+	info, _ = os.Stat(config.ConfigDir)
+	assert.Equal(t, dirMode.Mode(), info.Mode())
+}
+
+func TestMountConfigReadOnlyForExecCommands(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("mount namespace needs Linux and root")
+	}
+	GetConfig().ProtectConfig = ProtectConfigMount
+	defer func() {
+		GetConfig().ProtectConfig = ProtectConfigOff
+	}()
+	setUp(t)
+	defer tearDown()
+	idFile := GetConfig().AgentIdFile
+	id, _ := ioutil.ReadFile(idFile)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", Sprintf("echo hacked > %v", idFile)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(log, "Read-only file system"), log)
+	current, _ := ioutil.ReadFile(idFile)
+	assert.Equal(t, string(id), string(current))
+}
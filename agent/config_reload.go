@@ -0,0 +1,233 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bufio"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReloadableEnvs are settings reloaded from config.ConfigFile, without
+// dropping the connection to Go server or restarting builds. Builds
+// running keep the settings they started with.
+var ReloadableEnvs = []string{
+	"DEBUG",
+	"GOCD_AGENT_LABELS",
+	"GOCD_AGENT_RETRY_BUDGET",
+	"GOCD_AGENT_RETRY_BACKOFF",
+	"GOCD_AGENT_RETRY_MAX_BACKOFF",
+	"GOCD_AGENT_REDACTION_POLICY",
+	"GOCD_AGENT_ALLOWED_COMMANDS",
+	"GOCD_AGENT_DENIED_COMMANDS",
+}
+
+// reloadLock guards the Config fields of ReloadableEnvs, which are read
+// by the agent while ReloadConfig may change them.
+var reloadLock sync.RWMutex
+
+type reloadableConfig struct {
+	debug           bool
+	labels          map[string]string
+	retriesPerBuild int
+	retryBackoff    time.Duration
+	retryMaxBackoff time.Duration
+	redactionRules  []*RedactionRule
+	allowedCommands []string
+	deniedCommands  []string
+}
+
+// parseReloadable parses ReloadableEnvs, env returns defaultVal for
+// settings not set like readEnv.
+func parseReloadable(env func(varname string, defaultVal string) string) (*reloadableConfig, error) {
+	var err error
+	r := &reloadableConfig{debug: env("DEBUG", "") != ""}
+	if r.labels, err = ParseLabels(env("GOCD_AGENT_LABELS", "")); err != nil {
+		return nil, Err("GOCD_AGENT_LABELS is invalid: %v", err)
+	}
+	budget := env("GOCD_AGENT_RETRY_BUDGET", "20")
+	if r.retriesPerBuild, err = strconv.Atoi(budget); err != nil || r.retriesPerBuild < 0 {
+		return nil, Err("GOCD_AGENT_RETRY_BUDGET is invalid: %v", budget)
+	}
+	if r.retryBackoff, err = time.ParseDuration(env("GOCD_AGENT_RETRY_BACKOFF", "1s")); err != nil {
+		return nil, Err("GOCD_AGENT_RETRY_BACKOFF is invalid: %v", err)
+	}
+	if r.retryMaxBackoff, err = time.ParseDuration(env("GOCD_AGENT_RETRY_MAX_BACKOFF", "1m")); err != nil {
+		return nil, Err("GOCD_AGENT_RETRY_MAX_BACKOFF is invalid: %v", err)
+	}
+	if policy := env("GOCD_AGENT_REDACTION_POLICY", ""); policy != "" {
+		if r.redactionRules, err = LoadRedactionPolicy(policy); err != nil {
+			return nil, Err("GOCD_AGENT_REDACTION_POLICY is invalid: %v", err)
+		}
+	}
+	if r.allowedCommands, err = parseCommandNames(env("GOCD_AGENT_ALLOWED_COMMANDS", "")); err != nil {
+		return nil, Err("GOCD_AGENT_ALLOWED_COMMANDS is invalid: %v", err)
+	}
+	if r.deniedCommands, err = parseCommandNames(env("GOCD_AGENT_DENIED_COMMANDS", "")); err != nil {
+		return nil, Err("GOCD_AGENT_DENIED_COMMANDS is invalid: %v", err)
+	}
+	return r, nil
+}
+
+// ReloadConfig reloads ReloadableEnvs set in config.ConfigFile, nothing
+// is changed when any of them is invalid. Settings not in the file are
+// read from the environment the agent started with.
+func ReloadConfig() error {
+	if config.ConfigFile == "" {
+		return Err("GOCD_AGENT_CONFIG_FILE is not set")
+	}
+	envs, err := ParseEnvFile(config.ConfigFile)
+	if err != nil {
+		return err
+	}
+	var reloaded []string
+	for _, name := range ReloadableEnvs {
+		if _, ok := envs[name]; ok {
+			reloaded = append(reloaded, name)
+		}
+	}
+	r, err := parseReloadable(func(varname string, defaultVal string) string {
+		value, ok := envs[varname]
+		if !ok {
+			return readEnv(varname, defaultVal)
+		}
+		if value == "" {
+			return defaultVal
+		}
+		return value
+	})
+	if err != nil {
+		return err
+	}
+	reloadLock.Lock()
+	config.OutputDebugLog = r.debug
+	config.Labels = r.labels
+	config.RetriesPerBuild = r.retriesPerBuild
+	config.RetryBackoff = r.retryBackoff
+	config.RetryMaxBackoff = r.retryMaxBackoff
+	config.RedactionRules = r.redactionRules
+	config.AllowedCommands = r.allowedCommands
+	config.DeniedCommands = r.deniedCommands
+	reloadLock.Unlock()
+	setDebugLog(r.debug)
+	LogInfo("reloaded %v from %v", strings.Join(reloaded, ", "), config.ConfigFile)
+	return nil
+}
+
+func (c *Config) labels() map[string]string {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return c.Labels
+}
+
+func (c *Config) retryBackoff() (time.Duration, time.Duration) {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return c.RetryBackoff, c.RetryMaxBackoff
+}
+
+func (c *Config) retryBudget() *RetryBudget {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return NewRetryBudget(c.RetriesPerBuild, c.RetryBackoff, c.RetryMaxBackoff)
+}
+
+func (c *Config) redactionRules() []*RedactionRule {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return c.RedactionRules
+}
+
+// executors are Executors allowed by the command policy, see
+// AllowedCommands.
+func (c *Config) executors() map[protocol.CommandName]Executor {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return commandPolicy(Executors(), c.AllowedCommands, c.DeniedCommands)
+}
+
+func reloadHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := ReloadConfig(); err != nil {
+		logger.Error.Printf("reload config failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(Sprintf("Reloaded config from %v\n", config.ConfigFile)))
+}
+
+// Reload asks the agent running locally to reload its config.
+func Reload(socketFile string, out io.Writer) error {
+	resp, err := adminClient(socketFile).Post("http://agent"+AdminReloadPath, "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return Err("reload config failed: %v", strings.TrimSpace(string(body)))
+	}
+	_, err = out.Write(body)
+	return err
+}
+
+func setDebugLog(debug bool) {
+	if debug {
+		logger.Debug.SetOutput(logger.Info.Writer())
+	} else {
+		logger.Debug.SetOutput(ioutil.Discard)
+	}
+}
+
+// ParseEnvFile parses a shell file of "[export ]NAME=value" lines, like
+// /etc/default/gocd-golang-agent.
+func ParseEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	envs := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, Err("invalid line in %v: %v", path, line)
+		}
+		value := line[i+1:]
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		envs[line[:i]] = value
+	}
+	return envs, scanner.Err()
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bytes"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadConfigFromConfigFile(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	dir, err := ioutil.TempDir("", "config-reload")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "gocd-golang-agent")
+	writeFile(dir, "gocd-golang-agent", `# reloaded on SIGHUP
+export GOCD_SERVER_URL=https://example.com:8154/go
+export GOCD_AGENT_LABELS="zone=b"
+GOCD_AGENT_RETRY_BUDGET=7
+GOCD_AGENT_RETRY_BACKOFF='2s'
+`)
+	conf := GetConfig()
+	defer func(labels map[string]string, retries int, backoff time.Duration) {
+		conf.ConfigFile = ""
+		conf.Labels = labels
+		conf.RetriesPerBuild = retries
+		conf.RetryBackoff = backoff
+	}(conf.Labels, conf.RetriesPerBuild, conf.RetryBackoff)
+	conf.ConfigFile = file
+
+	var out bytes.Buffer
+	assert.Nil(t, Reload(conf.AdminSocketFile, &out))
+	assert.Equal(t, "Reloaded config from "+file+"\n", out.String())
+	assert.Equal(t, map[string]string{"zone": "b"}, conf.Labels)
+	assert.Equal(t, 7, conf.RetriesPerBuild)
+	assert.Equal(t, 2*time.Second, conf.RetryBackoff)
+	// only reloadable settings are changed
+	assert.Equal(t, "localhost", conf.ServerUrl.Hostname())
+
+	assert.Nil(t, os.Remove(file))
+	writeFile(dir, "gocd-golang-agent", "GOCD_AGENT_LABELS=zone=c\nGOCD_AGENT_RETRY_BUDGET=-1\n")
+	err = Reload(conf.AdminSocketFile, &out)
+	assert.NotNil(t, err)
+	assert.Equal(t, "reload config failed: GOCD_AGENT_RETRY_BUDGET is invalid: -1", err.Error())
+	assert.Equal(t, map[string]string{"zone": "b"}, conf.Labels)
+	// the file is not exported to the agent environment
+	assert.Equal(t, "", os.Getenv("GOCD_AGENT_LABELS"))
+}
+
+func TestReloadCommandPolicy(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	dir, err := ioutil.TempDir("", "config-reload")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeFile(dir, "gocd-golang-agent", "GOCD_AGENT_DENIED_COMMANDS=exec, git\n")
+	conf := GetConfig()
+	defer func() {
+		conf.ConfigFile = ""
+		conf.DeniedCommands = nil
+	}()
+	conf.ConfigFile = filepath.Join(dir, "gocd-golang-agent")
+
+	assert.Nil(t, ReloadConfig())
+	assert.Equal(t, []string{"exec", "git"}, conf.DeniedCommands)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.EchoCommand("hello"),
+		protocol.ExecCommand("echo", "abcd"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(log, "Build command exec is denied by the agent command policy"), log)
+
+	assert.Nil(t, os.Remove(conf.ConfigFile))
+	writeFile(dir, "gocd-golang-agent", "GOCD_AGENT_ALLOWED_COMMANDS=echo,rm\n")
+	assert.Equal(t, "GOCD_AGENT_ALLOWED_COMMANDS is invalid: unknown build command rm", ReloadConfig().Error())
+	assert.Equal(t, []string{"exec", "git"}, conf.DeniedCommands)
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// heartbeatWriter tracks when a task last wrote output and whether the
+// output ended a line.
+type heartbeatWriter struct {
+	io.Writer
+	mu         sync.Mutex
+	lastOutput time.Time
+	midLine    bool
+}
+
+func (w *heartbeatWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastOutput = time.Now()
+	if len(p) > 0 {
+		w.midLine = p[len(p)-1] != '\n'
+	}
+	return w.Writer.Write(p)
+}
+
+// beat logs a heartbeat line unless the task is in the middle of a line,
+// which would be broken by it, it returns when the task last wrote output.
+func (w *heartbeatWriter) beat(ctx *BuildContext, lastBeat, now, started time.Time, interval time.Duration) time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.lastOutput.After(lastBeat) {
+		lastBeat = w.lastOutput
+	}
+	if now.Sub(lastBeat) >= interval && !w.midLine {
+		lastBeat = now
+		ctx.ConsoleLog("[go] still running (%v)...\n", formatElapsed(now.Sub(started)))
+	}
+	return lastBeat
+}
+
+// startHeartbeat logs a "still running" console line every interval a
+// task started at started is silent, and stops when stop is closed. The
+// silence starts over whenever the task writes output, so heartbeats are
+// not repeated in between output lines, and a task silent after partial
+// line output gets no heartbeat until it ends the line.
+func startHeartbeat(ctx *BuildContext, w *heartbeatWriter, started time.Time, interval time.Duration, stop chan bool) {
+	w.mu.Lock()
+	w.lastOutput = started
+	w.mu.Unlock()
+	go func() {
+		lastBeat := started
+		tick := time.NewTicker(interval / 4)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-tick.C:
+				lastBeat = w.beat(ctx, lastBeat, now, started, interval)
+			}
+		}
+	}()
+}
+
+// formatElapsed formats d in whole minutes, or seconds under a minute.
+func formatElapsed(d time.Duration) string {
+	if d < time.Minute {
+		return d.Truncate(time.Second).String()
+	}
+	if d < time.Hour {
+		return Sprintf("%dm", int(d/time.Minute))
+	}
+	return Sprintf("%dh%dm", int(d/time.Hour), int(d%time.Hour/time.Minute))
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogHeartbeatWhileExecIsSilent(t *testing.T) {
+	GetConfig().ConsoleHeartbeatInterval = 200 * time.Millisecond
+	defer func() {
+		GetConfig().ConsoleHeartbeatInterval = 0
+	}()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", "echo start; sleep 0.7; echo resumed; sleep 0.1"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	log = trimTimestamp(log)
+	silent := log[strings.Index(log, "start\n"):strings.Index(log, "resumed\n")]
+	assert.True(t, strings.Count(silent, "[go] still running (") >= 2, log)
+	assert.False(t, strings.Contains(log[strings.Index(log, "resumed\n"):], "still running"), log)
+}
+
+func TestNoHeartbeatInTheMiddleOfALine(t *testing.T) {
+	GetConfig().ConsoleHeartbeatInterval = 200 * time.Millisecond
+	defer func() {
+		GetConfig().ConsoleHeartbeatInterval = 0
+	}()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", "printf 'waiting...'; sleep 0.5; echo done; sleep 0.35"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	log = trimTimestamp(log)
+	assert.True(t, strings.Contains(log, "waiting...done\n"), log)
+	assert.True(t, strings.Contains(log, "done\n[go] still running ("), log)
+	assert.True(t, strings.Contains(log, ")...\n"), log)
+}
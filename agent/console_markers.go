@@ -0,0 +1,185 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"io"
+	"strings"
+)
+
+// Go server renders console lines written as "<tag>|<timestamp> <text>"
+// into collapsible sections and annotations. Go server has no tag ending
+// a section, "?0" ends tasks that passed, so sections end with a tag of
+// the agent's own.
+const (
+	ConsoleSectionStartTag = "##"
+	ConsoleSectionEndTag   = "#/"
+	ConsoleAnnotationTag   = "!!"
+)
+
+var consoleTags = []string{ConsoleSectionStartTag, ConsoleSectionEndTag, ConsoleAnnotationTag}
+
+// tagged makes a console line of text tagged by tag, only the agent may
+// write such lines.
+func tagged(tag, text string) string {
+	return string(stream.TagMark) + tag + "|" + text + "\n"
+}
+
+// untaggedWriter drops stream.TagMark from task output, so that a task
+// printing e.g. "##|name" does not start a console section.
+type untaggedWriter struct {
+	io.Writer
+}
+
+func (w untaggedWriter) Write(p []byte) (int, error) {
+	if bytes.IndexByte(p, stream.TagMark) < 0 {
+		return w.Writer.Write(p)
+	}
+	_, err := w.Writer.Write(bytes.Replace(p, []byte{stream.TagMark}, nil, -1))
+	return len(p), err
+}
+
+// markerWriter converts marker lines of task output, e.g. "::group::name"
+// or "::error file=a.go,line=1::message", into tagged console lines.
+// Only lines starting with ':' are held until they end, so Flush must be
+// called when the output is done. It drops stream.TagMark of task output
+// itself, in place of an untaggedWriter it writes to.
+type markerWriter struct {
+	io.Writer
+	line   []byte
+	held   bool
+	bol    bool
+	groups []string
+}
+
+func newMarkerWriter(writer io.Writer) *markerWriter {
+	if untagged, ok := writer.(untaggedWriter); ok {
+		writer = untagged.Writer
+	}
+	return &markerWriter{Writer: writer, bol: true}
+}
+
+func (w *markerWriter) Write(in []byte) (int, error) {
+	var out []byte
+	for _, b := range in {
+		if b == stream.TagMark {
+			continue
+		}
+		if w.bol && b == ':' {
+			w.held = true
+		}
+		w.bol = b == '\n'
+		if !w.held {
+			out = append(out, b)
+			continue
+		}
+		w.line = append(w.line, b)
+		if b == '\n' || len(w.line) >= stream.MaxPendingLineSize {
+			out = w.appendLine(out, w.line)
+			w.line = w.line[:0]
+			w.held = false
+		}
+	}
+	if len(out) > 0 {
+		if _, err := w.Writer.Write(out); err != nil {
+			return len(in), err
+		}
+	}
+	return len(in), nil
+}
+
+// Flush writes out the last line and closes sections left open.
+func (w *markerWriter) Flush() error {
+	out := w.appendLine(nil, w.line)
+	w.line = w.line[:0]
+	w.held = false
+	if len(w.groups) > 0 && (len(out) > 0 && out[len(out)-1] != '\n' || len(out) == 0 && !w.bol) {
+		out = append(out, '\n')
+	}
+	w.bol = true
+	for len(w.groups) > 0 {
+		out = w.appendLine(out, []byte("::endgroup::\n"))
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := w.Writer.Write(out)
+	return err
+}
+
+func (w *markerWriter) appendLine(out, line []byte) []byte {
+	text := strings.TrimRight(string(line), "\r\n")
+	if !strings.HasPrefix(text, "::") {
+		return append(out, line...)
+	}
+	i := strings.Index(text[2:], "::")
+	if i < 0 {
+		return append(out, line...)
+	}
+	command, message := text[2:2+i], text[4+i:]
+	var props string
+	if sp := strings.IndexByte(command, ' '); sp >= 0 {
+		command, props = command[:sp], command[sp+1:]
+	}
+	var marker string
+	switch command {
+	case "group":
+		w.groups = append(w.groups, message)
+		marker = tagged(ConsoleSectionStartTag, message)
+	case "endgroup":
+		if len(w.groups) == 0 {
+			return out
+		}
+		marker = tagged(ConsoleSectionEndTag, w.groups[len(w.groups)-1])
+		w.groups = w.groups[:len(w.groups)-1]
+	case "error", "warning", "notice":
+		marker = tagged(ConsoleAnnotationTag, annotation(command, props, message))
+	default:
+		return append(out, line...)
+	}
+	return append(out, marker...)
+}
+
+// annotation formats a message with properties file, line, col and title
+// as "ERROR file:line:col: title: message"
+func annotation(level, props, message string) string {
+	p := make(map[string]string)
+	for _, prop := range strings.Split(props, ",") {
+		if kv := strings.SplitN(strings.TrimSpace(prop), "=", 2); len(kv) == 2 {
+			p[kv[0]] = kv[1]
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteString(strings.ToUpper(level))
+	if file := p["file"]; file != "" {
+		buf.WriteString(" " + file)
+		for _, k := range []string{"line", "col"} {
+			if p[k] == "" {
+				break
+			}
+			buf.WriteString(":" + p[k])
+		}
+		buf.WriteString(":")
+	}
+	if title := p["title"]; title != "" {
+		buf.WriteString(" " + title + ":")
+	}
+	buf.WriteString(" " + message)
+	return buf.String()
+}
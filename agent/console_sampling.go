@@ -0,0 +1,107 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// DefaultConsoleSamplePattern matches console lines always sent to server
+// when console output is sampled.
+const DefaultConsoleSamplePattern = `(?i)error|warn|fail|exception`
+
+var invalidConsoleLogChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// consoleSampler sends server a sample of console output once it is over
+// config.ConsoleSampleAfter lines, full output is kept in file on agent.
+type consoleSampler struct {
+	*stream.SampleWriter
+	file   *os.File
+	prefix func() []byte
+}
+
+// startConsoleSampling returns nil when full output can't be kept, so that
+// nothing is lost. Notes of sampling are prefixed with prefix like other
+// console lines.
+func startConsoleSampling(w io.Writer, buildId string, prefix func() []byte) *consoleSampler {
+	dir := consoleLogDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		LogInfo("WARN: console output is not sampled, could not create %v: %v", dir, err)
+		return nil
+	}
+	name := invalidConsoleLogChars.ReplaceAllString(buildId, "_") + ".log"
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		LogInfo("WARN: console output is not sampled, could not create full console log: %v", err)
+		return nil
+	}
+	pruneConsoleLogs(dir)
+	sampler := stream.NewSampleWriter(w, config.ConsoleSampleAfter, config.ConsoleSampleEvery, config.ConsoleSamplePattern)
+	sampler.Notice = func() []byte {
+		return consoleNote(prefix, "Console output is over %v lines, only every %vth line and lines matching /%v/ are sent to server from here on, full output is kept in %v on agent %v",
+			config.ConsoleSampleAfter, config.ConsoleSampleEvery, config.ConsoleSamplePattern, file.Name(), config.Hostname)
+	}
+	sampler.Skipped = func(n int) []byte {
+		return consoleNote(prefix, "... %v lines skipped ...", n)
+	}
+	return &consoleSampler{SampleWriter: sampler, file: file, prefix: prefix}
+}
+
+func consoleNote(prefix func() []byte, format string, a ...interface{}) []byte {
+	return append(prefix(), Sprintf("[go] "+format+"\n", a...)...)
+}
+
+// Close writes the partial line left and how many lines were skipped.
+func (c *consoleSampler) Close() {
+	c.Flush()
+	if skipped := c.SkippedLines(); skipped > 0 {
+		c.Writer.Write(consoleNote(c.prefix, "%v console lines were not sent to server, full output is kept in %v on agent %v", skipped, c.file.Name(), config.Hostname))
+	}
+	if err := c.file.Close(); err != nil {
+		LogInfo("WARN: full console log %v may be incomplete: %v", c.file.Name(), err)
+	}
+}
+
+func consoleLogDir() string {
+	if config.LogDir != "" {
+		return filepath.Join(config.LogDir, "consoles")
+	}
+	return filepath.Join(config.WorkingDir, "consoles")
+}
+
+// pruneConsoleLogs keeps full console logs of the latest RecentConsoleLogs
+// builds.
+func pruneConsoleLogs(dir string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+	for i, info := range infos {
+		if i >= RecentConsoleLogs {
+			os.Remove(filepath.Join(dir, info.Name()))
+		}
+	}
+}
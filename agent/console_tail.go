@@ -0,0 +1,61 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"sync"
+)
+
+// ConsoleTail fans out console output to local tail subscribers. Slow
+// subscribers miss output instead of blocking the build.
+type ConsoleTail struct {
+	mu          sync.Mutex
+	subscribers map[chan []byte]bool
+}
+
+var consoleTail = &ConsoleTail{subscribers: make(map[chan []byte]bool)}
+
+func (t *ConsoleTail) Write(data []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.subscribers) == 0 {
+		return len(data), nil
+	}
+	chunk := make([]byte, len(data))
+	copy(chunk, data)
+	for ch := range t.subscribers {
+		select {
+		case ch <- chunk:
+		default:
+		}
+	}
+	return len(data), nil
+}
+
+func (t *ConsoleTail) Subscribe() chan []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ch := make(chan []byte, 1024)
+	t.subscribers[ch] = true
+	return ch
+}
+
+func (t *ConsoleTail) Unsubscribe(ch chan []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.subscribers, ch)
+}
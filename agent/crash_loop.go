@@ -0,0 +1,204 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// MaxCrashLoopErrors is how many errors of the latest restarts go into a
+// crash loop bundle.
+var MaxCrashLoopErrors = 20
+
+type crashLoopError struct {
+	time time.Time
+	err  string
+}
+
+var crashLoop struct {
+	mu        sync.Mutex
+	restarts  []time.Time
+	errors    []crashLoopError
+	detected  bool
+	restartAt time.Time
+}
+
+// CrashLoopDelay returns how long to wait before starting the agent again
+// after Start returned err, given delay of RestartDelay. When the agent
+// restarted more than config.CrashLoopRestarts times within
+// config.CrashLoopWindow, it writes a crash loop bundle once, and slows
+// restarts down to config.CrashLoopRestartInterval until the agent runs
+// for config.CrashLoopWindow without restarting.
+func CrashLoopDelay(err error, delay time.Duration) time.Duration {
+	if config.CrashLoopRestarts == 0 || !isCrash(err) {
+		return delay
+	}
+	crashLoop.mu.Lock()
+	defer crashLoop.mu.Unlock()
+	now := time.Now()
+	if !crashLoop.restartAt.IsZero() && now.Sub(crashLoop.restartAt) > config.CrashLoopWindow {
+		if crashLoop.detected {
+			LogInfo("agent recovered from crash loop")
+		}
+		crashLoop.restarts = nil
+		crashLoop.detected = false
+	}
+	restarts := crashLoop.restarts[:0]
+	for _, t := range crashLoop.restarts {
+		if now.Sub(t) <= config.CrashLoopWindow {
+			restarts = append(restarts, t)
+		}
+	}
+	crashLoop.restarts = append(restarts, now)
+	crashLoop.errors = append(crashLoop.errors, crashLoopError{time: now, err: Sprintf("%v", err)})
+	if over := len(crashLoop.errors) - MaxCrashLoopErrors; over > 0 {
+		crashLoop.errors = crashLoop.errors[over:]
+	}
+
+	if !crashLoop.detected && len(crashLoop.restarts) > config.CrashLoopRestarts {
+		crashLoop.detected = true
+		LogInfo("agent restarted %v times in %v, restart every %v until it recovers",
+			len(crashLoop.restarts), config.CrashLoopWindow, config.CrashLoopRestartInterval)
+		if file, err := writeCrashLoopBundle(crashLoop.errors); err != nil {
+			logger.Error.Printf("write crash loop bundle failed: %v", err)
+		} else {
+			LogInfo("crash loop bundle is written to %v", file)
+		}
+	}
+	if crashLoop.detected && delay < config.CrashLoopRestartInterval {
+		delay = config.CrashLoopRestartInterval
+	}
+	crashLoop.restartAt = now.Add(delay)
+	return delay
+}
+
+// isCrash tells whether Start returned err for something going wrong in
+// the agent, rather than the agent waiting for approval, being paused,
+// reconnecting on purpose, server closing the connection or the network
+// failing, which RestartDelay handles.
+func isCrash(err error) bool {
+	if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false
+	}
+	switch err.(type) {
+	case *PendingApprovalError, *AgentPausedError, *ConnectionExpiredError, *ConnectionClosedError:
+		return false
+	}
+	var netErr net.Error
+	return !errors.As(err, &netErr)
+}
+
+// writeCrashLoopBundle writes errors of the latest restarts, the agent
+// config with secrets redacted, connectivity checks of Go server and the
+// tail of the agent log to a zip file in the log directory.
+func writeCrashLoopBundle(errors []crashLoopError) (string, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	var errorLog bytes.Buffer
+	for _, e := range errors {
+		errorLog.WriteString(Sprintf("%v %v\n", e.time.Format(time.RFC3339), e.err))
+	}
+	if err := zipBytes(zw, "errors.log", errorLog.Bytes()); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(redactedConfig(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := zipBytes(zw, "config.json", data); err != nil {
+		return "", err
+	}
+	if err := zipBytes(zw, "connectivity.log", checkConnectivity()); err != nil {
+		return "", err
+	}
+	if config.LogDir != "" {
+		if err := zipLogTail(zw, "agent.log", filepath.Join(config.LogDir, "gocd-golang-agent.log")); err != nil {
+			return "", err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+
+	dir := config.LogDir
+	if dir == "" {
+		dir = config.WorkingDir
+	}
+	file := filepath.Join(dir, Sprintf("crash-loop-%v.zip", time.Now().Format("20060102150405")))
+	if err := Mkdirs(dir); err != nil {
+		return "", err
+	}
+	return file, ioutil.WriteFile(file, buf.Bytes(), 0600)
+}
+
+// checkConnectivity resolves, dials and requests Go server, and reports
+// how each step went.
+func checkConnectivity() []byte {
+	var out bytes.Buffer
+	check := func(name string, f func() error) {
+		start := time.Now()
+		err := f()
+		result := "ok"
+		if err != nil {
+			result = err.Error()
+		}
+		out.WriteString(Sprintf("%v (%v): %v\n", name, time.Since(start), result))
+	}
+	host, _, _ := net.SplitHostPort(config.ServerHostAndPort)
+	check("resolve "+host, func() error {
+		addrs, err := net.LookupHost(host)
+		if err == nil {
+			out.WriteString(Sprintf("%v resolves to %v\n", host, addrs))
+		}
+		return err
+	})
+	check("dial "+config.ServerHostAndPort, func() error {
+		conn, err := dialServer(config.ServerHostAndPort, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+	check("request "+config.HttpsServerURL(), func() error {
+		client, err := GoServerRemoteClient(false)
+		if err != nil {
+			return err
+		}
+		client.Timeout = ServerURLDialTimeout
+		resp, err := client.Get(config.HttpsServerURL())
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return Err("server responded %v", resp.Status)
+		}
+		return nil
+	})
+	return out.Bytes()
+}
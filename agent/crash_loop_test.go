@@ -0,0 +1,70 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowDownRestartsAndWriteBundleInCrashLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocd-crash-loop")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	conf := GetConfig()
+	defer func(restarts int, window, interval time.Duration, logDir string) {
+		conf.CrashLoopRestarts = restarts
+		conf.CrashLoopWindow = window
+		conf.CrashLoopRestartInterval = interval
+		conf.LogDir = logDir
+	}(conf.CrashLoopRestarts, conf.CrashLoopWindow, conf.CrashLoopRestartInterval, conf.LogDir)
+	conf.CrashLoopRestarts = 2
+	conf.CrashLoopWindow = 200 * time.Millisecond
+	conf.CrashLoopRestartInterval = 50 * time.Millisecond
+	conf.LogDir = dir
+
+	assert.Equal(t, time.Millisecond, CrashLoopDelay(Err("boom 1"), time.Millisecond))
+	assert.Equal(t, time.Millisecond, CrashLoopDelay(&PendingApprovalError{}, time.Millisecond))
+	assert.Equal(t, time.Millisecond, CrashLoopDelay(nil, time.Millisecond))
+	assert.Equal(t, time.Millisecond, CrashLoopDelay(&ConnectionClosedError{}, time.Millisecond))
+	assert.Equal(t, time.Millisecond, CrashLoopDelay(&net.OpError{Op: "dial", Err: Err("connection refused")}, time.Millisecond))
+	assert.Equal(t, time.Millisecond, CrashLoopDelay(Err("boom 2"), time.Millisecond))
+	files, _ := filepath.Glob(filepath.Join(dir, "crash-loop-*.zip"))
+	assert.Equal(t, 0, len(files))
+
+	assert.Equal(t, 50*time.Millisecond, CrashLoopDelay(Err("boom 3"), time.Millisecond))
+	assert.Equal(t, 50*time.Millisecond, CrashLoopDelay(Err("boom 4"), time.Millisecond))
+	files, _ = filepath.Glob(filepath.Join(dir, "crash-loop-*.zip"))
+	assert.Equal(t, 1, len(files))
+	bundle := readZip(files[0])
+	assert.True(t, strings.Contains(bundle["errors.log"], "boom 1\n"))
+	assert.True(t, strings.Contains(bundle["errors.log"], "boom 3\n"))
+	assert.False(t, strings.Contains(bundle["errors.log"], "Pending"))
+	assert.True(t, strings.Contains(bundle["connectivity.log"], "dial "+conf.ServerHostAndPort))
+	assert.True(t, strings.Contains(bundle["config.json"], "\"CrashLoopRestarts\": 2"))
+
+	// the agent ran for longer than the window since the last restart
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, time.Millisecond, CrashLoopDelay(Err("boom 5"), time.Millisecond))
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"regexp"
+	"sync"
+)
+
+// CredentialProvider resolves a secret reference into the secret value,
+// so that secure environment variables can carry references instead of
+// plaintext secrets through GoCD server config.
+type CredentialProvider interface {
+	Resolve(ref string) (string, error)
+}
+
+// secretPlaceholder matches {{SECRET:<provider>:<reference>}}
+var secretPlaceholder = regexp.MustCompile(`\{\{SECRET:([\w-]+):([^}]+)\}\}`)
+
+var (
+	credentialProviders   = make(map[string]CredentialProvider)
+	credentialProvidersMu sync.RWMutex
+)
+
+// RegisterCredentialProvider makes provider available to placeholders
+// naming it, a provider registered with the same name is replaced.
+func RegisterCredentialProvider(name string, provider CredentialProvider) {
+	credentialProvidersMu.Lock()
+	defer credentialProvidersMu.Unlock()
+	if provider == nil {
+		delete(credentialProviders, name)
+	} else {
+		credentialProviders[name] = provider
+	}
+}
+
+func registerDefaultCredentialProviders() {
+	if vault := VaultProviderFromEnv(); vault != nil {
+		RegisterCredentialProvider("vault", vault)
+	}
+	if aws := AWSSecretsManagerProviderFromEnv(); aws != nil {
+		RegisterCredentialProvider("aws", aws)
+	}
+}
+
+// ResolveSecrets replaces secret placeholders in value with secrets
+// from credential providers, resolved secrets are returned as well.
+func ResolveSecrets(value string) (string, []string, error) {
+	var secrets []string
+	var err error
+	resolved := secretPlaceholder.ReplaceAllStringFunc(value, func(placeholder string) string {
+		if err != nil {
+			return placeholder
+		}
+		m := secretPlaceholder.FindStringSubmatch(placeholder)
+		credentialProvidersMu.RLock()
+		provider := credentialProviders[m[1]]
+		credentialProvidersMu.RUnlock()
+		if provider == nil {
+			err = Err("unknown credential provider %v", m[1])
+			return placeholder
+		}
+		secret, e := provider.Resolve(m[2])
+		if e != nil {
+			err = Err("%v could not resolve %v: %v", m[1], m[2], e)
+			return placeholder
+		}
+		secrets = append(secrets, secret)
+		return secret
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return resolved, secrets, nil
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWSSecretsManagerProvider reads secrets from AWS Secrets Manager,
+// reference is "<secret id>" or "<secret id>#<json key>" for secrets
+// stored as JSON objects.
+type AWSSecretsManagerProvider struct {
+	Region          string
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	// Endpoint defaults to https://secretsmanager.<region>.amazonaws.com
+	Endpoint string
+	Client   *http.Client
+}
+
+// AWSSecretsManagerProviderFromEnv configures the provider from the
+// standard AWS environment variables, returns nil when credentials or
+// region are not set.
+func AWSSecretsManagerProviderFromEnv() *AWSSecretsManagerProvider {
+	p := &AWSSecretsManagerProvider{
+		Region:          readEnv("AWS_REGION", os.Getenv("AWS_DEFAULT_REGION")),
+		AccessKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Client:          &http.Client{Timeout: 30 * time.Second},
+	}
+	if p.Region == "" || p.AccessKeyId == "" || p.SecretAccessKey == "" {
+		return nil
+	}
+	return p
+}
+
+func (p *AWSSecretsManagerProvider) Resolve(ref string) (string, error) {
+	id, key := splitSecretRef(ref, "")
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = Sprintf("https://secretsmanager.%v.amazonaws.com", p.Region)
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if p.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.SessionToken)
+	}
+	SignAWSRequest(req, body, p.AccessKeyId, p.SecretAccessKey, p.Region, "secretsmanager", time.Now())
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", Err("secrets manager responded %v", resp.Status)
+	}
+	var secret struct {
+		SecretString string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+	if key == "" {
+		return secret.SecretString, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret.SecretString), &fields); err != nil {
+		return "", Err("secret is not a JSON object: %v", err)
+	}
+	value, ok := fields[key].(string)
+	if !ok {
+		return "", Err("key %v is not found", key)
+	}
+	return value, nil
+}
+
+// SignAWSRequest signs req with AWS Signature Version 4, all headers set
+// on req are signed.
+func SignAWSRequest(req *http.Request, body []byte, accessKeyId, secretAccessKey, region, service string, now time.Time) {
+	signAWSRequest(req, sha256Hex(body), accessKeyId, secretAccessKey, region, service, now)
+}
+
+// signAWSRequest signs req with payloadHash instead of hash of the body,
+// e.g. "UNSIGNED-PAYLOAD" for S3 requests streaming a body.
+func signAWSRequest(req *http.Request, payloadHash, accessKeyId, secretAccessKey, region, service string, now time.Time) {
+	date := now.UTC().Format("20060102T150405Z")
+	scope := strings.Join([]string{date[:8], region, service, "aws4_request"}, "/")
+	req.Header.Set("X-Amz-Date", date)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		date,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{date[:8], region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		accessKeyId, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(values url.Values) string {
+	var params []string
+	for name, vs := range values {
+		for _, v := range vs {
+			params = append(params, awsEscape(name)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func awsEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
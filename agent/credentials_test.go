@@ -0,0 +1,170 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"encoding/json"
+	"errors"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeCredentialProvider map[string]string
+
+func (p fakeCredentialProvider) Resolve(ref string) (string, error) {
+	if secret, ok := p[ref]; ok {
+		return secret, nil
+	}
+	return "", errors.New("not found")
+}
+
+func TestExportSecureEnvironmentVariableWithSecretPlaceholder(t *testing.T) {
+	RegisterCredentialProvider("fake", fakeCredentialProvider{"db#password": "s3cr3t"})
+	defer RegisterCredentialProvider("fake", nil)
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("DB_URL", "postgres://app:{{SECRET:fake:db#password}}@db", "true"),
+		protocol.ExecCommand("bash", "-c", "echo $DB_URL"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := "setting environment variable 'DB_URL' to value '********'\n" +
+		execBanner(GetConfig().WorkingDir, "bash", "-c", "echo $DB_URL") +
+		"postgres://app:********@db\n"
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestFailBuildWhenSecretPlaceholderCanNotBeResolved(t *testing.T) {
+	RegisterCredentialProvider("fake", fakeCredentialProvider{})
+	defer RegisterCredentialProvider("fake", nil)
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("TOKEN", "{{SECRET:fake:token}}", "true"),
+		protocol.ExportCommand("OTHER", "{{SECRET:unknown:token}}", "true").RunIf("any"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := "ERROR: Could not resolve secure environment variable 'TOKEN': fake could not resolve token: not found\n"
+	assert.Equal(t, expected, trimTimestamp(log))
+
+	_, _, err = ResolveSecrets("{{SECRET:unknown:token}}")
+	assert.Equal(t, "unknown credential provider unknown", err.Error())
+}
+
+func TestVaultProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/v1/secret/data/app":
+			w.Write([]byte(`{"data": {"data": {"password": "v2-secret"}, "metadata": {"version": 1}}}`))
+		case "/v1/kv/app":
+			w.Write([]byte(`{"data": {"value": "v1-secret"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	vault := &VaultProvider{Addr: server.URL, Token: "root", Client: server.Client()}
+	secret, err := vault.Resolve("secret/data/app#password")
+	assert.Nil(t, err)
+	assert.Equal(t, "v2-secret", secret)
+	secret, err = vault.Resolve("kv/app")
+	assert.Nil(t, err)
+	assert.Equal(t, "v1-secret", secret)
+	_, err = vault.Resolve("secret/data/app#username")
+	assert.Equal(t, "key username is not found", err.Error())
+	_, err = vault.Resolve("secret/data/missing")
+	assert.Equal(t, "vault responded 404 Not Found", err.Error())
+
+	vault.Token = "wrong"
+	_, err = vault.Resolve("kv/app")
+	assert.Equal(t, "vault responded 403 Forbidden", err.Error())
+}
+
+func TestAWSSecretsManagerProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			!strings.Contains(auth, "/eu-west-1/secretsmanager/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target, Signature=") ||
+			req.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		var input map[string]string
+		json.Unmarshal(body, &input)
+		switch input["SecretId"] {
+		case "prod/db":
+			w.Write([]byte(`{"SecretString": "{\"password\": \"json-secret\"}"}`))
+		case "prod/token":
+			w.Write([]byte(`{"SecretString": "plain-secret"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	aws := &AWSSecretsManagerProvider{
+		Region:          "eu-west-1",
+		AccessKeyId:     "AKID",
+		SecretAccessKey: "secret",
+		SessionToken:    "session",
+		Endpoint:        server.URL,
+		Client:          server.Client(),
+	}
+	secret, err := aws.Resolve("prod/db#password")
+	assert.Nil(t, err)
+	assert.Equal(t, "json-secret", secret)
+	secret, err = aws.Resolve("prod/token")
+	assert.Nil(t, err)
+	assert.Equal(t, "plain-secret", secret)
+	_, err = aws.Resolve("prod/missing")
+	assert.Equal(t, "secrets manager responded 400 Bad Request", err.Error())
+}
+
+func TestSignAWSRequest(t *testing.T) {
+	// example from AWS Signature Version 4 documentation
+	req, _ := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	now, _ := time.Parse("20060102T150405Z", "20150830T123600Z")
+	SignAWSRequest(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "iam", now)
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		req.Header.Get("Authorization"))
+}
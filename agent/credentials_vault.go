@@ -0,0 +1,90 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// VaultProvider reads secrets from HashiCorp Vault key/value engines,
+// reference is "<path>#<key>", e.g. "secret/data/app#password". Key
+// defaults to "value".
+type VaultProvider struct {
+	Addr   string
+	Token  string
+	Client *http.Client
+}
+
+// VaultProviderFromEnv configures a VaultProvider from VAULT_ADDR and
+// VAULT_TOKEN, returns nil when VAULT_ADDR is not set.
+func VaultProviderFromEnv() *VaultProvider {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil
+	}
+	return &VaultProvider{
+		Addr:   addr,
+		Token:  os.Getenv("VAULT_TOKEN"),
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (v *VaultProvider) Resolve(ref string) (string, error) {
+	path, key := splitSecretRef(ref, "value")
+	req, err := http.NewRequest(http.MethodGet, Join("/", v.Addr, "v1", path), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", Err("vault responded %v", resp.Status)
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+	data := secret.Data
+	// kv version 2 nests secret data and metadata under data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	value, ok := data[key].(string)
+	if !ok {
+		return "", Err("key %v is not found", key)
+	}
+	return value, nil
+}
+
+func splitSecretRef(ref, defaultKey string) (string, string) {
+	if i := strings.LastIndex(ref, "#"); i > -1 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, defaultKey
+}
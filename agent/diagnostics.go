@@ -0,0 +1,187 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/bmatcuk/doublestar"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DiagnosticsArtifactName = "diagnostics"
+	dmesgTailLines          = 200
+)
+
+type DiagnosticsCollector func(s *BuildSession, dir string) error
+
+func DiagnosticsCollectors() map[string]DiagnosticsCollector {
+	return map[string]DiagnosticsCollector{
+		"dmesg":  collectDmesg,
+		"docker": collectDockerPs,
+		"cores":  collectCoreDumps,
+	}
+}
+
+func diagnosticsEnabled() bool {
+	return config.DiagnosticsScript != "" || len(config.DiagnosticsCollectors) > 0
+}
+
+// collectDiagnostics runs the configured collectors after the first task
+// failure of a build and uploads whatever they produce as the diagnostics
+// artifact. Collector failures are reported but never change build status.
+func (s *BuildSession) collectDiagnostics() {
+	dir, err := ioutil.TempDir("", "gocd-diagnostics")
+	if err != nil {
+		s.warn("Could not collect diagnostics: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	collectors := DiagnosticsCollectors()
+	for _, name := range config.DiagnosticsCollectors {
+		collect := collectors[name]
+		if collect == nil {
+			s.warn("Unknown diagnostics collector: %v", name)
+			continue
+		}
+		if err := collect(s, dir); err != nil {
+			s.warn("Diagnostics collector %v failed: %v", name, err)
+		}
+	}
+	if config.DiagnosticsScript != "" {
+		if err := runDiagnosticsScript(s, dir); err != nil {
+			s.warn("Diagnostics script %v failed: %v", config.DiagnosticsScript, err)
+		}
+	}
+
+	s.ConsoleLog("Uploading diagnostics to %v\n", DiagnosticsArtifactName)
+	if err := uploadArtifactsAs(s.context(), dir, "", DiagnosticsArtifactName); err != nil {
+		s.warn("Could not upload diagnostics: %v", err)
+	}
+}
+
+func runDiagnosticsScript(s *BuildSession, dir string) error {
+	out, err := os.Create(filepath.Join(dir, "script.log"))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	cmd := exec.Command(config.DiagnosticsScript)
+	cmd.Dir = dir
+	cmd.Env = append(s.Env(), "GO_DIAGNOSTICS_DIR="+dir, "GO_BUILD_WORKING_DIR="+s.wd)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}
+
+func collectDmesg(s *BuildSession, dir string) error {
+	output, err := exec.Command("dmesg").Output()
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(output, []byte{'\n'})
+	if len(lines) > dmesgTailLines {
+		lines = lines[len(lines)-dmesgTailLines:]
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "dmesg.txt"), bytes.Join(lines, []byte{'\n'}), 0644)
+}
+
+func collectDockerPs(s *BuildSession, dir string) error {
+	output, err := exec.Command("docker", "ps", "-a").CombinedOutput()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "docker-ps.txt"), output, 0644)
+}
+
+func collectCoreDumps(s *BuildSession, dir string) error {
+	_, err := collectCores(dir, time.Time{})
+	return err
+}
+
+// collectCores gzips core dumps matching config.DiagnosticsCorePattern and
+// modified since the given time into dir/cores, returns how many it found.
+func collectCores(dir string, since time.Time) (int, error) {
+	matches, err := doublestar.Glob(config.DiagnosticsCorePattern)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, core := range matches {
+		info, err := os.Stat(core)
+		if err != nil || !info.Mode().IsRegular() || info.ModTime().Before(since) {
+			continue
+		}
+		if err := gzipFile(core, filepath.Join(dir, "cores", filepath.Base(core)+".gz")); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// uploadCoreDumps uploads core dumps written since a process of the build
+// started as the diagnostics artifact.
+func (s *BuildSession) uploadCoreDumps(started time.Time) {
+	dir, err := ioutil.TempDir("", "gocd-cores")
+	if err != nil {
+		s.warn("Could not collect core dumps: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// file systems may keep modified time in seconds
+	count, err := collectCores(dir, started.Truncate(time.Second))
+	if err != nil {
+		s.warn("Could not collect core dumps: %v", err)
+	}
+	if count == 0 {
+		return
+	}
+	s.ConsoleLog("Uploading %v core dumps to %v\n", count, DiagnosticsArtifactName)
+	if err := uploadArtifactsAs(s.context(), dir, "", DiagnosticsArtifactName); err != nil {
+		s.warn("Could not upload core dumps: %v", err)
+	}
+}
+
+func gzipFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := Mkdirs(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		return err
+	}
+	return gz.Close()
+}
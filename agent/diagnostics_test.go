@@ -0,0 +1,110 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"compress/gzip"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCollectDiagnosticsOnFailure(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	script := filepath.Join(wd, "collect.sh")
+	err := ioutil.WriteFile(script, []byte("#!/bin/bash\necho \"collected from $GO_BUILD_WORKING_DIR\" > collected.txt\n"), 0755)
+	assert.Nil(t, err)
+	GetConfig().DiagnosticsScript = script
+	defer func() {
+		GetConfig().DiagnosticsScript = ""
+	}()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.FailCommand("boom").Setwd(relativePath(wd)),
+		protocol.FailCommand("boom again").RunIf("failed"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "ERROR: boom\nUploading diagnostics to diagnostics\n", trimTimestamp(log))
+
+	content, err := ioutil.ReadFile(goServer.ArtifactFile(buildId, "diagnostics/collected.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, Sprintf("collected from %v\n", wd), string(content))
+}
+
+func TestShouldNotCollectDiagnosticsWhenBuildPassed(t *testing.T) {
+	GetConfig().DiagnosticsCollectors = []string{"dmesg"}
+	defer func() {
+		GetConfig().DiagnosticsCollectors = nil
+	}()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	_, err := os.Stat(goServer.ArtifactFile(buildId, "diagnostics"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUploadCoreDumpsWhenTaskIsKilledBySignal(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	GetConfig().DiagnosticsCorePattern = filepath.Join(wd, "core*")
+	defer func() {
+		GetConfig().DiagnosticsCorePattern = "/tmp/core*"
+	}()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", "ulimit -c 0; echo dumped > core.42; kill -SEGV $$").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := execBanner(wd, "sh", "-c", "ulimit -c 0; echo dumped > core.42; kill -SEGV $$") +
+		"[go] Task was killed by signal: segmentation fault\n" +
+		"Uploading 1 core dumps to diagnostics\n" +
+		"ERROR: signal: segmentation fault\n"
+	assert.Equal(t, expected, trimTimestamp(log))
+
+	f, err := os.Open(goServer.ArtifactFile(buildId, "diagnostics/cores/core.42.gz"))
+	assert.Nil(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(gz)
+	assert.Nil(t, err)
+	assert.Equal(t, "dumped\n", string(content))
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DurationHistoryLength is how many latest durations of passed builds
+	// of a job are kept
+	DurationHistoryLength = 20
+	// DurationTrendMinBuilds is how many durations of a job are needed
+	// before builds are compared with their median
+	DurationTrendMinBuilds = 3
+	// DurationTrendFactor is how many times of the median duration a
+	// build can take before it is warned
+	DurationTrendFactor = 2
+	// DurationTrendMinimum is how much longer than the median a build
+	// must take to be warned, so that short builds are not warned for
+	// noise
+	DurationTrendMinimum = time.Second
+)
+
+// durationHistory is milliseconds of passed builds per job, oldest
+// first, it is kept in config.DurationHistoryFile.
+type durationHistory map[string][]int64
+
+var durationHistoryMu sync.Mutex
+
+// checkDurationTrend warns when the build passed in more than
+// DurationTrendFactor times the median duration of the latest builds of
+// its job on the agent, and adds its duration to the history.
+func (s *BuildSession) checkDurationTrend(duration time.Duration) {
+	if s.buildStatus != protocol.BuildPassed || s.buildLocator == "" {
+		return
+	}
+	durationHistoryMu.Lock()
+	defer durationHistoryMu.Unlock()
+	history := make(durationHistory)
+	if err := readJSONFile(config.DurationHistoryFile, &history); err != nil {
+		LogInfo("WARN: build duration history %v is ignored: %v", config.DurationHistoryFile, err)
+		history = make(durationHistory)
+	}
+	job := locatorJob(s.buildLocator)
+	durations := history[job]
+	if len(durations) >= DurationTrendMinBuilds {
+		median := medianDuration(durations)
+		if duration > DurationTrendFactor*median && duration-median >= DurationTrendMinimum {
+			s.warn("Build took %v, more than %v times the median %v of the latest %v passed builds of the job on this agent.",
+				duration.Round(time.Second), DurationTrendFactor, median.Round(time.Second), len(durations))
+		}
+	}
+	durations = append(durations, int64(duration/time.Millisecond))
+	if len(durations) > DurationHistoryLength {
+		durations = durations[len(durations)-DurationHistoryLength:]
+	}
+	history[job] = durations
+	if err := writeJSONFile(config.DurationHistoryFile, history); err != nil {
+		LogInfo("WARN: could not write build duration history %v: %v", config.DurationHistoryFile, err)
+	}
+}
+
+func medianDuration(millis []int64) time.Duration {
+	sorted := append([]int64(nil), millis...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	mid := len(sorted) / 2
+	median := sorted[mid]
+	if len(sorted)%2 == 0 {
+		median = (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return time.Duration(median) * time.Millisecond
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"encoding/json"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarnBuildTakingLongerThanTwiceMedianDurationOfJob(t *testing.T) {
+	historyFile := filepath.Join(os.TempDir(), "build-durations-trend.json")
+	defer os.Remove(historyFile)
+	GetConfig().DurationHistoryFile = historyFile
+	defer func() {
+		GetConfig().DurationHistoryFile = filepath.Join(GetConfig().WorkingDir, "build-durations.json")
+	}()
+	setUp(t)
+	defer tearDown()
+
+	job := "builds/" + buildId
+	assert.Nil(t, ioutil.WriteFile(historyFile, []byte(`{"`+job+`": [100, 200, 300]}`), 0644))
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("sleep", "1.2"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	// the build runs longer than stateLog waits
+	time.Sleep(time.Second)
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "WARN: Build took 1s, more than 2 times the median 0s of the latest 3 passed builds of the job on this agent."), log)
+
+	data, err := ioutil.ReadFile(historyFile)
+	assert.Nil(t, err)
+	var history map[string][]int64
+	assert.Nil(t, json.Unmarshal(data, &history))
+	assert.Equal(t, 4, len(history[job]))
+	assert.True(t, history[job][3] >= 1200, history[job])
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of agent events.
+const (
+	EventAgentRegistered   = "agentRegistered"
+	EventAgentConnected    = "agentConnected"
+	EventAgentDisconnected = "agentDisconnected"
+	EventBuildStarted      = "buildStarted"
+	EventBuildFinished     = "buildFinished"
+)
+
+// EventQueueSize is how many events wait for being published, events are
+// dropped when the publisher falls behind.
+const EventQueueSize = 256
+
+// Event is a lifecycle event of the agent.
+type Event struct {
+	Type         string    `json:"type"`
+	AgentId      string    `json:"agentId"`
+	Hostname     string    `json:"hostname"`
+	Time         time.Time `json:"time"`
+	BuildId      string    `json:"buildId,omitempty"`
+	BuildLocator string    `json:"buildLocator,omitempty"`
+	// Result of a finished build
+	Result protocol.BuildStatus `json:"result,omitempty"`
+	// Reason the agent disconnected for
+	Reason string `json:"reason,omitempty"`
+}
+
+// EventPublisher publishes agent events to a message bus.
+type EventPublisher interface {
+	Publish(event *Event) error
+}
+
+var (
+	eventPublisherMu sync.Mutex
+	eventPublisher   EventPublisher
+	events           chan *Event
+)
+
+// SetEventPublisher starts publishing agent events with publisher, nil
+// stops publishing.
+func SetEventPublisher(publisher EventPublisher) {
+	eventPublisherMu.Lock()
+	defer eventPublisherMu.Unlock()
+	if events != nil {
+		close(events)
+		events = nil
+	}
+	eventPublisher = publisher
+	if publisher == nil {
+		return
+	}
+	events = make(chan *Event, EventQueueSize)
+	go func(events chan *Event) {
+		for event := range events {
+			if err := publisher.Publish(event); err != nil {
+				logger.Error.Printf("publish %v event failed: %v", event.Type, err)
+			}
+		}
+	}(events)
+}
+
+// NewEventPublisher makes the publisher of an events URL, either
+// "nats://<host>:<port>/<subject>" for a NATS subject, or the http(s) URL
+// of a topic of a Kafka REST proxy, e.g. "http://<proxy>:8082/topics/<topic>".
+func NewEventPublisher(eventsURL string) (EventPublisher, error) {
+	u, err := url.Parse(eventsURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "nats":
+		subject := strings.TrimPrefix(u.Path, "/")
+		if subject == "" {
+			return nil, Err("NATS subject is missing in %v", SanitizeURL(u))
+		}
+		return &NATSPublisher{URL: u, Subject: subject}, nil
+	case "http", "https":
+		return &KafkaRESTPublisher{URL: eventsURL, Client: &http.Client{Timeout: 30 * time.Second}}, nil
+	}
+	return nil, Err("unsupported events URL %v", SanitizeURL(u))
+}
+
+func publishEvent(event *Event) {
+	eventPublisherMu.Lock()
+	defer eventPublisherMu.Unlock()
+	if events == nil {
+		return
+	}
+	event.AgentId = AgentId
+	event.Hostname = config.Hostname
+	event.Time = time.Now()
+	select {
+	case events <- event:
+	default:
+		incCounter(droppedEvents)
+	}
+}
+
+// NATSPublisher publishes events as JSON to Subject of the NATS server at
+// URL, user info of URL is sent as user and password.
+type NATSPublisher struct {
+	URL     *url.URL
+	Subject string
+
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Publish waits for the server to answer a PING after the message, so
+// that an event is not lost on a connection the server dropped.
+func (p *NATSPublisher) Publish(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	err = p.publish(data)
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
+
+func (p *NATSPublisher) connect() error {
+	host := p.URL.Host
+	if p.URL.Port() == "" {
+		host = net.JoinHostPort(p.URL.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "gocd-golang-agent"}
+	if user := p.URL.User; user != nil {
+		options["user"] = user.Username()
+		options["pass"], _ = user.Password()
+	}
+	connect, _ := json.Marshal(options)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	// server greets with INFO
+	if _, err := r.ReadString('\n'); err != nil {
+		conn.Close()
+		return err
+	}
+	if _, err := conn.Write([]byte("CONNECT " + string(connect) + "\r\n")); err != nil {
+		conn.Close()
+		return err
+	}
+	p.conn, p.r = conn, r
+	return nil
+}
+
+func (p *NATSPublisher) publish(data []byte) error {
+	p.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var buf bytes.Buffer
+	buf.WriteString(Sprintf("PUB %v %v\r\n", p.Subject, len(data)))
+	buf.Write(data)
+	buf.WriteString("\r\nPING\r\n")
+	if _, err := p.conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return Err("NATS server error: %v", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// KafkaRESTPublisher produces events as JSON records keyed by agent id to
+// the topic URL of a Kafka REST proxy.
+type KafkaRESTPublisher struct {
+	URL    string
+	Client *http.Client
+}
+
+func (p *KafkaRESTPublisher) Publish(event *Event) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"records": []map[string]interface{}{{"key": event.AgentId, "value": event}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := p.Client.Post(p.URL, "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return SanitizeError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return Err("Kafka REST proxy responded %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bufio"
+	"encoding/json"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type eventRecorder chan *Event
+
+func (r eventRecorder) Publish(event *Event) error {
+	r <- event
+	return nil
+}
+
+func (r eventRecorder) next(t *testing.T) *Event {
+	select {
+	case event := <-r:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("wait for event timeout")
+		return nil
+	}
+}
+
+func TestPublishAgentEvents(t *testing.T) {
+	events := make(eventRecorder, 10)
+	SetEventPublisher(events)
+	defer SetEventPublisher(nil)
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	// registration is cleaned when the previous test stopped the agent
+	event := events.next(t)
+	assert.Equal(t, EventAgentRegistered, event.Type)
+	assert.Equal(t, AgentId, event.AgentId)
+	event = events.next(t)
+	assert.Equal(t, EventAgentConnected, event.Type)
+	event = events.next(t)
+	assert.Equal(t, EventBuildStarted, event.Type)
+	assert.Equal(t, buildId, event.BuildId)
+	event = events.next(t)
+	assert.Equal(t, EventBuildFinished, event.Type)
+	assert.Equal(t, buildId, event.BuildId)
+	assert.Equal(t, protocol.BuildPassed, event.Result)
+}
+
+func TestNATSPublisher(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	published := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch fields[0] {
+			case "PUB":
+				size, _ := strconv.Atoi(fields[2])
+				payload := make([]byte, size+2)
+				io.ReadFull(r, payload)
+				published <- fields[1] + " " + string(payload[:size])
+			case "PING":
+				conn.Write([]byte("PONG\r\n"))
+			}
+		}
+	}()
+
+	u, err := url.Parse("nats://" + listener.Addr().String() + "/gocd.agents")
+	assert.Nil(t, err)
+	publisher := &NATSPublisher{URL: u, Subject: "gocd.agents"}
+	err = publisher.Publish(&Event{Type: EventAgentConnected, AgentId: "agent-1"})
+	assert.Nil(t, err)
+
+	msg := <-published
+	assert.True(t, strings.HasPrefix(msg, "gocd.agents {"))
+	var event Event
+	assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(msg, "gocd.agents ")), &event))
+	assert.Equal(t, EventAgentConnected, event.Type)
+	assert.Equal(t, "agent-1", event.AgentId)
+}
+
+func TestKafkaRESTPublisher(t *testing.T) {
+	var contentType string
+	var body struct {
+		Records []struct {
+			Key   string
+			Value Event
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		contentType = req.Header.Get("Content-Type")
+		json.NewDecoder(req.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	publisher, err := NewEventPublisher(server.URL + "/topics/gocd-agents")
+	assert.Nil(t, err)
+	err = publisher.Publish(&Event{Type: EventBuildFinished, AgentId: "agent-1", Result: "Passed"})
+	assert.Nil(t, err)
+	assert.Equal(t, "application/vnd.kafka.json.v2+json", contentType)
+	assert.Equal(t, 1, len(body.Records))
+	assert.Equal(t, "agent-1", body.Records[0].Key)
+	assert.Equal(t, protocol.BuildPassed, body.Records[0].Value.Result)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"encoding/json"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/server"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// goldenBuild is a build command stream in the json Go server sends, with
+// the console output and artifacts recorded from this agent running it.
+// It catches regressions of the agent, not incompatibilities with the
+// Java agent, which it is not captured from. In the command, console and
+// artifacts, ${PIPELINE_DIR} is the pipeline directory relative to the
+// agent working directory, and ${WORKING_DIR} the agent working
+// directory.
+type goldenBuild struct {
+	Description string
+	// ServerVersion is reported by the test server, the agent only
+	// checks it is supported, commands are run the same for any version
+	ServerVersion string
+	// Files are created in the pipeline directory before the build
+	Files     map[string]string
+	Command   json.RawMessage
+	Result    string
+	Console   []string
+	Artifacts map[string]string
+}
+
+func TestBuildCommandRegressions(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "golden", "*.json"))
+	assert.Nil(t, err)
+	assert.True(t, len(files) > 0, "no golden builds")
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		t.Run(name, func(t *testing.T) {
+			runGoldenBuild(t, "Golden_"+name, file)
+		})
+	}
+}
+
+func runGoldenBuild(t *testing.T, id, file string) {
+	data, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	var golden goldenBuild
+	assert.Nil(t, json.Unmarshal(data, &golden))
+
+	goServer.SetVersion(golden.ServerVersion)
+	defer goServer.SetVersion(server.Version)
+	setUpBuild(t, id)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	expand := strings.NewReplacer(
+		"${PIPELINE_DIR}", relativePath(wd),
+		"${WORKING_DIR}", GetConfig().WorkingDir,
+	).Replace
+	for path, content := range golden.Files {
+		assert.Nil(t, writeFile(filepath.Join(wd, filepath.Dir(path)), filepath.Base(path), content))
+	}
+	var command protocol.BuildCommand
+	assert.Nil(t, json.Unmarshal([]byte(expand(string(golden.Command))), &command))
+
+	goServer.SendBuild(AgentId, buildId, &command)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build "+golden.Result, stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	var console string
+	for _, line := range golden.Console {
+		console += expand(line) + "\n"
+	}
+	assert.Equal(t, console, trimTimestamp(log))
+
+	artifacts := goldenArtifacts(t, goServer.ArtifactFile(buildId, ""))
+	expected := make(map[string]string)
+	for path, content := range golden.Artifacts {
+		expected[path] = expand(content)
+	}
+	assert.Equal(t, sortedKeys(expected), sortedKeys(artifacts))
+	for path, content := range expected {
+		assert.Equal(t, content, artifacts[path], path)
+	}
+}
+
+// goldenArtifacts is content of artifact files of a build by their
+// slash separated paths.
+func goldenArtifacts(t *testing.T, dir string) map[string]string {
+	artifacts := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == dir {
+			return filepath.SkipDir
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		artifacts[filepath.ToSlash(rel)] = string(content)
+		return err
+	})
+	assert.Nil(t, err)
+	return artifacts
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
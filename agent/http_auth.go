@@ -0,0 +1,136 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Values of Config.HttpAuth, how the agent authenticates its requests to
+// Go server.
+const (
+	HttpAuthCert   = "cert"
+	HttpAuthCookie = "cookie"
+	HttpAuthToken  = "token"
+)
+
+// AgentCookieName is the name of the cookie HttpAuthCookie sends
+const AgentCookieName = "agentCookie"
+
+// HttpAuth authenticates connections and requests of the agent to Go
+// server, the websocket connection as well as console, artifact and
+// property requests.
+type HttpAuth interface {
+	// ConfigureTLS sets up client certificates of server connections
+	ConfigureTLS(c *tls.Config)
+	// Authenticate sets credentials in header of a request to server
+	Authenticate(header http.Header)
+}
+
+var (
+	httpAuthMu sync.Mutex
+	httpAuth   HttpAuth
+)
+
+// NewHttpAuth makes the HttpAuth of a Config.HttpAuth value, credentials
+// are read from the files registration writes into the config directory.
+func NewHttpAuth(name string) (HttpAuth, error) {
+	switch name {
+	case HttpAuthCert:
+		cert, err := tls.LoadX509KeyPair(config.AgentCertFile, config.AgentPrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &clientCertAuth{cert: cert}, nil
+	case HttpAuthCookie:
+		return &cookieAuth{}, nil
+	case HttpAuthToken:
+		token, err := ioutil.ReadFile(config.AgentTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return &bearerTokenAuth{token: strings.TrimSpace(string(token))}, nil
+	}
+	return nil, Err("unknown http auth %v", name)
+}
+
+// AgentHttpAuth returns the HttpAuth set up by the last registration, or
+// makes one of config.HttpAuth when the agent has not registered.
+func AgentHttpAuth() (HttpAuth, error) {
+	httpAuthMu.Lock()
+	defer httpAuthMu.Unlock()
+	if httpAuth != nil {
+		return httpAuth, nil
+	}
+	return NewHttpAuth(config.HttpAuth)
+}
+
+func setHttpAuth(auth HttpAuth) {
+	httpAuthMu.Lock()
+	defer httpAuthMu.Unlock()
+	httpAuth = auth
+}
+
+type clientCertAuth struct {
+	cert tls.Certificate
+}
+
+func (a *clientCertAuth) ConfigureTLS(c *tls.Config) {
+	c.Certificates = append(c.Certificates, a.cert)
+}
+
+func (a *clientCertAuth) Authenticate(header http.Header) {}
+
+// cookieAuth sends the cookie server set with setCookie
+type cookieAuth struct{}
+
+func (a *cookieAuth) ConfigureTLS(c *tls.Config) {}
+
+func (a *cookieAuth) Authenticate(header http.Header) {
+	if cookie := GetState("cookie"); cookie != "" {
+		header.Set("Cookie", (&http.Cookie{Name: AgentCookieName, Value: cookie}).String())
+	}
+}
+
+type bearerTokenAuth struct {
+	token string
+}
+
+func (a *bearerTokenAuth) ConfigureTLS(c *tls.Config) {}
+
+func (a *bearerTokenAuth) Authenticate(header http.Header) {
+	header.Set("Authorization", "Bearer "+a.token)
+}
+
+// authTransport authenticates requests to Go server host only, so that
+// credentials are not sent to artifact stores server redirects to.
+type authTransport struct {
+	auth HttpAuth
+	base http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == config.ServerUrl.Host {
+		req = req.Clone(req.Context())
+		t.auth.Authenticate(req.Header)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestAuthenticateServerRequestsWithConfiguredHttpAuth(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	headers := make(chan http.Header, 1)
+	goServer.HandleFunc("/auth-test", func(w http.ResponseWriter, req *http.Request) {
+		headers <- req.Header
+	})
+	requestHeader := func() http.Header {
+		client, err := GoServerRemoteClient(true)
+		assert.Nil(t, err)
+		resp, err := client.Get(goServerUrl + "/auth-test")
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return <-headers
+	}
+	defer func() {
+		GetConfig().HttpAuth = HttpAuthCert
+		assert.Nil(t, Register())
+	}()
+
+	assert.Nil(t, ioutil.WriteFile(GetConfig().AgentTokenFile, []byte("secret-token\n"), 0600))
+	defer os.Remove(GetConfig().AgentTokenFile)
+	GetConfig().HttpAuth = HttpAuthToken
+	assert.Nil(t, Register())
+	header := requestHeader()
+	assert.Equal(t, "Bearer secret-token", header.Get("Authorization"))
+	assert.Equal(t, "", header.Get("Cookie"))
+
+	waitFor(t, func() bool { return GetState("cookie") != "" })
+	GetConfig().HttpAuth = HttpAuthCookie
+	assert.Nil(t, Register())
+	header = requestHeader()
+	assert.Equal(t, AgentCookieName+"="+GetState("cookie"), header.Get("Cookie"))
+	assert.Equal(t, "", header.Get("Authorization"))
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// JobBadge is the status of the latest build of a job on the agent, for
+// wallboards and dashboards outside of Go server.
+type JobBadge struct {
+	Pipeline     string               `json:"pipeline,omitempty"`
+	Stage        string               `json:"stage,omitempty"`
+	Job          string               `json:"job,omitempty"`
+	BuildLocator string               `json:"buildLocator"`
+	Result       protocol.BuildStatus `json:"result"`
+	// Duration of the build in milliseconds
+	Duration    int64     `json:"duration"`
+	Url         string    `json:"url"`
+	AgentId     string    `json:"agentId"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+var badgeClient = &http.Client{Timeout: 30 * time.Second}
+
+// newJobBadge makes badge of the build at locator, pipeline, stage and job
+// are left out of locators not in "pipeline/counter/stage/counter/job"
+// format.
+func newJobBadge(locator string, result protocol.BuildStatus, duration time.Duration) *JobBadge {
+	locator = strings.Trim(locator, "/")
+	badge := &JobBadge{
+		BuildLocator: locator,
+		Result:       result,
+		Duration:     int64(duration / time.Millisecond),
+		Url:          Join("/", config.HttpsServerURL(), "tab/build/detail", locator),
+		AgentId:      AgentId,
+		CompletedAt:  time.Now(),
+	}
+	if parts := strings.Split(locator, "/"); len(parts) == 5 {
+		badge.Pipeline, badge.Stage, badge.Job = parts[0], parts[2], parts[4]
+	}
+	return badge
+}
+
+// dropJobBadge writes badge of the completed build into
+// config.BadgeDir as "<pipeline>/<stage>/<job>.json", and posts it to
+// config.BadgeURL in background. Failures are logged only, they don't
+// fail the build.
+func (s *BuildSession) dropJobBadge(duration time.Duration) {
+	if s.buildLocator == "" || (config.BadgeDir == "" && config.BadgeURL == "") {
+		return
+	}
+	badge := newJobBadge(s.buildLocator, s.buildStatus, duration)
+	if config.BadgeDir != "" {
+		file := filepath.Join(config.BadgeDir, filepath.FromSlash(locatorJob(s.buildLocator))+".json")
+		if err := writeJSONFile(file, badge); err != nil {
+			LogInfo("WARN: could not write job badge %v: %v", file, err)
+		}
+	}
+	if config.BadgeURL != "" {
+		go func(url string) {
+			if err := postJobBadge(url, badge); err != nil {
+				LogInfo("WARN: post job badge to %v failed: %v", SanitizeURLString(url), err)
+			}
+		}(config.BadgeURL)
+	}
+}
+
+func postJobBadge(url string, badge *JobBadge) error {
+	body, err := json.Marshal(badge)
+	if err != nil {
+		return err
+	}
+	resp, err := badgeClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return SanitizeError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return Err("dashboard responded %v", resp.Status)
+	}
+	return nil
+}
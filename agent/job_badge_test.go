@@ -0,0 +1,79 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"encoding/json"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDropJobBadgeOfCompletedBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badges")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	posted := make(chan *JobBadge, 1)
+	dashboard := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var badge JobBadge
+		if err := json.NewDecoder(r.Body).Decode(&badge); err == nil && r.Method == "POST" {
+			posted <- &badge
+		}
+	}))
+	defer dashboard.Close()
+	GetConfig().BadgeDir = dir
+	GetConfig().BadgeURL = dashboard.URL + "/badges"
+	defer func() {
+		GetConfig().BadgeDir = ""
+		GetConfig().BadgeURL = ""
+	}()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("false"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	file := filepath.Join(dir, "builds", buildId+".json")
+	waitFor(t, func() bool {
+		_, err := os.Stat(file)
+		return err == nil
+	})
+	data, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	var badge JobBadge
+	assert.Nil(t, json.Unmarshal(data, &badge))
+	assert.Equal(t, "builds/"+buildId, badge.BuildLocator)
+	assert.Equal(t, protocol.BuildFailed, badge.Result)
+	assert.Equal(t, GetConfig().HttpsServerURL()+"/tab/build/detail/builds/"+buildId, badge.Url)
+	assert.Equal(t, AgentId, badge.AgentId)
+
+	select {
+	case p := <-posted:
+		assert.Equal(t, badge, *p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("job badge is not posted")
+	}
+}
@@ -0,0 +1,73 @@
+// +build !linux,!windows
+
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// jobProcesses only tracks processes of jobs on Linux, elsewhere exec
+// commands start process groups of their own, which are killed when
+// they are canceled.
+type jobProcesses struct{}
+
+func newJobProcesses(buildId string) *jobProcesses {
+	return &jobProcesses{}
+}
+
+func (j *jobProcesses) prepare(cmd *exec.Cmd) func() error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	return nil
+}
+
+func (j *jobProcesses) track(pid int) {}
+
+// terminate sends SIGTERM to the process group of the process.
+func (j *jobProcesses) terminate(p *os.Process) error {
+	if err := syscall.Kill(-p.Pid, syscall.SIGTERM); err != nil {
+		return p.Signal(syscall.SIGTERM)
+	}
+	return nil
+}
+
+// killTree kills the process group of the process.
+func (j *jobProcesses) killTree(p *os.Process) error {
+	if err := syscall.Kill(-p.Pid, syscall.SIGKILL); err != nil {
+		if err := p.Kill(); err != os.ErrProcessDone {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *jobProcesses) killAll() int {
+	return 0
+}
+
+func (j *jobProcesses) recordUsage(state *os.ProcessState) {}
+
+func (j *jobProcesses) resourceUsage() *protocol.ResourceUsage {
+	return nil
+}
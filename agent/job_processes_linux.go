@@ -0,0 +1,323 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// jobProcesses tracks processes of a job, exec commands start process
+// groups of their own and in the job's cgroup under Config.JobCgroup when
+// it is set, so that processes left running, even daemons leaving the
+// group, are killed when the job ends.
+type jobProcesses struct {
+	mu     sync.Mutex
+	groups map[int]bool
+	cgroup string
+	// cgroupDir is the open cgroup of cgroup v2 that processes are
+	// cloned into
+	cgroupDir *os.File
+	usage     *protocol.ResourceUsage
+}
+
+func newJobProcesses(buildId string) *jobProcesses {
+	j := &jobProcesses{groups: make(map[int]bool)}
+	if config.JobCgroup == "" {
+		return j
+	}
+	cgroup := filepath.Join(config.JobCgroup, "job-"+strings.Replace(buildId, "/", "_", -1))
+	if err := os.MkdirAll(cgroup, 0755); err != nil {
+		LogInfo("WARN: could not create cgroup of job, only its process groups are tracked: %v", err)
+		return j
+	}
+	j.cgroup = cgroup
+	if _, err := os.Stat(filepath.Join(cgroup, "cgroup.controllers")); err == nil {
+		if j.cgroupDir, err = os.Open(cgroup); err != nil {
+			LogInfo("WARN: could not open cgroup of job: %v", err)
+		}
+	}
+	return j
+}
+
+// prepare makes cmd start a process group of its own in the job's cgroup,
+// the returned setup is run on the locked OS thread starting cmd, nil when
+// there is nothing to set up. Processes never run outside of the cgroup,
+// so that they cannot fork out of it before they are moved in.
+func (j *jobProcesses) prepare(cmd *exec.Cmd) func() error {
+	if j == nil {
+		return nil
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if j.cgroupDir != nil {
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(j.cgroupDir.Fd())
+		return nil
+	}
+	if j.cgroup == "" {
+		return nil
+	}
+	// cgroup v1 has threads in cgroups, children of the thread start in it
+	return func() error {
+		tasks := filepath.Join(j.cgroup, "tasks")
+		if err := ioutil.WriteFile(tasks, []byte(strconv.Itoa(syscall.Gettid())), 0644); err != nil {
+			return Err("Could not start process in cgroup %v: %v", j.cgroup, err)
+		}
+		return nil
+	}
+}
+
+// track adds the process group of the started process to the job.
+func (j *jobProcesses) track(pid int) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.groups[pid] = true
+}
+
+// killTree kills the process started by the job, with its descendants
+// in its process group, e.g. background jobs and pipelines started by a
+// shell, and waits until they are gone.
+func (j *jobProcesses) killTree(p *os.Process) error {
+	err := p.Kill()
+	if j == nil {
+		return err
+	}
+	if err != nil && err != os.ErrProcessDone {
+		return err
+	}
+	group := map[int]bool{p.Pid: true}
+	var pids []int
+	for i := 0; i < 100; i++ {
+		// exec commands lead process groups of their pids
+		syscall.Kill(-p.Pid, syscall.SIGKILL)
+		if pids = groupProcesses(group); len(pids) == 0 {
+			return nil
+		}
+		for _, pid := range pids {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return Err("processes %v are still running", pids)
+}
+
+// terminate sends SIGTERM to the process started by the job, and to its
+// descendants in its process group.
+func (j *jobProcesses) terminate(p *os.Process) error {
+	if err := p.Signal(syscall.SIGTERM); err != nil || j == nil {
+		return err
+	}
+	syscall.Kill(-p.Pid, syscall.SIGTERM)
+	return nil
+}
+
+// killAll kills processes left in process groups and the cgroup of the job,
+// removes the cgroup and returns how many processes were killed.
+func (j *jobProcesses) killAll() int {
+	if j == nil {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	killed := make(map[int]bool)
+	for i := 0; i < 50; i++ {
+		pids := groupProcesses(j.groups)
+		if j.cgroup != "" {
+			pids = append(pids, cgroupProcesses(j.cgroup)...)
+		}
+		if len(pids) == 0 {
+			break
+		}
+		for _, pid := range pids {
+			if err := syscall.Kill(pid, syscall.SIGKILL); err == nil {
+				killed[pid] = true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if j.cgroupDir != nil {
+		j.cgroupDir.Close()
+		if j.usage != nil {
+			cgroupUsage(j.cgroup, j.usage)
+		}
+	}
+	if j.cgroup != "" {
+		// cgroup is busy until zombies are reaped by their parents
+		for i := 0; ; i++ {
+			err := os.Remove(j.cgroup)
+			if err == nil {
+				break
+			}
+			if i == 50 {
+				LogInfo("WARN: could not remove cgroup of job: %v", err)
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return len(killed)
+}
+
+// recordUsage adds resources used by the exited process, and by its
+// children it waited for, to the job.
+func (j *jobProcesses) recordUsage(state *os.ProcessState) {
+	if j == nil || state == nil {
+		return
+	}
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.usage == nil {
+		j.usage = &protocol.ResourceUsage{}
+	}
+	j.usage.CPUSeconds += time.Duration(rusage.Utime.Nano() + rusage.Stime.Nano()).Seconds()
+	// in kilobytes on Linux
+	if rss := int64(rusage.Maxrss) * 1024; rss > j.usage.PeakRSS {
+		j.usage.PeakRSS = rss
+	}
+	j.usage.ReadBytes += int64(rusage.Inblock) * 512
+	j.usage.WriteBytes += int64(rusage.Oublock) * 512
+	j.usage.Processes++
+}
+
+// resourceUsage returns resources used by processes of the job, nil when
+// it ran none.
+func (j *jobProcesses) resourceUsage() *protocol.ResourceUsage {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.usage == nil {
+		return nil
+	}
+	usage := *j.usage
+	return &usage
+}
+
+// cgroupUsage replaces usage by stats of cgroup v2, which count all
+// processes of the job, including ones left running and killed. Stats
+// of controllers not enabled for the cgroup are left as they are.
+func cgroupUsage(cgroup string, usage *protocol.ResourceUsage) {
+	if stat := readCgroupStats(filepath.Join(cgroup, "cpu.stat")); stat["usage_usec"] > 0 {
+		usage.CPUSeconds = float64(stat["usage_usec"]) / 1e6
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(cgroup, "memory.peak")); err == nil {
+		if peak, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil {
+			usage.PeakRSS = peak
+		}
+	}
+	if stat := readCgroupStats(filepath.Join(cgroup, "io.stat")); len(stat) > 0 {
+		usage.ReadBytes = stat["rbytes"]
+		usage.WriteBytes = stat["wbytes"]
+	}
+}
+
+// readCgroupStats sums "key value" and "device key=value..." stats of a
+// cgroup file by key.
+func readCgroupStats(file string) map[string]int64 {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	stats := make(map[string]int64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && !strings.Contains(fields[1], "=") {
+			fields = []string{fields[0] + "=" + fields[1]}
+		}
+		for _, field := range fields {
+			if kv := strings.SplitN(field, "=", 2); len(kv) == 2 {
+				if v, err := strconv.ParseInt(kv[1], 10, 64); err == nil {
+					stats[kv[0]] += v
+				}
+			}
+		}
+	}
+	return stats
+}
+
+// cgroupProcesses finds live processes in cgroup, zombies are left to
+// their parents.
+func cgroupProcesses(cgroup string) []int {
+	data, err := ioutil.ReadFile(filepath.Join(cgroup, "cgroup.procs"))
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, line := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			continue
+		}
+		if fields := processStat(pid); len(fields) > 0 && fields[0] != "Z" {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// groupProcesses finds live processes in process groups from /proc.
+func groupProcesses(groups map[int]bool) []int {
+	var pids []int
+	if len(groups) == 0 {
+		return pids
+	}
+	dirs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		fields := processStat(pid)
+		if len(fields) < 3 || fields[0] == "Z" {
+			continue
+		}
+		if pgrp, _ := strconv.Atoi(fields[2]); groups[pgrp] {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// processStat returns fields of /proc/<pid>/stat after the command in
+// parentheses, which starts with state ppid pgrp session.
+func processStat(pid int) []string {
+	data, err := ioutil.ReadFile(Sprintf("/proc/%v/stat", pid))
+	if err != nil {
+		return nil
+	}
+	s := string(data)
+	return strings.Fields(s[strings.LastIndex(s, ")")+1:])
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKillProcessesLeftInJobProcessGroup(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	testKillProcessesLeftByJob(t, "sleep 30 > /dev/null 2>&1 & echo $!")
+}
+
+func TestKillDaemonsLeftInJobCgroup(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("cgroup needs root")
+	}
+	if _, err := os.Stat("/sys/fs/cgroup/pids/cgroup.procs"); err != nil {
+		t.Skip("cgroup v1 pids hierarchy is not available")
+	}
+	cgroup, err := ioutil.TempDir("/sys/fs/cgroup/pids", "gocd-golang-agent")
+	assert.Nil(t, err)
+	GetConfig().JobCgroup = cgroup
+	defer func() {
+		GetConfig().JobCgroup = ""
+		os.Remove(cgroup)
+	}()
+	setUp(t)
+	defer tearDown()
+	testKillProcessesLeftByJob(t, "setsid sleep 30 > /dev/null 2>&1 & echo $!")
+}
+
+func testKillProcessesLeftByJob(t *testing.T, script string) {
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("sh", "-c", script))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	lines := strings.Split(trimTimestamp(log), "\n")
+	assert.Equal(t, execBanner(GetConfig().WorkingDir, "sh", "-c", script), lines[0]+"\n")
+	assert.Equal(t, "WARN: Killed 1 processes left running by the job.", lines[2])
+	waitFor(t, func() bool {
+		stat, err := ioutil.ReadFile("/proc/" + lines[1] + "/stat")
+		return err != nil || strings.Contains(string(stat), ") Z ")
+	})
+}
+
+func TestReportResourceUsageOfJobProcesses(t *testing.T) {
+	GetConfig().ResourceUsageSummary = true
+	defer func() {
+		GetConfig().ResourceUsageSummary = false
+	}()
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", "head -c 1000000 /dev/urandom | md5sum"),
+		protocol.ExecCommand("true"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	usage := goServer.CompletedReport(buildId).ResourceUsage
+	assert.NotNil(t, usage)
+	assert.Equal(t, 2, usage.Processes)
+	assert.True(t, usage.PeakRSS > 0)
+	assert.True(t, usage.CPUSeconds >= 0)
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "[go] Resource usage of 2 processes: "))
+}
+
+func TestKillProcessTreeOfCanceledCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocd-process-tree")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "sleep.pid")
+
+	setUp(t)
+	defer tearDown()
+	// killed processes may be zombies until init reaps them
+	alive := "state=$(cut -d' ' -f3 /proc/$(cat " + pidFile + ")/stat 2>/dev/null); " +
+		"[ -n \"$state\" ] && [ \"$state\" != Z ] && echo alive || echo gone"
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", "sleep 30 & echo $! > "+pidFile+"; wait").SetOnCancel(
+			protocol.ExecCommand("sh", "-c", alive)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	waitFor(t, func() bool {
+		data, _ := ioutil.ReadFile(pidFile)
+		return strings.HasSuffix(string(data), "\n")
+	})
+
+	goServer.Send(AgentId, protocol.CancelMessage())
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(trimTimestamp(log), "gone\n"))
+}
+
+func TestTerminateCanceledCommandGracefully(t *testing.T) {
+	GetConfig().CancelGracePeriod = 5 * time.Second
+	defer func() {
+		GetConfig().CancelGracePeriod = 0
+	}()
+	log := cancelTaskAfterStarted(t, "trap 'echo cleaning up; exit 1' TERM; ")
+	assert.True(t, strings.Contains(log, "cleaning up\n[go] Task stopped in "))
+	assert.True(t, strings.Contains(log, " after SIGTERM.\n"))
+}
+
+func TestKillCanceledCommandNotStoppedInGracePeriod(t *testing.T) {
+	GetConfig().CancelGracePeriod = 100 * time.Millisecond
+	defer func() {
+		GetConfig().CancelGracePeriod = 0
+	}()
+	log := cancelTaskAfterStarted(t, "trap '' TERM; ")
+	assert.True(t, strings.HasSuffix(log, "[go] Task did not stop in 100ms after SIGTERM, killing it.\n"))
+}
+
+func TestFlushLastProgressLineOfCanceledCommand(t *testing.T) {
+	log := cancelTaskAfterStarted(t, "printf 'pulling 10%%\\rpulling 50%%'; ")
+	assert.True(t, strings.Contains(log, "\npulling 50%\n"), log)
+	assert.False(t, strings.Contains(log, "\npulling 10%"), log)
+}
+
+// cancelTaskAfterStarted cancels a build of a looping shell task once it
+// started, trap sets up the task first, returns console log of the build.
+func cancelTaskAfterStarted(t *testing.T, trap string) string {
+	dir, err := ioutil.TempDir("", "gocd-cancel-grace")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "started")
+
+	setUpBuild(t, t.Name())
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", trap+"touch "+marker+"; while true; do sleep 0.05; done"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	waitFor(t, func() bool {
+		_, err := os.Stat(marker)
+		return err == nil
+	})
+	goServer.Send(AgentId, protocol.CancelMessage())
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	return trimTimestamp(log)
+}
@@ -0,0 +1,170 @@
+// +build windows
+
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	processSetQuota                     = 0x0100
+	processTerminate                    = 0x0001
+	jobObjectBasicAccountingInformation = 1
+)
+
+var (
+	kernel32                      = syscall.NewLazyDLL("kernel32.dll")
+	procCreateJobObject           = kernel32.NewProc("CreateJobObjectW")
+	procAssignProcessToJobObject  = kernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject        = kernel32.NewProc("TerminateJobObject")
+	procQueryInformationJobObject = kernel32.NewProc("QueryInformationJobObject")
+)
+
+// jobObjectAccounting is JOBOBJECT_BASIC_ACCOUNTING_INFORMATION.
+type jobObjectAccounting struct {
+	TotalUserTime             int64
+	TotalKernelTime           int64
+	ThisPeriodTotalUserTime   int64
+	ThisPeriodTotalKernelTime int64
+	TotalPageFaultCount       uint32
+	TotalProcesses            uint32
+	ActiveProcesses           uint32
+	TotalTerminatedProcesses  uint32
+}
+
+// jobProcesses puts every process started by the job into a job object
+// of its own, so that processes it starts are killed with it.
+type jobProcesses struct {
+	mu      sync.Mutex
+	objects map[int]syscall.Handle
+}
+
+func newJobProcesses(buildId string) *jobProcesses {
+	return &jobProcesses{objects: make(map[int]syscall.Handle)}
+}
+
+func (j *jobProcesses) prepare(cmd *exec.Cmd) func() error {
+	return nil
+}
+
+// track puts the started process into a job object, its children
+// started after it are in the job object too.
+func (j *jobProcesses) track(pid int) {
+	if j == nil {
+		return
+	}
+	object, _, err := procCreateJobObject.Call(0, 0)
+	if object == 0 {
+		LogInfo("WARN: could not create job object of process %v: %v", pid, err)
+		return
+	}
+	process, err := syscall.OpenProcess(processSetQuota|processTerminate, false, uint32(pid))
+	if err != nil {
+		LogInfo("WARN: could not open process %v: %v", pid, err)
+		syscall.CloseHandle(syscall.Handle(object))
+		return
+	}
+	defer syscall.CloseHandle(process)
+	if r, _, err := procAssignProcessToJobObject.Call(object, uintptr(process)); r == 0 {
+		LogInfo("WARN: could not assign process %v to job object: %v", pid, err)
+		syscall.CloseHandle(syscall.Handle(object))
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.objects[pid] = syscall.Handle(object)
+}
+
+// terminate is not supported, as Windows has no SIGTERM for console
+// processes.
+func (j *jobProcesses) terminate(p *os.Process) error {
+	return Err("SIGTERM is not supported on Windows")
+}
+
+// killTree terminates the job object of the process, and waits until
+// processes in it are gone.
+func (j *jobProcesses) killTree(p *os.Process) error {
+	if j == nil {
+		return p.Kill()
+	}
+	j.mu.Lock()
+	object, ok := j.objects[p.Pid]
+	delete(j.objects, p.Pid)
+	j.mu.Unlock()
+	if !ok {
+		return p.Kill()
+	}
+	defer syscall.CloseHandle(object)
+	return terminateJobObject(object)
+}
+
+// killAll terminates job objects of processes of the job, returns how
+// many processes were left in them.
+func (j *jobProcesses) killAll() int {
+	if j == nil {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	killed := 0
+	for pid, object := range j.objects {
+		killed += activeProcesses(object)
+		if err := terminateJobObject(object); err != nil {
+			LogInfo("WARN: %v", err)
+		}
+		syscall.CloseHandle(object)
+		delete(j.objects, pid)
+	}
+	return killed
+}
+
+func (j *jobProcesses) recordUsage(state *os.ProcessState) {}
+
+func (j *jobProcesses) resourceUsage() *protocol.ResourceUsage {
+	return nil
+}
+
+func terminateJobObject(object syscall.Handle) error {
+	if r, _, err := procTerminateJobObject.Call(uintptr(object), 1); r == 0 {
+		return Err("could not terminate job object: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if activeProcesses(object) == 0 {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return Err("processes of job object are still running")
+}
+
+func activeProcesses(object syscall.Handle) int {
+	var info jobObjectAccounting
+	r, _, _ := procQueryInformationJobObject.Call(uintptr(object), jobObjectBasicAccountingInformation,
+		uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info), 0)
+	if r == 0 {
+		return 0
+	}
+	return int(info.ActiveProcesses)
+}
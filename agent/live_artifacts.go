@@ -0,0 +1,134 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// LiveArtifactsEnv is the job environment variable naming a directory,
+	// relative to the working directory, whose files are uploaded while
+	// the job is running.
+	LiveArtifactsEnv = "GO_LIVE_ARTIFACTS"
+	// LiveArtifactsDest is where live artifacts are uploaded to.
+	LiveArtifactsDest = "live"
+)
+
+// LiveArtifactsInterval is how often the live artifacts directory is
+// checked for new and changed files.
+var LiveArtifactsInterval = 30 * time.Second
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+type liveArtifacts struct {
+	s        *BuildSession
+	dir      string
+	uploaded map[string]fileStamp
+	stop     chan bool
+	done     chan bool
+}
+
+func (s *BuildSession) startLiveArtifacts(dir string) error {
+	if s.live != nil {
+		return Err("%v is already set to %v", LiveArtifactsEnv, s.live.dir)
+	}
+	absDir := filepath.Clean(filepath.Join(s.wd, dir))
+	if !strings.HasPrefix(absDir, s.rootDir) {
+		return Err("Live artifacts directory[%v] is outside the agent sandbox.", absDir)
+	}
+	if config.DisableArtifactUpload {
+		s.ConsoleLog("Artifact upload is disabled on this agent, skipped publishing live artifacts from %v\n", absDir)
+		return nil
+	}
+	s.live = &liveArtifacts{
+		s:        s,
+		dir:      absDir,
+		uploaded: make(map[string]fileStamp),
+		stop:     make(chan bool),
+		done:     make(chan bool),
+	}
+	s.ConsoleLog("Publishing files in %v as live artifacts to %v every %v\n", absDir, LiveArtifactsDest, LiveArtifactsInterval)
+	go s.live.run()
+	return nil
+}
+
+// stopLiveArtifacts uploads files changed since the last check and stops
+// watching the live artifacts directory.
+func (s *BuildSession) stopLiveArtifacts() {
+	if s.live == nil {
+		return
+	}
+	close(s.live.stop)
+	<-s.live.done
+}
+
+func (l *liveArtifacts) run() {
+	defer close(l.done)
+	tick := time.NewTicker(LiveArtifactsInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			// live artifacts can wait while server pushes back
+			if throttleOf(l.s.artifactUploadBaseURL).delay() == 0 {
+				l.publish()
+			}
+		case <-l.stop:
+			l.publish()
+			return
+		}
+	}
+}
+
+func (l *liveArtifacts) publish() {
+	filepath.Walk(l.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			// directory may not be created yet
+			return nil
+		}
+		stamp := fileStamp{size: info.Size(), modTime: info.ModTime()}
+		previous, uploaded := l.uploaded[path]
+		if uploaded && previous == stamp {
+			return nil
+		}
+		rel, _ := filepath.Rel(l.dir, path)
+		destDir := LiveArtifactsDest
+		if dir := filepath.Dir(rel); dir != "." {
+			destDir = Join("/", destDir, filepath.ToSlash(dir))
+		}
+		destPath := Join("/", destDir, info.Name())
+		if !uploaded {
+			l.s.ConsoleLog("Uploading live artifact %v to %v\n", path, destPath)
+		} else {
+			LogDebug("upload changed live artifact %v to %v", path, destPath)
+		}
+		if err := l.s.artifacts.Upload(path, destPath, l.s.context().ArtifactDestURL(destDir)); err != nil {
+			// try again next time
+			LogInfo("upload live artifact %v failed: %v", path, err)
+			return nil
+		}
+		l.uploaded[path] = stamp
+		return nil
+	})
+}
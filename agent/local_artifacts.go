@@ -0,0 +1,251 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"archive/zip"
+	"crypto/subtle"
+	"github.com/satori/go.uuid"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const LocalArtifactsPath = "/artifacts"
+
+var localArtifacts = &localArtifactServer{}
+
+// localArtifactServer serves artifacts kept in config.LocalArtifactsDir
+// on a loopback port, requests must have the bearer token of the server.
+type localArtifactServer struct {
+	// mu serializes keeping artifacts and their eviction
+	mu    sync.Mutex
+	once  sync.Once
+	err   error
+	url   *url.URL
+	token string
+}
+
+func (l *localArtifactServer) start() error {
+	l.once.Do(func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			l.err = err
+			return
+		}
+		l.token = uuid.NewV4().String()
+		l.url = &url.URL{Scheme: "http", Host: ln.Addr().String(), Path: LocalArtifactsPath}
+		LogInfo("local artifact server listen to %v", ln.Addr())
+		go http.Serve(ln, http.HandlerFunc(l.serve))
+	})
+	return l.err
+}
+
+func (l *localArtifactServer) serve(w http.ResponseWriter, req *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+l.token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	file, ok := localArtifactFile(strings.TrimPrefix(req.URL.Path, LocalArtifactsPath))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	info, err := os.Stat(file)
+	if err != nil && strings.HasSuffix(file, ".zip") {
+		// directories are fetched as <dir>.zip from Go server
+		file = strings.TrimSuffix(file, ".zip")
+		if info, err = os.Stat(file); err == nil && !info.IsDir() {
+			err = os.ErrNotExist
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if info.IsDir() {
+		err = zipLocalArtifactDir(w, file)
+	} else {
+		err = copyLocalArtifactFile(w, file)
+	}
+	// served artifacts are the recently used ones kept by eviction
+	now := time.Now()
+	filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			os.Chtimes(path, now, now)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error.Printf("serve local artifact %v failed: %v", file, err)
+	}
+}
+
+func copyLocalArtifactFile(w io.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = copyBuffered(w, f)
+	return err
+}
+
+// zipLocalArtifactDir zips dir with entries under its name, the same as
+// directories downloaded from Go server.
+func zipLocalArtifactDir(w io.Writer, dir string) error {
+	zw := zip.NewWriter(w)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Dir(dir), path)
+		if err != nil {
+			return err
+		}
+		entry, err := zw.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		return copyLocalArtifactFile(entry, path)
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// localArtifactKey is the same for the upload url of an artifact with its
+// dest path and the url it is downloaded from.
+func localArtifactKey(u *url.URL, destPath string) string {
+	key := path.Join("/", u.Path, destPath)
+	if file := u.Query().Get("file"); file != "" {
+		key = path.Join(key, file)
+	}
+	return key
+}
+
+// localArtifactFile returns where the artifact of key is kept, false when
+// key is outside of config.LocalArtifactsDir.
+func localArtifactFile(key string) (string, bool) {
+	root := filepath.Clean(config.LocalArtifactsDir)
+	file := filepath.Join(root, filepath.FromSlash(path.Clean("/"+key)))
+	return file, strings.HasPrefix(file, root+string(os.PathSeparator))
+}
+
+// keepLocalArtifact copies uploaded source into config.LocalArtifactsDir
+// for fetches of later jobs on the agent, and evicts least recently used
+// files when the directory is over config.LocalArtifactsSize. Files are
+// copied, not linked, so that jobs rewriting them don't change what is
+// kept.
+func keepLocalArtifact(source, destPath string, destURL *ArtifactDestURL) error {
+	dest, ok := localArtifactFile(localArtifactKey(destURL.Base, destPath))
+	if !ok {
+		return Err("artifact %v is outside of local artifacts dir", destPath)
+	}
+	localArtifacts.mu.Lock()
+	defer localArtifacts.mu.Unlock()
+	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		target := filepath.Join(dest, path[len(source):])
+		if err := Mkdirs(filepath.Dir(target)); err != nil {
+			return err
+		}
+		tmp, err := ioutil.TempFile(filepath.Dir(target), ".keep")
+		if err != nil {
+			return err
+		}
+		err = copyLocalArtifactFile(tmp, path)
+		tmp.Close()
+		if err == nil {
+			err = os.Rename(tmp.Name(), target)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return evictLeastRecentlyUsed(config.LocalArtifactsDir, config.LocalArtifactsSize)
+}
+
+func copyLocalArtifact(source, dest string) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return copyLocalArtifactFile(f, source)
+}
+
+// fetchLocalArtifact fetches the artifact at src from the local artifact
+// server into destPath.
+func fetchLocalArtifact(src *url.URL, destPath string, dir bool) error {
+	if err := localArtifacts.start(); err != nil {
+		return err
+	}
+	u := *localArtifacts.url
+	u.Path = path.Join(u.Path, localArtifactKey(src, ""))
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+localArtifacts.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Err("local artifact server responded %v", resp.Status)
+	}
+	if !dir {
+		if err := Mkdirs(filepath.Dir(destPath)); err != nil {
+			return err
+		}
+		f, err := os.Create(destPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = copyBuffered(f, resp.Body)
+		return err
+	}
+	zipfile, err := ioutil.TempFile("", "tmp.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(zipfile.Name())
+	_, err = copyBuffered(zipfile, resp.Body)
+	zipfile.Close()
+	if err != nil {
+		return err
+	}
+	return extractZip(zipfile.Name(), filepath.Dir(destPath))
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// RecentConsoleLogs is how many console logs of latest builds are
+	// kept in memory for log bundles.
+	RecentConsoleLogs = 5
+	// MaxBundledLogSize is how many bytes from the end of the agent log
+	// and of each console log go into a log bundle.
+	MaxBundledLogSize = 10 * 1024 * 1024
+)
+
+const redacted = "******"
+
+type recentConsole struct {
+	name string
+	mu   sync.Mutex
+	data []byte
+}
+
+// Write keeps the last MaxBundledLogSize bytes of console output.
+func (c *recentConsole) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = append(c.data, p...)
+	if over := len(c.data) - MaxBundledLogSize; over > 0 {
+		c.data = append(c.data[:0], c.data[over:]...)
+	}
+	return len(p), nil
+}
+
+func (c *recentConsole) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.data...)
+}
+
+var recentConsoles struct {
+	mu       sync.Mutex
+	consoles []*recentConsole
+}
+
+func recordRecentConsole(name string) *recentConsole {
+	recentConsoles.mu.Lock()
+	defer recentConsoles.mu.Unlock()
+	c := &recentConsole{name: name}
+	recentConsoles.consoles = append(recentConsoles.consoles, c)
+	if over := len(recentConsoles.consoles) - RecentConsoleLogs; over > 0 {
+		recentConsoles.consoles = recentConsoles.consoles[over:]
+	}
+	return c
+}
+
+func recentConsoleLogs() []*recentConsole {
+	recentConsoles.mu.Lock()
+	defer recentConsoles.mu.Unlock()
+	return append([]*recentConsole(nil), recentConsoles.consoles...)
+}
+
+// WriteLogBundle writes a zip of the agent log, console logs of the latest
+// builds and the agent config with secrets redacted, for support diagnostics.
+func WriteLogBundle(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	if config.LogDir != "" {
+		if err := zipLogTail(zw, "agent.log", filepath.Join(config.LogDir, "gocd-golang-agent.log")); err != nil {
+			return err
+		}
+	}
+	for i, c := range recentConsoleLogs() {
+		name := Sprintf("consoles/%v-%v.log", i+1, bundleFileName(c.name))
+		if err := zipBytes(zw, name, c.bytes()); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(redactedConfig(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := zipBytes(zw, "config.json", data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func bundleFileName(name string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name), "_")
+}
+
+// redactedConfig is config without credentials, which is bundled and
+// uploaded to server.
+func redactedConfig() *Config {
+	reloadLock.RLock()
+	c := *config
+	reloadLock.RUnlock()
+	if c.ServerUrl != nil && c.ServerUrl.User != nil {
+		u := *c.ServerUrl
+		u.User = nil
+		c.ServerUrl = &u
+	}
+	if c.AgentAutoRegisterKey != "" {
+		c.AgentAutoRegisterKey = redacted
+	}
+	for _, u := range []*string{&c.TaskCacheURL, &c.EventsURL, &c.BadgeURL} {
+		if *u != "" {
+			*u = SanitizeURLString(*u)
+		}
+	}
+	return &c
+}
+
+func zipLogTail(zw *zip.Writer, name, file string) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() > int64(MaxBundledLogSize) {
+		if _, err := f.Seek(-int64(MaxBundledLogSize), io.SeekEnd); err != nil {
+			return err
+		}
+	}
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = copyBuffered(w, f)
+	return err
+}
+
+func zipBytes(zw *zip.Writer, name string, data []byte) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// uploadLogBundle posts the log bundle to uploadUrl on server.
+func uploadLogBundle(httpClient *http.Client, uploadUrl string) error {
+	u, err := config.MakeFullServerURL(uploadUrl)
+	if err != nil {
+		return err
+	}
+	var bundle bytes.Buffer
+	if err := WriteLogBundle(&bundle); err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(u.String(), "application/zip", &bundle)
+	if err != nil {
+		return SanitizeError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Err("upload log bundle to %v failed: %v", SanitizeURL(u), resp.Status)
+	}
+	return nil
+}
+
+// SaveLogBundle saves log bundle of the agent running locally to file.
+func SaveLogBundle(socketFile, file string) error {
+	resp, err := adminClient(socketFile).Get("http://agent" + AdminLogBundlePath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Err("generate log bundle failed: %v", resp.Status)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var nonEnvNameChars = regexp.MustCompile("[^A-Z0-9_]")
+
+// materialRevisions are revisions of materials checked out by a build,
+// which are reported to server with status of the build.
+type materialRevisions struct {
+	mu        sync.Mutex
+	revisions []*protocol.MaterialRevision
+}
+
+// add records revision, replacing the material checked out into the same
+// directory before.
+func (m *materialRevisions) add(revision *protocol.MaterialRevision) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, r := range m.revisions {
+		if r.Dest == revision.Dest {
+			m.revisions[i] = revision
+			return
+		}
+	}
+	m.revisions = append(m.revisions, revision)
+}
+
+func (m *materialRevisions) list() []*protocol.MaterialRevision {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.revisions) == 0 {
+		return nil
+	}
+	return append([]*protocol.MaterialRevision(nil), m.revisions...)
+}
+
+// addMaterialRevision records revision checked out by the build, and
+// exports revisions of materials to later tasks like the Java agent:
+// GO_REVISION_<DEST>, GO_TO_REVISION_<DEST> and GO_FROM_REVISION_<DEST>
+// of every material, and GO_REVISION, GO_TO_REVISION and GO_FROM_REVISION
+// when the build has only one. fromRevision is the first revision of
+// modifications the build is triggered by, default to revision.
+func (ctx *BuildContext) addMaterialRevision(revision *protocol.MaterialRevision, fromRevision string) {
+	revision.FromRevision = fromRevision
+	if revision.FromRevision == "" {
+		revision.FromRevision = revision.Revision
+	}
+	if ctx.materials == nil {
+		ctx.materials = &materialRevisions{}
+	}
+	if ctx.Env == nil {
+		ctx.Env = make(map[string]string)
+	}
+	ctx.materials.add(revision)
+	revisions := ctx.materials.list()
+	for _, r := range revisions {
+		if r.Dest != "" {
+			ctx.exportMaterialRevision("_"+materialEnvName(r.Dest), r)
+		}
+	}
+	if len(revisions) == 1 {
+		ctx.exportMaterialRevision("", revisions[0])
+	} else {
+		delete(ctx.Env, "GO_REVISION")
+		delete(ctx.Env, "GO_TO_REVISION")
+		delete(ctx.Env, "GO_FROM_REVISION")
+	}
+}
+
+func (ctx *BuildContext) exportMaterialRevision(suffix string, revision *protocol.MaterialRevision) {
+	ctx.Env["GO_REVISION"+suffix] = revision.Revision
+	ctx.Env["GO_TO_REVISION"+suffix] = revision.Revision
+	ctx.Env["GO_FROM_REVISION"+suffix] = revision.FromRevision
+}
+
+// materialEnvName is dest in environment variable names, e.g.
+// "SRC_LIBS" of "src/libs".
+func materialEnvName(dest string) string {
+	return nonEnvNameChars.ReplaceAllString(strings.ToUpper(strings.Trim(dest, "/")), "_")
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// latencySummary is a Prometheus summary without quantiles.
+type latencySummary struct {
+	name, help string
+	count      int64
+	sum        time.Duration
+}
+
+// counter is a Prometheus counter.
+type counter struct {
+	name, help string
+	value      int64
+}
+
+var (
+	metricsMu sync.Mutex
+
+	assignmentLatency = &latencySummary{
+		name: "gocd_agent_build_assignment_seconds",
+		help: "Time from receiving a build to processing its commands.",
+	}
+	teardownLatency = &latencySummary{
+		name: "gocd_agent_build_teardown_seconds",
+		help: "Time from reporting a build completing to reporting it completed.",
+	}
+
+	retriedRequests = &counter{
+		name: "gocd_agent_retries_total",
+		help: "Artifact and console requests retried.",
+	}
+	retryBudgetExhausted = &counter{
+		name: "gocd_agent_retry_budget_exhausted_total",
+		help: "Artifact and console requests not retried as the retry budget of their build was spent.",
+	}
+	serverPushBacks = &counter{
+		name: "gocd_agent_server_push_backs_total",
+		help: "Console and artifact requests server responded 429 or 503 to.",
+	}
+	droppedEvents = &counter{
+		name: "gocd_agent_events_dropped_total",
+		help: "Agent events dropped as the event publisher fell behind.",
+	}
+)
+
+func observeLatency(summary *latencySummary, d time.Duration) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	summary.count++
+	summary.sum += d
+}
+
+func incCounter(c *counter) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	c.value++
+}
+
+// WriteMetrics writes metrics of the agent in Prometheus text format.
+func WriteMetrics(w io.Writer) error {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	var buf bytes.Buffer
+	for _, summary := range []*latencySummary{assignmentLatency, teardownLatency} {
+		buf.WriteString(Sprintf("# HELP %v %v\n", summary.name, summary.help))
+		buf.WriteString(Sprintf("# TYPE %v summary\n", summary.name))
+		buf.WriteString(Sprintf("%v_sum %v\n", summary.name, summary.sum.Seconds()))
+		buf.WriteString(Sprintf("%v_count %v\n", summary.name, summary.count))
+	}
+	for _, c := range []*counter{retriedRequests, retryBudgetExhausted, serverPushBacks, droppedEvents} {
+		buf.WriteString(Sprintf("# HELP %v %v\n", c.name, c.help))
+		buf.WriteString(Sprintf("# TYPE %v counter\n", c.name))
+		buf.WriteString(Sprintf("%v %v\n", c.name, c.value))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteMetrics(w)
+}
+
+// Metrics fetches metrics of the agent running locally.
+func Metrics(socketFile string, out io.Writer) error {
+	resp, err := adminClient(socketFile).Get("http://agent" + AdminMetricsPath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Err("fetch metrics failed: %v", resp.Status)
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
@@ -0,0 +1,42 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"syscall"
+)
+
+// mountReadOnly moves the calling thread into a new mount namespace in
+// which dir is bind mounted read-only, processes started from the thread
+// see the read-only mount while the agent can still write dir. The thread
+// must be locked and never unlocked. Needs CAP_SYS_ADMIN.
+func mountReadOnly(dir string) error {
+	if err := syscall.Unshare(syscall.CLONE_NEWNS); err != nil {
+		return Err("Could not create mount namespace: %v", err)
+	}
+	// keep mounts of the namespace from propagating back to the agent's
+	if err := syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return Err("Could not make mounts private: %v", err)
+	}
+	if err := syscall.Mount(dir, dir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return Err("Could not bind mount %v: %v", dir, err)
+	}
+	if err := syscall.Mount("", dir, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		return Err("Could not mount %v read-only: %v", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// setnsTrap is the setns(2) syscall number of each arch. Package syscall
+// has no Setns and its frozen tables lack SYS_SETNS on 386 and amd64, and
+// golang.org/x/sys is not a dependency of the agent (see build.sh).
+var setnsTrap = map[string]uintptr{
+	"386":     346,
+	"amd64":   308,
+	"arm":     375,
+	"arm64":   268,
+	"ppc64":   350,
+	"ppc64le": 350,
+	"s390x":   339,
+}
+
+// startInNetworkNamespace starts cmd in a new network namespace that only
+// has loopback when namespace is IsolatedNetwork, otherwise namespace is
+// the path of an existing network namespace, e.g. /var/run/netns/jobs.
+// Both need CAP_SYS_ADMIN.
+func startInNetworkNamespace(cmd *exec.Cmd, namespace string) error {
+	return startOnLockedThread(cmd, func() error {
+		return joinNetworkNamespace(cmd, namespace)
+	})
+}
+
+// joinNetworkNamespace must be called on a locked OS thread that is never
+// unlocked, so that the thread is terminated with its goroutine instead of
+// being reused in the job's namespace
+func joinNetworkNamespace(cmd *exec.Cmd, namespace string) error {
+	if namespace == IsolatedNetwork {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+		return nil
+	}
+
+	trap, ok := setnsTrap[runtime.GOARCH]
+	if !ok {
+		return Err("Network namespace is not supported on %v", runtime.GOARCH)
+	}
+	ns, err := os.Open(namespace)
+	if err != nil {
+		return Err("Could not open network namespace: %v", err)
+	}
+	defer ns.Close()
+	_, _, errno := syscall.RawSyscall(trap, ns.Fd(), syscall.CLONE_NEWNET, 0)
+	if errno != 0 {
+		return Err("Could not enter network namespace %v: %v", namespace, errno)
+	}
+	return nil
+}
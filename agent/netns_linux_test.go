@@ -0,0 +1,74 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestExecInIsolatedNetworkNamespace(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("network namespace needs root")
+	}
+	GetConfig().JobNetworkNamespace = IsolatedNetwork
+	defer func() {
+		GetConfig().JobNetworkNamespace = ""
+	}()
+	setUp(t)
+	defer tearDown()
+	testExecInNetworkNamespace(t, "tail -n +3 /proc/self/net/dev | cut -d: -f1 | xargs", "lo")
+}
+
+func TestExecInExistingNetworkNamespace(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("network namespace needs root")
+	}
+	holder := exec.Command("unshare", "--net", "sh", "-c",
+		"ip link set lo up && ip addr add 10.1.2.3/32 dev lo && sleep 30")
+	assert.Nil(t, holder.Start())
+	defer holder.Process.Kill()
+	waitFor(t, func() bool {
+		fib, _ := ioutil.ReadFile(Sprintf("/proc/%v/net/fib_trie", holder.Process.Pid))
+		return strings.Contains(string(fib), "10.1.2.3")
+	})
+
+	GetConfig().JobNetworkNamespace = Sprintf("/proc/%v/ns/net", holder.Process.Pid)
+	defer func() {
+		GetConfig().JobNetworkNamespace = ""
+	}()
+	setUp(t)
+	defer tearDown()
+	testExecInNetworkNamespace(t, "grep -o 10.1.2.3 /proc/self/net/fib_trie | head -1", "10.1.2.3")
+}
+
+func testExecInNetworkNamespace(t *testing.T, script, expected string) {
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("sh", "-c", script))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, execBanner(GetConfig().WorkingDir, "sh", "-c", script)+expected+"\n", trimTimestamp(log))
+}
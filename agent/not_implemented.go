@@ -20,7 +20,7 @@ import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 )
 
-func NotImplemented(s *BuildSession, cmd *protocol.BuildCommand) error {
-	s.warn("Golang Agent does not support build comamnd '%v' yet, related GoCD feature will not be supported. More details: https://github.com/gocd-contrib/gocd-golang-agent", cmd.Name)
+func NotImplemented(ctx *BuildContext, cmd *protocol.BuildCommand) error {
+	ctx.warn("Golang Agent does not support build comamnd '%v' yet, related GoCD feature will not be supported. More details: https://github.com/gocd-contrib/gocd-golang-agent", cmd.Name)
 	return nil
 }
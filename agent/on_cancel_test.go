@@ -45,10 +45,9 @@ func TestOnCancel1(t *testing.T) {
 	log, err := goServer.ConsoleLog(buildId)
 	assert.Nil(t, err)
 
-	expected := `echo before sleep
-read on cancel
-compose on cancel
-`
+	wd := GetConfig().WorkingDir
+	expected := "echo before sleep\n" + execBanner(wd, "sleep", "5") + "read on cancel\n" +
+		execBanner(wd, "echo", "compose on cancel") + "compose on cancel\n"
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
@@ -75,8 +74,9 @@ func TestOnCancel2(t *testing.T) {
 	log, err := goServer.ConsoleLog(buildId)
 	assert.Nil(t, err)
 
-	expected := `WARN: Kill cancel task because it did not finish in 10ms.
-`
+	wd := GetConfig().WorkingDir
+	expected := execBanner(wd, "sleep", "5") + execBanner(wd, "sleep", "60") +
+		"WARN: Kill cancel task because it did not finish in 10ms.\n"
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
@@ -99,7 +99,7 @@ func TestOnCancelShouldContinueMaskEchos(t *testing.T) {
 	assert.Nil(t, err)
 
 	config := GetConfig()
-	expected := Sprintf("$$$ on cancel: %v\n", config.WorkingDir)
+	expected := execBanner(config.WorkingDir, "sleep", "5") + Sprintf("$$$ on cancel: %v\n", config.WorkingDir)
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
@@ -125,3 +125,77 @@ func TestCancelBuildWhenBuildIsHangingOnTestCommand(t *testing.T) {
 	expected := "hello before cancel\n"
 	assert.Equal(t, expected, trimTimestamp(log))
 }
+
+func TestAcknowledgeCancelWithCleanCancelReport(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("sleep", "5"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	goServer.Send(AgentId, protocol.CancelMessage())
+
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	report := goServer.CompletedReport(buildId)
+	assert.Equal(t, protocol.BuildCanceled, report.Result)
+	assert.NotNil(t, report.Cancel)
+	assert.True(t, report.Cancel.Clean)
+	assert.Equal(t, "", report.Cancel.Error)
+}
+
+func TestAcknowledgeCancelWhenBuildDoesNotStopInTime(t *testing.T) {
+	CancelCommandTimeout = time.Second
+	CancelBuildTimeout = 50 * time.Millisecond
+	defer func() {
+		CancelCommandTimeout = DefaultCancelCommandTimeout
+		CancelBuildTimeout = DefaultCancelBuildTimeout
+	}()
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sleep", "5").SetOnCancel(protocol.ExecCommand("sleep", "60")),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	start := time.Now()
+	goServer.Send(AgentId, protocol.CancelMessage())
+
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.True(t, time.Since(start) < CancelCommandTimeout)
+	report := goServer.CompletedReport(buildId)
+	assert.Equal(t, protocol.BuildCanceled, report.Result)
+	assert.NotNil(t, report.Cancel)
+	assert.False(t, report.Cancel.Clean)
+	assert.Equal(t, "build did not stop in 50ms", report.Cancel.Error)
+
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
+
+func TestCancelBuildRunningOverMaxBuildDuration(t *testing.T) {
+	GetConfig().MaxBuildDuration = 200 * time.Millisecond
+	defer func() {
+		GetConfig().MaxBuildDuration = 0
+	}()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sleep", "5").SetOnCancel(echo("clean up")),
+		echo("should not process this echo"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := execBanner(GetConfig().WorkingDir, "sleep", "5") +
+		"ERROR: Build ran over the maximum build duration 200ms of the agent (GOCD_AGENT_MAX_BUILD_DURATION), it is canceled\n" +
+		"clean up\n"
+	assert.Equal(t, expected, trimTimestamp(log))
+
+	report := goServer.CompletedReport(buildId)
+	assert.Equal(t, protocol.BuildCanceled, report.Result)
+	assert.True(t, report.TimedOut)
+}
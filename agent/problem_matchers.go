@@ -0,0 +1,275 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// ProblemMatchersEnv is the job environment variable naming a json
+	// file, relative to the working directory, of problem matchers that
+	// scan output of exec commands.
+	ProblemMatchersEnv = "GO_PROBLEM_MATCHERS"
+	// ProblemsArtifactName is the artifact problems found are published as.
+	ProblemsArtifactName = "problems.json"
+)
+
+const (
+	ProblemError   = "error"
+	ProblemWarning = "warning"
+	ProblemNotice  = "notice"
+)
+
+// problemPattern numbers are regexp groups of the problem properties, 0
+// when the property is not matched.
+type problemPattern struct {
+	Regexp   string `json:"regexp"`
+	File     int    `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity int    `json:"severity"`
+	Code     int    `json:"code"`
+	Message  int    `json:"message"`
+
+	regexp *regexp.Regexp
+}
+
+type problemMatcher struct {
+	Owner    string         `json:"owner"`
+	Severity string         `json:"severity"`
+	Pattern  problemPattern `json:"pattern"`
+}
+
+type problem struct {
+	Owner    string `json:"owner"`
+	Severity string `json:"severity"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Code     string `json:"code,omitempty"`
+	Message  string `json:"message"`
+}
+
+// problemMatchers is shared by tasks of a parallel compose, problems are
+// kept in the order they are found.
+type problemMatchers struct {
+	Matchers    []*problemMatcher `json:"problemMatcher"`
+	MaxErrors   *int              `json:"maxErrors"`
+	MaxWarnings *int              `json:"maxWarnings"`
+
+	path     string
+	mu       sync.Mutex
+	problems []problem
+	errors   int
+	warnings int
+	breached bool
+}
+
+func (s *BuildSession) loadProblemMatchers(path string) error {
+	if s.problems != nil {
+		return Err("%v is already set to %v", ProblemMatchersEnv, s.problems.path)
+	}
+	absPath := filepath.Clean(filepath.Join(s.wd, path))
+	if !strings.HasPrefix(absPath, s.rootDir) {
+		return Err("Problem matchers file[%v] is outside the agent sandbox.", absPath)
+	}
+	data, err := ioutil.ReadFile(absPath)
+	if err != nil {
+		return Err("Could not read problem matchers: %v", err)
+	}
+	p := &problemMatchers{path: absPath}
+	if err := json.Unmarshal(data, p); err != nil {
+		return Err("Invalid problem matchers %v: %v", absPath, err)
+	}
+	for _, m := range p.Matchers {
+		if m.Pattern.regexp, err = regexp.Compile(m.Pattern.Regexp); err != nil {
+			return Err("Invalid regexp of problem matcher %v: %v", m.Owner, err)
+		}
+	}
+	s.problems = p
+	s.ConsoleLog("Scanning output of tasks with %v problem matchers from %v\n", len(p.Matchers), absPath)
+	return nil
+}
+
+// scanner returns a writer matching lines written to it, masked by
+// secrets, against problem matchers, and the func flushing its last line.
+func (p *problemMatchers) scanner(secrets *stream.SubstituteWriter) (io.Writer, func() error) {
+	if p == nil {
+		return nil, nil
+	}
+	lines := &problemLines{matchers: p}
+	if secrets == nil {
+		return lines, lines.Flush
+	}
+	return secrets.Filter(lines), lines.Flush
+}
+
+func (p *problemMatchers) match(line string) {
+	for _, m := range p.Matchers {
+		groups := m.Pattern.regexp.FindStringSubmatch(line)
+		if groups == nil {
+			continue
+		}
+		group := func(i int) string {
+			if i <= 0 || i >= len(groups) {
+				return ""
+			}
+			return groups[i]
+		}
+		number := func(i int) int {
+			n, _ := strconv.Atoi(group(i))
+			return n
+		}
+		severity := group(m.Pattern.Severity)
+		if severity == "" {
+			severity = m.Severity
+		}
+		message := group(m.Pattern.Message)
+		if m.Pattern.Message == 0 {
+			message = line
+		}
+		p.add(problem{
+			Owner:    m.Owner,
+			Severity: problemSeverity(severity),
+			File:     group(m.Pattern.File),
+			Line:     number(m.Pattern.Line),
+			Column:   number(m.Pattern.Column),
+			Code:     group(m.Pattern.Code),
+			Message:  message,
+		})
+		return
+	}
+}
+
+func (p *problemMatchers) add(pb problem) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.problems = append(p.problems, pb)
+	switch pb.Severity {
+	case ProblemError:
+		p.errors++
+	case ProblemWarning:
+		p.warnings++
+	}
+}
+
+// checkThresholds returns an error the first time problems found exceed
+// maxErrors or maxWarnings.
+func (p *problemMatchers) checkThresholds() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.breached {
+		return nil
+	}
+	if p.MaxErrors != nil && p.errors > *p.MaxErrors {
+		p.breached = true
+		return Err("Problem matchers found %v errors, more than %v allowed by %v", p.errors, *p.MaxErrors, p.path)
+	}
+	if p.MaxWarnings != nil && p.warnings > *p.MaxWarnings {
+		p.breached = true
+		return Err("Problem matchers found %v warnings, more than %v allowed by %v", p.warnings, *p.MaxWarnings, p.path)
+	}
+	return nil
+}
+
+// publishProblems uploads problems found so far as ProblemsArtifactName.
+func (s *BuildSession) publishProblems() {
+	if s.problems == nil {
+		return
+	}
+	p := s.problems
+	p.mu.Lock()
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"errors":   p.errors,
+		"warnings": p.warnings,
+		"problems": append([]problem{}, p.problems...),
+	}, "", "  ")
+	p.mu.Unlock()
+	if err != nil {
+		s.warn("Could not publish problems: %v", err)
+		return
+	}
+	dir, err := ioutil.TempDir("", "gocd-problems")
+	if err != nil {
+		s.warn("Could not publish problems: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, ProblemsArtifactName)
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		s.warn("Could not publish problems: %v", err)
+		return
+	}
+	s.ConsoleLog("Uploading %v problems found by problem matchers to %v\n", len(p.problems), ProblemsArtifactName)
+	if err := uploadArtifactsAs(s.context(), file, "", ProblemsArtifactName); err != nil {
+		s.warn("Could not upload problems: %v", err)
+	}
+}
+
+func problemSeverity(severity string) string {
+	severity = strings.ToLower(severity)
+	switch {
+	case strings.HasPrefix(severity, "warn"):
+		return ProblemWarning
+	case strings.HasPrefix(severity, "note"), strings.HasPrefix(severity, "notice"), strings.HasPrefix(severity, "info"):
+		return ProblemNotice
+	default:
+		return ProblemError
+	}
+}
+
+// problemLines holds a line until it ends, so that it is matched as a
+// whole.
+type problemLines struct {
+	matchers *problemMatchers
+	line     []byte
+}
+
+func (w *problemLines) Write(in []byte) (int, error) {
+	for _, b := range in {
+		if b != '\n' {
+			w.line = append(w.line, b)
+			if len(w.line) < stream.MaxPendingLineSize {
+				continue
+			}
+		}
+		w.matchers.match(strings.TrimSuffix(string(w.line), "\r"))
+		w.line = w.line[:0]
+	}
+	return len(in), nil
+}
+
+func (w *problemLines) Flush() error {
+	if len(w.line) > 0 {
+		w.matchers.match(string(w.line))
+		w.line = w.line[:0]
+	}
+	return nil
+}
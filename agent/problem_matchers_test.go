@@ -0,0 +1,85 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"testing"
+)
+
+const testProblemMatchers = `{
+  "problemMatcher": [
+    {"owner": "lint", "pattern": {"regexp": "^lint: (\\w+) (\\S+):(\\d+) (.*)$", "severity": 1, "file": 2, "line": 3, "message": 4}},
+    {"owner": "go", "severity": "error", "pattern": {"regexp": "^(.+\\.go):(\\d+):(\\d+): (.*)$", "file": 1, "line": 2, "column": 3, "message": 4}}
+  ],
+  "maxErrors": 0
+}`
+
+func TestPublishProblemsFoundInExecOutput(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	writeFile(wd, "matchers.json", testProblemMatchers)
+	output := `lint: warning a.go:1 unused import\nok\nb.go:3:5: undefined: x\n`
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand(ProblemMatchersEnv, "matchers.json", "false").Setwd(relativePath(wd)),
+		protocol.ExecCommand("printf", output).Setwd(relativePath(wd)),
+		echo("not run"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	matchers := wd + "/matchers.json"
+	expected := Sprintf("setting environment variable '%v' to value 'matchers.json'\n", ProblemMatchersEnv) +
+		Sprintf("Scanning output of tasks with 2 problem matchers from %v\n", matchers) +
+		execBanner(wd, "printf", output) +
+		"lint: warning a.go:1 unused import\nok\nb.go:3:5: undefined: x\n" +
+		Sprintf("ERROR: Problem matchers found 1 errors, more than 0 allowed by %v\n", matchers) +
+		"Uploading 2 problems found by problem matchers to problems.json\n"
+	assert.Equal(t, expected, trimTimestamp(log))
+
+	content, err := ioutil.ReadFile(goServer.ArtifactFile(buildId, ProblemsArtifactName))
+	assert.Nil(t, err)
+	assert.Equal(t, `{
+  "errors": 1,
+  "problems": [
+    {
+      "owner": "lint",
+      "severity": "warning",
+      "file": "a.go",
+      "line": 1,
+      "message": "unused import"
+    },
+    {
+      "owner": "go",
+      "severity": "error",
+      "file": "b.go",
+      "line": 3,
+      "column": 5,
+      "message": "undefined: x"
+    }
+  ],
+  "warnings": 1
+}`, string(content))
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PropertyUploadParallelism is how many properties are posted at a time
+// to a Go server not taking them in a batch.
+var PropertyUploadParallelism = 4
+
+// serverRejectsPropertyBatch is set once Go server responded 404 or 405
+// to a property batch, later properties are posted one by one until the
+// agent connects again.
+var serverRejectsPropertyBatch int32
+
+func resetPropertyBatch() {
+	atomic.StoreInt32(&serverRejectsPropertyBatch, 0)
+}
+
+type property struct {
+	name, value string
+}
+
+// Properties queues properties generated by a build and sends them to Go
+// server at BaseURL, nil to drop them.
+type Properties struct {
+	httpClient *http.Client
+	BaseURL    *url.URL
+	retries    *RetryBudget
+
+	mu      sync.Mutex
+	pending []property
+}
+
+func NewProperties(httpClient *http.Client, baseURL *url.URL, retries *RetryBudget) *Properties {
+	return &Properties{httpClient: httpClient, BaseURL: baseURL, retries: retries}
+}
+
+// Add queues property name to be sent by the next Flush.
+func (p *Properties) Add(name, value string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = append(p.pending, property{name: name, value: value})
+}
+
+// Flush sends queued properties in a single request when server takes a
+// batch of them, otherwise posts them one by one, PropertyUploadParallelism
+// at a time, each with retries. It returns the first error.
+func (p *Properties) Flush() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	props := p.pending
+	p.pending = nil
+	p.mu.Unlock()
+	if len(props) == 0 {
+		return nil
+	}
+	if len(props) > 1 && atomic.LoadInt32(&serverRejectsPropertyBatch) == 0 {
+		form := url.Values{}
+		for _, prop := range props {
+			form.Add(prop.name, prop.value)
+		}
+		statusCode, err := p.post(p.BaseURL.String(), form)
+		switch {
+		case err != nil:
+			return err
+		case statusCode == http.StatusNotFound || statusCode == http.StatusMethodNotAllowed:
+			if atomic.CompareAndSwapInt32(&serverRejectsPropertyBatch, 0, 1) {
+				LogInfo("Go server does not take properties in a batch, posting them one by one")
+			}
+		case statusCode/100 == 2:
+			return nil
+		default:
+			return Err("Failed to send %v properties. Server response: %v", len(props), statusCode)
+		}
+	}
+	return p.postEach(props)
+}
+
+func (p *Properties) postEach(props []property) error {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	sem := make(chan bool, PropertyUploadParallelism)
+	for _, prop := range props {
+		wg.Add(1)
+		sem <- true
+		go func(prop property) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := p.postOne(prop); err != nil {
+				once.Do(func() { firstErr = err })
+			}
+		}(prop)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (p *Properties) postOne(prop property) error {
+	target := strings.TrimSuffix(p.BaseURL.String(), "/") + "/" + url.PathEscape(prop.name)
+	for attempt := 1; ; attempt++ {
+		statusCode, err := p.post(target, url.Values{"value": {prop.value}})
+		if err != nil {
+			return err
+		}
+		if statusCode/100 == 2 {
+			return nil
+		}
+		// client side errors, no retry
+		if statusCode/100 == 4 && statusCode != http.StatusTooManyRequests {
+			return Err("Failed to send property %v. Server response: %v", prop.name, statusCode)
+		}
+		if attempt >= 3 || !p.retries.Retry(attempt) {
+			return Err("Failed to send property %v. Server response: %v", prop.name, statusCode)
+		}
+		time.Sleep(throttleOf(p.BaseURL).delay())
+	}
+}
+
+func (p *Properties) post(target string, form url.Values) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Confirm", "true")
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return 0, SanitizeError(err)
+	}
+	resp.Body.Close()
+	observeThrottle(resp)
+	return resp.StatusCode, nil
+}
+
+// flushProperties sends properties generated by the build so far.
+func (s *BuildSession) flushProperties() {
+	if err := s.properties.Flush(); err != nil {
+		s.warn("Could not send properties: %v", err)
+	}
+}
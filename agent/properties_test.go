@@ -0,0 +1,134 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSendPropertiesInOneBatch(t *testing.T) {
+	var mu sync.Mutex
+	var requests []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		req.ParseForm()
+		assert.Equal(t, "/properties/builds/1", req.URL.Path)
+		requests = append(requests, req.PostForm)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL + "/properties/builds/1")
+	props := NewProperties(server.Client(), u, nil)
+
+	props.Add("coverage", "87.5")
+	props.Add("tests", "42")
+	props.Add("name with spaces", "a&b=c")
+	assert.Nil(t, props.Flush())
+	assert.Nil(t, props.Flush())
+
+	assert.Equal(t, 1, len(requests))
+	assert.Equal(t, "87.5", requests[0].Get("coverage"))
+	assert.Equal(t, "42", requests[0].Get("tests"))
+	assert.Equal(t, "a&b=c", requests[0].Get("name with spaces"))
+}
+
+func TestPostPropertiesOneByOneWhenServerDoesNotTakeBatch(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string]string)
+	failures := map[string]bool{"tests": true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		name := strings.TrimPrefix(req.URL.Path, "/properties/builds/1/")
+		if name == req.URL.Path {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if failures[name] {
+			delete(failures, name)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		req.ParseForm()
+		received[name] = req.PostForm.Get("value")
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL + "/properties/builds/1")
+	props := NewProperties(server.Client(), u, NewRetryBudget(3, 0, 0))
+
+	props.Add("coverage", "87.5")
+	props.Add("tests", "42")
+	props.Add("name with spaces", "a&b=c")
+	assert.Nil(t, props.Flush())
+
+	assert.Equal(t, map[string]string{"coverage": "87.5", "tests": "42", "name with spaces": "a&b=c"}, received)
+}
+
+func TestGeneratePropertiesFromXPathOfXMLFile(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	report := `<coverage line-rate="0.875"><package name="agent" line-rate="0.9"/></coverage>`
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(wd, "coverage.xml"), []byte(report), 0644))
+	goServer.SendBuild(AgentId, buildId,
+		protocol.GeneratePropertyCommand("coverage", "coverage.xml", "/coverage/@line-rate").Setwd(relativePath(wd)),
+		protocol.GeneratePropertyCommand("packages", "coverage.xml", "count(//package)").Setwd(relativePath(wd)),
+		protocol.GeneratePropertyCommand("missing", "coverage.xml", "//class/@name").Setwd(relativePath(wd)),
+		protocol.GeneratePropertyCommand("illegal", "coverage.xml", "//package[").Setwd(relativePath(wd)),
+		protocol.GeneratePropertyCommand("nofile", "nofile.xml", "/coverage").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	assert.Equal(t, map[string]string{"coverage": "0.875", "packages": "1"}, goServer.Properties(buildId))
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "Property coverage = 0.875 created."), log)
+	assert.True(t, strings.Contains(log, "Failed to create property missing. Nothing matched xpath \"//class/@name\""), log)
+	assert.True(t, strings.Contains(log, "Failed to create property illegal. Illegal xpath: \"//package[\""), log)
+	assert.True(t, strings.Contains(log, "Failed to create property nofile. File "+filepath.Join(wd, "nofile.xml")+" does not exist."), log)
+}
+
+func TestFailToGeneratePropertyFromFileOutsideOfSandbox(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.GeneratePropertyCommand("hosts", "../../../../../../../../etc/hosts", "/").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	assert.Equal(t, 0, len(goServer.Properties(buildId)))
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "Property source[/etc/hosts] is outside the agent sandbox."), log)
+}
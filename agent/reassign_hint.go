@@ -0,0 +1,46 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"strings"
+	"syscall"
+)
+
+// infraError fails a build for an issue of the agent, e.g. a missing
+// tool, instead of the job.
+type infraError struct {
+	reason string
+	error
+}
+
+func infraErr(reason string, err error) error {
+	return &infraError{reason: reason, error: err}
+}
+
+// reassignHint tells whether err is an issue of the agent, nil if it is
+// not known to be.
+func reassignHint(err error) *protocol.ReassignHint {
+	if ie, ok := err.(*infraError); ok {
+		return &protocol.ReassignHint{Reason: ie.reason, Message: ie.Error()}
+	}
+	if strings.Contains(err.Error(), syscall.ENOSPC.Error()) {
+		return &protocol.ReassignHint{Reason: protocol.ReassignDiskFull, Message: err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"io/ioutil"
+	"regexp"
+)
+
+// RedactionRule replaces matches of Regexp in console output with
+// Replacement, DefaultSecretMask when it is empty.
+type RedactionRule struct {
+	Name        string `json:"name"`
+	Regexp      string `json:"regexp"`
+	Replacement string `json:"replacement"`
+
+	regexp *regexp.Regexp
+}
+
+// LoadRedactionPolicy reads redaction rules from a json policy file like
+// {"rules": [{"name": "card", "regexp": "\\b\\d{16}\\b"}]}
+func LoadRedactionPolicy(path string) ([]*RedactionRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy struct {
+		Rules []*RedactionRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, err
+	}
+	for _, rule := range policy.Rules {
+		if rule.regexp, err = regexp.Compile(rule.Regexp); err != nil {
+			return nil, Err("invalid regexp of rule %v: %v", rule.Name, err)
+		}
+		if rule.Replacement == "" {
+			rule.Replacement = DefaultSecretMask
+		}
+	}
+	return policy.Rules, nil
+}
+
+// redact applies rules to every line of log, so that ^ and $ match at
+// line boundaries.
+func redact(rules []*RedactionRule, log []byte) []byte {
+	if len(rules) == 0 {
+		return log
+	}
+	lines := bytes.SplitAfter(log, []byte("\n"))
+	for i, line := range lines {
+		for _, rule := range rules {
+			end := len(line)
+			if end > 0 && line[end-1] == '\n' {
+				end--
+			}
+			line = append(rule.regexp.ReplaceAll(line[:end], []byte(rule.Replacement)), line[end:]...)
+		}
+		lines[i] = line
+	}
+	return bytes.Join(lines, nil)
+}
+
+// lineRedactor redacts console output with rules line by line, the last
+// line is held until it ends, so that a match written in pieces is still
+// redacted. Lines longer than stream.MaxPendingLineSize are not held.
+type lineRedactor struct {
+	rules []*RedactionRule
+	tail  []byte
+}
+
+func (r *lineRedactor) redact(log []byte) []byte {
+	if len(r.rules) == 0 {
+		return log
+	}
+	data := append(r.tail, log...)
+	i := bytes.LastIndexByte(data, '\n') + 1
+	if len(data)-i >= stream.MaxPendingLineSize {
+		i = len(data)
+	}
+	r.tail = append([]byte(nil), data[i:]...)
+	return redact(r.rules, data[:i])
+}
+
+// flush returns the held line redacted.
+func (r *lineRedactor) flush() []byte {
+	tail := r.tail
+	r.tail = nil
+	return redact(r.rules, tail)
+}
@@ -27,6 +27,7 @@ import (
 	"net/url"
 	"os"
 	"runtime"
+	"time"
 )
 
 func ReadGoServerCACert() error {
@@ -36,7 +37,7 @@ func ReadGoServerCACert() error {
 	}
 
 	LogInfo("fetching Go server[%v] CA certificate", config.ServerHostAndPort)
-	conn, err := tls.Dial("tcp", config.ServerHostAndPort, &tls.Config{
+	conn, err := dialServer(config.ServerHostAndPort, &tls.Config{
 		InsecureSkipVerify: true,
 	})
 	if err != nil {
@@ -45,6 +46,9 @@ func ReadGoServerCACert() error {
 	}
 	defer conn.Close()
 	state := conn.ConnectionState()
+	if err := checkServerPin(state.PeerCertificates[0].Raw); err != nil {
+		return err
+	}
 	certOut, err := os.Create(config.GoServerCAFile)
 	if err != nil {
 		logger.Error.Printf("failed to open %v for writing: %s", config.GoServerCAFile, err)
@@ -70,15 +74,10 @@ func GoServerRootCAs() (*x509.CertPool, error) {
 	return roots, nil
 }
 
-func GoServerTlsConfig(withClientCert bool) (*tls.Config, error) {
-	certs := make([]tls.Certificate, 0)
-	if withClientCert {
-		cert, err := tls.LoadX509KeyPair(config.AgentCertFile, config.AgentPrivateKeyFile)
-		if err != nil {
-			return nil, err
-		}
-		certs = append(certs, cert)
-	}
+// GoServerTlsConfig makes TLS config of connections to Go server, which
+// is set up by AgentHttpAuth when authenticated, e.g. with client
+// certificates.
+func GoServerTlsConfig(authenticated bool) (*tls.Config, error) {
 	roots, err := GoServerRootCAs()
 	if err != nil {
 		return nil, err
@@ -87,22 +86,40 @@ func GoServerTlsConfig(withClientCert bool) (*tls.Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &tls.Config{
-		Certificates: certs,
-		RootCAs:      roots,
-		ServerName:   serverName,
-	}, nil
+	tlsConfig := &tls.Config{
+		Certificates:          make([]tls.Certificate, 0),
+		RootCAs:               roots,
+		ServerName:            serverName,
+		VerifyPeerCertificate: verifyServerPin,
+	}
+	if authenticated {
+		auth, err := AgentHttpAuth()
+		if err != nil {
+			return nil, err
+		}
+		auth.ConfigureTLS(tlsConfig)
+	}
+	return tlsConfig, nil
 }
 
-func GoServerRemoteClient(withClientCert bool) (*http.Client, error) {
-	config, err := GoServerTlsConfig(withClientCert)
+// GoServerRemoteClient makes http client of Go server, requests of which
+// are authenticated by AgentHttpAuth when authenticated.
+func GoServerRemoteClient(authenticated bool) (*http.Client, error) {
+	config, err := GoServerTlsConfig(authenticated)
 	if err != nil {
 		return nil, err
 	}
 	tr := &http.Transport{
 		TLSClientConfig: config,
 	}
-	return &http.Client{Transport: tr}, nil
+	if !authenticated {
+		return &http.Client{Transport: tr}, nil
+	}
+	auth, err := AgentHttpAuth()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: &authTransport{auth: auth, base: tr}}, nil
 }
 
 func Register() error {
@@ -115,10 +132,16 @@ func Register() error {
 	if err := readAgentKeyAndCerts(registerData()); err != nil {
 		return err
 	}
-	return nil
+	auth, err := NewHttpAuth(config.HttpAuth)
+	if err != nil {
+		return err
+	}
+	setHttpAuth(auth)
+	return pinServerCertificate()
 }
 
 func CleanRegistration() error {
+	setHttpAuth(nil)
 	files := []string{config.GoServerCAFile,
 		config.AgentPrivateKeyFile,
 		config.AgentCertFile}
@@ -148,12 +171,12 @@ func requestToken() error {
 
 	url, err := config.TokenURL(AgentId)
 	if agentTokenErr != nil {
-		LogInfo( "fetching token from : %v", url.String())
+		LogInfo( "fetching token from : %v", SanitizeURL(url))
 	}
 	resp, err := client.Get(url.String())
 
 	if err != nil {
-		return err
+		return SanitizeError(err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusOK {
@@ -165,7 +188,7 @@ func requestToken() error {
 			return err2
 		}
 	}else{
-		LogInfo("Cannot fetch token from : %v", url)
+		LogInfo("Cannot fetch token from : %v", SanitizeURL(url))
 		return err
 	}
 
@@ -186,6 +209,7 @@ func registerData() map[string]string {
 		"elasticAgentId":                config.AgentAutoRegisterElasticAgentId,
 		"elasticPluginId":               config.AgentAutoRegisterElasticPluginId,
 		"supportsBuildCommandProtocol":  "true",
+		"agentLabels":                   FormatLabels(config.labels()),
 	}
 }
 
@@ -222,16 +246,19 @@ func readAgentKeyAndCerts(params map[string]string) error {
 
 
 	url, err := config.RegistrationURL()
-	LogInfo("fetching agent key and certificates from: %v", url)
+	LogInfo("fetching agent key and certificates from: %v", SanitizeURL(url))
 	if err != nil {
 		return err
 	}
 	resp, err := client.PostForm(url.String(), form)
 	if err != nil {
-		return err
+		return SanitizeError(err)
 	}
 
 	defer resp.Body.Close()
+	if err := checkServerVersion(resp.Header); err != nil {
+		return err
+	}
 	var registration protocol.Registration
 
 	dec := json.NewDecoder(resp.Body)
@@ -240,14 +267,84 @@ func readAgentKeyAndCerts(params map[string]string) error {
 		return err
 	}
 	if registration.AgentCertificate == "" {
-		return Err("Register failed, probably need approve agent registration on Server side")
+		return pendingApproval()
 	}
+	pendingApprovalWarned = false
 
 	ioutil.WriteFile(config.AgentPrivateKeyFile, []byte(registration.AgentPrivateKey), 0600)
 	ioutil.WriteFile(config.AgentCertFile, []byte(registration.AgentCertificate), 0600)
+	publishEvent(&Event{Type: EventAgentRegistered})
 	return nil
 }
 
+// PendingApprovalRetryInterval is how often an agent waiting for approval
+// checks registration again.
+var PendingApprovalRetryInterval = 60 * time.Second
+
+var pendingApprovalWarned bool
+
+// PendingApprovalError means server keeps the agent pending until it is
+// enabled on server side, which is not an error worth retrying quickly.
+type PendingApprovalError struct {
+	AgentId string
+}
+
+func (e *PendingApprovalError) Error() string {
+	return Sprintf("agent %v is pending approval on Go server", e.AgentId)
+}
+
+func pendingApproval() error {
+	if !pendingApprovalWarned {
+		pendingApprovalWarned = true
+		LogInfo("WARN: Agent %v (%v) is pending approval on Go server %v. Enable it on the Agents page of the server, or set GOCD_AGENT_AUTO_REGISTER_KEY to the agentAutoRegisterKey of the server to register automatically. Checking again every %v.",
+			AgentId, config.Hostname, config.HttpsServerURL(), PendingApprovalRetryInterval)
+	} else {
+		LogDebug("agent is still pending approval")
+	}
+	return &PendingApprovalError{AgentId: AgentId}
+}
+
+// RestartDelay returns how long to wait before starting the agent again
+// after Start returned err.
+func RestartDelay(err error) time.Duration {
+	if _, ok := err.(*PendingApprovalError); ok {
+		return PendingApprovalRetryInterval
+	}
+	if _, ok := err.(*ConnectionExpiredError); ok {
+		return 0
+	}
+	if _, ok := err.(*AgentPausedError); ok {
+		// Start waits until the agent is resumed
+		return 0
+	}
+	switch closeCode(err) {
+	case CloseGoingAway:
+		return ServerGoingAwayRetryInterval
+	case CloseTryAgainLater:
+		// server may tell when to come back in the reason, e.g. "30s"
+		if d, perr := time.ParseDuration(err.(*ConnectionClosedError).Status.Reason); perr == nil && d > 0 {
+			return d
+		}
+		return TryAgainLaterRetryInterval
+	}
+	return RestartInterval
+}
+
+// ShouldStop tells whether the agent should quit instead of starting again
+// after Start returned err.
+func ShouldStop(err error) bool {
+	if _, ok := err.(*UnsupportedServerVersionError); ok {
+		return true
+	}
+	if isServerCertificateChanged(err) {
+		return true
+	}
+	if _, ok := err.(*AgentUpdatedError); ok {
+		return true
+	}
+	return closeCode(err) == CloseUnsupportedData
+}
+
 func extractServerDN(certFileName string) (string, error) {
 	pemBlock, err := ioutil.ReadFile(certFileName)
 	if err != nil {
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bytes"
+	"encoding/pem"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/server"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWarnOnceAndRetrySlowlyWhenAgentIsPendingApproval(t *testing.T) {
+	goServer.SetPendingApproval(true)
+	defer goServer.SetPendingApproval(false)
+	assert.Nil(t, CleanRegistration())
+	warnings := pendingApprovalWarnings()
+
+	for i := 0; i < 2; i++ {
+		err := Start()
+		_, ok := err.(*PendingApprovalError)
+		assert.True(t, ok)
+		assert.Equal(t, PendingApprovalRetryInterval, RestartDelay(err))
+	}
+	assert.Equal(t, warnings+1, pendingApprovalWarnings())
+	assert.Equal(t, RestartInterval, RestartDelay(Err("websocket connection is closed")))
+}
+
+func TestRefuseGoServerPresentingCertificateOtherThanPinned(t *testing.T) {
+	setUp(t)
+	tearDown()
+
+	data, err := ioutil.ReadFile(goServer.CertPemFile)
+	assert.Nil(t, err)
+	block, _ := pem.Decode(data)
+	fingerprint := CertificateFingerprint(block.Bytes)
+	pinFile := GetConfig().ServerPinFile
+	pinned, err := ioutil.ReadFile(pinFile)
+	assert.Nil(t, err)
+	assert.Equal(t, fingerprint+"\n", string(pinned))
+
+	// registering again after reregister message
+	assert.Nil(t, ioutil.WriteFile(pinFile, []byte("0123\n"), 0600))
+	err = Start()
+	changed, ok := err.(*ServerCertificateChangedError)
+	assert.True(t, ok)
+	assert.Equal(t, fingerprint, changed.Found)
+	assert.True(t, ShouldStop(err))
+
+	// connecting with certificates of registration
+	assert.Nil(t, ResetServerCertificatePin(pinFile))
+	assert.Nil(t, Register())
+	assert.Nil(t, ioutil.WriteFile(pinFile, []byte("0123\n"), 0600))
+	client, err := GoServerRemoteClient(false)
+	assert.Nil(t, err)
+	_, err = client.Get(goServerUrl + server.StatusPath)
+	assert.True(t, ShouldStop(err))
+
+	assert.Nil(t, ResetServerCertificatePin(pinFile))
+	assert.Nil(t, Register())
+	pinned, err = ioutil.ReadFile(pinFile)
+	assert.Nil(t, err)
+	assert.Equal(t, fingerprint+"\n", string(pinned))
+}
+
+func TestFetchCACertificateOfIPv6GoServer(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available: " + err.Error())
+	}
+	ipv6Server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ipv6Server.Listener.Close()
+	ipv6Server.Listener = l
+	ipv6Server.StartTLS()
+	defer ipv6Server.Close()
+
+	hostAndPort := GetConfig().ServerHostAndPort
+	GetConfig().ServerHostAndPort = l.Addr().String()
+	defer func() {
+		GetConfig().ServerHostAndPort = hostAndPort
+		// fetched again from goServer by the next test
+		os.Remove(GetConfig().GoServerCAFile)
+		ResetServerCertificatePin(GetConfig().ServerPinFile)
+	}()
+	os.Remove(GetConfig().GoServerCAFile)
+	assert.Nil(t, ResetServerCertificatePin(GetConfig().ServerPinFile))
+
+	assert.Nil(t, ReadGoServerCACert())
+	data, err := ioutil.ReadFile(GetConfig().GoServerCAFile)
+	assert.Nil(t, err)
+	block, _ := pem.Decode(data)
+	assert.NotNil(t, block)
+	assert.True(t, bytes.Equal(ipv6Server.Certificate().Raw, block.Bytes))
+}
+
+func pendingApprovalWarnings() int {
+	log, _ := ioutil.ReadFile(filepath.Join(os.Getenv("GOCD_AGENT_LOG_DIR"), "gocd-golang-agent.log"))
+	return strings.Count(string(log), "is pending approval on Go server")
+}
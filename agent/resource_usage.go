@@ -0,0 +1,29 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+// logResourceUsage logs resources used by processes of the build to its
+// console when config.ResourceUsageSummary is on.
+func (s *BuildSession) logResourceUsage() {
+	usage := s.processes.resourceUsage()
+	if usage == nil || !config.ResourceUsageSummary {
+		return
+	}
+	s.ConsoleLog("[go] Resource usage of %v processes: %.2fs CPU, %v peak RSS, %v read, %v written\n",
+		usage.Processes, usage.CPUSeconds, FormatByteSize(usage.PeakRSS),
+		FormatByteSize(usage.ReadBytes), FormatByteSize(usage.WriteBytes))
+}
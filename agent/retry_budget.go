@@ -0,0 +1,82 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryBudget is how many times artifact and console requests of a build
+// can be retried in total, so that agents back off together instead of
+// retrying every request when the server is struggling. A nil budget
+// retries without limit and waiting.
+type RetryBudget struct {
+	mu         sync.Mutex
+	remaining  int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func NewRetryBudget(retries int, backoff, maxBackoff time.Duration) *RetryBudget {
+	return &RetryBudget{remaining: retries, backoff: backoff, maxBackoff: maxBackoff}
+}
+
+// Take takes a retry of the given attempt, starting from 1, from the
+// budget and returns how long to wait before it, false when the budget is
+// spent.
+func (b *RetryBudget) Take(attempt int) (time.Duration, bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.remaining <= 0 {
+		incCounter(retryBudgetExhausted)
+		return 0, false
+	}
+	b.remaining--
+	incCounter(retriedRequests)
+	return b.jitteredBackoff(attempt), true
+}
+
+// Retry takes a retry and waits for its backoff, false when the budget is
+// spent.
+func (b *RetryBudget) Retry(attempt int) bool {
+	wait, ok := b.Take(attempt)
+	if ok {
+		time.Sleep(wait)
+	}
+	return ok
+}
+
+// jitteredBackoff doubles backoff for every attempt up to maxBackoff, and
+// waits randomly between half and all of it.
+func (b *RetryBudget) jitteredBackoff(attempt int) time.Duration {
+	d := b.backoff
+	for i := 1; i < attempt && d < b.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > b.maxBackoff {
+		d = b.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bytes"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/xli/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryBudgetIsSharedByRequests(t *testing.T) {
+	budget := NewRetryBudget(2, 100*time.Millisecond, 150*time.Millisecond)
+
+	wait, ok := budget.Take(1)
+	assert.True(t, ok)
+	assert.True(t, wait >= 50*time.Millisecond && wait <= 100*time.Millisecond)
+	wait, ok = budget.Take(3)
+	assert.True(t, ok)
+	assert.True(t, wait >= 75*time.Millisecond && wait <= 150*time.Millisecond)
+	_, ok = budget.Take(1)
+	assert.False(t, ok)
+
+	var nilBudget *RetryBudget
+	assert.True(t, nilBudget.Retry(1))
+
+	var out bytes.Buffer
+	assert.Nil(t, WriteMetrics(&out))
+	assert.True(t, strings.Contains(out.String(), "# TYPE gocd_agent_retries_total counter\n"))
+	assert.True(t, strings.Contains(out.String(), "# TYPE gocd_agent_retry_budget_exhausted_total counter\n"))
+}
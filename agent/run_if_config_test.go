@@ -45,7 +45,7 @@ func TestRunIfConfig(t *testing.T) {
 
 	expected := `should echo if any when passed
 should echo if passed when passed
-ERROR: exec: "cmdnotexist": executable file not found in $PATH
+` + execBanner(GetConfig().WorkingDir, "cmdnotexist") + `ERROR: exec: "cmdnotexist": executable file not found in $PATH
 should echo if failed when failed
 should echo if any when failed
 `
@@ -81,3 +81,94 @@ func TestComposeCommandWithRunIfConfig(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "hello world6\n", trimTimestamp(log))
 }
+
+func TestSubCommandsOfComposeRunOnFailureStartAsPassed(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.FailCommand("boom"),
+		protocol.ComposeCommand(
+			protocol.EchoCommand("on failure 1"),
+			protocol.EchoCommand("on failure 2"),
+		).RunIf("failed"),
+		protocol.ComposeCommand(
+			protocol.EchoCommand("on any"),
+		).RunIf("any"),
+		protocol.ComposeCommand(
+			protocol.EchoCommand("should not echo"),
+		),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `ERROR: boom
+on failure 1
+on failure 2
+on any
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestSubCommandsOfComposeEvaluateRunIfAfterSiblingFailed(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ComposeCommand(
+			protocol.EchoCommand("before"),
+			protocol.FailCommand("boom"),
+			protocol.EchoCommand("should not echo"),
+			protocol.EchoCommand("cleanup").RunIf("failed"),
+			protocol.EchoCommand("always").RunIf("any"),
+		),
+		protocol.EchoCommand("after compose failed").RunIf("failed"),
+		protocol.EchoCommand("should not echo after compose failed"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `before
+ERROR: boom
+cleanup
+always
+after compose failed
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestFailureInsideComposeRunOnFailure(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.FailCommand("first"),
+		protocol.ComposeCommand(
+			protocol.FailCommand("second"),
+			protocol.EchoCommand("should not echo"),
+			protocol.EchoCommand("recover").RunIf("failed"),
+		).RunIf("failed"),
+		protocol.EchoCommand("still failed").RunIf("failed"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `ERROR: first
+ERROR: second
+recover
+still failed
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
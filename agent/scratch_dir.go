@@ -0,0 +1,72 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// scratchDir is the per-build temp directory of a job, a tmpfs of
+// config.JobTmpfsSize when it could be mounted, otherwise a directory
+// on disk.
+type scratchDir struct {
+	dir     string
+	mounted bool
+}
+
+// makeScratchDir creates the scratch directory of the job and points
+// TMPDIR, TMP and TEMP of the job to it.
+func (s *BuildSession) makeScratchDir() error {
+	size := config.JobTmpfsSize
+	if size <= 0 {
+		return nil
+	}
+	dir, err := ioutil.TempDir("", "gocd-scratch")
+	if err != nil {
+		return Err("Could not create scratch directory of the job: %v", err)
+	}
+	s.scratch = &scratchDir{dir: dir}
+	if available, err := memAvailable(); err == nil && available < size {
+		s.warn("Only %v of memory is available, scratch directory %v of the job is on disk instead of a %v tmpfs.", FormatByteSize(available), dir, FormatByteSize(size))
+	} else if err := mountTmpfs(dir, size); err != nil {
+		s.warn("Could not mount a %v tmpfs, scratch directory %v of the job is on disk: %v", FormatByteSize(size), dir, err)
+	} else {
+		s.scratch.mounted = true
+		s.ConsoleLog("Mounted a %v tmpfs as scratch directory %v of the job\n", FormatByteSize(size), dir)
+	}
+	for _, name := range []string{"TMPDIR", "TMP", "TEMP"} {
+		s.envs[name] = dir
+	}
+	return nil
+}
+
+// removeScratchDir unmounts and removes the scratch directory of the job.
+func (s *BuildSession) removeScratchDir() {
+	if s.scratch == nil {
+		return
+	}
+	if s.scratch.mounted {
+		if err := unmountTmpfs(s.scratch.dir); err != nil {
+			LogInfo("WARN: could not unmount scratch directory %v: %v", s.scratch.dir, err)
+		}
+	}
+	if err := os.RemoveAll(s.scratch.dir); err != nil {
+		LogInfo("WARN: could not remove scratch directory %v: %v", s.scratch.dir, err)
+	}
+	s.scratch = nil
+}
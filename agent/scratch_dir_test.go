@@ -0,0 +1,82 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestScratchDirOfJobIsRemovedWhenJobEnds(t *testing.T) {
+	GetConfig().JobTmpfsSize = 1024 * 1024
+	defer func() {
+		GetConfig().JobTmpfsSize = 0
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", "echo $TMPDIR > tmpdir.txt && echo scratch > $TMPDIR/data").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	tmpdir, err := ioutil.ReadFile(filepath.Join(wd, "tmpdir.txt"))
+	assert.Nil(t, err)
+	dir := strings.TrimSpace(string(tmpdir))
+	assert.True(t, strings.Contains(filepath.Base(dir), "gocd-scratch"), dir)
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err), "scratch directory should be removed")
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "Mounted a 1.0 MB tmpfs as scratch directory "+dir) ||
+		strings.Contains(log, "scratch directory "+dir+" of the job is on disk"), log)
+}
+
+func TestScratchDirOfJobFallsBackToDiskWhenMemoryIsLow(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("available memory is only known on Linux")
+	}
+	GetConfig().JobTmpfsSize = 1 << 50
+	defer func() {
+		GetConfig().JobTmpfsSize = 0
+	}()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", "test -d \"$TMPDIR\" && test \"$TMP\" = \"$TMPDIR\""),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "of memory is available, scratch directory"), log)
+	assert.True(t, strings.Contains(log, "of the job is on disk instead of a 1024.0 TB tmpfs"), log)
+}
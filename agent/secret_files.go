@@ -0,0 +1,108 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// secretFiles are files of values exported by export commands with the
+// "file" arg, for secrets too large or sensitive for environment
+// variables, e.g. kubeconfigs and keystores. They are shredded when the
+// job ends.
+type secretFiles struct {
+	mu    sync.Mutex
+	dir   string
+	files []string
+}
+
+// write writes content to a new file only the agent user can access,
+// under parent, or the temp directory when parent is empty, and returns
+// its path.
+func (f *secretFiles) write(parent, name string, content []byte) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dir == "" {
+		dir, err := ioutil.TempDir(parent, "gocd-secret-files")
+		if err != nil {
+			return "", err
+		}
+		f.dir = dir
+	}
+	file, err := ioutil.TempFile(f.dir, bundleFileName(name)+"-")
+	if err != nil {
+		return "", err
+	}
+	f.files = append(f.files, file.Name())
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return "", err
+	}
+	return file.Name(), file.Close()
+}
+
+// shred overwrites the files with zeros before removing them, so that
+// secrets do not linger on disk after the job.
+func (f *secretFiles) shred() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, name := range f.files {
+		if err := shredFile(name); err != nil {
+			LogInfo("WARN: could not shred secret file %v: %v", name, err)
+		}
+	}
+	if f.dir != "" {
+		if err := os.RemoveAll(f.dir); err != nil {
+			LogInfo("WARN: could not remove secret files directory %v: %v", f.dir, err)
+		}
+	}
+	f.dir = ""
+	f.files = nil
+}
+
+func shredFile(name string) error {
+	file, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil {
+		_, err = file.Write(make([]byte, info.Size()))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// writeSecretFile writes content of environment variable name to a
+// secret file, in the scratch directory of the job when it has one.
+func (s *BuildSession) writeSecretFile(name string, content []byte) (string, error) {
+	parent := ""
+	if s.scratch != nil {
+		parent = s.scratch.dir
+	}
+	return s.secretFiles.write(parent, name, content)
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/api"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestQueryServerAPIsWithAgentCredentials(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.AddPipelineInstance(&api.PipelineInstance{Name: "up", Counter: 1, Label: "1",
+		Stages: []*api.StageInstance{{Name: "build", Counter: 1, Result: api.ResultPassed}}})
+	goServer.AddPipelineInstance(&api.PipelineInstance{Name: "up", Counter: 2, Label: "2",
+		Stages: []*api.StageInstance{{Name: "build", Counter: 1, Result: api.ResultFailed}}})
+	goServer.AddPipelineInstance(&api.PipelineInstance{Name: "up", Counter: 3, Label: "3",
+		Stages: []*api.StageInstance{{Name: "build", Counter: 2, Result: api.ResultUnknown}}})
+
+	client, err := ServerAPIClient()
+	assert.Nil(t, err)
+
+	history, err := client.PipelineHistory("up")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(history))
+	assert.Equal(t, 3, history[0].Counter)
+
+	latest, err := client.LatestPassed("up", "build")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", latest.Label)
+
+	stage, err := client.StageInstance("up", 3, "build", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "up", stage.PipelineName)
+	assert.False(t, stage.Completed())
+
+	_, err = client.StageInstance("up", 3, "build", 1)
+	assert.True(t, api.IsNotFound(err))
+	_, err = client.PipelineHistory("unknown")
+	assert.True(t, api.IsNotFound(err))
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ServerCertificateChangedError means Go server presents a certificate
+// other than the one pinned on first registration, which may be a man in
+// the middle. The pin is removed with ResetServerCertificatePin once the
+// change is verified.
+type ServerCertificateChangedError struct {
+	Pinned, Found string
+}
+
+func (e *ServerCertificateChangedError) Error() string {
+	return Sprintf("Go server certificate changed, pinned SHA-256 fingerprint is %v but server presents %v. Run \"gocd-golang-agent reset-server-pin\" if the change is expected.", e.Pinned, e.Found)
+}
+
+// ServerPinFile is where the fingerprint of Go server certificate is kept,
+// resolved without loading the whole config so that CLI commands can find it.
+func ServerPinFile() string {
+	wd, _ := filepath.Abs(os.Getenv("GOCD_AGENT_WORKING_DIR"))
+	return filepath.Join(wd, readEnv("GOCD_AGENT_CONFIG_DIR", "config"), "go-server-pin")
+}
+
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// ResetServerCertificatePin forgets the pinned Go server certificate, the
+// certificate server presents at next registration is pinned instead.
+func ResetServerCertificatePin(pinFile string) error {
+	err := os.Remove(pinFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func readServerPin() (string, error) {
+	data, err := ioutil.ReadFile(config.ServerPinFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// checkServerPin verifies the leaf certificate server presents against
+// the pin, nothing is pinned before first registration.
+func checkServerPin(leaf []byte) error {
+	pinned, err := readServerPin()
+	if err != nil || pinned == "" {
+		return err
+	}
+	if found := CertificateFingerprint(leaf); found != pinned {
+		return &ServerCertificateChangedError{Pinned: pinned, Found: found}
+	}
+	return nil
+}
+
+func verifyServerPin(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return Err("Go server presents no certificate")
+	}
+	return checkServerPin(rawCerts[0])
+}
+
+// pinServerCertificate pins the certificate of Go server the agent has
+// registered with, unless one is pinned already.
+func pinServerCertificate() error {
+	if pinned, err := readServerPin(); err != nil || pinned != "" {
+		return err
+	}
+	data, err := ioutil.ReadFile(config.GoServerCAFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Err("failed to parse Go server certificate")
+	}
+	fingerprint := CertificateFingerprint(block.Bytes)
+	LogInfo("pin Go server certificate, SHA-256 fingerprint: %v", fingerprint)
+	return ioutil.WriteFile(config.ServerPinFile, []byte(fingerprint+"\n"), 0600)
+}
+
+// isServerCertificateChanged also finds the error in errors of HTTP
+// requests failed by it.
+func isServerCertificateChanged(err error) bool {
+	var changed *ServerCertificateChangedError
+	return errors.As(err, &changed)
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var throttles = struct {
+	sync.Mutex
+	byHost map[string]*serverThrottle
+}{byHost: make(map[string]*serverThrottle)}
+
+// throttleOf returns the throttle of the server at u, which slows down
+// console and artifact requests of the agent to it while it pushes back
+// with 429 or 503 responses.
+func throttleOf(u *url.URL) *serverThrottle {
+	throttles.Lock()
+	defer throttles.Unlock()
+	var host string
+	if u != nil {
+		host = u.Host
+	}
+	t, ok := throttles.byHost[host]
+	if !ok {
+		t = &serverThrottle{}
+		throttles.byHost[host] = t
+	}
+	return t
+}
+
+// observeThrottle records the response of a console or artifact request
+// in the throttle of its server.
+func observeThrottle(resp *http.Response) {
+	if resp.Request != nil {
+		throttleOf(resp.Request.URL).observe(resp)
+	}
+}
+
+type serverThrottle struct {
+	mu      sync.Mutex
+	strikes int
+	until   time.Time
+}
+
+func (t *serverThrottle) observe(resp *http.Response) {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		t.pushBack(retryAfter(resp))
+	case resp.StatusCode/100 == 2:
+		t.recover()
+	}
+}
+
+// pushBack holds requests off for retryAfter, or for a backoff doubling
+// with every push back in a row when server did not tell.
+func (t *serverThrottle) pushBack(retryAfter time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.strikes++
+	incCounter(serverPushBacks)
+	d := retryAfter
+	if d <= 0 {
+		d = throttleBackoff(t.strikes)
+	}
+	if until := time.Now().Add(d); until.After(t.until) {
+		t.until = until
+	}
+	if t.strikes == 1 {
+		LogInfo("Server is overloaded, slowing down requests for %v", d)
+	}
+}
+
+func (t *serverThrottle) recover() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.strikes > 0 {
+		LogInfo("Server recovered after %v push backs", t.strikes)
+	}
+	t.strikes, t.until = 0, time.Time{}
+}
+
+// delay is how long requests should hold off, 0 when server is fine.
+func (t *serverThrottle) delay() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d := t.until.Sub(time.Now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// wait pauses non-critical requests until server recovers, false when
+// cancel is closed first.
+func (t *serverThrottle) wait(cancel <-chan bool) bool {
+	for {
+		d := t.delay()
+		if d <= 0 {
+			return true
+		}
+		select {
+		case <-time.After(d):
+		case <-cancel:
+			return false
+		}
+	}
+}
+
+func throttleBackoff(strikes int) time.Duration {
+	d, max := time.Second, time.Minute
+	if config != nil {
+		d, max = config.retryBackoff()
+	}
+	for i := 1; i < strikes && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// retryAfter reads the Retry-After header in seconds, 0 when there is none.
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
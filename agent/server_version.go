@@ -0,0 +1,145 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MinSupportedServerVersion is the oldest Go server supporting the build
+// command protocol. Newer servers are supported unless the first version
+// not to run against is configured, see GOCD_AGENT_MAX_SERVER_VERSION, as
+// the agent can't know which future server breaks the protocol.
+var MinSupportedServerVersion = "16.7.0"
+
+// UnsupportedServerVersionError means the agent should not run against
+// the Go server, retrying does not help until either side is upgraded.
+type UnsupportedServerVersionError struct {
+	Version string
+}
+
+func (e *UnsupportedServerVersionError) Error() string {
+	supported := ">= " + MinSupportedServerVersion
+	if config.MaxServerVersion != "" {
+		supported += " and < " + config.MaxServerVersion
+	}
+	return Sprintf("Go server version %v is not supported, supported versions are %v; set GOCD_AGENT_IGNORE_SERVER_VERSION to run anyway", e.Version, supported)
+}
+
+// checkConnectingServerVersion checks the version of Go server before
+// every websocket connection, as the server may be upgraded while the
+// agent is registered, by a HEAD request of the websocket path.
+func checkConnectingServerVersion(client *http.Client) error {
+	u, err := config.MakeFullServerURL(config.WebSocketPath)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Head(u.String())
+	if err != nil {
+		return SanitizeError(err)
+	}
+	resp.Body.Close()
+	return checkServerVersion(resp.Header)
+}
+
+// checkServerVersion checks the version Go server reported in the
+// header of a response, e.g. of registration.
+func checkServerVersion(header http.Header) error {
+	version := header.Get(protocol.ServerVersionHeader)
+	if version == "" {
+		LogInfo("Go server did not report its version, skipped version check")
+		return nil
+	}
+	LogInfo("Go server version: %v", version)
+	supported, err := isSupportedServerVersion(version)
+	if err != nil {
+		logger.Error.Printf("could not check Go server version: %v", err)
+		return nil
+	}
+	if supported {
+		return nil
+	}
+	err = &UnsupportedServerVersionError{Version: version}
+	if config.IgnoreServerVersion {
+		LogInfo("WARN: %v", err)
+		return nil
+	}
+	return err
+}
+
+func isSupportedServerVersion(version string) (bool, error) {
+	v, err := ParseVersion(version)
+	if err != nil {
+		return false, err
+	}
+	min, err := ParseVersion(MinSupportedServerVersion)
+	if err != nil {
+		return false, err
+	}
+	if CompareVersions(v, min) < 0 {
+		return false, nil
+	}
+	if config.MaxServerVersion == "" {
+		return true, nil
+	}
+	max, err := ParseVersion(config.MaxServerVersion)
+	if err != nil {
+		return false, err
+	}
+	return CompareVersions(v, max) < 0, nil
+}
+
+// ParseVersion parses the numeric part of versions like "16.7.0" and
+// "17.3.0 (4704-9c8f5a6b7d)".
+func ParseVersion(version string) ([]int, error) {
+	numeric := strings.TrimSpace(version)
+	if i := strings.IndexAny(numeric, " -+("); i >= 0 {
+		numeric = numeric[:i]
+	}
+	var parts []int
+	for _, p := range strings.Split(numeric, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, Err("invalid version %q", version)
+		}
+		parts = append(parts, n)
+	}
+	return parts, nil
+}
+
+// CompareVersions returns -1, 0 or 1 when version a is older than, same
+// as or newer than b, missing parts are taken as 0.
+func CompareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	}
+	return 0
+}
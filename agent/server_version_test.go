@@ -0,0 +1,86 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/server"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	v, err := ParseVersion("16.7.0")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{16, 7, 0}, v)
+	v, err = ParseVersion("17.3.0 (4704-9c8f5a6b7d)")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{17, 3, 0}, v)
+	_, err = ParseVersion("latest")
+	assert.NotNil(t, err)
+}
+
+func TestCompareVersions(t *testing.T) {
+	assert.Equal(t, 0, CompareVersions([]int{16, 7}, []int{16, 7, 0}))
+	assert.Equal(t, -1, CompareVersions([]int{16, 7, 0}, []int{16, 10, 0}))
+	assert.Equal(t, 1, CompareVersions([]int{17}, []int{16, 12, 3}))
+}
+
+func TestRefuseToRunAgainstUnsupportedServerVersion(t *testing.T) {
+	goServer.SetVersion("15.1.0")
+	defer goServer.SetVersion(server.Version)
+	assert.Nil(t, CleanRegistration())
+
+	err := Start()
+	_, ok := err.(*UnsupportedServerVersionError)
+	assert.True(t, ok)
+	assert.True(t, contains(err.Error(), "Go server version 15.1.0 is not supported"))
+}
+
+func TestRefuseToConnectToServerUpgradedToUnsupportedVersion(t *testing.T) {
+	GetConfig().MaxServerVersion = "19.0.0"
+	defer func() {
+		GetConfig().MaxServerVersion = ""
+		goServer.SetVersion(server.Version)
+	}()
+	assert.Nil(t, Register())
+	goServer.SetVersion("19.1.0")
+
+	err := Start()
+	_, ok := err.(*UnsupportedServerVersionError)
+	assert.True(t, ok)
+	assert.True(t, contains(err.Error(), "Go server version 19.1.0 is not supported, supported versions are >= 16.7.0 and < 19.0.0"))
+}
+
+func TestIgnoreServerVersion(t *testing.T) {
+	GetConfig().IgnoreServerVersion = true
+	GetConfig().MaxServerVersion = "19.0.0"
+	goServer.SetVersion("19.1.0")
+	defer func() {
+		GetConfig().IgnoreServerVersion = false
+		GetConfig().MaxServerVersion = ""
+		goServer.SetVersion(server.Version)
+	}()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SSHKeysEnv is the job environment variable naming environment variables
+// of the job, usually secure ones, holding private keys loaded into an
+// ssh-agent of the job, e.g. "DEPLOY_KEY,SUBMODULE_KEY".
+const SSHKeysEnv = "GO_SSH_KEYS"
+
+// SSHAgentStartTimeout is how long to wait for ssh-agent to listen.
+var SSHAgentStartTimeout = 5 * time.Second
+
+// sshAgent is the ssh-agent of a job, tasks reach it by SSH_AUTH_SOCK.
+type sshAgent struct {
+	dir    string
+	socket string
+	cmd    *exec.Cmd
+	done   chan error
+}
+
+func (s *BuildSession) loadSSHKeys(names string) error {
+	if s.ssh == nil {
+		agent, err := startSSHAgent()
+		if err != nil {
+			return Err("Could not start ssh-agent for the job: %v", err)
+		}
+		s.ssh = agent
+		s.envs["SSH_AUTH_SOCK"] = agent.socket
+		s.ConsoleLog("Started ssh-agent for the job, SSH_AUTH_SOCK=%v\n", agent.socket)
+	}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		key, ok := s.envs[name]
+		if !ok {
+			return Err("Environment variable '%v' in %v is not set", name, SSHKeysEnv)
+		}
+		add := exec.Command("ssh-add", "-")
+		add.Env = s.commandEnv(nil)
+		add.Stdin = strings.NewReader(strings.TrimSpace(key) + "\n")
+		add.Stdout = s.secrets
+		add.Stderr = s.secrets
+		if err := add.Run(); err != nil {
+			return Err("Could not add ssh key '%v' to ssh-agent: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func startSSHAgent() (*sshAgent, error) {
+	dir, err := ioutil.TempDir("", "gocd-ssh-agent")
+	if err != nil {
+		return nil, err
+	}
+	agent := &sshAgent{
+		dir:    dir,
+		socket: filepath.Join(dir, "agent.sock"),
+		done:   make(chan error, 1),
+	}
+	// -D keeps ssh-agent in foreground, so that it is killed with the job
+	agent.cmd = exec.Command("ssh-agent", "-D", "-a", agent.socket)
+	if err := agent.cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	go func() {
+		agent.done <- agent.cmd.Wait()
+	}()
+	deadline := time.Now().Add(SSHAgentStartTimeout)
+	for {
+		if _, err := os.Stat(agent.socket); err == nil {
+			return agent, nil
+		}
+		if time.Now().After(deadline) {
+			agent.stop()
+			return nil, Err("ssh-agent did not listen to %v in %v", agent.socket, SSHAgentStartTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (a *sshAgent) stop() {
+	a.cmd.Process.Kill()
+	<-a.done
+	os.RemoveAll(a.dir)
+}
+
+// stopSSHAgent kills ssh-agent of the job, keys loaded are gone with it.
+func (s *BuildSession) stopSSHAgent() {
+	if s.ssh == nil {
+		return
+	}
+	s.ssh.stop()
+	s.ssh = nil
+}
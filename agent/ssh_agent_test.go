@@ -0,0 +1,82 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSSHKeysIntoSSHAgentOfJob(t *testing.T) {
+	if _, err := exec.LookPath("ssh-agent"); err != nil {
+		t.Skip("ssh-agent is not installed")
+	}
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	keyFile := filepath.Join(wd, "deploy_key")
+	assert.Nil(t, exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "deploy@gocd", "-f", keyFile).Run())
+	key, err := ioutil.ReadFile(keyFile)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Remove(keyFile))
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("DEPLOY_KEY", string(key), "true"),
+		protocol.ExportCommand(SSHKeysEnv, "DEPLOY_KEY", "false"),
+		protocol.ExecCommand("sh", "-c", "ssh-add -l > keys.txt && echo $SSH_AUTH_SOCK > socket.txt").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	keys, err := ioutil.ReadFile(filepath.Join(wd, "keys.txt"))
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(keys), "deploy@gocd (ED25519)"), string(keys))
+	socket, err := ioutil.ReadFile(filepath.Join(wd, "socket.txt"))
+	assert.Nil(t, err)
+	_, err = os.Stat(strings.TrimSpace(string(socket)))
+	assert.True(t, os.IsNotExist(err), "ssh-agent of the job should be stopped")
+}
+
+func TestFailJobWhenSSHKeyIsNotSet(t *testing.T) {
+	if _, err := exec.LookPath("ssh-agent"); err != nil {
+		t.Skip("ssh-agent is not installed")
+	}
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand(SSHKeysEnv, "DEPLOY_KEY", "false"),
+		echo("should not run"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(log, "Environment variable 'DEPLOY_KEY' in GO_SSH_KEYS is not set"), log)
+	assert.False(t, strings.Contains(log, "should not run"), log)
+}
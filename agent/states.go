@@ -23,9 +23,11 @@ import (
 )
 
 var state = map[string]string{
-	"runtimeStatus": "Idle",
+	"runtimeStatus": protocol.RuntimeStatusIdle,
 }
 
+var agentSession = &protocol.AgentSession{}
+
 var lock sync.Mutex
 
 func SetState(key, value string) {
@@ -41,6 +43,21 @@ func GetState(key string) string {
 	return state[key]
 }
 
+// SetAgentSession keeps session data server sent with setCookie, the
+// cookie is also kept as "cookie" state for pings.
+func SetAgentSession(session *protocol.AgentSession) {
+	SetState("cookie", session.Cookie)
+	lock.Lock()
+	defer lock.Unlock()
+	agentSession = session
+}
+
+func GetAgentSession() *protocol.AgentSession {
+	lock.Lock()
+	defer lock.Unlock()
+	return agentSession
+}
+
 func GetAgentRuntimeInfo() *protocol.AgentRuntimeInfo {
 	info := protocol.AgentRuntimeInfo{
 		Identifier: &protocol.AgentIdentifier{
@@ -51,6 +68,7 @@ func GetAgentRuntimeInfo() *protocol.AgentRuntimeInfo {
 		BuildingInfo: &protocol.AgentBuildingInfo{
 			BuildingInfo: GetState("buildLocatorForDisplay"),
 			BuildLocator: GetState("buildLocator"),
+			BuildId:      GetState("buildId"),
 		},
 		RuntimeStatus:                GetState("runtimeStatus"),
 		Location:                     config.WorkingDir,
@@ -59,6 +77,7 @@ func GetAgentRuntimeInfo() *protocol.AgentRuntimeInfo {
 		ElasticPluginId:              config.AgentAutoRegisterElasticPluginId,
 		ElasticAgentId:               config.AgentAutoRegisterElasticAgentId,
 		SupportsBuildCommandProtocol: true,
+		Labels:                       config.labels(),
 	}
 	if cookie := GetState("cookie"); cookie != "" {
 		info.Cookie = cookie
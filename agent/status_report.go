@@ -0,0 +1,166 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const StatusReportPath = "/status-report"
+
+var (
+	// StatusReportLogLines is how many lines from the end of the agent log
+	// go into a status report.
+	StatusReportLogLines = 50
+	// StatusReportReadSize is how many bytes from the end of the agent log
+	// are read for its last lines.
+	StatusReportReadSize int64 = 64 * 1024
+
+	cgroupFile    = "/proc/self/cgroup"
+	containerIdRE = regexp.MustCompile(`[0-9a-f]{64}`)
+)
+
+// StatusReport is what elastic agent plugins show on the agent status
+// report page of Go server.
+type StatusReport struct {
+	AgentId         string            `json:"agentId"`
+	Hostname        string            `json:"hostname"`
+	ElasticAgentId  string            `json:"elasticAgentId,omitempty"`
+	ElasticPluginId string            `json:"elasticPluginId,omitempty"`
+	RuntimeStatus   string            `json:"runtimeStatus"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	CurrentJob      *JobStatus        `json:"currentJob,omitempty"`
+	LastJob         *JobStatus        `json:"lastJob,omitempty"`
+	Container       *ContainerInfo    `json:"container,omitempty"`
+	RecentLogs      []string          `json:"recentLogs"`
+}
+
+type JobStatus struct {
+	BuildLocator           string `json:"buildLocator"`
+	BuildLocatorForDisplay string `json:"buildLocatorForDisplay"`
+	// Result is the job result reported to Go server, Status is the
+	// status of the build on the agent, e.g. "Error" for a build failed
+	// for an issue of the agent. Only the last job has them.
+	Result protocol.BuildStatus `json:"result,omitempty"`
+	Status string               `json:"status,omitempty"`
+}
+
+// ContainerInfo tells the container the agent runs in, found from cgroups
+// of the agent process.
+type ContainerInfo struct {
+	Id string `json:"id"`
+}
+
+func GetStatusReport() *StatusReport {
+	report := &StatusReport{
+		AgentId:         AgentId,
+		Hostname:        config.Hostname,
+		ElasticAgentId:  config.AgentAutoRegisterElasticAgentId,
+		ElasticPluginId: config.AgentAutoRegisterElasticPluginId,
+		RuntimeStatus:   GetState("runtimeStatus"),
+		Labels:          config.labels(),
+		Container:       containerInfo(),
+		RecentLogs:      recentAgentLogs(),
+	}
+	if report.RuntimeStatus == protocol.RuntimeStatusBuilding {
+		report.CurrentJob = &JobStatus{
+			BuildLocator:           GetState("buildLocator"),
+			BuildLocatorForDisplay: GetState("buildLocatorForDisplay"),
+		}
+	}
+	if status := GetState("lastBuildStatus"); status != "" {
+		report.LastJob = &JobStatus{
+			BuildLocator:           GetState("lastBuildLocator"),
+			BuildLocatorForDisplay: GetState("lastBuildLocatorForDisplay"),
+			Result:                 protocol.ServerResult(protocol.BuildStatus(status)),
+			Status:                 status,
+		}
+	}
+	return report
+}
+
+// StatusReportHandler serves the status report as JSON.
+func StatusReportHandler(w http.ResponseWriter, req *http.Request) {
+	data, err := json.Marshal(GetStatusReport())
+	if err != nil {
+		logger.Error.Printf("generate status report failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// StartStatusReportServer serves the status report at
+// config.StatusReportAddress for elastic agent plugins.
+func StartStatusReportServer() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(StatusReportPath, StatusReportHandler)
+	LogInfo("status report server listen to %v", config.StatusReportAddress)
+	return http.ListenAndServe(config.StatusReportAddress, mux)
+}
+
+func containerInfo() *ContainerInfo {
+	data, err := ioutil.ReadFile(cgroupFile)
+	if err != nil {
+		return nil
+	}
+	if id := containerIdRE.FindString(string(data)); id != "" {
+		return &ContainerInfo{Id: id}
+	}
+	return nil
+}
+
+func recentAgentLogs() []string {
+	lines := []string{}
+	if config.LogDir == "" {
+		return lines
+	}
+	f, err := os.Open(filepath.Join(config.LogDir, "gocd-golang-agent.log"))
+	if err != nil {
+		return lines
+	}
+	defer f.Close()
+	partial := false
+	if info, err := f.Stat(); err == nil && info.Size() > StatusReportReadSize {
+		_, err := f.Seek(-StatusReportReadSize, io.SeekEnd)
+		partial = err == nil
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 4096), int(StatusReportReadSize))
+	for scanner.Scan() {
+		if partial {
+			// skip the line cut by seeking
+			partial = false
+			continue
+		}
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+		if over := len(lines) - StatusReportLogLines; over > 0 {
+			lines = lines[over:]
+		}
+	}
+	return lines
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"encoding/json"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeStatusReportOfCurrentJob(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	server := httptest.NewServer(http.HandlerFunc(StatusReportHandler))
+	defer server.Close()
+
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("sleep", "0.5"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	resp, err := http.Get(server.URL)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var report StatusReport
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, AgentId, report.AgentId)
+	assert.Equal(t, "Building", report.RuntimeStatus)
+	assert.Equal(t, "/builds/"+buildId, report.CurrentJob.BuildLocator)
+	assert.True(t, len(report.RecentLogs) > 0)
+	assert.True(t, len(report.RecentLogs) <= StatusReportLogLines)
+
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	assert.Nil(t, GetStatusReport().CurrentJob)
+}
+
+func TestReportResultOfJobForEachBuildStatus(t *testing.T) {
+	var tests = []struct {
+		name    string
+		command *protocol.BuildCommand
+		status  protocol.BuildStatus
+		result  protocol.BuildStatus
+	}{
+		{"Passed", protocol.EchoCommand("hello"), protocol.BuildPassed, "Passed"},
+		{"Failed", protocol.FailCommand("boom"), protocol.BuildFailed, "Failed"},
+		{"Error", protocol.ExportCommand(ToolRequirementsEnv, "missing-tool", "false"), protocol.BuildError, "Failed"},
+		{"Cancelled", protocol.ExecCommand("sleep", "5"), protocol.BuildCanceled, "Cancelled"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setUpBuild(t, "TestReportResultOfJob"+test.name)
+			defer tearDown()
+
+			goServer.SendBuild(AgentId, buildId, test.command)
+			assert.Equal(t, "agent Building", stateLog.Next())
+			if test.status == protocol.BuildCanceled {
+				goServer.Send(AgentId, protocol.CancelMessage())
+			}
+			assert.Equal(t, "build "+string(test.result), stateLog.Next())
+			assert.Equal(t, "agent Idle", stateLog.Next())
+
+			assert.Equal(t, test.result, goServer.CompletedReport(buildId).Result)
+			last := GetStatusReport().LastJob
+			assert.Equal(t, "/builds/"+buildId, last.BuildLocator)
+			assert.Equal(t, test.result, last.Result)
+			assert.Equal(t, string(test.status), last.Status)
+		})
+	}
+}
@@ -0,0 +1,389 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/bmatcuk/doublestar"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Values of env variable GO_TASK_CACHE_REMOTE a job opts in the remote
+// task cache with.
+const (
+	RemoteTaskCacheRead      = "read"
+	RemoteTaskCacheReadWrite = "readwrite"
+)
+
+// taskCache keeps outputs of a successful exec command by fingerprint of
+// the command and its inputs, nil when the command is not cached.
+type taskCache struct {
+	wd          string
+	outputs     []string
+	fingerprint string
+	// remote is nil unless the job opted in the remote cache
+	remote CacheBackend
+	push   bool
+}
+
+func newTaskCache(wd string, cmd *protocol.BuildCommand, execCmd *exec.Cmd) (*taskCache, error) {
+	if config.TaskCacheDir == "" {
+		return nil, nil
+	}
+	if _, ok := cmd.Args["cacheOutputs"]; !ok {
+		return nil, nil
+	}
+	outputs, err := cmd.ListArg("cacheOutputs")
+	if err != nil {
+		return nil, err
+	}
+	for _, output := range outputs {
+		path := filepath.Join(wd, output)
+		if output == "" || !strings.HasPrefix(path, wd+string(filepath.Separator)) {
+			return nil, Err("Cache output %v is outside the working directory %v", output, wd)
+		}
+	}
+	var inputs, envNames []string
+	if _, ok := cmd.Args["cacheInputs"]; ok {
+		if inputs, err = cmd.ListArg("cacheInputs"); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := cmd.Args["cacheEnv"]; ok {
+		if envNames, err = cmd.ListArg("cacheEnv"); err != nil {
+			return nil, err
+		}
+	}
+	fingerprint, err := taskFingerprint(wd, cmd, execCmd, inputs, envNames)
+	if err != nil {
+		return nil, err
+	}
+	c := &taskCache{wd: wd, outputs: outputs, fingerprint: fingerprint}
+	switch remote := envMap(execCmd.Env)["GO_TASK_CACHE_REMOTE"]; remote {
+	case "":
+	case RemoteTaskCacheRead, RemoteTaskCacheReadWrite:
+		if config.TaskCacheURL == "" {
+			break
+		}
+		if c.remote, err = NewCacheBackend(config.TaskCacheURL); err != nil {
+			return nil, err
+		}
+		c.push = remote == RemoteTaskCacheReadWrite
+	default:
+		return nil, Err("GO_TASK_CACHE_REMOTE is invalid: %v, it should be %v or %v",
+			remote, RemoteTaskCacheRead, RemoteTaskCacheReadWrite)
+	}
+	return c, nil
+}
+
+func envMap(env []string) map[string]string {
+	m := make(map[string]string)
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i > 0 {
+			m[kv[:i]] = kv[i+1:]
+		}
+	}
+	return m
+}
+
+// taskFingerprint hashes working directory, command line, input, env
+// variables named envNames and content of files matched by inputs.
+func taskFingerprint(wd string, cmd *protocol.BuildCommand, execCmd *exec.Cmd, inputs, envNames []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "wd %q\n", cmd.WorkingDirectory)
+	fmt.Fprintf(h, "args %q\n", execCmd.Args)
+	fmt.Fprintf(h, "input %q\n", cmd.ExecInput)
+
+	env := envMap(execCmd.Env)
+	sort.Strings(envNames)
+	for _, name := range envNames {
+		fmt.Fprintf(h, "env %q=%q\n", name, env[name])
+	}
+
+	files := make(map[string]bool)
+	for _, input := range inputs {
+		matches, err := doublestar.Glob(EscapeGlob(wd) + "/" + input)
+		if err != nil {
+			return "", err
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+				files[match] = true
+			}
+		}
+	}
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return "", err
+		}
+		rel, _ := filepath.Rel(wd, path)
+		fmt.Fprintf(h, "file %q %v\n", filepath.ToSlash(rel), sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *taskCache) dir() string {
+	return filepath.Join(config.TaskCacheDir, c.fingerprint)
+}
+
+// restore replaces outputs in working directory with the cached ones,
+// false when the fingerprint is not cached.
+func (c *taskCache) restore() (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+	if _, err := os.Stat(c.dir()); err != nil {
+		if found, err := c.fetch(); !found || err != nil {
+			return false, err
+		}
+	}
+	for _, output := range c.outputs {
+		dest := filepath.Join(c.wd, output)
+		if err := os.RemoveAll(dest); err != nil {
+			return false, err
+		}
+		src := filepath.Join(c.dir(), output)
+		if _, err := os.Lstat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := copyTree(src, dest); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// save copies outputs into the cache, outputs that do not exist are
+// cached as absent.
+func (c *taskCache) save() error {
+	if c == nil {
+		return nil
+	}
+	if err := Mkdirs(config.TaskCacheDir); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(config.TaskCacheDir, c.fingerprint+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	for _, output := range c.outputs {
+		src := filepath.Join(c.wd, output)
+		if _, err := os.Lstat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := copyTree(src, filepath.Join(tmp, output)); err != nil {
+			return err
+		}
+	}
+	// rename so that a fingerprint is never found half cached
+	if err := os.Rename(tmp, c.dir()); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if c.push {
+		return c.upload()
+	}
+	return nil
+}
+
+// fetch gets the entry from remote cache into the local one, false when
+// remote cache does not have it.
+func (c *taskCache) fetch() (bool, error) {
+	if c.remote == nil {
+		return false, nil
+	}
+	if err := Mkdirs(config.TaskCacheDir); err != nil {
+		return false, err
+	}
+	archive, err := ioutil.TempFile(config.TaskCacheDir, c.fingerprint+".tar.gz")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+	if found, err := c.remote.Get(c.fingerprint, archive); !found || err != nil {
+		return false, err
+	}
+	LogInfo("fetched task cache %v from remote cache", c.fingerprint)
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	tmp, err := ioutil.TempDir(config.TaskCacheDir, c.fingerprint+".tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmp)
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return false, err
+	}
+	if err := extractTar(gz, tmp); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, c.dir()); err != nil && !os.IsExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// upload puts the local entry to remote cache.
+func (c *taskCache) upload() error {
+	archive, err := ioutil.TempFile(config.TaskCacheDir, c.fingerprint+".tar.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+	if err := writeTarGz(c.dir(), archive); err != nil {
+		return err
+	}
+	size, err := archive.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return c.remote.Put(c.fingerprint, archive, size)
+}
+
+// writeTarGz writes files, symlinks and directories in dir to w as a
+// gzipped tar.
+func writeTarGz(dir string, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// copyTree copies file, symlink or directory src to dest.
+func copyTree(src, dest string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := Mkdirs(filepath.Dir(target)); err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyRegularFile(path, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+func copyRegularFile(src, dest string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := Mkdirs(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// cacheServer is a remote task cache keeping entries by request path.
+type cacheServer struct {
+	mu       sync.Mutex
+	entries  map[string][]byte
+	requests []*http.Request
+}
+
+func (c *cacheServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, req)
+	switch req.Method {
+	case http.MethodPut:
+		body, _ := ioutil.ReadAll(req.Body)
+		c.entries[req.URL.Path] = body
+	case http.MethodGet:
+		if body, ok := c.entries[req.URL.Path]; ok {
+			w.Write(body)
+		} else {
+			http.NotFound(w, req)
+		}
+	}
+}
+
+func TestRestoreOutputsOfCachedTask(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "gocd-task-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheDir)
+	GetConfig().TaskCacheDir = cacheDir
+	defer func() {
+		GetConfig().TaskCacheDir = ""
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	writeFile(filepath.Join(wd, "src"), "main.c", "int main() {}")
+	build := func() *protocol.BuildCommand {
+		return protocol.ExecCommand("sh", "-c", "mkdir -p bin && cp src/main.c bin/app").
+			SetCache([]string{"src/**"}, []string{"bin"}, []string{"CC"}).
+			Setwd(relativePath(wd))
+	}
+	goServer.SendBuild(AgentId, buildId,
+		build(),
+		protocol.ExecCommand("rm", "-rf", "bin").Setwd(relativePath(wd)),
+		build(),
+		protocol.ExecCommand("sh", "-c", "echo 'int main() { return 1; }' > src/main.c").Setwd(relativePath(wd)),
+		build(),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	task := execBanner(wd, "sh", "-c", "mkdir -p bin && cp src/main.c bin/app")
+	entries, err := ioutil.ReadDir(cacheDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	restored := ""
+	for _, entry := range entries {
+		if contains(log, entry.Name()) {
+			restored = entry.Name()
+		}
+	}
+	assert.Equal(t, 64, len(restored))
+	expected := task +
+		execBanner(wd, "rm", "-rf", "bin") +
+		Sprintf("[go] Skipped task %v, outputs are restored from task cache %v\n",
+			ShellQuote("sh", "-c", "mkdir -p bin && cp src/main.c bin/app"), restored) +
+		execBanner(wd, "sh", "-c", "echo 'int main() { return 1; }' > src/main.c") +
+		task
+	assert.Equal(t, expected, trimTimestamp(log))
+
+	content, err := ioutil.ReadFile(filepath.Join(wd, "bin", "app"))
+	assert.Nil(t, err)
+	assert.Equal(t, "int main() { return 1; }\n", string(content))
+}
+
+func TestFetchCachedTaskFromRemoteCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "gocd-task-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheDir)
+	remote := &cacheServer{entries: make(map[string][]byte)}
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	GetConfig().TaskCacheDir = cacheDir
+	GetConfig().TaskCacheURL = server.URL + "/cache"
+	defer func() {
+		GetConfig().TaskCacheDir = ""
+		GetConfig().TaskCacheURL = ""
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	writeFile(filepath.Join(wd, "src"), "main.c", "int main() {}")
+	build := protocol.ExecCommand("sh", "-c", "mkdir -p bin && cp src/main.c bin/app").
+		SetCache([]string{"src/**"}, []string{"bin"}, nil).
+		Setwd(relativePath(wd))
+	clean := protocol.ExecCommand("sh", "-c", "rm -rf bin "+cacheDir+"/*").Setwd(relativePath(wd))
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("GO_TASK_CACHE_REMOTE", "readwrite", "false"),
+		build,
+		clean,
+		build,
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	remote.mu.Lock()
+	assert.Equal(t, 1, len(remote.entries))
+	var key string
+	for path := range remote.entries {
+		key = strings.TrimSuffix(strings.TrimPrefix(path, "/cache/"), ".tar.gz")
+	}
+	remote.mu.Unlock()
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(log, Sprintf("outputs are restored from task cache %v\n", key)))
+
+	content, err := ioutil.ReadFile(filepath.Join(wd, "bin", "app"))
+	assert.Nil(t, err)
+	assert.Equal(t, "int main() {}", string(content))
+}
+
+func TestS3CacheBackend(t *testing.T) {
+	remote := &cacheServer{entries: make(map[string][]byte)}
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	backend := &S3CacheBackend{
+		Bucket:          "builds",
+		Prefix:          "cache/",
+		Region:          "us-east-1",
+		AccessKeyId:     "AKID",
+		SecretAccessKey: "secret",
+		Endpoint:        server.URL,
+		Client:          http.DefaultClient,
+	}
+
+	var got strings.Builder
+	found, err := backend.Get("abc", &got)
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	err = backend.Put("abc", strings.NewReader("entry"), 5)
+	assert.Nil(t, err)
+	found, err = backend.Get("abc", &got)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "entry", got.String())
+
+	put := remote.requests[1]
+	assert.Equal(t, "/builds/cache/abc.tar.gz", put.URL.Path)
+	assert.Equal(t, "UNSIGNED-PAYLOAD", put.Header.Get("X-Amz-Content-Sha256"))
+	assert.True(t, strings.HasPrefix(put.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"))
+	assert.True(t, contains(put.Header.Get("Authorization"), "/us-east-1/s3/aws4_request"))
+}
@@ -23,13 +23,13 @@ import (
 	"strings"
 )
 
-func CommandTest(s *BuildSession, cmd *protocol.BuildCommand) error {
+func CommandTest(ctx *BuildContext, cmd *protocol.BuildCommand) error {
 	flag := cmd.Args["flag"]
 
 	if flag == "-eq" || flag == "-neq" || flag == "-in" || flag == "-nin" {
-		output, err := s.processTestCommand(cmd.SubCommands[0])
+		output, err := ctx.commands().processTestCommand(cmd.SubCommands[0])
 		if err != nil {
-			s.debugLog("test -eq exec command error: %v", err)
+			ctx.debugLog("test -eq exec command error: %v", err)
 		}
 		expected := strings.TrimSpace(cmd.Args["left"])
 		actual := strings.TrimSpace(output.String())
@@ -54,7 +54,7 @@ func CommandTest(s *BuildSession, cmd *protocol.BuildCommand) error {
 		return nil
 	}
 
-	targetPath := filepath.Join(s.wd, cmd.Args["left"])
+	targetPath := filepath.Join(ctx.Wd, cmd.Args["left"])
 	info, err := os.Stat(targetPath)
 	switch flag {
 	case "-d":
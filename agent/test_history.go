@@ -0,0 +1,150 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TestHistoryLength is how many latest results of a test are kept
+	TestHistoryLength = 10
+	// TestHistoryMaxTests is how many tests are kept in the history file,
+	// the ones not seen for the longest time are dropped
+	TestHistoryMaxTests = 50000
+)
+
+// FlakyTest is a test that passed, failed and passed again in its latest
+// results, History is the results, oldest first, "P" for passed and "F"
+// for failed.
+type FlakyTest struct {
+	Name    string
+	History string
+}
+
+type testResults struct {
+	Results string `json:"results"`
+	Seen    int64  `json:"seen"`
+}
+
+// testHistory is results of tests per job, it is kept in
+// config.TestHistoryFile.
+type testHistory map[string]map[string]*testResults
+
+var testHistoryMu sync.Mutex
+
+// recordTestHistory adds results of test cases of the build to the test
+// history of its job, and returns the tests that turned flaky with them.
+// Failing to keep the history is a warning only.
+func recordTestHistory(ctx *BuildContext, cases []*TestCase) []*FlakyTest {
+	testHistoryMu.Lock()
+	defer testHistoryMu.Unlock()
+	history := make(testHistory)
+	if err := readJSONFile(config.TestHistoryFile, &history); err != nil {
+		ctx.warn("test history %v is ignored: %v", config.TestHistoryFile, err)
+		history = make(testHistory)
+	}
+	job := locatorJob(ctx.BuildLocator)
+	tests := history[job]
+	if tests == nil {
+		tests = make(map[string]*testResults)
+		history[job] = tests
+	}
+	now := time.Now().Unix()
+	var flaky []*FlakyTest
+	for _, tc := range cases {
+		if tc.Skipped {
+			continue
+		}
+		name := tc.Name
+		if tc.ClassName != "" {
+			name = tc.ClassName + "." + tc.Name
+		}
+		result := "P"
+		if tc.Failure != nil || tc.Error != nil {
+			result = "F"
+		}
+		r := tests[name]
+		if r == nil {
+			r = &testResults{}
+			tests[name] = r
+		}
+		wasFlaky := isFlaky(r.Results)
+		r.Results += result
+		if len(r.Results) > TestHistoryLength {
+			r.Results = r.Results[len(r.Results)-TestHistoryLength:]
+		}
+		r.Seen = now
+		if !wasFlaky && isFlaky(r.Results) {
+			flaky = append(flaky, &FlakyTest{Name: name, History: r.Results})
+		}
+	}
+	history.prune(TestHistoryMaxTests)
+	if err := writeJSONFile(config.TestHistoryFile, history); err != nil {
+		ctx.warn("could not write test history %v: %v", config.TestHistoryFile, err)
+	}
+	for _, f := range flaky {
+		ctx.ConsoleLog("[go] Test %v is flaky, latest results: %v\n", f.Name, f.History)
+	}
+	return flaky
+}
+
+// isFlaky tells whether a test failed once between passes.
+func isFlaky(results string) bool {
+	return strings.Contains(results, "PFP")
+}
+
+// locatorJob is the build locator without counters, e.g.
+// "pipeline/stage/job" of "pipeline/12/stage/1/job".
+func locatorJob(locator string) string {
+	var parts []string
+	for _, part := range strings.Split(strings.Trim(locator, "/"), "/") {
+		if _, err := strconv.Atoi(part); err != nil {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// prune drops the tests not seen for the longest time when there are
+// more than max tests.
+func (h testHistory) prune(max int) {
+	type seen struct {
+		job, test string
+		at        int64
+	}
+	var all []seen
+	for job, tests := range h {
+		for test, r := range tests {
+			all = append(all, seen{job, test, r.Seen})
+		}
+	}
+	if len(all) <= max {
+		return
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].at < all[j].at })
+	for _, s := range all[:len(all)-max] {
+		delete(h[s.job], s.test)
+		if len(h[s.job]) == 0 {
+			delete(h, s.job)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFlagNewlyFlakyTestsInTestReport(t *testing.T) {
+	historyFile := filepath.Join(os.TempDir(), "test-history-flaky.json")
+	defer os.Remove(historyFile)
+	GetConfig().TestHistoryFile = historyFile
+	defer func() {
+		GetConfig().TestHistoryFile = filepath.Join(GetConfig().WorkingDir, "test-history.json")
+	}()
+	setUp(t)
+	defer tearDown()
+
+	// builds run with the same locator, as builds of the same job
+	wd := createPipelineDir()
+	report := func(failure string) string {
+		xml := `<testsuite name="Foo" tests="2" failures="0" errors="0" time="0.2">
+  <testcase classname="com.example.Foo" name="testStable" time="0.1"/>
+  <testcase classname="com.example.Foo" name="testFlaky" time="0.1">` + failure + `</testcase>
+</testsuite>`
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(wd, "junit.xml"), []byte(xml), 0644))
+		goServer.SendBuild(AgentId, buildId,
+			protocol.GenerateTestReportCommand("testoutput", "junit.xml").Setwd(relativePath(wd)),
+		)
+		assert.Equal(t, "agent Building", stateLog.Next())
+		assert.Equal(t, "build Passed", stateLog.Next())
+		assert.Equal(t, "agent Idle", stateLog.Next())
+		content, err := ioutil.ReadFile(goServer.ArtifactFile(buildId, "testoutput/index.html"))
+		assert.Nil(t, err)
+		return string(content)
+	}
+
+	assert.False(t, strings.Contains(report(""), "Newly Flaky Tests"))
+	assert.False(t, strings.Contains(report(`<failure message="timeout">timeout</failure>`), "Newly Flaky Tests"))
+	content := report("")
+	assert.True(t, strings.Contains(content, "Newly Flaky Tests (1)"), content)
+	assert.True(t, strings.Contains(content, "com.example.Foo.testFlaky"), content)
+	assert.True(t, strings.Contains(content, "PFP"), content)
+	assert.False(t, strings.Contains(content, "com.example.Foo.testStable"), content)
+
+	assert.False(t, strings.Contains(report(""), "Newly Flaky Tests"))
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"context"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ToolRequirementsEnv is the job environment variable declaring tools the
+// job needs on the agent, e.g. "git>=2.30,docker".
+const ToolRequirementsEnv = "GO_AGENT_REQUIRES"
+
+var (
+	// ToolVersionTimeout is how long to wait for a tool to print its version.
+	ToolVersionTimeout = 10 * time.Second
+
+	// toolVersionArgs are arguments printing version of tools not
+	// supporting "--version".
+	toolVersionArgs = map[string][]string{
+		"go":   {"version"},
+		"java": {"-version"},
+	}
+
+	toolRequirementRE = regexp.MustCompile(`^([^<>=\s]+)\s*(?:(>=|<=|==|=|>|<)\s*(\S+))?$`)
+	toolVersionRE     = regexp.MustCompile(`\d+(\.\d+)+`)
+)
+
+type ToolRequirement struct {
+	Tool     string
+	Operator string
+	Version  []int
+
+	declared string
+}
+
+func (r *ToolRequirement) String() string {
+	return r.declared
+}
+
+func ParseToolRequirements(requires string) ([]*ToolRequirement, error) {
+	var requirements []*ToolRequirement
+	for _, item := range strings.Split(requires, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		match := toolRequirementRE.FindStringSubmatch(item)
+		if match == nil {
+			return nil, Err("invalid tool requirement %q", item)
+		}
+		requirement := &ToolRequirement{Tool: match[1], Operator: match[2], declared: item}
+		if requirement.Operator != "" {
+			version, err := ParseVersion(match[3])
+			if err != nil {
+				return nil, Err("invalid tool requirement %q: %v", item, err)
+			}
+			requirement.Version = version
+		}
+		requirements = append(requirements, requirement)
+	}
+	return requirements, nil
+}
+
+// checkToolRequirements checks tools declared by job environment variable
+// ToolRequirementsEnv, so that a job missing tools fails before running
+// any task.
+func (s *BuildSession) checkToolRequirements(requires string) error {
+	requirements, err := ParseToolRequirements(requires)
+	if err != nil {
+		return Err("%v is invalid: %v", ToolRequirementsEnv, err)
+	}
+	var unmet []string
+	for _, requirement := range requirements {
+		if err := s.checkToolRequirement(requirement); err != nil {
+			unmet = append(unmet, err.Error())
+		}
+	}
+	if len(unmet) > 0 {
+		return infraErr(protocol.ReassignToolMissing, Err("Job tool requirements are not met: %v", strings.Join(unmet, "; ")))
+	}
+	return nil
+}
+
+func (s *BuildSession) checkToolRequirement(requirement *ToolRequirement) error {
+	path, err := lookPath(requirement.Tool, s.Env())
+	if err != nil {
+		return Err("%v is required but %v is not found in PATH", requirement, requirement.Tool)
+	}
+	if requirement.Operator == "" {
+		s.ConsoleLog("Found required tool %v at %v\n", requirement.Tool, path)
+		return nil
+	}
+	version, err := s.toolVersion(path, requirement.Tool)
+	if err != nil {
+		return Err("%v is required but version of %v could not be found: %v", requirement, path, err)
+	}
+	if !versionSatisfies(version, requirement) {
+		return Err("%v is required but %v is version %v", requirement, path, joinVersion(version))
+	}
+	s.ConsoleLog("Found required tool %v %v at %v\n", requirement.Tool, joinVersion(version), path)
+	return nil
+}
+
+// lookPath is exec.LookPath searching PATH of env, i.e. PATH tasks of
+// the job run with, rather than PATH of the agent.
+func lookPath(file string, env []string) (string, error) {
+	if strings.ContainsRune(file, '/') || strings.ContainsRune(file, filepath.Separator) {
+		return exec.LookPath(file)
+	}
+	path := ""
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") || runtime.GOOS == "windows" && strings.HasPrefix(strings.ToUpper(e), "PATH=") {
+			path = e[len("PATH="):]
+		}
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		if found, err := exec.LookPath(filepath.Join(dir, file)); err == nil {
+			return found, nil
+		}
+	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+}
+
+func (s *BuildSession) toolVersion(path, tool string) ([]int, error) {
+	args, ok := toolVersionArgs[tool]
+	if !ok {
+		args = []string{"--version"}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ToolVersionTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = s.Env()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, err
+	}
+	version := toolVersionRE.FindString(string(out))
+	if version == "" {
+		return nil, Err("no version in output of %v %v", tool, strings.Join(args, " "))
+	}
+	return ParseVersion(version)
+}
+
+func versionSatisfies(version []int, requirement *ToolRequirement) bool {
+	c := CompareVersions(version, requirement.Version)
+	switch requirement.Operator {
+	case ">=":
+		return c >= 0
+	case ">":
+		return c > 0
+	case "<=":
+		return c <= 0
+	case "<":
+		return c < 0
+	default:
+		return c == 0
+	}
+}
+
+func joinVersion(version []int) string {
+	parts := make([]string, len(version))
+	for i, n := range version {
+		parts[i] = Sprintf("%v", n)
+	}
+	return strings.Join(parts, ".")
+}
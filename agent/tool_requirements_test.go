@@ -0,0 +1,97 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFailJobWhenRequiredToolsAreMissing(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	bin := filepath.Join(createPipelineDir(), "bin")
+	assert.Nil(t, os.Mkdir(bin, 0755))
+	tool := filepath.Join(bin, "fake-tool")
+	assert.Nil(t, ioutil.WriteFile(tool, []byte("#!/bin/sh\necho \"fake-tool version 1.2.3\"\n"), 0755))
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand(ToolRequirementsEnv, "fake-tool>=1.2, fake-tool>2, missing-tool", "false"),
+		echo("should not run"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf("setting environment variable '%v' to value 'fake-tool>=1.2, fake-tool>2, missing-tool'\n", ToolRequirementsEnv) +
+		Sprintf("Found required tool fake-tool 1.2.3 at %v\n", tool) +
+		Sprintf("ERROR: Job tool requirements are not met: fake-tool>2 is required but %v is version 1.2.3; missing-tool is required but missing-tool is not found in PATH\n", tool)
+	assert.Equal(t, expected, trimTimestamp(log))
+
+	report := goServer.CompletedReport(buildId)
+	assert.NotNil(t, report.Reassign)
+	assert.Equal(t, protocol.ReassignToolMissing, report.Reassign.Reason)
+}
+
+func TestFindRequiredToolsInPathOfJob(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	bin := filepath.Join(createPipelineDir(), "bin")
+	assert.Nil(t, os.Mkdir(bin, 0755))
+	tool := filepath.Join(bin, "job-tool")
+	assert.Nil(t, ioutil.WriteFile(tool, []byte("#!/bin/sh\necho \"job-tool 2.0\"\n"), 0755))
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"), "false"),
+		protocol.ExportCommand(ToolRequirementsEnv, "job-tool>=2", "false"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(trimTimestamp(log), Sprintf("Found required tool job-tool 2.0 at %v\n", tool)), log)
+}
+
+func TestParseToolRequirements(t *testing.T) {
+	requirements, err := ParseToolRequirements("git>=2.30, docker,node = 18")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(requirements))
+	assert.Equal(t, "git", requirements[0].Tool)
+	assert.Equal(t, ">=", requirements[0].Operator)
+	assert.Equal(t, []int{2, 30}, requirements[0].Version)
+	assert.Equal(t, "docker", requirements[1].Tool)
+	assert.Equal(t, "", requirements[1].Operator)
+	assert.Equal(t, "=", requirements[2].Operator)
+
+	_, err = ParseToolRequirements("git>=latest")
+	assert.NotNil(t, err)
+}
@@ -21,6 +21,8 @@ var UNIT_TEST_REPORT_TEMPLATE = `<div class="tests">
     <span class="tests_total_count">{{.Tests}}</span>
     , Failures:
     <span class="tests_failed_count">{{.Failures}}</span>
+    , Errors:
+    <span class="tests_error_count">{{.Errors}}</span>
     , Not run:
     <span class="tests_ignored_count">{{.Skipped}}</span>
     , Time:
@@ -29,7 +31,21 @@ var UNIT_TEST_REPORT_TEMPLATE = `<div class="tests">
   </p>
 </div>
 
-{{if .Failures }}
+{{if .FlakyTests}}
+<table class="section-table" cellpadding="2" cellspacing="0" border="0" width="98%">
+  <tr>
+    <td colspan="2" class="sectionheader">Newly Flaky Tests ({{ len .FlakyTests }})</td>
+  </tr>
+  {{range .FlakyTests}}
+  <tr>
+    <td class="section-data">{{ .Name }}</td>
+    <td class="section-data">{{ .History }}</td>
+  </tr>
+  {{end}}
+</table>
+{{end}}
+
+{{if .FailuresAndErrors }}
 <table class="section-table" cellpadding="2" cellspacing="0" border="0" width="98%">
   {{range .TestCases}}
     {{if .Failure}}
@@ -47,10 +63,10 @@ var UNIT_TEST_REPORT_TEMPLATE = `<div class="tests">
   {{end}}
 </table>
 {{end}}
-{{if .Failures}}
+{{if .FailuresAndErrors}}
 <table class="section-table" cellpadding="2" cellspacing="0" border="0" width="98%">
   <tr>
-    <td colspan="2" class="sectionheader">Unit Test Failure and Error Details ({{ .Failures }})</td>
+    <td colspan="2" class="sectionheader">Unit Test Failure and Error Details ({{ .FailuresAndErrors }})</td>
   </tr>
   {{range .TestCases}}
     {{if .Failure}}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// serverRejectsGzip is set once Go server responded 415 to a gzipped
+// upload, later uploads are sent as they are until the agent connects
+// again.
+var serverRejectsGzip int32
+
+// gzipUploads is true when compressible files of artifact uploads are
+// stored in the zip as they are and the whole request body is gzipped.
+func gzipUploads() bool {
+	return len(config.GzipUploadExtensions) > 0 && atomic.LoadInt32(&serverRejectsGzip) == 0
+}
+
+func rejectGzipUploads() {
+	if atomic.CompareAndSwapInt32(&serverRejectsGzip, 0, 1) {
+		LogInfo("Go server does not accept gzipped artifact uploads, sending them as they are")
+	}
+}
+
+func resetGzipUploads() {
+	atomic.StoreInt32(&serverRejectsGzip, 0)
+}
+
+// compressible tells whether path has one of config.GzipUploadExtensions.
+func compressible(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range config.GzipUploadExtensions {
+		if strings.ToLower("."+strings.TrimPrefix(e, ".")) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func gzipBody(dst *bytes.Buffer, body []byte) error {
+	gz := gzip.NewWriter(dst)
+	if _, err := gz.Write(body); err != nil {
+		return err
+	}
+	return gz.Close()
+}
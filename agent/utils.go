@@ -19,16 +19,34 @@ package agent
 import (
 	"bytes"
 	"crypto/md5"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
 func Join(sep string, parts ...string) string {
 	var buf bytes.Buffer
 	for i, s := range parts {
@@ -67,18 +85,60 @@ func BaseDirOfPathWithWildcard(path string) string {
 	return base[:len(base)-1]
 }
 
-func AppendUrlParam(base *url.URL, paramName, paramValue string) *url.URL {
-	url, _ := url.Parse(base.String())
-	values := url.Query()
-	values.Set(paramName, paramValue)
-	base.RawQuery = values.Encode()
-	return url
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`,
+	"[", `\[`, "]", `\]`, "{", `\{`, "}", `\}`)
+
+// EscapeGlob escapes glob meta characters in path so that it is matched
+// literally. Path is returned as is on Windows, where '\' is the path
+// separator instead of the escape character.
+func EscapeGlob(path string) string {
+	if runtime.GOOS == "windows" {
+		return path
+	}
+	return globEscaper.Replace(path)
+}
+
+// ParseGCPercent parses GOGC value, "off" turns GC off.
+func ParseGCPercent(s string) (int, error) {
+	if strings.EqualFold(strings.TrimSpace(s), "off") {
+		return -1, nil
+	}
+	percent, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, Err("invalid GOGC value %q", s)
+	}
+	return percent, nil
+}
+
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
 }
 
-func AppendUrlPath(base *url.URL, path string) *url.URL {
-	url, _ := url.Parse(base.String())
-	url.RawPath = Join("/", url.RawPath, path)
-	return url
+// copyBuffered is io.Copy with a pooled buffer.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// DirSize returns total size of files in dir, symlinks are not followed.
+func DirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
 }
 
 func Mkdirs(path string) error {
@@ -122,19 +182,7 @@ func isClosedChan(ch chan bool) bool {
 }
 
 func ParseChecksum(checksum string) map[string]string {
-	ret := make(map[string]string)
-	for _, l := range strings.Split(checksum, "\n") {
-		if strings.HasPrefix(l, "#") {
-			continue
-		}
-		// issue #30 : The string 'l' sometimes has "\r" add which make the md5 checksum invalid.
-		l = strings.Trim(l,"\r");
-		i := strings.Index(l, "=")
-		if i > -1 {
-			ret[l[:i]] = l[i+1:]
-		}
-	}
-	return ret
+	return protocol.ParseProperties(checksum)
 }
 
 func ComputeMd5(filePath string) (string, error) {
@@ -152,3 +200,175 @@ func ComputeMd5(filePath string) (string, error) {
 	var result []byte
 	return Sprintf("%x", hash.Sum(result)), nil
 }
+
+// ParseByteSize parses sizes like "512", "100KB", "50GB"; empty means 0.
+func ParseByteSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	if size == "" {
+		return 0, nil
+	}
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(size, unit.suffix) {
+			n, err := strconv.ParseInt(strings.TrimSpace(size[:len(size)-len(unit.suffix)]), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return n * unit.size, nil
+		}
+	}
+	return strconv.ParseInt(size, 10, 64)
+}
+
+func FormatByteSize(size int64) string {
+	for _, unit := range byteSizeUnits {
+		if size >= unit.size && unit.size > 1 {
+			return Sprintf("%.1f %v", float64(size)/float64(unit.size), unit.suffix)
+		}
+	}
+	return Sprintf("%d B", size)
+}
+
+// ParseLabels parses comma separated key=value pairs, e.g.
+// "team=payments,zone=eu-west-1".
+func ParseLabels(labels string) (map[string]string, error) {
+	ret := make(map[string]string)
+	for _, label := range strings.Split(labels, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		i := strings.Index(label, "=")
+		if i < 1 {
+			return nil, Err("label '%v' is not in key=value format", label)
+		}
+		ret[strings.TrimSpace(label[:i])] = strings.TrimSpace(label[i+1:])
+	}
+	return ret, nil
+}
+
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// SanitizeForLog quotes control characters of s and cuts it down to max
+// bytes, so that untrusted payloads cannot forge or flood log lines.
+func SanitizeForLog(s string, max int) string {
+	if len(s) <= max {
+		return strconv.Quote(s)
+	}
+	return Sprintf("%v...(%v more bytes)", strconv.Quote(s[:max]), len(s)-max)
+}
+
+// ShellQuote joins args into a command line that can be pasted into a
+// POSIX shell, args with special characters are single quoted.
+func ShellQuote(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-./=:@%+,") == "" {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// secretQueryParams are parts of names of query parameters that may carry
+// credentials in URLs from server, e.g. "token" and "X-Amz-Signature".
+var secretQueryParams = []string{"token", "key", "secret", "signature", "sig", "password", "auth", "credential"}
+
+// redactedInURL replaces secrets in URLs, where "******" would be escaped.
+const redactedInURL = "REDACTED"
+
+// SanitizeURL returns u for logging, with password of user info and
+// values of query parameters that may carry credentials redacted.
+func SanitizeURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	sanitized := *u
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			sanitized.User = url.UserPassword(u.User.Username(), redactedInURL)
+		}
+	}
+	if u.RawQuery != "" {
+		query, err := url.ParseQuery(u.RawQuery)
+		if err != nil {
+			sanitized.RawQuery = redactedInURL
+		} else if redactSecretParams(query) {
+			sanitized.RawQuery = query.Encode()
+		}
+	}
+	return sanitized.String()
+}
+
+// SanitizeURLString is SanitizeURL of URL s, which is left out when it
+// is invalid.
+func SanitizeURLString(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "[invalid URL]"
+	}
+	return SanitizeURL(u)
+}
+
+// SanitizeError sanitizes URL of errors of HTTP requests, which are
+// logged and shown in console.
+func SanitizeError(err error) error {
+	if ue, ok := err.(*url.Error); ok {
+		return &url.Error{Op: ue.Op, URL: SanitizeURLString(ue.URL), Err: ue.Err}
+	}
+	return err
+}
+
+func redactSecretParams(query url.Values) bool {
+	redactedAny := false
+	for name, values := range query {
+		lower := strings.ToLower(name)
+		for _, secret := range secretQueryParams {
+			if strings.Contains(lower, secret) {
+				for i := range values {
+					values[i] = redactedInURL
+				}
+				redactedAny = true
+				break
+			}
+		}
+	}
+	return redactedAny
+}
+
+// readJSONFile decodes json file into v, v is untouched when file does
+// not exist.
+func readJSONFile(file string, v interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSONFile replaces file with v encoded as json through a temp file,
+// so that it is never left half written.
+func writeJSONFile(file string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := Mkdirs(filepath.Dir(file)); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
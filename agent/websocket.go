@@ -17,8 +17,11 @@
 package agent
 
 import (
+	"crypto/tls"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"golang.org/x/net/websocket"
+	"net"
+	"strings"
 	"time"
 )
 
@@ -26,6 +29,14 @@ type WebsocketConnection struct {
 	Conn     *websocket.Conn
 	Send     chan *protocol.Message
 	Received chan *protocol.Message
+
+	closeFrames *closeFrameReader
+}
+
+// CloseStatus returns how server closed the connection, nil if server
+// has not sent a close frame.
+func (wc *WebsocketConnection) CloseStatus() *CloseStatus {
+	return wc.closeFrames.CloseStatus()
 }
 
 func (wc *WebsocketConnection) Close() {
@@ -46,18 +57,65 @@ func MakeWebsocketConnection(wsLoc, httpLoc string) (*WebsocketConnection, error
 		return nil, err
 	}
 	wsConfig.TlsConfig = tlsConfig
-	LogInfo("connect to: %v", wsLoc)
-	ws, err := websocket.DialConfig(wsConfig)
+	auth, err := AgentHttpAuth()
+	if err != nil {
+		return nil, err
+	}
+	auth.Authenticate(wsConfig.Header)
+	LogInfo("connect to: %v", SanitizeURLString(wsLoc))
+	tlsConn, err := dialServer(hostAndPort(wsConfig.Location), tlsConfig)
 	if err != nil {
 		return nil, err
 	}
+	closeFrames := &closeFrameReader{Conn: tlsConn}
+	ws, err := websocket.NewClient(wsConfig, closeFrames)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
 	acknowledge := make(chan string)
 	send := make(chan *protocol.Message)
 	received := make(chan *protocol.Message)
 
 	go startReceiveMessage(ws, received, acknowledge)
 	go startSendMessage(ws, send, acknowledge)
-	return &WebsocketConnection{Conn: ws, Send: send, Received: received}, nil
+	return &WebsocketConnection{Conn: ws, Send: send, Received: received, closeFrames: closeFrames}, nil
+}
+
+// ServerDialFallbackDelay is how long dialing server waits for addresses
+// of the first address family before also trying the other family.
+const ServerDialFallbackDelay = 300 * time.Millisecond
+
+// dialServer dials host of hostport by name for every connection, so that
+// the agent follows DNS based failover of server instead of connecting to
+// a dead address again. net.Dialer tries the resolved addresses in order,
+// and dials a dual-stack host like Happy Eyeballs (RFC 8305).
+func dialServer(hostport string, tlsConfig *tls.Config) (*tls.Conn, error) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		// zone of an IPv6 literal is not part of its certificate
+		tlsConfig.ServerName = stripZone(host)
+	}
+	dialer := &net.Dialer{Timeout: ServerURLDialTimeout, FallbackDelay: ServerDialFallbackDelay}
+	conn, err := tls.DialWithDialer(dialer, "tcp", hostport, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	LogInfo("connected to %v at %v", host, conn.RemoteAddr())
+	return conn, nil
+}
+
+// stripZone returns host without zone of an IPv6 literal, e.g. "fe80::1"
+// of "fe80::1%eth0".
+func stripZone(host string) string {
+	if i := strings.LastIndex(host, "%"); i > 0 && net.ParseIP(host[:i]) != nil {
+		return host[:i]
+	}
+	return host
 }
 
 func startSendMessage(ws *websocket.Conn, send chan *protocol.Message, acknowledge chan string) {
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// Close codes of websocket connections closed by server, see RFC 6455.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	ClosePolicyViolation = 1008
+	CloseTryAgainLater   = 1013
+)
+
+var (
+	// ServerGoingAwayRetryInterval is how long to wait before reconnecting
+	// to a server going away, e.g. restarting.
+	ServerGoingAwayRetryInterval = 30 * time.Second
+	// TryAgainLaterRetryInterval is how long to wait before reconnecting to
+	// a server asking to try again later without saying when.
+	TryAgainLaterRetryInterval = 60 * time.Second
+)
+
+// CloseStatus is the code and reason server closed websocket connection with.
+type CloseStatus struct {
+	Code   int
+	Reason string
+}
+
+// ConnectionClosedError means the websocket connection to server is
+// closed, Status is nil unless server closed it with a close frame.
+type ConnectionClosedError struct {
+	Status *CloseStatus
+}
+
+func (e *ConnectionClosedError) Error() string {
+	if e.Status == nil {
+		return "Websocket connection is closed"
+	}
+	return Sprintf("Websocket connection is closed by server, code: %v, reason: %v", e.Status.Code, e.Status.Reason)
+}
+
+// connectionClosed handles server closing the connection with status,
+// registration is cleaned for a policy violation so that the agent
+// registers again when it is started again.
+func connectionClosed(status *CloseStatus) error {
+	if status != nil {
+		LogInfo("server closed connection, code: %v, reason: %v", status.Code, status.Reason)
+		if status.Code == ClosePolicyViolation {
+			CleanRegistration()
+		}
+	}
+	return &ConnectionClosedError{Status: status}
+}
+
+// ConnectionExpiredError means the agent closed the websocket connection
+// as it reached Config.MaxConnectionAge.
+type ConnectionExpiredError struct {
+	Age time.Duration
+}
+
+func (e *ConnectionExpiredError) Error() string {
+	return Sprintf("Websocket connection reached max age %v", e.Age)
+}
+
+func closeCode(err error) int {
+	if closed, ok := err.(*ConnectionClosedError); ok && closed.Status != nil {
+		return closed.Status.Code
+	}
+	return 0
+}
+
+// closeFrameReader records the close frame server sends through conn,
+// which golang.org/x/net/websocket reads but does not expose. Server
+// frames are not masked, so the frames can be followed from the end of
+// the handshake response without decoding payloads.
+type closeFrameReader struct {
+	net.Conn
+
+	mu        sync.Mutex
+	status    *CloseStatus
+	handshake bool
+	tail      uint32
+	header    []byte
+	opcode    byte
+	remaining uint64
+	payload   []byte
+}
+
+func (r *closeFrameReader) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.mu.Lock()
+	r.scan(p[:n])
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *closeFrameReader) CloseStatus() *CloseStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+func (r *closeFrameReader) scan(data []byte) {
+	for len(data) > 0 {
+		if !r.handshake {
+			r.tail = r.tail<<8 | uint32(data[0])
+			data = data[1:]
+			r.handshake = r.tail == 0x0d0a0d0a
+			continue
+		}
+		if r.remaining > 0 {
+			n := uint64(len(data))
+			if n > r.remaining {
+				n = r.remaining
+			}
+			if r.opcode == websocketCloseFrame && len(r.payload) < 125 {
+				r.payload = append(r.payload, data[:n]...)
+			}
+			data = data[n:]
+			if r.remaining -= n; r.remaining == 0 {
+				r.frameRead()
+			}
+			continue
+		}
+		r.header = append(r.header, data[0])
+		data = data[1:]
+		if length, ok := frameLength(r.header); ok {
+			r.opcode = r.header[0] & 0x0f
+			r.header = r.header[:0]
+			if r.remaining = length; length == 0 {
+				r.frameRead()
+			}
+		}
+	}
+}
+
+const websocketCloseFrame = 8
+
+func (r *closeFrameReader) frameRead() {
+	if r.opcode == websocketCloseFrame && r.status == nil {
+		r.status = &CloseStatus{Code: CloseNoStatus}
+		if len(r.payload) >= 2 {
+			r.status.Code = int(binary.BigEndian.Uint16(r.payload))
+			r.status.Reason = string(r.payload[2:])
+		}
+	}
+	r.payload = nil
+}
+
+// frameLength returns payload length once header is a complete frame header.
+func frameLength(header []byte) (uint64, bool) {
+	if len(header) < 2 {
+		return 0, false
+	}
+	length := uint64(header[1] & 0x7f)
+	size := 2
+	switch length {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if header[1]&0x80 != 0 {
+		size += 4
+	}
+	if len(header) < size {
+		return 0, false
+	}
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		length = binary.BigEndian.Uint64(header[2:10])
+	}
+	return length, true
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHandleServerCloseCodes(t *testing.T) {
+	tests := []struct {
+		code   int
+		reason string
+		delay  time.Duration
+		stop   bool
+	}{
+		{CloseGoingAway, "server restarting", ServerGoingAwayRetryInterval, false},
+		{CloseTryAgainLater, "2m", 2 * time.Minute, false},
+		{CloseTryAgainLater, "busy", TryAgainLaterRetryInterval, false},
+		{ClosePolicyViolation, "unknown agent", RestartInterval, false},
+		{CloseUnsupportedData, "", RestartInterval, true},
+	}
+	for _, test := range tests {
+		stateLog.Reset(buildId, AgentId)
+		stopped := make(chan error)
+		go func() {
+			stopped <- Start()
+		}()
+		assert.Equal(t, "agent Idle", stateLog.Next())
+
+		goServer.CloseAgent(AgentId, test.code, test.reason)
+		var err error
+		select {
+		case err = <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("wait for agent stop timeout")
+		}
+		closed, ok := err.(*ConnectionClosedError)
+		assert.True(t, ok)
+		assert.Equal(t, test.code, closed.Status.Code)
+		assert.Equal(t, test.reason, closed.Status.Reason)
+		assert.Equal(t, test.delay, RestartDelay(err))
+		assert.Equal(t, test.stop, ShouldStop(err))
+
+		_, err = os.Stat(GetConfig().AgentCertFile)
+		assert.Equal(t, test.code == ClosePolicyViolation, os.IsNotExist(err))
+	}
+}
+
+func TestKeepBuildRunningWhenConnectionIsClosed(t *testing.T) {
+	buildId = "TestKeepBuildRunningWhenConnectionIsClosed"
+	stateLog.Reset(buildId, AgentId)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for {
+			err := Start()
+			if _, ok := err.(*ConnectionClosedError); !ok {
+				return
+			}
+		}
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	goServer.SendBuild(AgentId, buildId,
+		echo("before reconnect"),
+		protocol.ExecCommand("sleep", "0.5"),
+		echo("after reconnect"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	goServer.CloseAgent(AgentId, CloseGoingAway, "server restarting")
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := "before reconnect\n" +
+		execBanner(GetConfig().WorkingDir, "sleep", "0.5") +
+		"after reconnect\n"
+	assert.Equal(t, expected, trimTimestamp(log))
+
+	goServer.Send(AgentId, protocol.ReregisterMessage())
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait for agent stop timeout")
+	}
+}
+
+func TestReconnectWhenConnectionReachesMaxAge(t *testing.T) {
+	GetConfig().MaxConnectionAge = 100 * time.Millisecond
+	defer func() {
+		GetConfig().MaxConnectionAge = 0
+	}()
+	stateLog.Reset(buildId, AgentId)
+	stopped := make(chan error)
+	go func() {
+		stopped <- Start()
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	var err error
+	select {
+	case err = <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait for agent stop timeout")
+	}
+	expired, ok := err.(*ConnectionExpiredError)
+	assert.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, expired.Age)
+	assert.Equal(t, time.Duration(0), RestartDelay(err))
+	assert.False(t, ShouldStop(err))
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PipelineDiskQuotaWarnPercent is how full a pipeline workspace gets
+// before builds are warned about its disk quota.
+const PipelineDiskQuotaWarnPercent = 90
+
+// quotaCheckedCommands grow pipeline workspace or ship it to server, they
+// are refused when the workspace is over config.PipelineDiskQuota.
+var quotaCheckedCommands = map[protocol.CommandName]bool{
+	protocol.CommandDownloadFile:   true,
+	protocol.CommandDownloadDir:    true,
+	protocol.CommandExtract:        true,
+	protocol.CommandUploadArtifact: true,
+	protocol.CommandGit:            true,
+	protocol.CommandSvn:            true,
+}
+
+// pipelineWorkspace returns name and directory of the pipeline workspace
+// dir is in, i.e. <agent working dir>/pipelines/<name>.
+func (s *BuildSession) pipelineWorkspace(dir string) (string, string) {
+	pipelines := filepath.Join(s.rootDir, "pipelines")
+	rel, err := filepath.Rel(pipelines, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", ""
+	}
+	name := strings.Split(rel, string(os.PathSeparator))[0]
+	return name, filepath.Join(pipelines, name)
+}
+
+// checkWorkspaceQuota warns when pipeline workspace of working directory
+// is getting close to its disk quota and fails when it is over.
+func (s *BuildSession) checkWorkspaceQuota(command protocol.CommandName) error {
+	quota := config.PipelineDiskQuota
+	if quota <= 0 {
+		return nil
+	}
+	name, workspace := s.pipelineWorkspace(s.wd)
+	if name == "" {
+		return nil
+	}
+	usage, ok := s.workspaceUsage[workspace]
+	if !ok {
+		var err error
+		if usage, err = DirSize(workspace); err != nil {
+			return err
+		}
+		if s.workspaceUsage == nil {
+			s.workspaceUsage = make(map[string]int64)
+		}
+		s.workspaceUsage[workspace] = usage
+	}
+	s.debugLog("pipeline %v workspace usage: %v", name, FormatByteSize(usage))
+	if usage > quota {
+		return infraErr(protocol.ReassignDiskFull, Err("Workspace of pipeline %v uses %v, which exceeds its disk quota %v (GOCD_AGENT_PIPELINE_DISK_QUOTA), %v is refused",
+			name, FormatByteSize(usage), FormatByteSize(quota), command))
+	}
+	if usage*100 >= quota*PipelineDiskQuotaWarnPercent && !s.quotaWarned {
+		s.quotaWarned = true
+		s.warn("Workspace of pipeline %v uses %v of its disk quota %v", name, FormatByteSize(usage), FormatByteSize(quota))
+	}
+	return nil
+}
+
+// trackWorkspaceUsage measures dest of a fetch, extract or checkout command
+// before it runs, the returned func adds what it wrote to the tracked usage
+// of the pipeline workspace, so that the workspace is not walked again.
+func (s *BuildSession) trackWorkspaceUsage(cmd *protocol.BuildCommand) func() {
+	_, workspace := s.pipelineWorkspace(s.wd)
+	if config.PipelineDiskQuota <= 0 || workspace == "" || cmd.Name == protocol.CommandUploadArtifact {
+		return func() {}
+	}
+	dest := filepath.Join(s.wd, cmd.Args["dest"])
+	if _, destWorkspace := s.pipelineWorkspace(dest); destWorkspace != workspace {
+		return s.dropWorkspaceUsage
+	}
+	before, err := DirSize(dest)
+	return func() {
+		after, err2 := DirSize(dest)
+		if _, ok := s.workspaceUsage[workspace]; !ok || err != nil || err2 != nil {
+			delete(s.workspaceUsage, workspace)
+			return
+		}
+		s.workspaceUsage[workspace] += after - before
+	}
+}
+
+// dropWorkspaceUsage forgets tracked workspace usage after commands that
+// may write anything, like exec, it is measured again by the next check.
+func (s *BuildSession) dropWorkspaceUsage() {
+	s.workspaceUsage = nil
+}
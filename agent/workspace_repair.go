@@ -0,0 +1,167 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Policies of repairing git work trees in the workspace of a job before it
+// starts, see config.WorkspaceRepair.
+const (
+	WorkspaceRepairOff    = "off"
+	WorkspaceRepairUnlock = "unlock"
+	WorkspaceRepairReset  = "reset"
+)
+
+// gitLockFiles are left behind by git processes killed with the job that
+// ran them, and fail git commands of later jobs.
+var gitLockFiles = []string{"index.lock", "HEAD.lock", "config.lock", "shallow.lock", "packed-refs.lock"}
+
+var interruptedGitOperations = []struct {
+	state   string
+	command string
+}{
+	{"MERGE_HEAD", "merge"},
+	{"rebase-merge", "rebase"},
+	{"rebase-apply", "rebase"},
+	{"CHERRY_PICK_HEAD", "cherry-pick"},
+	{"REVERT_HEAD", "revert"},
+}
+
+// repairWorkspaces repairs git work trees in working directories of the
+// job, and in their sub directories where materials are checked out.
+func (s *BuildSession) repairWorkspaces() error {
+	if config.WorkspaceRepair == WorkspaceRepairOff {
+		return nil
+	}
+	for _, dir := range gitWorkTrees(s.workingDirs(s.command, nil)) {
+		if err := s.repairGitWorkTree(dir); err != nil {
+			return infraErr(protocol.ReassignWorkspaceCorrupted, Err("Could not repair git work tree %v: %v", dir, err))
+		}
+	}
+	return nil
+}
+
+func (s *BuildSession) workingDirs(cmd *protocol.BuildCommand, dirs []string) []string {
+	if cmd == nil {
+		return dirs
+	}
+	dir := filepath.Clean(filepath.Join(s.rootDir, cmd.WorkingDirectory))
+	if strings.HasPrefix(dir, s.rootDir) && !containsString(dirs, dir) {
+		dirs = append(dirs, dir)
+	}
+	for _, sub := range cmd.SubCommands {
+		dirs = s.workingDirs(sub, dirs)
+	}
+	return s.workingDirs(cmd.Test, dirs)
+}
+
+func gitWorkTrees(dirs []string) []string {
+	var trees []string
+	add := func(dir string) {
+		if info, err := os.Stat(filepath.Join(dir, ".git")); err == nil && info.IsDir() && !containsString(trees, dir) {
+			trees = append(trees, dir)
+		}
+	}
+	for _, dir := range dirs {
+		add(dir)
+		children, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, child := range children {
+			if child.IsDir() && child.Name() != ".git" {
+				add(filepath.Join(dir, child.Name()))
+			}
+		}
+	}
+	return trees
+}
+
+func (s *BuildSession) repairGitWorkTree(dir string) error {
+	gitDir := filepath.Join(dir, ".git")
+	var repaired []string
+	for _, lock := range gitLockFiles {
+		err := os.Remove(filepath.Join(gitDir, lock))
+		if err == nil {
+			repaired = append(repaired, "removed stale "+lock)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, op := range interruptedGitOperations {
+		state := filepath.Join(gitDir, op.state)
+		if _, err := os.Stat(state); err != nil {
+			continue
+		}
+		if err := git(dir, op.command, "--abort"); err != nil {
+			if config.WorkspaceRepair != WorkspaceRepairReset {
+				return Err("interrupted %v could not be aborted: %v", op.command, err)
+			}
+			// reset below makes the work tree consistent again
+			if err := os.RemoveAll(state); err != nil {
+				return err
+			}
+		}
+		repaired = append(repaired, "aborted interrupted "+op.command)
+	}
+	if config.WorkspaceRepair == WorkspaceRepairReset {
+		status := git(dir, "status", "--porcelain")
+		if status != nil || len(repaired) > 0 {
+			if status != nil {
+				// corrupted index is rebuilt by reset
+				os.Remove(filepath.Join(gitDir, "index"))
+			}
+			if err := git(dir, "reset", "--hard", "HEAD"); err != nil {
+				return err
+			}
+			if err := git(dir, "clean", "-ffdx"); err != nil {
+				return err
+			}
+			repaired = append(repaired, "reset and cleaned the work tree")
+		}
+	}
+	if len(repaired) > 0 {
+		LogInfo("repaired git work tree %v: %v", dir, strings.Join(repaired, ", "))
+		s.ConsoleLog("[go] Repaired git work tree %v: %v\n", dir, strings.Join(repaired, ", "))
+	}
+	return nil
+}
+
+func git(dir string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return Err("git %v failed: %v %v", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// createBrokenGitWorkTree leaves a merge conflict and a stale index.lock
+// in a git work tree of dir
+func createBrokenGitWorkTree(t *testing.T, dir string) {
+	script := `git init -q -b main . &&
+git config user.name gocd && git config user.email gocd@example.com &&
+echo a > file && git add file && git commit -q -m a &&
+git checkout -q -b topic && echo b > file && git commit -q -am b &&
+git checkout -q main && echo c > file && git commit -q -am c &&
+(git merge topic > /dev/null; true) &&
+touch .git/index.lock`
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	assert.Nil(t, err, string(output))
+}
+
+func TestRepairGitWorkTreeBeforeJobStarts(t *testing.T) {
+	GetConfig().WorkspaceRepair = WorkspaceRepairUnlock
+	defer func() {
+		GetConfig().WorkspaceRepair = WorkspaceRepairOff
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	material := filepath.Join(wd, "material")
+	assert.Nil(t, os.Mkdir(material, 0755))
+	createBrokenGitWorkTree(t, material)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("git", "status", "--porcelain").Setwd(relativePath(material)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf("[go] Repaired git work tree %v: removed stale index.lock, aborted interrupted merge\n", material) +
+		execBanner(material, "git", "status", "--porcelain")
+	assert.Equal(t, expected, trimTimestamp(log))
+	_, err = os.Stat(filepath.Join(material, ".git", "MERGE_HEAD"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFailJobWhenGitWorkTreeCanNotBeRepaired(t *testing.T) {
+	GetConfig().WorkspaceRepair = WorkspaceRepairUnlock
+	defer func() {
+		GetConfig().WorkspaceRepair = WorkspaceRepairOff
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	createBrokenGitWorkTree(t, wd)
+	// merge can't be aborted without index
+	assert.Nil(t, os.Remove(filepath.Join(wd, ".git", "index")))
+
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("git", "status").Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	report := goServer.CompletedReport(buildId)
+	assert.NotNil(t, report.Reassign)
+	assert.Equal(t, protocol.ReassignWorkspaceCorrupted, report.Reassign.Reason)
+	assert.True(t, strings.Contains(report.Reassign.Message, "interrupted merge could not be aborted"), report.Reassign.Message)
+}
+
+func TestResetGitWorkTreeWhenItCanNotBeRepaired(t *testing.T) {
+	GetConfig().WorkspaceRepair = WorkspaceRepairReset
+	defer func() {
+		GetConfig().WorkspaceRepair = WorkspaceRepairOff
+	}()
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	createBrokenGitWorkTree(t, wd)
+	assert.Nil(t, os.Remove(filepath.Join(wd, ".git", "index")))
+	writeFile(wd, "untracked", "left by previous job")
+
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("git", "status", "--porcelain").Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf("[go] Repaired git work tree %v: removed stale index.lock, aborted interrupted merge, reset and cleaned the work tree\n", wd) +
+		execBanner(wd, "git", "status", "--porcelain")
+	assert.Equal(t, expected, trimTimestamp(log))
+	_, err = os.Stat(filepath.Join(wd, "untracked"))
+	assert.True(t, os.IsNotExist(err))
+}
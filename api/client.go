@@ -0,0 +1,180 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package api is a client of Go server pipeline and stage APIs, used by
+// the agent with its own credentials and open to embedders.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	PipelinesPath = "/api/pipelines"
+	StagesPath    = "/api/stages"
+	FilesPath     = "/files"
+
+	AcceptHeader = "application/vnd.go.cd.v1+json"
+)
+
+// Results of a stage, Unknown until the stage is completed.
+const (
+	ResultPassed    = "Passed"
+	ResultFailed    = "Failed"
+	ResultCancelled = "Cancelled"
+	ResultUnknown   = "Unknown"
+)
+
+type PipelineInstance struct {
+	Name    string           `json:"name"`
+	Counter int              `json:"counter"`
+	Label   string           `json:"label"`
+	Stages  []*StageInstance `json:"stages"`
+}
+
+type StageInstance struct {
+	Name            string         `json:"name"`
+	Counter         int            `json:"counter"`
+	Result          string         `json:"result"`
+	PipelineName    string         `json:"pipeline_name,omitempty"`
+	PipelineCounter int            `json:"pipeline_counter,omitempty"`
+	Jobs            []*JobInstance `json:"jobs,omitempty"`
+}
+
+type JobInstance struct {
+	Name   string `json:"name"`
+	State  string `json:"state"`
+	Result string `json:"result"`
+}
+
+// Stage returns the stage named name of the pipeline instance, nil if
+// it is not scheduled.
+func (p *PipelineInstance) Stage(name string) *StageInstance {
+	for _, stage := range p.Stages {
+		if stage.Name == name {
+			return stage
+		}
+	}
+	return nil
+}
+
+// Completed is true once the stage passed, failed or is cancelled.
+func (s *StageInstance) Completed() bool {
+	return s.Result != "" && s.Result != ResultUnknown
+}
+
+// StatusError is returned when server responds with an unexpected status.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("GET %v: %v", e.URL, e.Status)
+}
+
+// IsNotFound is true when err is a 404 response.
+func IsNotFound(err error) bool {
+	se, ok := err.(*StatusError)
+	return ok && se.StatusCode == http.StatusNotFound
+}
+
+type Client struct {
+	// BaseURL is Go server url including its context path, e.g.
+	// https://go.example.com:8154/go
+	BaseURL    *url.URL
+	HttpClient *http.Client
+}
+
+func NewClient(baseURL *url.URL, httpClient *http.Client) *Client {
+	return &Client{BaseURL: baseURL, HttpClient: httpClient}
+}
+
+// PipelineHistory returns the latest instances of pipeline, newest first.
+func (c *Client) PipelineHistory(pipeline string) ([]*PipelineInstance, error) {
+	var history struct {
+		Pipelines []*PipelineInstance `json:"pipelines"`
+	}
+	if err := c.get(c.url(PipelinesPath, pipeline, "history"), &history); err != nil {
+		return nil, err
+	}
+	return history.Pipelines, nil
+}
+
+func (c *Client) StageInstance(pipeline string, pipelineCounter int, stage string, stageCounter int) (*StageInstance, error) {
+	var instance StageInstance
+	u := c.url(StagesPath, pipeline, strconv.Itoa(pipelineCounter), stage, strconv.Itoa(stageCounter))
+	if err := c.get(u, &instance); err != nil {
+		return nil, err
+	}
+	return &instance, nil
+}
+
+// LatestPassed returns the newest instance of pipeline whose stage
+// passed, nil if there is none in the pipeline history.
+func (c *Client) LatestPassed(pipeline, stage string) (*PipelineInstance, error) {
+	history, err := c.PipelineHistory(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range history {
+		if s := instance.Stage(stage); s != nil && s.Result == ResultPassed {
+			return instance, nil
+		}
+	}
+	return nil, nil
+}
+
+// ArtifactURL is where path of artifacts of job in a stage instance is
+// fetched from.
+func (c *Client) ArtifactURL(pipeline string, pipelineCounter int, stage string, stageCounter int, job, path string) string {
+	return c.url(FilesPath, pipeline, strconv.Itoa(pipelineCounter), stage, strconv.Itoa(stageCounter), job) +
+		"/" + strings.TrimPrefix(path, "/")
+}
+
+func (c *Client) url(path string, segments ...string) string {
+	u := strings.TrimSuffix(c.BaseURL.String(), "/") + path
+	for _, segment := range segments {
+		u += "/" + url.PathEscape(segment)
+	}
+	return u
+}
+
+func (c *Client) get(u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", AcceptHeader)
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{URL: u, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("GET %v: invalid response: %v", u, err)
+	}
+	return nil
+}
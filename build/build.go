@@ -178,7 +178,7 @@ func runTest(pwd string){
 	if err == nil {
 		os.Remove(testReport)
 	}
-	args = []string{"test", "-test.v", goAgent + "..." }
+	args = []string{"test", "-race", "-test.v", goAgent + "..." }
 	gotest := exec.Command("go", args...)
 	goreport := exec.Command(reportCmd,reportCmd_args...)
 	reader, writer := io.Pipe()
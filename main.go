@@ -22,6 +22,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var (
@@ -39,13 +41,117 @@ func main() {
 		os.Exit(0)
 	}
 
+	if flag.Arg(0) == "tail" {
+		if err := agent.Tail(agent.AdminSocketFile(), os.Stdout, make(chan bool)); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not tail console of the local agent:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if flag.Arg(0) == "metrics" {
+		if err := agent.Metrics(agent.AdminSocketFile(), os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not fetch metrics of the local agent:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if flag.Arg(0) == "reset-server-pin" {
+		if err := agent.ResetServerCertificatePin(agent.ServerPinFile()); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not reset pinned Go server certificate:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Reset pinned Go server certificate, the certificate of Go server is pinned again at next registration")
+		os.Exit(0)
+	}
+
+	if flag.Arg(0) == "logs" {
+		file := flag.Arg(1)
+		if file == "" {
+			file = "gocd-golang-agent-logs.zip"
+		}
+		if err := agent.SaveLogBundle(agent.AdminSocketFile(), file); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not save log bundle of the local agent:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Saved log bundle to", file)
+		os.Exit(0)
+	}
+
+	if flag.Arg(0) == "reload" {
+		if err := agent.Reload(agent.AdminSocketFile(), os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not reload config of the local agent:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if flag.Arg(0) == "status" {
+		if err := agent.Status(agent.AdminSocketFile(), os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not fetch status of the local agent:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	switch flag.Arg(0) {
+	case "cancel", "drain", "pause", "resume", "update":
+		if err := agent.Control(agent.AdminSocketFile(), flag.Arg(0), os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not "+flag.Arg(0)+" the local agent:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	agent.Initialize()
+	reloadOnSIGHUP()
+	go func() {
+		if err := agent.StartAdminServer(); err != nil {
+			agent.LogInfo("admin server stopped: %v", err)
+		}
+	}()
+	if agent.GetConfig().AdminAddress != "" {
+		go func() {
+			if err := agent.StartRemoteAdminServer(); err != nil {
+				agent.LogInfo("remote admin server stopped: %v", err)
+			}
+		}()
+	}
+	if agent.GetConfig().StatusReportAddress != "" {
+		go func() {
+			if err := agent.StartStatusReportServer(); err != nil {
+				agent.LogInfo("status report server stopped: %v", err)
+			}
+		}()
+	}
 	for {
 		err := agent.Start()
-		if err != nil {
-			agent.LogInfo("something wrong: %v", err.Error())
+		if agent.ShouldStop(err) {
+			agent.LogInfo("quit: %v", err)
+			os.Exit(1)
 		}
-		agent.LogInfo("sleep 10 seconds and restart")
-		time.Sleep(10 * time.Second)
+		delay := agent.CrashLoopDelay(err, agent.RestartDelay(err))
+		// pending approval is warned once by the agent
+		if _, pending := err.(*agent.PendingApprovalError); !pending {
+			if err != nil {
+				agent.LogInfo("something wrong: %v", err.Error())
+			}
+			agent.LogInfo("sleep %v and restart", delay)
+		}
+		time.Sleep(delay)
 	}
 }
+
+// reloadOnSIGHUP reloads config of the agent on SIGHUP, like most daemons.
+func reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := agent.ReloadConfig(); err != nil {
+				agent.LogInfo("reload config failed: %v", err)
+			}
+		}
+	}()
+}
@@ -16,6 +16,12 @@
 
 package protocol
 
+// Runtime statuses of an agent reported in AgentRuntimeInfo
+const (
+	RuntimeStatusIdle     = "Idle"
+	RuntimeStatusBuilding = "Building"
+)
+
 type AgentIdentifier struct {
 	HostName  string `json:"hostName"`
 	IpAddress string `json:"ipAddress"`
@@ -25,6 +31,9 @@ type AgentIdentifier struct {
 type AgentBuildingInfo struct {
 	BuildingInfo string `json:"buildingInfo"`
 	BuildLocator string `json:"buildLocator"`
+	// BuildId is the build running on the agent, for server to reattach
+	// it after the agent reconnected
+	BuildId string `json:"buildId,omitempty"`
 }
 
 type AgentRuntimeInfo struct {
@@ -39,4 +48,5 @@ type AgentRuntimeInfo struct {
 	ElasticPluginId              string             `json:"elasticPluginId"`
 	ElasticAgentId               string             `json:"elasticAgentId"`
 	SupportsBuildCommandProtocol bool               `json:"supportsBuildCommandProtocol"`
+	Labels                       map[string]string  `json:"labels,omitempty"`
 }
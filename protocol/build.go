@@ -16,12 +16,58 @@
 
 package protocol
 
+import (
+	"strings"
+)
+
+// BuildStatus is the status of a running build, and the result of a
+// completed one.
+type BuildStatus string
+
 const (
-	BuildPassed   = "Passed"
-	BuildFailed   = "Failed"
-	BuildCanceled = "Cancelled"
+	BuildPassed   BuildStatus = "Passed"
+	BuildFailed   BuildStatus = "Failed"
+	BuildCanceled BuildStatus = "Cancelled"
+	// BuildError is a build failed for an issue of the agent rather than
+	// of the job, Go server takes it as failed, see ServerResult
+	BuildError BuildStatus = "Error"
+	// BuildUnknown is the result of a build Go server does not know
+	BuildUnknown BuildStatus = "Unknown"
 )
 
+// JobState is the state of a job reported to Go server.
+type JobState string
+
+const (
+	JobPreparing  JobState = "Preparing"
+	JobBuilding   JobState = "Building"
+	JobCompleting JobState = "Completing"
+	JobCompleted  JobState = "Completed"
+)
+
+// Valid tells whether s is one of the Job states.
+func (s JobState) Valid() bool {
+	switch s {
+	case JobPreparing, JobBuilding, JobCompleting, JobCompleted:
+		return true
+	}
+	return false
+}
+
+// ServerResult is the job result Go server expects for a build status,
+// which is matched case-insensitively like runIf, e.g. "failed".
+func ServerResult(status BuildStatus) BuildStatus {
+	switch strings.ToLower(string(status)) {
+	case "passed":
+		return BuildPassed
+	case "failed", "error":
+		return BuildFailed
+	case "cancelled", "canceled":
+		return BuildCanceled
+	}
+	return BuildUnknown
+}
+
 type Build struct {
 	BuildId                string
 	BuildLocator           string
@@ -18,41 +18,94 @@ package protocol
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
 	"strings"
 )
 
 const (
 	TestReportFileName = "index.html"
+	ExecInput          = ""
+)
+
+// RunIf is the build status a command runs at, matched case-insensitively.
+type RunIf string
 
-	RunIfConfigAny    = "any"
-	RunIfConfigPassed = "passed"
-	ExecInput         = ""
-
-	CommandCompose             = "compose"
-	CommandCond                = "cond"
-	CommandAnd                 = "and"
-	CommandOr                  = "or"
-	CommandExport              = "export"
-	CommandTest                = "test"
-	CommandExec                = "exec"
-	CommandEcho                = "echo"
-	CommandUploadArtifact      = "uploadArtifact"
-	CommandReportCurrentStatus = "reportCurrentStatus"
-	CommandReportCompleting    = "reportCompleting"
-	CommandMkdirs              = "mkdirs"
-	CommandCleandir            = "cleandir"
-	CommandFail                = "fail"
-	CommandSecret              = "secret"
-	CommandDownloadFile        = "downloadFile"
-	CommandDownloadDir         = "downloadDir"
-	CommandGenerateTestReport  = "generateTestReport"
-	CommandGenerateProperty    = "generateProperty"
+const (
+	RunIfConfigAny    RunIf = "any"
+	RunIfConfigPassed RunIf = "passed"
+	RunIfConfigFailed RunIf = "failed"
 )
 
+// Valid tells whether r is one of the RunIfConfig constants.
+func (r RunIf) Valid() bool {
+	for _, known := range []RunIf{RunIfConfigAny, RunIfConfigPassed, RunIfConfigFailed} {
+		if strings.EqualFold(string(r), string(known)) {
+			return true
+		}
+	}
+	return false
+}
+
+// CommandName is the name of a build command.
+type CommandName string
+
+const (
+	CommandCompose              CommandName = "compose"
+	CommandCond                 CommandName = "cond"
+	CommandAnd                  CommandName = "and"
+	CommandOr                   CommandName = "or"
+	CommandExport               CommandName = "export"
+	CommandTest                 CommandName = "test"
+	CommandExec                 CommandName = "exec"
+	CommandEcho                 CommandName = "echo"
+	CommandUploadArtifact       CommandName = "uploadArtifact"
+	CommandReportCurrentStatus  CommandName = "reportCurrentStatus"
+	CommandReportCompleting     CommandName = "reportCompleting"
+	CommandMkdirs               CommandName = "mkdirs"
+	CommandCleandir             CommandName = "cleandir"
+	CommandFail                 CommandName = "fail"
+	CommandSecret               CommandName = "secret"
+	CommandDownloadFile         CommandName = "downloadFile"
+	CommandDownloadDir          CommandName = "downloadDir"
+	CommandGenerateTestReport   CommandName = "generateTestReport"
+	CommandGenerateProperty     CommandName = "generateProperty"
+	CommandUploadHtmlReport     CommandName = "uploadHtmlReport"
+	CommandDownloadAgentPlugins CommandName = "downloadAgentPlugins"
+	CommandExtract              CommandName = "extract"
+	CommandWaitFor              CommandName = "waitFor"
+	CommandDockerCompose        CommandName = "dockerCompose"
+	CommandWorkspaceSnapshot    CommandName = "workspaceSnapshot"
+	CommandGit                  CommandName = "git"
+	CommandSvn                  CommandName = "svn"
+)
+
+var requiredArgs = map[CommandName][]string{
+	CommandExport:               {"name"},
+	CommandExec:                 {"command"},
+	CommandUploadArtifact:       {"src"},
+	CommandReportCurrentStatus:  {"status"},
+	CommandMkdirs:               {"path"},
+	CommandCleandir:             {"path"},
+	CommandSecret:               {"value"},
+	CommandTest:                 {"flag"},
+	CommandDownloadFile:         {"src", "url", "dest", "checksumUrl", "checksumFile"},
+	CommandDownloadDir:          {"src", "url", "dest", "checksumUrl", "checksumFile"},
+	CommandUploadHtmlReport:     {"src", "name"},
+	CommandGenerateProperty:     {"name", "src", "xpath"},
+	CommandDownloadAgentPlugins: {"url", "dest"},
+	CommandExtract:              {"src"},
+	CommandWaitFor:              {"timeout"},
+	CommandDockerCompose:        {"file"},
+	CommandWorkspaceSnapshot:    {"keyFiles"},
+	CommandGit:                  {"url"},
+	CommandSvn:                  {"url"},
+}
+
 type BuildCommand struct {
-	Name             string
+	Name             CommandName
 	Args             map[string]string
-	RunIfConfig      string
+	RunIfConfig      RunIf
 	ExecInput        string
 	SubCommands      []*BuildCommand
 	WorkingDirectory string
@@ -60,7 +113,7 @@ type BuildCommand struct {
 	OnCancel         *BuildCommand
 }
 
-func NewBuildCommand(name string) *BuildCommand {
+func NewBuildCommand(name CommandName) *BuildCommand {
 	return &BuildCommand{
 		Name:        name,
 		RunIfConfig: RunIfConfigPassed,
@@ -85,6 +138,45 @@ func ComposeCommand(commands ...*BuildCommand) *BuildCommand {
 	return NewBuildCommand(CommandCompose).AddCommands(commands...)
 }
 
+// GitCommand checks out revision, or the tip of branch when it is empty,
+// of git repository url into dest. Set "shallow" arg to "true" for a
+// shallow clone, and "clean" to "false" to keep untracked files.
+func GitCommand(url, branch, revision, dest string) *BuildCommand {
+	return NewBuildCommand(CommandGit).
+		AddArg("url", url).
+		AddArg("branch", branch).
+		AddArg("revision", revision).
+		AddArg("dest", dest)
+}
+
+// SvnCommand checks out revision of the subversion repository at url into
+// dest, HEAD when revision is empty.
+func SvnCommand(url, username, password, revision, dest string) *BuildCommand {
+	return NewBuildCommand(CommandSvn).
+		AddArg("url", url).
+		AddArg("username", username).
+		AddArg("password", password).
+		AddArg("revision", revision).
+		AddArg("dest", dest)
+}
+
+// WorkspaceSnapshotCommand runs commands installing dependencies of the
+// working directory, unless it is restored from the agent's snapshot taken
+// after them with the same content of keyFiles, e.g. lockfiles.
+func WorkspaceSnapshotCommand(keyFiles []string, commands ...*BuildCommand) *BuildCommand {
+	return NewBuildCommand(CommandWorkspaceSnapshot).AddListArg("keyFiles", keyFiles).AddCommands(commands...)
+}
+
+// ParallelComposeCommand runs commands concurrently, at most maxParallel
+// of them at a time, or as many as CPUs of the agent when it is 0.
+func ParallelComposeCommand(maxParallel int, commands ...*BuildCommand) *BuildCommand {
+	cmd := ComposeCommand(commands...).AddArg("parallel", "true")
+	if maxParallel > 0 {
+		cmd.AddArg("maxParallel", strconv.Itoa(maxParallel))
+	}
+	return cmd
+}
+
 func CondCommand(commands ...*BuildCommand) *BuildCommand {
 	return NewBuildCommand("cond").AddCommands(commands...)
 }
@@ -114,13 +206,25 @@ func ExportCommand(kvs ...string) *BuildCommand {
 	return NewBuildCommand(CommandExport).SetArgs(args)
 }
 
-func ReportCurrentStatusCommand(jobState string) *BuildCommand {
-	args := map[string]string{"status": jobState}
+// ExportFileCommand exports name as the path of a file of value, which
+// the agent writes with permissions of its user only and shreds when
+// the job ends. Value is base64 encoded when encoding is "base64", e.g.
+// for keystores.
+func ExportFileCommand(name, value, secure, encoding string) *BuildCommand {
+	cmd := ExportCommand(name, value, secure).AddArg("file", "true")
+	if encoding != "" {
+		cmd.AddArg("encoding", encoding)
+	}
+	return cmd
+}
+
+func ReportCurrentStatusCommand(jobState JobState) *BuildCommand {
+	args := map[string]string{"status": string(jobState)}
 	return NewBuildCommand(CommandReportCurrentStatus).SetArgs(args)
 }
 
 func ReportCompletingCommand() *BuildCommand {
-	return NewBuildCommand(CommandReportCompleting).RunIf("any")
+	return NewBuildCommand(CommandReportCompleting).RunIf(RunIfConfigAny)
 }
 
 func TestCommand(args ...string) *BuildCommand {
@@ -166,6 +270,18 @@ func UploadArtifactCommand(src, dest, ignoreUnmatchError string) *BuildCommand {
 	return NewBuildCommand(CommandUploadArtifact).SetArgs(args)
 }
 
+// DeltaUploadArtifactCommand uploads only files changed since the previous
+// run of the job, whose md5.checksum file is at deltaBase.
+func DeltaUploadArtifactCommand(src, dest, ignoreUnmatchError, deltaBase string) *BuildCommand {
+	return UploadArtifactCommand(src, dest, ignoreUnmatchError).AddArg("deltaBase", deltaBase)
+}
+
+// AsyncUploadArtifactCommand uploads in background while later commands
+// run, the job waits for it before reporting completing.
+func AsyncUploadArtifactCommand(src, dest, ignoreUnmatchError string) *BuildCommand {
+	return UploadArtifactCommand(src, dest, ignoreUnmatchError).AddArg("async", "true")
+}
+
 func DownloadFileCommand(src, url, dest, checksumUrl, checksumPath string) *BuildCommand {
 	return DownloadCommand(CommandDownloadFile, src, url, dest, checksumUrl, checksumPath)
 }
@@ -174,7 +290,7 @@ func DownloadDirCommand(src, url, dest, checksumUrl, checksumPath string) *Build
 	return DownloadCommand(CommandDownloadDir, src, url, dest, checksumUrl, checksumPath)
 }
 
-func DownloadCommand(file_or_dir, src, url, dest, checksumUrl, checksumPath string) *BuildCommand {
+func DownloadCommand(file_or_dir CommandName, src, url, dest, checksumUrl, checksumPath string) *BuildCommand {
 	args := map[string]string{
 		"src":          src,
 		"url":          url,
@@ -189,12 +305,53 @@ func GenerateTestReportCommand(args ...string) *BuildCommand {
 	return NewBuildCommand(CommandGenerateTestReport).AddArg("uploadPath", args[0]).AddListArg("srcs", args[1:])
 }
 
+// GeneratePropertyCommand sets property name of the job to the value of
+// xpath in the XML file src.
+func GeneratePropertyCommand(name, src, xpath string) *BuildCommand {
+	return NewBuildCommand(CommandGenerateProperty).AddArg("name", name).AddArg("src", src).AddArg("xpath", xpath)
+}
+
+func UploadHtmlReportCommand(src, name string) *BuildCommand {
+	return NewBuildCommand(CommandUploadHtmlReport).AddArg("src", src).AddArg("name", name)
+}
+
+// DownloadAgentPluginsCommand downloads zip of plugins or tools from url
+// and unzips it into dest inside agent working directory, checksum is md5
+// of the zip, empty to skip verification.
+func DownloadAgentPluginsCommand(url, checksum, dest string) *BuildCommand {
+	return NewBuildCommand(CommandDownloadAgentPlugins).AddArg("url", url).AddArg("checksum", checksum).AddArg("dest", dest)
+}
+
+// ExtractCommand unpacks zip, tar or gzipped tar archive src into dest,
+// both relative to working directory.
+func ExtractCommand(src, dest string) *BuildCommand {
+	return NewBuildCommand(CommandExtract).AddArg("src", src).AddArg("dest", dest)
+}
+
+// WaitForCommand polls target of kind "url", "file" or "stage" until
+// condition is met or timeout, e.g. "5m", is reached. Stage target is
+// "<pipeline>/<counter>/<stage>/<counter>", empty condition is the
+// default of the kind.
+func WaitForCommand(kind, target, condition, timeout string) *BuildCommand {
+	return NewBuildCommand(CommandWaitFor).AddArg(kind, target).AddArg("condition", condition).AddArg("timeout", timeout)
+}
+
+// DockerComposeCommand starts services of the docker compose file, or only
+// the given ones, they are stopped when the job ends.
+func DockerComposeCommand(file string, services ...string) *BuildCommand {
+	cmd := NewBuildCommand(CommandDockerCompose).AddArg("file", file)
+	if len(services) > 0 {
+		cmd.AddListArg("services", services)
+	}
+	return cmd
+}
+
 func (cmd *BuildCommand) RunIfAny() bool {
-	return strings.EqualFold(RunIfConfigAny, cmd.RunIfConfig)
+	return strings.EqualFold(string(RunIfConfigAny), string(cmd.RunIfConfig))
 }
 
-func (cmd *BuildCommand) RunIfMatch(buildStatus string) bool {
-	return strings.EqualFold(cmd.RunIfConfig, buildStatus)
+func (cmd *BuildCommand) RunIfMatch(buildStatus BuildStatus) bool {
+	return strings.EqualFold(string(cmd.RunIfConfig), string(buildStatus))
 }
 
 func (cmd *BuildCommand) AddCommands(commands ...*BuildCommand) *BuildCommand {
@@ -223,6 +380,36 @@ func (cmd *BuildCommand) AddListArg(name string, list []string) *BuildCommand {
 	return cmd.AddArg(name, string(bs))
 }
 
+func (cmd *BuildCommand) AddMapArg(name string, m map[string]string) *BuildCommand {
+	bs, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	return cmd.AddArg(name, string(bs))
+}
+
+// SetEnv sets environment variables of an exec command, which override
+// variables of the build for the command only.
+func (cmd *BuildCommand) SetEnv(env map[string]string) *BuildCommand {
+	return cmd.AddMapArg("env", env)
+}
+
+// SetSecureEnv marks variables set by SetEnv as secure, their values are
+// masked in console output like values of secure exported variables.
+func (cmd *BuildCommand) SetSecureEnv(names ...string) *BuildCommand {
+	return cmd.AddListArg("secureEnv", names)
+}
+
+// SetCache opts an exec command in the agent's task cache: the command is
+// skipped and its outputs are restored from the cache when the command, the
+// env variables named envNames and the files matched by inputs are the same
+// as a previous successful run on the agent.
+func (cmd *BuildCommand) SetCache(inputs, outputs, envNames []string) *BuildCommand {
+	return cmd.AddListArg("cacheInputs", inputs).
+		AddListArg("cacheOutputs", outputs).
+		AddListArg("cacheEnv", envNames)
+}
+
 func (cmd *BuildCommand) SetTest(test *BuildCommand) *BuildCommand {
 	cmd.Test = test
 	return cmd
@@ -238,7 +425,7 @@ func (cmd *BuildCommand) SetExecInput(input string) *BuildCommand {
 	return cmd
 }
 
-func (cmd *BuildCommand) RunIf(c string) *BuildCommand {
+func (cmd *BuildCommand) RunIf(c RunIf) *BuildCommand {
 	cmd.RunIfConfig = c
 	return cmd
 }
@@ -248,7 +435,80 @@ func (cmd *BuildCommand) SetOnCancel(c *BuildCommand) *BuildCommand {
 	return cmd
 }
 
+// Validate checks args the command can't be processed without, the
+// error names the missing field and includes the command JSON.
+func (cmd *BuildCommand) Validate() error {
+	for _, arg := range requiredArgs[cmd.Name] {
+		if _, ok := cmd.Args[arg]; !ok {
+			return cmd.invalid("%v command requires arg '%v'", cmd.Name, arg)
+		}
+	}
+	if cmd.RunIfConfig != "" && !cmd.RunIfConfig.Valid() {
+		return cmd.invalid("unknown runIfConfig '%v'", cmd.RunIfConfig)
+	}
+	if cmd.Name == CommandReportCurrentStatus && !JobState(cmd.Args["status"]).Valid() {
+		return cmd.invalid("unknown job state '%v'", cmd.Args["status"])
+	}
+	if cmd.Name == CommandExec {
+		if _, ok := cmd.Args["env"]; ok {
+			if _, err := cmd.MapArg("env"); err != nil {
+				return cmd.invalid("exec command arg 'env' is not a map of strings: %v", err)
+			}
+		}
+		if _, ok := cmd.Args["secureEnv"]; ok {
+			if _, err := cmd.ListArg("secureEnv"); err != nil {
+				return cmd.invalid("exec command arg 'secureEnv' is not a list of strings: %v", err)
+			}
+		}
+		for _, arg := range []string{"cacheInputs", "cacheOutputs", "cacheEnv"} {
+			if _, ok := cmd.Args[arg]; ok {
+				if _, err := cmd.ListArg(arg); err != nil {
+					return cmd.invalid("exec command arg '%v' is not a list of strings: %v", arg, err)
+				}
+			}
+		}
+	}
+	if cmd.Name == CommandWorkspaceSnapshot {
+		if _, err := cmd.ListArg("keyFiles"); err != nil {
+			return cmd.invalid("workspaceSnapshot command arg 'keyFiles' is not a list of strings: %v", err)
+		}
+	}
+	if cmd.Name == CommandWaitFor {
+		var kinds []string
+		for _, kind := range []string{"url", "file", "stage"} {
+			if _, ok := cmd.Args[kind]; ok {
+				kinds = append(kinds, kind)
+			}
+		}
+		if len(kinds) != 1 {
+			return cmd.invalid("waitFor command requires one of args 'url', 'file' and 'stage'")
+		}
+	}
+	if cmd.Name == CommandTest {
+		switch cmd.Args["flag"] {
+		case "-eq", "-neq", "-in", "-nin":
+			if len(cmd.SubCommands) != 1 {
+				return cmd.invalid("test command with flag %v requires one sub command", cmd.Args["flag"])
+			}
+		}
+	}
+	return nil
+}
+
+func (cmd *BuildCommand) invalid(format string, a ...interface{}) error {
+	js, _ := json.Marshal(cmd)
+	return fmt.Errorf("Invalid build command, %v: %s", fmt.Sprintf(format, a...), js)
+}
+
 func (cmd *BuildCommand) ListArg(name string) (list []string, err error) {
 	err = json.Unmarshal([]byte(cmd.Args[name]), &list)
 	return
 }
+
+// MapArg decodes arg name of a JSON object, nil when there is no such arg.
+func (cmd *BuildCommand) MapArg(name string) (m map[string]string, err error) {
+	if arg, ok := cmd.Args[name]; ok {
+		err = json.Unmarshal([]byte(arg), &m)
+	}
+	return
+}
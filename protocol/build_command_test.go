@@ -19,6 +19,7 @@ package protocol_test
 import (
 	. "github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"github.com/xli/assert"
+	"strings"
 	"testing"
 )
 
@@ -34,6 +35,18 @@ func TestListArg(t *testing.T) {
 	assert.Equal(t, `["hello","world","!"]`, cmd.Args["lines"])
 }
 
+func TestMapArg(t *testing.T) {
+	cmd := ExecCommand("make").SetEnv(map[string]string{"GOOS": "linux"})
+	env, err := cmd.MapArg("env")
+	assert.Nil(t, err)
+	assert.Equal(t, "linux", env["GOOS"])
+	assert.Equal(t, `{"GOOS":"linux"}`, cmd.Args["env"])
+
+	env, err = cmd.MapArg("missing")
+	assert.Nil(t, err)
+	assert.Nil(t, env)
+}
+
 func TestAddArg(t *testing.T) {
 	cmd := NewBuildCommand(CommandCompose)
 	cmd.AddArg("hello", "world")
@@ -46,3 +59,42 @@ func TestAddCommands(t *testing.T) {
 	cmd.AddCommands(NewBuildCommand(CommandEcho))
 	assert.Equal(t, 1, len(cmd.SubCommands))
 }
+
+func TestValidate(t *testing.T) {
+	assert.Nil(t, ExecCommand("echo", "hello").Validate())
+	assert.Nil(t, UploadArtifactCommand("src", "", "false").Validate())
+	assert.Nil(t, TestCommand("-eq", "hello", "echo", "hello").Validate())
+	assert.Nil(t, NewBuildCommand("fancy").Validate())
+
+	err := NewBuildCommand(CommandExec).Validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, `Invalid build command, exec command requires arg 'command': {"Name":"exec","Args":null,"RunIfConfig":"passed","ExecInput":"","SubCommands":null,"WorkingDirectory":"","Test":null,"OnCancel":null}`, err.Error())
+
+	err = ExecCommand("make").AddArg("env", `["GOOS=linux"]`).Validate()
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "Invalid build command, exec command arg 'env' is not a map of strings: "))
+
+	assert.Nil(t, ExecCommand("make").SetCache([]string{"src/**"}, []string{"bin"}, nil).Validate())
+	err = ExecCommand("make").AddArg("cacheOutputs", "bin").Validate()
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "Invalid build command, exec command arg 'cacheOutputs' is not a list of strings: "))
+
+	err = NewBuildCommand(CommandTest).AddArg("flag", "-eq").AddArg("left", "hello").Validate()
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "Invalid build command, test command with flag -eq requires one sub command: "))
+
+	assert.Nil(t, WaitForCommand("file", "ready", "", "1m").Validate())
+	err = NewBuildCommand(CommandWaitFor).AddArg("timeout", "1m").Validate()
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "Invalid build command, waitFor command requires one of args 'url', 'file' and 'stage': "))
+
+	assert.Nil(t, EchoCommand("hello").RunIf(RunIfConfigFailed).Validate())
+	err = EchoCommand("hello").RunIf("faild").Validate()
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "Invalid build command, unknown runIfConfig 'faild': "))
+
+	assert.Nil(t, ReportCurrentStatusCommand(JobBuilding).Validate())
+	err = ReportCurrentStatusCommand("Bulding").Validate()
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "Invalid build command, unknown job state 'Bulding': "))
+}
@@ -0,0 +1,44 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestServerResultOfBuildStatus(t *testing.T) {
+	var tests = []struct {
+		status BuildStatus
+		result BuildStatus
+	}{
+		{BuildPassed, "Passed"},
+		{"passed", "Passed"},
+		{BuildFailed, "Failed"},
+		{"failed", "Failed"},
+		{BuildError, "Failed"},
+		{"error", "Failed"},
+		{BuildCanceled, "Cancelled"},
+		{"canceled", "Cancelled"},
+		{"", "Unknown"},
+		{"Building", "Unknown"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.result, ServerResult(test.status), string(test.status))
+	}
+}
@@ -21,22 +21,27 @@ import (
 	"github.com/satori/go.uuid"
 )
 
+// Action is the kind of a websocket message.
+type Action string
+
 const (
-	SetCookieAction           = "setCookie"
-	CancelBuildAction         = "cancelBuild"
-	ReregisterAction          = "reregister"
-	BuildAction               = "build"
-	PingAction                = "ping"
-	AckAction                 = "acknowledge"
-	ReportCurrentStatusAction = "reportCurrentStatus"
-	ReportCompletingAction    = "reportCompleting"
-	ReportCompletedAction     = "reportCompleted"
-	AssignWorkAction          = "assignWork"
-	ConsoleOutActon           = "consoleOut"
+	SetCookieAction           Action = "setCookie"
+	CancelBuildAction         Action = "cancelBuild"
+	ReregisterAction          Action = "reregister"
+	BuildAction               Action = "build"
+	PingAction                Action = "ping"
+	AckAction                 Action = "acknowledge"
+	NackAction                Action = "negativeAcknowledge"
+	ReportCurrentStatusAction Action = "reportCurrentStatus"
+	ReportCompletingAction    Action = "reportCompleting"
+	ReportCompletedAction     Action = "reportCompleted"
+	AssignWorkAction          Action = "assignWork"
+	ConsoleOutActon           Action = "consoleOut"
+	UploadAgentLogsAction     Action = "uploadAgentLogs"
 )
 
 type Message struct {
-	Action string `json:"action"`
+	Action Action `json:"action"`
 	Data   string `json:"data"`
 	AcknowledgeId  string `json:"acknowledgementId"`
 }
@@ -47,6 +52,30 @@ func (m *Message) DataBuild() *Build {
 	return &build
 }
 
+// DataAgentSession parses setCookie data, which is either the cookie
+// string or an AgentSession object carrying extra session properties.
+func (m *Message) DataAgentSession() *AgentSession {
+	var session AgentSession
+	if err := json.Unmarshal([]byte(m.Data), &session.Cookie); err != nil {
+		json.Unmarshal([]byte(m.Data), &session)
+	}
+	return &session
+}
+
+// Nack tells the server that the agent skipped a message it could not
+// process, e.g. an action it does not know.
+type Nack struct {
+	AcknowledgeId string `json:"acknowledgementId"`
+	Action        Action `json:"action"`
+	Reason        string `json:"reason"`
+}
+
+func (m *Message) DataNack() *Nack {
+	var nack Nack
+	json.Unmarshal([]byte(m.Data), &nack)
+	return &nack
+}
+
 func (m *Message) DataString() string {
 	var str string
 	json.Unmarshal([]byte(m.Data), &str)
@@ -65,7 +94,7 @@ func (m *Message) Report() *Report {
 	return &report
 }
 
-func newMessage(action string, data interface{}) *Message {
+func newMessage(action Action, data interface{}) *Message {
 	json, err := json.Marshal(data)
 	if err != nil {
 		panic(err)
@@ -82,10 +111,18 @@ func SetCookieMessage(cookie string) *Message {
 	return newMessage(SetCookieAction, cookie)
 }
 
+func SetAgentSessionMessage(session *AgentSession) *Message {
+	return newMessage(SetCookieAction, session)
+}
+
 func AckMessage(ackId string) *Message {
 	return newMessage(AckAction, ackId)
 }
 
+func NackMessage(nack *Nack) *Message {
+	return newMessage(NackAction, nack)
+}
+
 func BuildMessage(cmd *Build) *Message {
 	return newMessage(BuildAction, cmd)
 }
@@ -94,7 +131,7 @@ func PingMessage(data *AgentRuntimeInfo) *Message {
 	return newMessage(PingAction, data)
 }
 
-func ReportMessage(t string, report *Report) *Message {
+func ReportMessage(t Action, report *Report) *Message {
 	return newMessage(t, report)
 }
 
@@ -102,6 +139,11 @@ func CompletedMessage(report *Report) *Message {
 	return ReportMessage(ReportCompletedAction, report)
 }
 
+// UploadAgentLogsMessage asks the agent to upload its log bundle to url.
+func UploadAgentLogsMessage(url string) *Message {
+	return newMessage(UploadAgentLogsAction, url)
+}
+
 func ReregisterMessage() *Message {
 	return &Message{Action: ReregisterAction}
 }
@@ -0,0 +1,42 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestDataAgentSessionFromCookieString(t *testing.T) {
+	session := SetCookieMessage("cookie-value").DataAgentSession()
+	assert.Equal(t, "cookie-value", session.Cookie)
+	assert.Equal(t, "", session.WorkingDir)
+	assert.Equal(t, 0, len(session.Flags))
+}
+
+func TestDataAgentSessionFromSessionObject(t *testing.T) {
+	msg := SetAgentSessionMessage(&AgentSession{
+		Cookie:     "cookie-value",
+		WorkingDir: "pipelines",
+		Flags:      map[string]string{"fastCheckout": "true"},
+	})
+	session := msg.DataAgentSession()
+	assert.Equal(t, "cookie-value", session.Cookie)
+	assert.Equal(t, "pipelines", session.WorkingDir)
+	assert.Equal(t, "true", session.Flags["fastCheckout"])
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// EscapePropertyKey escapes key the way java.util.Properties stores it,
+// artifact checksum files are read by Java code on the server.
+func EscapePropertyKey(key string) string {
+	var buf bytes.Buffer
+	for _, r := range key {
+		switch r {
+		case '\\', ' ', '=', ':', '#', '!':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\f':
+			buf.WriteString(`\f`)
+		default:
+			if r < 0x20 || r > 0x7e {
+				for _, c := range utf16.Encode([]rune{r}) {
+					buf.WriteString(`\u`)
+					buf.WriteString(strings.ToUpper(strconv.FormatUint(uint64(c)|0x10000, 16)[1:]))
+				}
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// ParseProperties parses "key=value" lines written with escaped keys,
+// comment lines starting with '#' or '!' are ignored.
+func ParseProperties(content string) map[string]string {
+	ret := make(map[string]string)
+	for _, l := range strings.Split(content, "\n") {
+		l = strings.Trim(l, "\r")
+		if strings.HasPrefix(l, "#") || strings.HasPrefix(l, "!") {
+			continue
+		}
+		key, value, ok := splitProperty(l)
+		if ok {
+			ret[key] = value
+		}
+	}
+	return ret
+}
+
+func splitProperty(line string) (key, value string, ok bool) {
+	var units []uint16
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '=' || c == ':':
+			return string(utf16.Decode(units)), line[i+1:], true
+		case c == '\\' && i+1 < len(line):
+			i++
+			switch line[i] {
+			case 't':
+				units = append(units, '\t')
+			case 'n':
+				units = append(units, '\n')
+			case 'r':
+				units = append(units, '\r')
+			case 'f':
+				units = append(units, '\f')
+			case 'u':
+				if i+5 > len(line) {
+					return "", "", false
+				}
+				u, err := strconv.ParseUint(line[i+1:i+5], 16, 16)
+				if err != nil {
+					return "", "", false
+				}
+				units = append(units, uint16(u))
+				i += 4
+			default:
+				i += appendRune(&units, line[i:]) - 1
+			}
+		default:
+			i += appendRune(&units, line[i:]) - 1
+		}
+	}
+	return "", "", false
+}
+
+func appendRune(units *[]uint16, s string) int {
+	r, size := utf8.DecodeRuneInString(s)
+	*units = append(*units, utf16.Encode([]rune{r})...)
+	return size
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestEscapePropertyKey(t *testing.T) {
+	assert.Equal(t, "dest/hello/3.txt", EscapePropertyKey("dest/hello/3.txt"))
+	assert.Equal(t, `a\ b\=c\:d\#e\!f\\g`, EscapePropertyKey(`a b=c:d#e!f\g`))
+	assert.Equal(t, `\u00FCn\u00EFc\u00F8d\u00E9`, EscapePropertyKey("ünïcødé"))
+	assert.Equal(t, `\uD83D\uDE00\t\n`, EscapePropertyKey("😀\t\n"))
+}
+
+func TestParseProperties(t *testing.T) {
+	keys := []string{"dest/hello/3.txt", "with space.txt", "100%.txt", "a+b.txt",
+		"ünïcødé.txt", "eq=1:2!.txt", "#hash.txt", `back\slash.txt`, "😀.txt"}
+	content := "#\n#Fri Jan 01 00:00:00 UTC 2016\n"
+	for _, key := range keys {
+		content += EscapePropertyKey(key) + "=" + key + "\r\n"
+	}
+	properties := ParseProperties(content)
+	assert.Equal(t, len(keys), len(properties))
+	for _, key := range keys {
+		assert.Equal(t, key, properties[key])
+	}
+
+	assert.Equal(t, "ü", ParseProperties(`ü=ü`)["ü"])
+	assert.Equal(t, 0, len(ParseProperties("no separator\n\\u12=broken")))
+}
@@ -16,6 +16,10 @@
 
 package protocol
 
+// ServerVersionHeader is the response header of registration requests
+// carrying version of the Go server.
+const ServerVersionHeader = "X-GoCD-Version"
+
 type Registration struct {
 	AgentPrivateKey, AgentCertificate string
 }
@@ -18,7 +18,72 @@ package protocol
 
 type Report struct {
 	BuildId          string            `json:"buildId"`
-	Result           string            `json:"result"`
-	JobState         string            `json:"jobState"`
+	Result           BuildStatus       `json:"result"`
+	JobState         JobState          `json:"jobState"`
 	AgentRuntimeInfo *AgentRuntimeInfo `json:"agentRuntimeInfo"`
+	Cancel           *CancelReport     `json:"cancel,omitempty"`
+	Reassign         *ReassignHint     `json:"reassign,omitempty"`
+	// TimedOut is true when the agent canceled the build as it ran
+	// longer than the maximum build duration of the agent
+	TimedOut bool `json:"timedOut,omitempty"`
+
+	// AssignmentLatency is milliseconds from the agent receiving the build
+	// to processing its commands, TeardownLatency is milliseconds from
+	// reporting completing to reporting completed. Only completed reports
+	// have them.
+	AssignmentLatency int64 `json:"assignmentLatencyMillis,omitempty"`
+	TeardownLatency   int64 `json:"teardownLatencyMillis,omitempty"`
+
+	// MaterialRevisions are revisions of materials the build checked out
+	MaterialRevisions []*MaterialRevision `json:"materialRevisions,omitempty"`
+
+	// ResourceUsage is what processes of the build used, only completed
+	// reports of builds running processes have it.
+	ResourceUsage *ResourceUsage `json:"resourceUsage,omitempty"`
+}
+
+// ResourceUsage sums CPU time and IO of processes of a build. PeakRSS is
+// the largest resident set of a single process, or of the job cgroup when
+// jobs run in cgroups of their own. Processes is how many processes the
+// agent started for the build.
+type ResourceUsage struct {
+	CPUSeconds float64 `json:"cpuSeconds"`
+	PeakRSS    int64   `json:"peakRssBytes"`
+	ReadBytes  int64   `json:"readBytes"`
+	WriteBytes int64   `json:"writeBytes"`
+	Processes  int     `json:"processes"`
+}
+
+// MaterialRevision is the revision of a material checked out into Dest,
+// relative to the working directory of the build. FromRevision is the
+// first revision of modifications the build is triggered by.
+type MaterialRevision struct {
+	Type         string `json:"type"`
+	Url          string `json:"url"`
+	Dest         string `json:"dest"`
+	Revision     string `json:"revision"`
+	FromRevision string `json:"fromRevision,omitempty"`
+}
+
+// CancelReport acknowledges a cancelBuild message, Clean is false when
+// processes of the build could not be killed or the build did not stop
+// in time.
+type CancelReport struct {
+	Clean bool   `json:"clean"`
+	Error string `json:"error,omitempty"`
+}
+
+// Reasons of ReassignHint
+const (
+	ReassignDiskFull           = "diskFull"
+	ReassignToolMissing        = "toolMissing"
+	ReassignWorkspaceCorrupted = "workspaceCorrupted"
+)
+
+// ReassignHint is in the completed report of a failed build when it
+// failed for an issue of the agent rather than of the job, so that server
+// can retry the job on another agent.
+type ReassignHint struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
 }
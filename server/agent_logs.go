@@ -0,0 +1,54 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+func agentLogsHandler(s *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		agentId := path.Base(req.URL.Path)
+		bytes, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			s.responseBadRequest(err, w)
+			return
+		}
+		file := s.AgentLogBundleFile(agentId)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			s.responseInternalError(err, w)
+			return
+		}
+		if err := ioutil.WriteFile(file, bytes, 0644); err != nil {
+			s.responseInternalError(err, w)
+			return
+		}
+		s.log("received log bundle of agent %v", agentId)
+	}
+}
+
+func (s *Server) AgentLogsUrl(agentId string) string {
+	return AgentLogsPath + "/" + agentId
+}
+
+func (s *Server) AgentLogBundleFile(agentId string) string {
+	return filepath.Join(s.WorkingDir, "agent-logs", agentId+".zip")
+}
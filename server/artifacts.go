@@ -19,10 +19,14 @@ package server
 import (
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 )
@@ -81,12 +85,33 @@ func handleArtifactDownload(s *Server, w http.ResponseWriter, req *http.Request)
 }
 
 func handleArtifactsUpload(s *Server, w http.ResponseWriter, req *http.Request) {
-	buildId := parseBuildId(req.URL.Path)
+	// upload url path ends with the artifact dest dir
+	buildId := req.URL.Query().Get("buildId")
+	if buildId == "" {
+		s.responseBadRequest(errors.New("buildId is missing"), w)
+		return
+	}
+	encoding := req.Header.Get("Content-Encoding")
+	s.addUploadEncoding(buildId, encoding)
+	if encoding == "gzip" {
+		if s.rejectsGzip() {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			s.responseBadRequest(err, w)
+			return
+		}
+		defer gz.Close()
+		req.Body = gz
+	}
 	form, err := req.MultipartReader()
 	if err != nil {
 		s.responseBadRequest(err, w)
 		return
 	}
+	var deltaBase string
 	for {
 		part, err := form.NextPart()
 		if err == io.EOF {
@@ -110,11 +135,57 @@ func handleArtifactsUpload(s *Server, w http.ResponseWriter, req *http.Request)
 				s.responseInternalError(err, w)
 				return
 			}
+		case "delta_base":
+			bytes, err := ioutil.ReadAll(part)
+			if err != nil {
+				s.responseInternalError(err, w)
+				return
+			}
+			base, err := url.Parse(string(bytes))
+			if err != nil {
+				s.responseBadRequest(err, w)
+				return
+			}
+			deltaBase = parseBuildId(base.Path)
+		case "file_unchanged":
+			bytes, err := ioutil.ReadAll(part)
+			if err != nil {
+				s.responseInternalError(err, w)
+				return
+			}
+			if deltaBase == "" {
+				s.responseBadRequest(errors.New("delta_base is missing"), w)
+				return
+			}
+			err = copyUnchangedArtifacts(s, deltaBase, buildId, bytes)
+			if err != nil {
+				s.responseInternalError(err, w)
+				return
+			}
 		}
 	}
 	w.WriteHeader(http.StatusCreated)
 }
 
+// copyUnchangedArtifacts copies files the agent did not upload again from
+// the artifacts of the previous run.
+func copyUnchangedArtifacts(s *Server, from, to string, checksum []byte) error {
+	for file := range protocol.ParseProperties(string(checksum)) {
+		data, err := ioutil.ReadFile(s.ArtifactFile(from, file))
+		if err != nil {
+			return err
+		}
+		dest := s.ArtifactFile(to, file)
+		if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(dest, data, 0644); err != nil {
+			return err
+		}
+	}
+	return s.appendToFile(s.ChecksumFile(to), checksum)
+}
+
 func extractToArtifactDir(s *Server, buildId string, part *multipart.Part) error {
 	// TODO: find out the right way to unzip multipart.Part in memory
 	data, err := ioutil.ReadAll(part)
@@ -189,3 +260,31 @@ func zipDirecotry(source string) (string, error) {
 	return zipfile.Name(), err
 
 }
+
+// SetRejectGzip makes artifact uploads with gzip content encoding
+// responded 415, like servers not supporting it.
+func (s *Server) SetRejectGzip(reject bool) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.rejectGzip = reject
+}
+
+func (s *Server) rejectsGzip() bool {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.rejectGzip
+}
+
+// UploadEncodings returns content encodings of artifact uploads of the
+// build in the order they are received, empty for uploads not encoded.
+func (s *Server) UploadEncodings(buildId string) []string {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return append([]string{}, s.uploadEncodings[buildId]...)
+}
+
+func (s *Server) addUploadEncoding(buildId, encoding string) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.uploadEncodings[buildId] = append(s.uploadEncodings[buildId], encoding)
+}
@@ -19,19 +19,72 @@ package server
 import (
 	"io/ioutil"
 	"net/http"
+	"strconv"
 )
 
+const ConsoleOffsetHeader = "X-Console-Offset"
+
 func consoleHandler(s *Server) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
-		buildId := parseBuildId(req.URL.Path)
-		bytes, err := ioutil.ReadAll(req.Body)
+		switch req.Method {
+		case http.MethodGet:
+			handleConsoleFetch(s, w, req)
+		default:
+			handleConsoleAppend(s, w, req)
+		}
+	}
+}
+
+// handleConsoleAppend appends to the console log; when the agent sends the
+// offset the chunk starts at, bytes already appended are skipped so that a
+// resent chunk does not duplicate output.
+func handleConsoleAppend(s *Server, w http.ResponseWriter, req *http.Request) {
+	buildId := parseBuildId(req.URL.Path)
+	bytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		s.responseBadRequest(err, w)
+		return
+	}
+	if h := req.Header.Get(ConsoleOffsetHeader); h != "" {
+		offset, err := strconv.ParseInt(h, 10, 64)
 		if err != nil {
 			s.responseBadRequest(err, w)
 			return
 		}
-		err = s.appendToFile(s.ConsoleLogFile(buildId), bytes)
+		size := s.consoleLogSize(buildId)
+		if offset > size {
+			s.log("console offset %v is ahead of console log size %v", offset, size)
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if skip := size - offset; skip >= int64(len(bytes)) {
+			bytes = nil
+		} else {
+			bytes = bytes[skip:]
+		}
+	}
+	err = s.appendToFile(s.ConsoleLogFile(buildId), bytes)
+	if err != nil {
+		s.responseInternalError(err, w)
+	}
+}
+
+func handleConsoleFetch(s *Server, w http.ResponseWriter, req *http.Request) {
+	buildId := parseBuildId(req.URL.Path)
+	var offset int64
+	if o := req.URL.Query().Get("offset"); o != "" {
+		var err error
+		offset, err = strconv.ParseInt(o, 10, 64)
 		if err != nil {
-			s.responseInternalError(err, w)
+			s.responseBadRequest(err, w)
+			return
 		}
 	}
+	log, next, err := s.ConsoleLogFrom(buildId, offset)
+	if err != nil {
+		s.responseBadRequest(err, w)
+		return
+	}
+	w.Header().Set(ConsoleOffsetHeader, strconv.FormatInt(next, 10))
+	w.Write([]byte(log))
 }
@@ -17,6 +17,7 @@
 package server
 
 import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"net/http"
 )
 
@@ -31,3 +32,14 @@ func (s *Server) LimittedRequestEntitySize(handler func(http.ResponseWriter, *ht
 		handler(w, req)
 	}
 }
+
+// ReportVersion sets the version header of responses of handler, like
+// Go server does for every response, when the server has a version.
+func (s *Server) ReportVersion(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if version := s.Version(); version != "" {
+			w.Header().Set(protocol.ServerVersionHeader, version)
+		}
+		handler(w, req)
+	}
+}
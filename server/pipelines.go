@@ -0,0 +1,85 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/api"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AddPipelineInstance records instance in history of its pipeline, it
+// replaces the recorded instance with the same counter.
+func (s *Server) AddPipelineInstance(instance *api.PipelineInstance) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	history := s.pipelines[instance.Name]
+	for i, recorded := range history {
+		if recorded.Counter == instance.Counter {
+			history[i] = instance
+			return
+		}
+	}
+	s.pipelines[instance.Name] = append([]*api.PipelineInstance{instance}, history...)
+}
+
+func (s *Server) pipelineHistory(name string) []*api.PipelineInstance {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return append([]*api.PipelineInstance{}, s.pipelines[name]...)
+}
+
+// pipelineHistoryHandler serves /api/pipelines/<name>/history
+func pipelineHistoryHandler(s *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, api.PipelinesPath+"/"), "/")
+		if len(parts) != 2 || parts[1] != "history" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		history := s.pipelineHistory(parts[0])
+		if len(history) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.responseJSON(map[string]interface{}{"pipelines": history}, w)
+	}
+}
+
+// stageInstanceHandler serves /api/stages/<pipeline>/<counter>/<stage>/<counter>
+func stageInstanceHandler(s *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, api.StagesPath+"/"), "/")
+		if len(parts) != 4 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		pipelineCounter, _ := strconv.Atoi(parts[1])
+		stageCounter, _ := strconv.Atoi(parts[3])
+		for _, instance := range s.pipelineHistory(parts[0]) {
+			stage := instance.Stage(parts[2])
+			if instance.Counter == pipelineCounter && stage != nil && stage.Counter == stageCounter {
+				found := *stage
+				found.PipelineName, found.PipelineCounter = instance.Name, instance.Counter
+				s.responseJSON(&found, w)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// propertiesHandler keeps properties agents post for builds, either in a
+// batch to the property URL of a build, or one by one to
+// <property URL>/<name>.
+func propertiesHandler(s *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := req.ParseForm(); err != nil {
+			s.responseBadRequest(err, w)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, PropertiesPath+"/builds/"), "/")
+		props := make(map[string]string)
+		if len(parts) == 1 {
+			for name := range req.PostForm {
+				props[name] = req.PostForm.Get(name)
+			}
+		} else {
+			props[parts[1]] = req.PostForm.Get("value")
+		}
+		s.fieldChangeMu.Lock()
+		defer s.fieldChangeMu.Unlock()
+		if s.properties[parts[0]] == nil {
+			s.properties[parts[0]] = make(map[string]string)
+		}
+		for name, value := range props {
+			s.properties[parts[0]][name] = value
+		}
+	}
+}
+
+// Properties returns properties posted for build.
+func (s *Server) Properties(buildId string) map[string]string {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	props := make(map[string]string)
+	for name, value := range s.properties[buildId] {
+		props[name] = value
+	}
+	return props
+}
@@ -17,6 +17,7 @@
 package server
 
 import (
+	"encoding/binary"
 	"fmt"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"github.com/satori/go.uuid"
@@ -56,14 +57,20 @@ func (agent *RemoteAgent) processMessage(server *Server, msg *protocol.Message)
 			server.add(agent)
 			agent.SetCookie()
 		}
+		server.setAgentRuntimeInfo(agent.id, info)
 		agentState := info.RuntimeStatus
 		server.notifyAgent(agent.id, agentState)
-	case "reportCurrentStatus":
+	case protocol.ReportCurrentStatusAction:
 		report := msg.Report()
-		server.notifyBuild(report.BuildId, report.JobState)
-	case "reportCompleting", "reportCompleted":
+		server.notifyBuild(report.BuildId, string(report.JobState))
+	case protocol.ReportCompletingAction, protocol.ReportCompletedAction:
 		report := msg.Report()
-		server.notifyBuild(report.BuildId, report.Result)
+		if msg.Action == protocol.ReportCompletedAction {
+			server.setCompletedReport(report)
+		}
+		server.notifyBuild(report.BuildId, string(report.Result))
+	case protocol.NackAction:
+		server.addNack(agent.id, msg.DataNack())
 	}
 }
 
@@ -90,3 +97,13 @@ func (agent *RemoteAgent) String() string {
 func (agent *RemoteAgent) Close() error {
 	return agent.conn.Close()
 }
+
+// CloseWith sends a close frame with code and reason, agent closes the
+// connection when it receives it.
+func (agent *RemoteAgent) CloseWith(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	agent.conn.PayloadType = websocket.CloseFrame
+	_, err := agent.conn.Write(append(payload, reason...))
+	return err
+}
@@ -17,6 +17,7 @@
 package server
 
 import (
+	"encoding/json"
 	"net/http"
 )
 
@@ -29,3 +30,13 @@ func (s *Server) responseInternalError(err error, w http.ResponseWriter) {
 	s.error("Server internal error: %v", err)
 	w.WriteHeader(http.StatusInternalServerError)
 }
+
+func (s *Server) responseJSON(data interface{}, w http.ResponseWriter) {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		s.responseInternalError(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
@@ -18,12 +18,15 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/api"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"golang.org/x/net/websocket"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -34,12 +37,17 @@ const (
 	WebSocketPath    = "/agent-websocket"
 	RegistrationPath = "/agent-register"
 	StatusPath       = "/status"
+	AgentsPath       = "/api/agents"
+	AgentLogsPath    = "/agent-logs"
 
 	ConsoleLogPath = "/console"
 	ArtifactsPath  = "/artifacts"
 	PropertiesPath = "/properties"
 )
 
+// Version is the Go server version reported to agents by default.
+const Version = "16.7.0"
+
 type StateListener interface {
 	Notify(class, id, state string)
 }
@@ -49,6 +57,12 @@ type AgentMessage struct {
 	Msg     *protocol.Message
 }
 
+type agentClose struct {
+	agentId string
+	code    int
+	reason  string
+}
+
 type Server struct {
 	Address              string
 	CertPemFile          string
@@ -57,41 +71,65 @@ type Server struct {
 	Logger               *log.Logger
 	StateListeners       []StateListener
 	maxRequestEntitySize int64
+	version              string
+	pendingApproval      bool
+	rejectGzip           bool
+	uploadEncodings      map[string][]string
+	runtimeInfos         map[string]*protocol.AgentRuntimeInfo
+	completedReports     map[string]*protocol.Report
+	nacks                map[string][]*protocol.Nack
+	pipelines            map[string][]*api.PipelineInstance
+	properties           map[string]map[string]string
 	fieldChangeMu        sync.Mutex
 
 	addAgent    chan *RemoteAgent
 	delAgent    chan *RemoteAgent
 	sendMessage chan *AgentMessage
+	closeAgent  chan *agentClose
 }
 
 func New(address, certFile, keyFile, workingDir string, logger *log.Logger) *Server {
 	return &Server{
-		Address:     address,
-		CertPemFile: certFile,
-		KeyPemFile:  keyFile,
-		WorkingDir:  workingDir,
-		Logger:      logger,
-		addAgent:    make(chan *RemoteAgent),
-		delAgent:    make(chan *RemoteAgent),
-		sendMessage: make(chan *AgentMessage),
+		Address:          address,
+		CertPemFile:      certFile,
+		KeyPemFile:       keyFile,
+		WorkingDir:       workingDir,
+		Logger:           logger,
+		version:          Version,
+		runtimeInfos:     make(map[string]*protocol.AgentRuntimeInfo),
+		completedReports: make(map[string]*protocol.Report),
+		nacks:            make(map[string][]*protocol.Nack),
+		pipelines:        make(map[string][]*api.PipelineInstance),
+		properties:       make(map[string]map[string]string),
+		uploadEncodings:  make(map[string][]string),
+		addAgent:         make(chan *RemoteAgent),
+		delAgent:         make(chan *RemoteAgent),
+		sendMessage:      make(chan *AgentMessage),
+		closeAgent:       make(chan *agentClose),
 	}
 
 }
 
 func (s *Server) Start() error {
 	go manageAgents(s)
-	http.Handle(WebSocketPath, websocketHandler(s))
+	http.HandleFunc(WebSocketPath, s.ReportVersion(websocketHandler(s).ServeHTTP))
 	s.HandleFunc(RegistrationPath, registorHandler(s))
 	s.HandleFunc(ConsoleLogPath+"/", consoleHandler(s))
 	s.HandleFunc(ArtifactsPath+"/", artifactsHandler(s))
 	s.HandleFunc(StatusPath, statusHandler())
+	s.HandleFunc(AgentsPath, agentsHandler(s))
+	s.HandleFunc(AgentsPath+"/", agentsHandler(s))
+	s.HandleFunc(AgentLogsPath+"/", agentLogsHandler(s))
+	s.HandleFunc(PropertiesPath+"/", propertiesHandler(s))
+	s.HandleFunc(api.PipelinesPath+"/", pipelineHistoryHandler(s))
+	s.HandleFunc(api.StagesPath+"/", stageInstanceHandler(s))
 	s.log("listen to %v", s.Address)
 	return http.ListenAndServeTLS(s.Address, s.CertPemFile, s.KeyPemFile, nil)
 }
 
 func (s *Server) HandleFunc(path string, handler func(http.ResponseWriter, *http.Request)) {
 	http.HandleFunc(path,
-		s.LimittedRequestEntitySize(handler))
+		s.ReportVersion(s.LimittedRequestEntitySize(handler)))
 }
 
 func (s *Server) SendBuild(agentId, buildId string, commands ...*protocol.BuildCommand) {
@@ -105,6 +143,34 @@ func (s *Server) SendBuild(agentId, buildId string, commands ...*protocol.BuildC
 	s.Send(agentId, protocol.BuildMessage(build))
 }
 
+// SetVersion changes the Go server version reported to registering
+// agents, empty to not report it.
+func (s *Server) SetVersion(version string) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.version = version
+}
+
+func (s *Server) Version() string {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.version
+}
+
+// SetPendingApproval keeps registering agents pending, as if they need
+// to be enabled on server side.
+func (s *Server) SetPendingApproval(pending bool) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.pendingApproval = pending
+}
+
+func (s *Server) isPendingApproval() bool {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.pendingApproval
+}
+
 func (s *Server) SetMaxRequestEntitySize(size int64) {
 	s.fieldChangeMu.Lock()
 	defer s.fieldChangeMu.Unlock()
@@ -117,11 +183,81 @@ func (s *Server) MaxRequestEntitySize() int64 {
 	return s.maxRequestEntitySize
 }
 
+// AgentRuntimeInfo returns what the agent reported in its last ping.
+func (s *Server) AgentRuntimeInfo(agentId string) *protocol.AgentRuntimeInfo {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.runtimeInfos[agentId]
+}
+
+func (s *Server) setAgentRuntimeInfo(agentId string, info *protocol.AgentRuntimeInfo) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.runtimeInfos[agentId] = info
+}
+
+// CompletedReport returns the last reportCompleted message of the build.
+func (s *Server) CompletedReport(buildId string) *protocol.Report {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.completedReports[buildId]
+}
+
+func (s *Server) setCompletedReport(report *protocol.Report) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.completedReports[report.BuildId] = report
+}
+
+// Nacks returns messages the agent replied that it skipped.
+func (s *Server) Nacks(agentId string) []*protocol.Nack {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return append([]*protocol.Nack(nil), s.nacks[agentId]...)
+}
+
+func (s *Server) addNack(agentId string, nack *protocol.Nack) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.nacks[agentId] = append(s.nacks[agentId], nack)
+}
+
+func (s *Server) agentRuntimeInfos() []*protocol.AgentRuntimeInfo {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	infos := make([]*protocol.AgentRuntimeInfo, 0, len(s.runtimeInfos))
+	for _, info := range s.runtimeInfos {
+		infos = append(infos, info)
+	}
+	return infos
+}
+
 func (s *Server) ConsoleLog(buildId string) (string, error) {
 	bytes, err := ioutil.ReadFile(s.ConsoleLogFile(buildId))
 	return string(bytes), err
 }
 
+// ConsoleLogFrom returns console log appended after offset, and the offset
+// to continue from next time.
+func (s *Server) ConsoleLogFrom(buildId string, offset int64) (string, int64, error) {
+	bytes, err := ioutil.ReadFile(s.ConsoleLogFile(buildId))
+	if err != nil {
+		return "", offset, err
+	}
+	if offset > int64(len(bytes)) {
+		return "", offset, fmt.Errorf("offset %v is beyond console log size %v", offset, len(bytes))
+	}
+	return string(bytes[offset:]), int64(len(bytes)), nil
+}
+
+func (s *Server) consoleLogSize(buildId string) int64 {
+	info, err := os.Stat(s.ConsoleLogFile(buildId))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
 func (s *Server) Checksum(buildId string) (string, error) {
 	bytes, err := ioutil.ReadFile(s.ChecksumFile(buildId))
 	return string(bytes), err
@@ -136,7 +272,7 @@ func (s *Server) ArtifactFile(buildId, file string) string {
 }
 
 func (s *Server) ArtifactUrl(buildId, file string) string {
-	return ArtifactsPath + "/builds/" + buildId + "?file=" + file
+	return ArtifactsPath + "/builds/" + buildId + "?file=" + url.QueryEscape(file)
 }
 
 func (s *Server) ChecksumFile(buildId string) string {
@@ -151,6 +287,11 @@ func (s *Server) Send(agentId string, msg *protocol.Message) {
 	s.sendMessage <- &AgentMessage{agentId: agentId, Msg: msg}
 }
 
+// CloseAgent closes websocket connection of agent with close code and reason.
+func (s *Server) CloseAgent(agentId string, code int, reason string) {
+	s.closeAgent <- &agentClose{agentId: agentId, code: code, reason: reason}
+}
+
 func (s *Server) log(format string, v ...interface{}) {
 	s.Logger.Printf(format, v...)
 }
@@ -208,7 +349,10 @@ func manageAgents(s *Server) {
 		case agent := <-s.addAgent:
 			agents[agent.id] = agent
 		case agent := <-s.delAgent:
-			delete(agents, agent.id)
+			// agent may have connected again before its old connection is closed
+			if agents[agent.id] == agent {
+				delete(agents, agent.id)
+			}
 		case am := <-s.sendMessage:
 			agent := agents[am.agentId]
 			if agent != nil {
@@ -216,6 +360,16 @@ func manageAgents(s *Server) {
 			} else {
 				s.log("could not find agent by id %v for sending message: %v", am.agentId, am.Msg.Action)
 			}
+		case ac := <-s.closeAgent:
+			agent := agents[ac.agentId]
+			if agent != nil {
+				delete(agents, ac.agentId)
+				if err := agent.CloseWith(ac.code, ac.reason); err != nil {
+					s.error("close agent %v failed: %v", ac.agentId, err)
+				}
+			} else {
+				s.log("could not find agent by id %v for closing", ac.agentId)
+			}
 		}
 	}
 }
@@ -226,6 +380,47 @@ func statusHandler() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+// agentsHandler lists runtime info of all agents, or of one agent
+// by /api/agents/<uuid>; ?label=team=payments filters agents by label.
+func agentsHandler(s *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var data interface{}
+		if id := strings.TrimPrefix(req.URL.Path, AgentsPath+"/"); id != req.URL.Path && id != "" {
+			info := s.AgentRuntimeInfo(id)
+			if info == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			data = info
+		} else {
+			infos := make([]*protocol.AgentRuntimeInfo, 0)
+			for _, info := range s.agentRuntimeInfos() {
+				if matchLabels(info, req.URL.Query()["label"]) {
+					infos = append(infos, info)
+				}
+			}
+			data = infos
+		}
+		bytes, err := json.Marshal(data)
+		if err != nil {
+			s.responseInternalError(err, w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bytes)
+	}
+}
+
+func matchLabels(info *protocol.AgentRuntimeInfo, labels []string) bool {
+	for _, label := range labels {
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) != 2 || info.Labels[kv[0]] != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
 // todo: does not generate real agent cert and private key yet, just
 // use server cert and private key for testing environment.
 func registorHandler(s *Server) func(http.ResponseWriter, *http.Request) {
@@ -234,6 +429,10 @@ func registorHandler(s *Server) func(http.ResponseWriter, *http.Request) {
 		var err error
 		var reg *protocol.Registration
 
+		if s.isPendingApproval() {
+			w.Write([]byte("{}"))
+			return
+		}
 		agentPrivateKey, err = ioutil.ReadFile(s.KeyPemFile)
 		if err != nil {
 			s.responseInternalError(err, w)
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream
+
+import (
+	"io"
+)
+
+// MaxPendingLineSize is how long a line can grow before it is written out
+// without waiting for its end.
+var MaxPendingLineSize = 64 * 1024
+
+// CarriageReturnWriter collapses lines rewritten with '\r', e.g. progress
+// bars, into their final state. A line is held until it ends, so Flush
+// must be called when the output is done.
+type CarriageReturnWriter struct {
+	io.Writer
+	line []byte
+	cr   bool
+}
+
+func NewCarriageReturnWriter(writer io.Writer) *CarriageReturnWriter {
+	return &CarriageReturnWriter{Writer: writer}
+}
+
+func (w *CarriageReturnWriter) Write(in []byte) (int, error) {
+	var out []byte
+	for _, b := range in {
+		if w.cr {
+			w.cr = false
+			if b == '\n' {
+				// "\r\n" ends a line
+				out = append(append(out, w.line...), '\r', '\n')
+				w.line = w.line[:0]
+				continue
+			}
+			w.line = w.line[:0]
+		}
+		switch b {
+		case '\r':
+			w.cr = true
+		case '\n':
+			out = append(append(out, w.line...), '\n')
+			w.line = w.line[:0]
+		default:
+			w.line = append(w.line, b)
+			if len(w.line) >= MaxPendingLineSize {
+				out = append(out, w.line...)
+				w.line = w.line[:0]
+			}
+		}
+	}
+	if len(out) > 0 {
+		if _, err := w.Writer.Write(out); err != nil {
+			return len(in), err
+		}
+	}
+	return len(in), nil
+}
+
+// Flush writes out the last line, which did not end with a line break.
+func (w *CarriageReturnWriter) Flush() error {
+	w.cr = false
+	if len(w.line) == 0 {
+		return nil
+	}
+	_, err := w.Writer.Write(w.line)
+	w.line = w.line[:0]
+	return err
+}
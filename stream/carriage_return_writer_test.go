@@ -0,0 +1,61 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream_test
+
+import (
+	"bytes"
+	. "github.com/gocd-contrib/gocd-golang-agent/stream"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestCarriageReturnWriter(t *testing.T) {
+	var tests = []struct {
+		inputs []string
+		output string
+	}{
+		{[]string{"hello\n"}, "hello\n"},
+		{[]string{"10%\r50%\r100%\n"}, "100%\n"},
+		{[]string{"10%\r", "50%\r", "100%\n", "done\n"}, "100%\ndone\n"},
+		{[]string{"hello\r\nworld\r\n"}, "hello\r\nworld\r\n"},
+		{[]string{"hello\r", "\nworld"}, "hello\r\nworld"},
+		{[]string{"10%\r100%\r"}, "100%"},
+		{[]string{"no line break"}, "no line break"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := NewCarriageReturnWriter(&buf)
+		for _, d := range test.inputs {
+			size, err := w.Write([]byte(d))
+			assert.Nil(t, err)
+			assert.Equal(t, len(d), size)
+		}
+		assert.Nil(t, w.Flush())
+		assert.Equal(t, test.output, buf.String())
+	}
+}
+
+func TestCarriageReturnWriterWritesOutLongLines(t *testing.T) {
+	MaxPendingLineSize = 4
+	defer func() {
+		MaxPendingLineSize = 64 * 1024
+	}()
+	var buf bytes.Buffer
+	w := NewCarriageReturnWriter(&buf)
+	w.Write([]byte("abcdef"))
+	assert.Equal(t, "abcd", buf.String())
+}
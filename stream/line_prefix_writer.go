@@ -0,0 +1,75 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// LinePrefixWriter writes whole lines with Prefix to Writer in single
+// writes, so that lines of concurrent writers sharing Writer are not
+// mixed up. Flush writes what is left of the last line.
+type LinePrefixWriter struct {
+	Writer io.Writer
+	Prefix []byte
+
+	mu   sync.Mutex
+	line []byte
+}
+
+func NewLinePrefixWriter(writer io.Writer, prefix string) *LinePrefixWriter {
+	return &LinePrefixWriter{Writer: writer, Prefix: []byte(prefix)}
+}
+
+func (w *LinePrefixWriter) Write(out []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data := out
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			w.line = append(w.line, data...)
+			break
+		}
+		w.line = append(w.line, data[:i+1]...)
+		data = data[i+1:]
+		if err := w.writeLine(); err != nil {
+			return 0, err
+		}
+	}
+	return len(out), nil
+}
+
+func (w *LinePrefixWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.line) == 0 {
+		return nil
+	}
+	w.line = append(w.line, '\n')
+	return w.writeLine()
+}
+
+func (w *LinePrefixWriter) writeLine() error {
+	line := make([]byte, 0, len(w.Prefix)+len(w.line))
+	line = append(append(line, w.Prefix...), w.line...)
+	w.line = w.line[:0]
+	_, err := w.Writer.Write(line)
+	return err
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream_test
+
+import (
+	"bytes"
+	. "github.com/gocd-contrib/gocd-golang-agent/stream"
+	"github.com/xli/assert"
+	"testing"
+)
+
+type writes struct {
+	writes []string
+}
+
+func (w *writes) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestLinePrefixWriterWritesWholeLines(t *testing.T) {
+	var out writes
+	w := NewLinePrefixWriter(&out, "[task 1] ")
+	for _, d := range []string{"hel", "lo\nwor", "ld\n\n", "!"} {
+		size, err := w.Write([]byte(d))
+		assert.Nil(t, err)
+		assert.Equal(t, len(d), size)
+	}
+	assert.Equal(t, []string{"[task 1] hello\n", "[task 1] world\n", "[task 1] \n"}, out.writes)
+	assert.Nil(t, w.Flush())
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, "[task 1] !\n", out.writes[3])
+	assert.Equal(t, 4, len(out.writes))
+}
+
+func TestLinePrefixWriterFlushNothing(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewLinePrefixWriter(&buf, "> ")
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, "", buf.String())
+}
@@ -21,14 +21,21 @@ import (
 	"io"
 )
 
+// TagMark starts console lines tagged by the agent, task output with it
+// must have it dropped so that tasks cannot forge tags.
+const TagMark = '\x1e'
+
 type PrefixWriter struct {
 	io.Writer
 	Prefix func() []byte
-	ap     bool
+	// Tags are kept in front of the prefix when a line starts with TagMark
+	// and one of them followed by '|' in a single write, TagMark is dropped
+	Tags []string
+	ap   bool
 }
 
 func NewPrefixWriter(writer io.Writer, prefix func() []byte) *PrefixWriter {
-	return &PrefixWriter{writer, prefix, true}
+	return &PrefixWriter{Writer: writer, Prefix: prefix, ap: true}
 }
 
 func (w *PrefixWriter) Write(out []byte) (int, error) {
@@ -44,6 +51,7 @@ func (w *PrefixWriter) Write(out []byte) (int, error) {
 			break
 		}
 		if i > 0 || w.ap {
+			line = w.writeTag(line)
 			if err := w.appendPrefix(); err != nil {
 				return -1, err
 			}
@@ -57,6 +65,20 @@ func (w *PrefixWriter) Write(out []byte) (int, error) {
 	return len(out), nil
 }
 
+func (w *PrefixWriter) writeTag(line []byte) []byte {
+	if len(line) == 0 || line[0] != TagMark {
+		return line
+	}
+	line = line[1:]
+	for _, tag := range w.Tags {
+		if len(line) > len(tag) && string(line[:len(tag)]) == tag && line[len(tag)] == '|' {
+			w.Writer.Write(line[:len(tag)+1])
+			return line[len(tag)+1:]
+		}
+	}
+	return line
+}
+
 func (w *PrefixWriter) appendPrefix() error {
 	_, err := w.Writer.Write(w.Prefix())
 	return err
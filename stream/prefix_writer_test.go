@@ -55,3 +55,25 @@ func TestPrefixWriter(t *testing.T) {
 		assert.Equal(t, test.output, buf.String())
 	}
 }
+
+func TestPrefixWriterKeepsTagsInFrontOfPrefix(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewPrefixWriter(&buf, func() []byte {
+		return []byte("12:00 ")
+	})
+	w.Tags = []string{"##", "?0"}
+	w.Write([]byte("\x1e##|build\nhello\n"))
+	w.Write([]byte("\x1e?0|"))
+	w.Write([]byte("!!|hi\n"))
+	assert.Equal(t, "##|12:00 build\n12:00 hello\n?0|12:00 !!|hi\n", buf.String())
+}
+
+func TestPrefixWriterTagsLinesWithTagMarkOnly(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewPrefixWriter(&buf, func() []byte {
+		return []byte("12:00 ")
+	})
+	w.Tags = []string{"##"}
+	w.Write([]byte("##|not a tag\n\x1e&&|unknown\n"))
+	assert.Equal(t, "12:00 ##|not a tag\n12:00 &&|unknown\n", buf.String())
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+)
+
+// SampleWriter writes the first After lines as they are, then only every
+// Every-th line and lines matching Keep. Notice is written once when
+// sampling starts, and Skipped in front of a line written after skipped
+// lines.
+type SampleWriter struct {
+	io.Writer
+	After   int
+	Every   int
+	Keep    *regexp.Regexp
+	Notice  func() []byte
+	Skipped func(n int) []byte
+
+	lines   int
+	skipped int
+	gap     int
+	line    []byte
+}
+
+func NewSampleWriter(writer io.Writer, after, every int, keep *regexp.Regexp) *SampleWriter {
+	return &SampleWriter{Writer: writer, After: after, Every: every, Keep: keep}
+}
+
+func (w *SampleWriter) Write(out []byte) (int, error) {
+	size := len(out)
+	for len(out) > 0 {
+		end := bytes.IndexByte(out, '\n') + 1
+		if end == 0 {
+			end = len(out)
+		}
+		line := out[:end]
+		out = out[end:]
+		complete := line[len(line)-1] == '\n'
+		if w.lines < w.After {
+			if _, err := w.Writer.Write(line); err != nil {
+				return -1, err
+			}
+			if complete {
+				w.lines++
+			}
+			continue
+		}
+		// lines are sampled whole, partial ones wait for their end
+		w.line = append(w.line, line...)
+		if complete {
+			if err := w.sample(); err != nil {
+				return -1, err
+			}
+		}
+	}
+	return size, nil
+}
+
+// Flush writes the partial line left, e.g. when output ends without a
+// newline.
+func (w *SampleWriter) Flush() error {
+	if len(w.line) == 0 {
+		return nil
+	}
+	return w.writeLine(true)
+}
+
+// SkippedLines is the number of lines skipped so far.
+func (w *SampleWriter) SkippedLines() int {
+	return w.skipped
+}
+
+func (w *SampleWriter) sample() error {
+	if w.lines == w.After && w.Notice != nil {
+		if _, err := w.Writer.Write(w.Notice()); err != nil {
+			return err
+		}
+	}
+	w.lines++
+	n := w.lines - w.After
+	keep := w.Every <= 1 || n%w.Every == 0 || (w.Keep != nil && w.Keep.Match(w.line))
+	return w.writeLine(keep)
+}
+
+func (w *SampleWriter) writeLine(keep bool) error {
+	defer func() {
+		w.line = w.line[:0]
+	}()
+	if !keep {
+		w.skipped++
+		w.gap++
+		return nil
+	}
+	if w.gap > 0 && w.Skipped != nil {
+		if _, err := w.Writer.Write(w.Skipped(w.gap)); err != nil {
+			return err
+		}
+	}
+	w.gap = 0
+	_, err := w.Writer.Write(w.line)
+	return err
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream_test
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/gocd-contrib/gocd-golang-agent/stream"
+	"github.com/xli/assert"
+	"regexp"
+	"testing"
+)
+
+func TestSampleWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewSampleWriter(&buf, 2, 3, regexp.MustCompile("ERROR"))
+	w.Notice = func() []byte {
+		return []byte("--sampling--\n")
+	}
+	w.Skipped = func(n int) []byte {
+		return []byte(fmt.Sprintf("--%v skipped--\n", n))
+	}
+	for _, d := range []string{"1\n2", "\n3\n4\n5", "\n6 ERROR\n", "7\n8\n9\n10"} {
+		size, err := w.Write([]byte(d))
+		assert.Nil(t, err)
+		assert.Equal(t, len(d), size)
+	}
+	assert.Equal(t, "1\n2\n--sampling--\n--2 skipped--\n5\n6 ERROR\n--1 skipped--\n8\n", buf.String())
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, "1\n2\n--sampling--\n--2 skipped--\n5\n6 ERROR\n--1 skipped--\n8\n--1 skipped--\n10", buf.String())
+	assert.Equal(t, 4, w.SkippedLines())
+}
+
+func TestSampleWriterPassesPartialLinesBeforeSampling(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewSampleWriter(&buf, 1, 2, nil)
+	w.Write([]byte("progress"))
+	assert.Equal(t, "progress", buf.String())
+	w.Write([]byte("...\nnext"))
+	assert.Equal(t, "progress...\n", buf.String())
+	w.Write([]byte("\n"))
+	assert.Equal(t, "progress...\n", buf.String())
+}
@@ -17,34 +17,116 @@
 package stream
 
 import (
+	"bytes"
 	"io"
+	"sort"
 	"strings"
+	"sync"
 )
 
+// SubstituteWriter replaces keys of Substitutions in what is written with
+// their values, strings or funcs returning strings. A longer key wins over
+// the keys it starts with. The end of a write that may be the start of a
+// key is held until the next write or Flush, so that a secret split
+// across writes is still replaced.
 type SubstituteWriter struct {
 	io.Writer
 	Substitutions map[string]interface{}
+
+	mu      sync.Mutex
+	pending []byte
 }
 
 func NewSubstituteWriter(writer io.Writer) *SubstituteWriter {
-	return &SubstituteWriter{writer, make(map[string]interface{})}
+	return &SubstituteWriter{Writer: writer, Substitutions: make(map[string]interface{})}
 }
 
+// Filter makes a writer to writer with the same substitutions.
 func (w *SubstituteWriter) Filter(writer io.Writer) *SubstituteWriter {
-	return &SubstituteWriter{writer, w.Substitutions}
+	return &SubstituteWriter{Writer: writer, Substitutions: w.Substitutions}
 }
 
 func (w *SubstituteWriter) Write(out []byte) (int, error) {
-	str := string(out)
-	for k, v := range w.Substitutions {
-		vs, ok := v.(string)
-		if !ok {
-			f, _ := v.(func() string)
-			vs = f()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data := append(w.pending, out...)
+	w.pending = nil
+	keys := w.keys()
+	var starts [256]bool
+	for _, k := range keys {
+		starts[k[0]] = true
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(data); {
+		if !starts[data[i]] {
+			buf.WriteByte(data[i])
+			i++
+			continue
+		}
+		key, partial := matchKey(data[i:], keys)
+		if partial {
+			w.pending = append([]byte(nil), data[i:]...)
+			break
 		}
-		str = strings.Replace(str, k, vs, -1)
+		if key == "" {
+			buf.WriteByte(data[i])
+			i++
+			continue
+		}
+		buf.WriteString(w.value(key))
+		i += len(key)
 	}
-
-	_, err := w.Writer.Write([]byte(str))
+	if buf.Len() == 0 {
+		return len(out), nil
+	}
+	_, err := w.Writer.Write(buf.Bytes())
 	return len(out), err
 }
+
+// Flush writes out what is held as the start of a key.
+func (w *SubstituteWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) == 0 {
+		return nil
+	}
+	pending := w.pending
+	w.pending = nil
+	_, err := w.Writer.Write(pending)
+	return err
+}
+
+// keys are non-empty keys of substitutions, longest first
+func (w *SubstituteWriter) keys() []string {
+	keys := make([]string, 0, len(w.Substitutions))
+	for k := range w.Substitutions {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+	return keys
+}
+
+func (w *SubstituteWriter) value(key string) string {
+	if v, ok := w.Substitutions[key].(string); ok {
+		return v
+	}
+	f, _ := w.Substitutions[key].(func() string)
+	return f()
+}
+
+// matchKey returns the longest of keys data starts with, or partial when
+// data is the start of a longer key.
+func matchKey(data []byte, keys []string) (key string, partial bool) {
+	for _, k := range keys {
+		if len(data) >= len(k) {
+			if string(data[:len(k)]) == k {
+				return k, false
+			}
+		} else if strings.HasPrefix(k, string(data)) {
+			return "", true
+		}
+	}
+	return "", false
+}
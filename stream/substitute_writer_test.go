@@ -73,3 +73,21 @@ func TestSubstituteWriter(t *testing.T) {
 		assert.Equal(t, test.output, buf.String())
 	}
 }
+
+func TestSubstituteWriterReplacesKeysSplitAcrossWrites(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewSubstituteWriter(&buf)
+	w.Substitutions["secret"] = "***"
+	w.Substitutions["secretive"] = "+++"
+
+	for _, d := range []string{"a sec", "ret b se", "cretive c s", "ecre"} {
+		size, err := w.Write([]byte(d))
+		assert.Nil(t, err)
+		assert.Equal(t, len(d), size)
+	}
+	assert.Equal(t, "a *** b +++ c ", buf.String())
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, "a *** b +++ c secre", buf.String())
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, "a *** b +++ c secre", buf.String())
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// tokenize splits source into tokens, string literals keep their quotes.
+func tokenize(source string) ([]string, error) {
+	var tokens []string
+	runes := []rune(source)
+	isNameRune := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' || r == ':'
+	}
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '/',
+			r == '.' && i+1 < len(runes) && runes[i+1] == '.',
+			r == '!' && i+1 < len(runes) && runes[i+1] == '=':
+			tokens = append(tokens, string(runes[i:i+2]))
+			i += 2
+		case unicode.IsDigit(r) || r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		case strings.ContainsRune("/[]()@,=.*", r):
+			tokens = append(tokens, string(r))
+			i++
+		case r == '"' || r == '\'':
+			j := i + 1
+			for j < len(runes) && runes[j] != r {
+				j++
+			}
+			if j == len(runes) {
+				return nil, fmt.Errorf("unterminated string in xpath %q", source)
+			}
+			tokens = append(tokens, string(runes[i:j+1]))
+			i = j + 1
+		case isNameRune(r):
+			j := i + 1
+			for j < len(runes) && isNameRune(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q in xpath %q", r, source)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("xpath is empty")
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) peek(offset int) string {
+	if p.pos+offset < len(p.tokens) {
+		return p.tokens[p.pos+offset]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek(0)
+	p.pos++
+	return t
+}
+
+func (p *parser) expect(token string) error {
+	if t := p.next(); t != token {
+		return p.unexpected(t, token)
+	}
+	return nil
+}
+
+func (p *parser) unexpected(found, expected string) error {
+	if found == "" {
+		return fmt.Errorf("expected %q at end of xpath", expected)
+	}
+	return fmt.Errorf("expected %q but found %q in xpath", expected, found)
+}
+
+func (p *parser) parseExpr() (expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if op := p.peek(0); op == "=" || op == "!=" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &comparison{left: left, right: right, not: op == "!="}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	t := p.peek(0)
+	switch {
+	case t == "":
+		return nil, p.unexpected(t, "expression")
+	case t[0] == '"' || t[0] == '\'':
+		p.next()
+		return &literal{t[1 : len(t)-1]}, nil
+	case t[0] >= '0' && t[0] <= '9' || t[0] == '.' && len(t) > 1 && t != "..":
+		p.next()
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in xpath", t)
+		}
+		return &literal{f}, nil
+	case p.peek(1) == "(" && t != "text" && t != "node":
+		return p.parseFunction()
+	}
+	return p.parsePath()
+}
+
+func (p *parser) parseFunction() (expr, error) {
+	f := &function{name: p.next()}
+	arity, ok := functions[f.name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported function %v() in xpath", f.name)
+	}
+	p.next()
+	for p.peek(0) != ")" {
+		if len(f.args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		f.args = append(f.args, arg)
+	}
+	p.next()
+	if len(f.args) < arity[0] || arity[1] >= 0 && len(f.args) > arity[1] {
+		return nil, fmt.Errorf("wrong number of arguments of %v() in xpath", f.name)
+	}
+	return f, nil
+}
+
+func (p *parser) parsePath() (expr, error) {
+	path := &path{}
+	descendants := false
+	switch p.peek(0) {
+	case "/":
+		p.next()
+		path.absolute = true
+		if !p.atStep() {
+			return path, nil
+		}
+	case "//":
+		p.next()
+		path.absolute = true
+		descendants = true
+	}
+	for {
+		s, err := p.parseStep()
+		if err != nil {
+			return nil, err
+		}
+		s.descendants = descendants
+		path.steps = append(path.steps, s)
+		switch p.peek(0) {
+		case "/":
+			descendants = false
+		case "//":
+			descendants = true
+		default:
+			return path, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) atStep() bool {
+	switch t := p.peek(0); t {
+	case "", "]", ")", ",", "=", "!=":
+		return false
+	}
+	return true
+}
+
+func (p *parser) parseStep() (*step, error) {
+	s := &step{axis: childAxis}
+	switch t := p.next(); t {
+	case ".":
+		s.axis, s.name = selfAxis, "node()"
+	case "..":
+		s.axis, s.name = parentAxis, "node()"
+	case "@":
+		s.axis = attributeAxis
+		name := p.next()
+		if !isName(name) && name != "*" {
+			return nil, p.unexpected(name, "attribute name")
+		}
+		s.name = localName(name)
+	case "*":
+		s.name = t
+	case "text", "node":
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		s.name = t + "()"
+	default:
+		if !isName(t) {
+			return nil, p.unexpected(t, "step")
+		}
+		s.name = localName(t)
+	}
+	for p.peek(0) == "[" {
+		p.next()
+		predicate, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		s.predicates = append(s.predicates, predicate)
+	}
+	return s, nil
+}
+
+func isName(t string) bool {
+	if t == "" || strings.HasSuffix(t, ":") {
+		return false
+	}
+	r := []rune(t)[0]
+	return unicode.IsLetter(r) || r == '_'
+}
+
+// localName is name without its prefix
+func localName(name string) string {
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
@@ -0,0 +1,454 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package xpath evaluates the subset of XPath 1.0 that property
+// generation tasks use on XML reports: location paths with child,
+// descendant ("//"), attribute, self and parent steps, name, "*", text()
+// and node() tests, predicates of positions and comparisons, and the
+// count, sum, string, number, round, floor, ceiling, normalize-space,
+// contains, concat, position and last functions. Prefixes of names are
+// ignored, names match local names of elements and attributes.
+package xpath
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type nodeKind int
+
+const (
+	rootNode nodeKind = iota
+	elementNode
+	attributeNode
+	textNode
+)
+
+// Node is a node of a parsed XML document.
+type Node struct {
+	kind     nodeKind
+	name     string
+	value    string
+	order    int
+	parent   *Node
+	children []*Node
+	attrs    []*Node
+}
+
+// Read parses XML file.
+func Read(file string) (*Node, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Parse parses XML document of r, its root node is returned.
+func Parse(r io.Reader) (*Node, error) {
+	root := &Node{kind: rootNode}
+	order := 1
+	current := root
+	d := xml.NewDecoder(r)
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			e := &Node{kind: elementNode, name: t.Name.Local, order: order, parent: current}
+			order++
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+					continue
+				}
+				e.attrs = append(e.attrs, &Node{kind: attributeNode, name: attr.Name.Local, value: attr.Value, order: order, parent: e})
+				order++
+			}
+			current.children = append(current.children, e)
+			current = e
+		case xml.EndElement:
+			current = current.parent
+		case xml.CharData:
+			if n := len(current.children); n > 0 && current.children[n-1].kind == textNode {
+				current.children[n-1].value += string(t)
+				continue
+			}
+			current.children = append(current.children, &Node{kind: textNode, value: string(t), order: order, parent: current})
+			order++
+		}
+	}
+	if len(root.children) == 0 {
+		return nil, fmt.Errorf("no root element")
+	}
+	return root, nil
+}
+
+// String is the string-value of n, text of all its descendants for
+// elements and the document.
+func (n *Node) String() string {
+	if n.kind == attributeNode || n.kind == textNode {
+		return n.value
+	}
+	var buf strings.Builder
+	var walk func(*Node)
+	walk = func(n *Node) {
+		for _, c := range n.children {
+			if c.kind == textNode {
+				buf.WriteString(c.value)
+			} else {
+				walk(c)
+			}
+		}
+	}
+	walk(n)
+	return buf.String()
+}
+
+// Expr is a compiled XPath expression.
+type Expr struct {
+	source string
+	root   expr
+}
+
+// Compile parses XPath expression source.
+func Compile(source string) (*Expr, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in xpath %q", p.tokens[p.pos], source)
+	}
+	return &Expr{source: source, root: e}, nil
+}
+
+// Evaluate returns the string value of the expression on doc, and whether
+// anything matched it: a non-empty node set, a non-zero number, a
+// non-empty string or true.
+func (e *Expr) Evaluate(doc *Node) (string, bool) {
+	v := e.root.eval(&context{node: doc, position: 1, size: 1})
+	return toString(v), toBool(v)
+}
+
+func (e *Expr) String() string {
+	return e.source
+}
+
+// values are []*Node, float64, string or bool
+type value interface{}
+
+type context struct {
+	node           *Node
+	position, size int
+}
+
+type expr interface {
+	eval(ctx *context) value
+}
+
+func toString(v value) string {
+	switch v := v.(type) {
+	case []*Node:
+		if len(v) == 0 {
+			return ""
+		}
+		return v[0].String()
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return "NaN"
+		case math.IsInf(v, 1):
+			return "Infinity"
+		case math.IsInf(v, -1):
+			return "-Infinity"
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return v.(string)
+}
+
+func toNumber(v value) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(toString(v)), 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return f
+}
+
+func toBool(v value) bool {
+	switch v := v.(type) {
+	case []*Node:
+		return len(v) > 0
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case bool:
+		return v
+	}
+	return v.(string) != ""
+}
+
+type literal struct{ v value }
+
+func (l *literal) eval(ctx *context) value { return l.v }
+
+type comparison struct {
+	left, right expr
+	not         bool
+}
+
+func (c *comparison) eval(ctx *context) value {
+	return equals(c.left.eval(ctx), c.right.eval(ctx)) != c.not
+}
+
+func equals(left, right value) bool {
+	if nodes, ok := left.([]*Node); ok {
+		for _, n := range nodes {
+			if equals(n.String(), right) {
+				return true
+			}
+		}
+		return false
+	}
+	if _, ok := right.([]*Node); ok {
+		return equals(right, left)
+	}
+	switch {
+	case isBool(left) || isBool(right):
+		return toBool(left) == toBool(right)
+	case isNumber(left) || isNumber(right):
+		return toNumber(left) == toNumber(right)
+	}
+	return toString(left) == toString(right)
+}
+
+func isBool(v value) bool {
+	_, ok := v.(bool)
+	return ok
+}
+
+func isNumber(v value) bool {
+	_, ok := v.(float64)
+	return ok
+}
+
+type function struct {
+	name string
+	args []expr
+}
+
+// functions are arity checked by the parser, -1 for any
+var functions = map[string][2]int{
+	"count":           {1, 1},
+	"sum":             {1, 1},
+	"string":          {0, 1},
+	"number":          {0, 1},
+	"round":           {1, 1},
+	"floor":           {1, 1},
+	"ceiling":         {1, 1},
+	"normalize-space": {0, 1},
+	"contains":        {2, 2},
+	"concat":          {2, -1},
+	"position":        {0, 0},
+	"last":            {0, 0},
+}
+
+func (f *function) arg(ctx *context, i int) value {
+	if i < len(f.args) {
+		return f.args[i].eval(ctx)
+	}
+	return []*Node{ctx.node}
+}
+
+func (f *function) eval(ctx *context) value {
+	switch f.name {
+	case "count":
+		nodes, _ := f.arg(ctx, 0).([]*Node)
+		return float64(len(nodes))
+	case "sum":
+		nodes, _ := f.arg(ctx, 0).([]*Node)
+		sum := 0.0
+		for _, n := range nodes {
+			sum += toNumber(n.String())
+		}
+		return sum
+	case "string":
+		return toString(f.arg(ctx, 0))
+	case "number":
+		return toNumber(f.arg(ctx, 0))
+	case "round":
+		return math.Floor(toNumber(f.arg(ctx, 0)) + 0.5)
+	case "floor":
+		return math.Floor(toNumber(f.arg(ctx, 0)))
+	case "ceiling":
+		return math.Ceil(toNumber(f.arg(ctx, 0)))
+	case "normalize-space":
+		return strings.Join(strings.Fields(toString(f.arg(ctx, 0))), " ")
+	case "contains":
+		return strings.Contains(toString(f.arg(ctx, 0)), toString(f.arg(ctx, 1)))
+	case "concat":
+		var buf strings.Builder
+		for i := range f.args {
+			buf.WriteString(toString(f.arg(ctx, i)))
+		}
+		return buf.String()
+	case "position":
+		return float64(ctx.position)
+	}
+	return float64(ctx.size)
+}
+
+type axis int
+
+const (
+	childAxis axis = iota
+	attributeAxis
+	selfAxis
+	parentAxis
+)
+
+type step struct {
+	axis axis
+	// descendants is true for a step after "//"
+	descendants bool
+	// name is "*" for any element or attribute, "text()" or "node()"
+	name       string
+	predicates []expr
+}
+
+type path struct {
+	absolute bool
+	steps    []*step
+}
+
+func (p *path) eval(ctx *context) value {
+	nodes := []*Node{ctx.node}
+	if p.absolute {
+		root := ctx.node
+		for root.parent != nil {
+			root = root.parent
+		}
+		nodes = []*Node{root}
+	}
+	for _, s := range p.steps {
+		var next []*Node
+		for _, n := range nodes {
+			if s.descendants {
+				for _, d := range descendantsOrSelf(n) {
+					next = append(next, s.apply(d)...)
+				}
+			} else {
+				next = append(next, s.apply(n)...)
+			}
+		}
+		nodes = inDocumentOrder(next)
+	}
+	return nodes
+}
+
+func (s *step) apply(n *Node) []*Node {
+	var candidates []*Node
+	switch s.axis {
+	case childAxis:
+		candidates = n.children
+	case attributeAxis:
+		candidates = n.attrs
+	case selfAxis:
+		candidates = []*Node{n}
+	case parentAxis:
+		if n.parent != nil {
+			candidates = []*Node{n.parent}
+		}
+	}
+	var matched []*Node
+	for _, c := range candidates {
+		if s.matches(c) {
+			matched = append(matched, c)
+		}
+	}
+	for _, predicate := range s.predicates {
+		var kept []*Node
+		for i, m := range matched {
+			v := predicate.eval(&context{node: m, position: i + 1, size: len(matched)})
+			if f, ok := v.(float64); ok {
+				if f == float64(i+1) {
+					kept = append(kept, m)
+				}
+			} else if toBool(v) {
+				kept = append(kept, m)
+			}
+		}
+		matched = kept
+	}
+	return matched
+}
+
+func (s *step) matches(n *Node) bool {
+	switch s.name {
+	case "node()":
+		return true
+	case "text()":
+		return n.kind == textNode
+	case "*":
+		return n.kind == elementNode || n.kind == attributeNode
+	}
+	return (n.kind == elementNode || n.kind == attributeNode) && n.name == s.name
+}
+
+func descendantsOrSelf(n *Node) []*Node {
+	nodes := []*Node{n}
+	for _, c := range n.children {
+		nodes = append(nodes, descendantsOrSelf(c)...)
+	}
+	return nodes
+}
+
+func inDocumentOrder(nodes []*Node) []*Node {
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].order < nodes[j].order })
+	var unique []*Node
+	for i, n := range nodes {
+		if i == 0 || n != nodes[i-1] {
+			unique = append(unique, n)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xpath_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/xpath"
+	"github.com/xli/assert"
+	"strings"
+	"testing"
+)
+
+const report = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites xmlns="urn:reports">
+  <testsuite name="unit" tests="3" failures="1" time="1.5">
+    <testcase name="a"/>
+    <testcase name="b"><failure message="boom">trace</failure></testcase>
+    <testcase name="c"/>
+  </testsuite>
+  <testsuite name="integration" tests="2" failures="0" time="2.25">
+    <testcase name="d"/>
+    <testcase name="e"/>
+  </testsuite>
+  <coverage line-rate="0.875"> 87.5 % </coverage>
+</testsuites>`
+
+func TestEvaluateXPath(t *testing.T) {
+	doc, err := Parse(strings.NewReader(report))
+	assert.Nil(t, err)
+	for xpath, expected := range map[string]string{
+		"/testsuites/coverage/@line-rate":                    "0.875",
+		"//coverage":                                         " 87.5 % ",
+		"normalize-space(//coverage/text())":                 "87.5 %",
+		"count(//testcase)":                                  "5",
+		"sum(//testsuite/@tests)":                            "5",
+		"sum(/testsuites/testsuite/@time)":                   "3.75",
+		"round(sum(//@time))":                                "4",
+		"//testsuite[2]/@name":                               "integration",
+		"//testsuite[last()]/testcase[1]/@name":              "d",
+		"//testsuite[@name='unit']/@failures":                "1",
+		"//testcase[failure]/@name":                          "b",
+		"string(//failure/@message)":                         "boom",
+		"count(//testcase[@name!='a'])":                      "4",
+		"//failure/../../@name":                              "unit",
+		"concat(//testsuite/@name, '-', count(//testsuite))": "unit-2",
+		"//r:coverage/@line-rate":                            "0.875",
+	} {
+		e, err := Compile(xpath)
+		assert.Nil(t, err, xpath)
+		value, matched := e.Evaluate(doc)
+		assert.Equal(t, expected, value, xpath)
+		assert.True(t, matched, xpath)
+	}
+}
+
+func TestXPathMatchingNothing(t *testing.T) {
+	doc, err := Parse(strings.NewReader(report))
+	assert.Nil(t, err)
+	for _, xpath := range []string{"//missing", "/testsuites/@tests", "count(//missing)", "//testsuite[3]"} {
+		e, err := Compile(xpath)
+		assert.Nil(t, err, xpath)
+		_, matched := e.Evaluate(doc)
+		assert.False(t, matched, xpath)
+	}
+}
+
+func TestCompileIllegalXPath(t *testing.T) {
+	for _, xpath := range []string{"", "//", "/a[", "count(", "unknown(//a)", "count(//a, //b)", "/a/'b", "/a]"} {
+		_, err := Compile(xpath)
+		assert.NotNil(t, err, xpath)
+	}
+}
+
+func TestParseIllegalXML(t *testing.T) {
+	_, err := Parse(strings.NewReader("<a><b></a>"))
+	assert.NotNil(t, err)
+	_, err = Parse(strings.NewReader(""))
+	assert.NotNil(t, err)
+}